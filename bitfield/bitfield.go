@@ -22,3 +22,8 @@ func (bf Bitfield) SetPiece(index int) {
 	}
 	bf[byteIndex] |= 128 >> bitIndex
 }
+
+// New creates an empty bitfield large enough to hold n pieces.
+func New(n int) Bitfield {
+	return make(Bitfield, (n+7)/8)
+}
@@ -7,19 +7,50 @@ import (
 	"time"
 
 	"github.com/VIVelev/bittorrent/bitfield"
+	"github.com/VIVelev/bittorrent/event"
+	"github.com/VIVelev/bittorrent/extension"
 	"github.com/VIVelev/bittorrent/handshake"
+	"github.com/VIVelev/bittorrent/logging"
 	"github.com/VIVelev/bittorrent/message"
+	"github.com/VIVelev/bittorrent/metrics"
+	"github.com/VIVelev/bittorrent/mse"
 	"github.com/VIVelev/bittorrent/peer"
+	"github.com/VIVelev/bittorrent/utp"
 )
 
-// Client is a TCP connection with one peer.
+// Client is a TCP or uTP connection with one peer.
 type Client struct {
 	Conn     net.Conn
 	Choked   bool
 	Bitfield bitfield.Bitfield
+	// PeerID is the id the peer introduced itself with in the handshake.
+	PeerID [20]byte
+	// Fast is set when both sides support the Fast Extension (BEP 6).
+	Fast bool
+	// AllowedFast holds the pieces the peer lets us request while choked.
+	AllowedFast bitfield.Bitfield
+	// Suggested holds the pieces the peer advised us to download, oldest first.
+	Suggested []int
+	// Choking is set while we choke the peer, from the handshake until we unchoke it.
+	Choking bool
+	// Allowed holds the pieces we let the peer request while we choke it.
+	Allowed bitfield.Bitfield
+	// Extended is set when both sides support the Extension Protocol (BEP 10).
+	Extended bool
+	// Extensions maps the extensions the peer supports to their extended message ids.
+	Extensions map[string]int
+	// V2 is set when both sides support BitTorrent v2 (BEP 52) and may exchange hashes.
+	V2 bool
+	// MetadataSize is the size of the info dictionary the peer advertised, BEP 9.
+	MetadataSize int
+	// ClientName is the name and version of the software of the peer from its extension
+	// handshake, empty until it is read or when the peer did not tell.
+	ClientName string
+	// Advertised holds the pieces we told the peer we have during the handshake.
+	Advertised bitfield.Bitfield
 }
 
-func completeHandshake(conn net.Conn, infoHash, peerID [20]byte) (*handshake.Handshake, error) {
+func completeHandshake(conn net.Conn, infoHash, peerID [20]byte, v2 bool) (*handshake.Handshake, error) {
 	conn.SetDeadline(time.Now().Add(3 * time.Second))
 	defer conn.SetDeadline(time.Time{}) // disable the deadline
 
@@ -27,6 +58,11 @@ func completeHandshake(conn net.Conn, infoHash, peerID [20]byte) (*handshake.Han
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
+	hs.Enable(handshake.ExtFast)
+	hs.Enable(handshake.ExtExtended)
+	if v2 {
+		hs.Enable(handshake.ExtV2)
+	}
 	req := handshake.Marshal(hs)
 	_, err := conn.Write(req[:])
 	if err != nil {
@@ -44,7 +80,9 @@ func completeHandshake(conn net.Conn, infoHash, peerID [20]byte) (*handshake.Han
 	return res, nil
 }
 
-func recvBitfield(conn net.Conn) (bitfield.Bitfield, error) {
+// recvBitfield reads the peer's bitfield. When fast is set, Have All and
+// Have None are accepted in its place and expanded to numPieces bits.
+func recvBitfield(conn net.Conn, numPieces int, fast bool) (bitfield.Bitfield, error) {
 	conn.SetDeadline(time.Now().Add(5 * time.Second))
 	defer conn.SetDeadline(time.Time{}) // disable the deadline
 
@@ -55,35 +93,366 @@ func recvBitfield(conn net.Conn) (bitfield.Bitfield, error) {
 	if msg == nil {
 		return nil, fmt.Errorf("expected bitfield message, but got %s", msg)
 	}
-	if msg.ID != message.MsgBitfield {
+
+	switch {
+	case msg.ID == message.MsgBitfield:
+		return msg.Payload, nil
+	case msg.ID == message.MsgHaveAll && fast:
+		bf := bitfield.New(numPieces)
+		for i := 0; i < numPieces; i++ {
+			bf.SetPiece(i)
+		}
+		return bf, nil
+	case msg.ID == message.MsgHaveNone && fast:
+		return bitfield.New(numPieces), nil
+	default:
 		return nil, fmt.Errorf("expected bitfield message, but got %s", msg)
 	}
+}
+
+// Dialer contains options for connecting to peers.
+type Dialer struct {
+	// Encryption is the Message Stream Encryption policy.
+	Encryption mse.Policy
+	// Timeout is the maximum amount of time a dial will wait for a connect to complete.
+	Timeout time.Duration
+	// DisableUTP dials peers over TCP only. Otherwise uTP is tried first.
+	DisableUTP bool
+	// UTP is the socket uTP connections are made over.
+	// When nil, every connection gets its own ephemeral socket.
+	UTP *utp.Socket
+	// V2 advertises support for BitTorrent v2, set it for v2 and hybrid torrents.
+	V2 bool
+	// WrapConn, when set, wraps every connection before encryption, e.g. to limit its rate.
+	WrapConn func(net.Conn) net.Conn
+	// Events receives an event.PeerConnected for every completed handshake, none when nil.
+	Events *event.Bus
+	// Metrics receives the outcome of the dials and the latency of the successful ones,
+	// none when nil.
+	Metrics *metrics.Registry
+	// Logger receives the fallbacks of the dials at the debug level, none when nil.
+	Logger *logging.Logger
+}
+
+// utpTimeout bounds a uTP connection attempt before falling back to TCP.
+const utpTimeout time.Duration = 3 * time.Second
+
+// DefaultDialer is used by New.
+var DefaultDialer = &Dialer{
+	Encryption: mse.PolicyPrefer,
+	Timeout:    15 * time.Second,
+}
 
-	return msg.Payload, nil
+// New connects to a peer with DefaultDialer.
+func New(p peer.Peer, infoHash, peerID [20]byte, numPieces int) (*Client, error) {
+	return DefaultDialer.Dial(p, infoHash, peerID, numPieces)
 }
 
-// New connects to a peer, completes a handshake, and receives a bitfield.
-func New(p peer.Peer, infoHash, peerID [20]byte) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", p.String(), 15*time.Second)
+// Dial connects to a peer, completes a handshake, and receives a bitfield.
+// numPieces is the number of pieces in the torrent.
+func (d *Dialer) Dial(p peer.Peer, infoHash, peerID [20]byte, numPieces int) (*Client, error) {
+	return d.DialHave(p, infoHash, peerID, numPieces, nil)
+}
+
+// DialHave is like Dial, but advertises the pieces set in have to the peer.
+func (d *Dialer) DialHave(p peer.Peer, infoHash, peerID [20]byte, numPieces int, have bitfield.Bitfield) (*Client, error) {
+	start := time.Now()
+	dials := d.Metrics.Counter("bittorrent_peer_dials_total", "Connections dialed to peers by outcome.", "result")
+	conn, err := d.connect(p, infoHash)
+	if err != nil {
+		dials.With("connect_failed").Inc()
+		return nil, err
+	}
+
+	c, err := d.handshake(conn, infoHash, peerID, numPieces, have)
+	if err != nil {
+		dials.With("handshake_failed").Inc()
+		return nil, err
+	}
+	dials.With("connected").Inc()
+	d.Metrics.Histogram("bittorrent_peer_dial_duration_seconds", "Latency of the dials to peers up to a completed handshake.",
+		metrics.DefaultBuckets).With().ObserveDuration(time.Since(start))
+	d.Events.Publish(event.Event{Type: event.PeerConnected, InfoHash: infoHash, Peer: p})
+	return c, nil
+}
+
+// dial connects over uTP, falling back to TCP.
+func (d *Dialer) dial(p peer.Peer) (net.Conn, error) {
+	if !d.DisableUTP {
+		timeout := utpTimeout
+		if d.Timeout > 0 && d.Timeout < timeout {
+			timeout = d.Timeout
+		}
+
+		var conn net.Conn
+		var err error
+		if d.UTP != nil {
+			conn, err = d.UTP.DialTimeout(p.String(), timeout)
+		} else {
+			conn, err = utp.DialTimeout("udp", p.String(), timeout)
+		}
+		if err == nil {
+			return d.wrap(conn), nil
+		}
+		d.Logger.Debug("uTP failed, retrying over TCP", logging.Peer(p), logging.Err(err))
+	}
+	conn, err := net.DialTimeout("tcp", p.String(), d.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return d.wrap(conn), nil
+}
+
+func (d *Dialer) wrap(conn net.Conn) net.Conn {
+	if d.WrapConn == nil {
+		return conn
+	}
+	return d.WrapConn(conn)
+}
+
+// connect dials p and negotiates encryption as dictated by the policy.
+func (d *Dialer) connect(p peer.Peer, infoHash [20]byte) (net.Conn, error) {
+	conn, err := d.dial(p)
+	if err != nil {
+		return nil, fmt.Errorf("connection: %s", err)
+	}
+	if d.Encryption == mse.PolicyDisable {
+		return conn, nil
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	ec, err := mse.Initiate(conn, infoHash, d.Encryption.Methods())
+	conn.SetDeadline(time.Time{}) // disable the deadline
+	if err == nil {
+		return ec, nil
+	}
+	conn.Close()
+	if d.Encryption == mse.PolicyRequire {
+		return nil, fmt.Errorf("encryption: %s", err)
+	}
+
+	// fall back to plaintext
+	d.Logger.Debug("encryption failed, retrying in plaintext", logging.Peer(p), logging.Err(err))
+	conn, err = d.dial(p)
 	if err != nil {
 		return nil, fmt.Errorf("connection: %s", err)
 	}
+	return conn, nil
+}
 
-	_, err = completeHandshake(conn, infoHash, peerID)
+func (d *Dialer) handshake(conn net.Conn, infoHash, peerID [20]byte, numPieces int, have bitfield.Bitfield) (*Client, error) {
+	res, err := completeHandshake(conn, infoHash, peerID, d.V2)
 	if err != nil {
+		conn.Close()
 		return nil, fmt.Errorf("handshake: %s", err)
 	}
+	c, err := setup(conn, res, numPieces, have)
+	if err != nil {
+		return nil, err
+	}
+	c.V2 = d.V2 && res.Supports(handshake.ExtV2)
+	return c, nil
+}
+
+// Accept completes the handshakes for an inbound connection under the encryption policy.
+// torrents maps the info hashes we serve to their number of pieces.
+// Returns the client and the info hash it asked for.
+func Accept(conn net.Conn, policy mse.Policy, peerID [20]byte, torrents map[[20]byte]int) (*Client, [20]byte, error) {
+	infoHashes := make([][20]byte, 0, len(torrents))
+	for ih := range torrents {
+		infoHashes = append(infoHashes, ih)
+	}
+	return AcceptHave(conn, policy, peerID, infoHashes, func(infoHash [20]byte) (int, bitfield.Bitfield, bool, bool) {
+		numPieces, ok := torrents[infoHash]
+		return numPieces, nil, false, ok
+	})
+}
+
+// HaveFunc returns the number of pieces of the torrent with the given info hash, the pieces
+// of it we have and whether it is a v2 torrent. ok is false for the torrents we do not serve.
+type HaveFunc func(infoHash [20]byte) (numPieces int, have bitfield.Bitfield, v2 bool, ok bool)
 
-	bf, err := recvBitfield(conn)
+// AcceptHave is like Accept for the torrents with the given info hashes,
+// advertising the pieces we have as reported by lookup.
+func AcceptHave(conn net.Conn, policy mse.Policy, peerID [20]byte, infoHashes [][20]byte, lookup HaveFunc) (*Client, [20]byte, error) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	ec, _, err := mse.Accept(conn, policy, infoHashes)
 	if err != nil {
+		conn.Close()
+		return nil, [20]byte{}, fmt.Errorf("encryption: %s", err)
+	}
+	defer conn.SetDeadline(time.Time{}) // disable the deadline
+
+	req, err := handshake.Unmarshal(ec)
+	if err != nil {
+		conn.Close()
+		return nil, [20]byte{}, fmt.Errorf("handshake: %s", err)
+	}
+	numPieces, have, v2, ok := lookup(req.InfoHash)
+	if !ok {
+		conn.Close()
+		return nil, req.InfoHash, fmt.Errorf("handshake: unknown InfoHash: %x", req.InfoHash)
+	}
+
+	hs := &handshake.Handshake{
+		InfoHash: req.InfoHash,
+		PeerID:   peerID,
+	}
+	hs.Enable(handshake.ExtFast)
+	hs.Enable(handshake.ExtExtended)
+	if v2 {
+		hs.Enable(handshake.ExtV2)
+	}
+	res := handshake.Marshal(hs)
+	if _, err := ec.Write(res[:]); err != nil {
+		conn.Close()
+		return nil, req.InfoHash, fmt.Errorf("handshake: write: %s", err)
+	}
+
+	c, err := setup(ec, req, numPieces, have)
+	if err != nil {
+		return nil, req.InfoHash, err
+	}
+	c.V2 = v2 && req.Supports(handshake.ExtV2)
+	return c, req.InfoHash, nil
+}
+
+// setup exchanges bitfields after a completed handshake. have holds the pieces we have, if any.
+func setup(conn net.Conn, res *handshake.Handshake, numPieces int, have bitfield.Bitfield) (*Client, error) {
+	fast := res.Supports(handshake.ExtFast)
+
+	if msg := haveMessage(have, numPieces, fast); msg != nil {
+		if _, err := conn.Write(message.Marshal(msg)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("bitfield: %s", err)
+		}
+	}
+
+	bf, err := recvBitfield(conn, numPieces, fast)
+	if err != nil {
+		conn.Close()
 		return nil, fmt.Errorf("bitfield: %s", err)
 	}
 
-	return &Client{
-		Conn:     conn,
-		Choked:   true,
-		Bitfield: bf,
-	}, nil
+	c := &Client{
+		Conn:        conn,
+		Choked:      true,
+		Bitfield:    bf,
+		PeerID:      res.PeerID,
+		Fast:        fast,
+		AllowedFast: bitfield.New(numPieces),
+		Choking:     true,
+		Allowed:     bitfield.New(numPieces),
+		Extended:    res.Supports(handshake.ExtExtended),
+		Advertised:  bitfield.New(numPieces),
+	}
+	copy(c.Advertised, have)
+	if c.Extended {
+		if err := c.writeExtensionHandshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("extension handshake: %s", err)
+		}
+	}
+	return c, nil
+}
+
+// haveMessage returns the message advertising the pieces in have, or nil when none is due.
+// With the Fast Extension the bitfield is mandatory, Have All and Have None may replace it.
+func haveMessage(have bitfield.Bitfield, numPieces int, fast bool) *message.Message {
+	count := 0
+	for i := 0; i < numPieces; i++ {
+		if have.HasPiece(i) {
+			count++
+		}
+	}
+	switch {
+	case fast && count == 0:
+		return message.HaveNone()
+	case fast && count == numPieces:
+		return message.HaveAll()
+	case count == 0:
+		return nil
+	default:
+		return message.Bitfield(have)
+	}
+}
+
+// CanRequest checks if blocks of the piece at index may be requested now.
+func (c *Client) CanRequest(index int) bool {
+	return !c.Choked || c.AllowedFast.HasPiece(index)
+}
+
+// Suggest records a Suggest Piece hint from the peer.
+func (c *Client) Suggest(index int) {
+	for _, i := range c.Suggested {
+		if i == index {
+			return
+		}
+	}
+	c.Suggested = append(c.Suggested, index)
+}
+
+// Unsuggest forgets a Suggest Piece hint, e.g. once the piece is downloaded.
+func (c *Client) Unsuggest(index int) {
+	for i, s := range c.Suggested {
+		if s == index {
+			c.Suggested = append(c.Suggested[:i:i], c.Suggested[i+1:]...)
+			return
+		}
+	}
+}
+
+// CanServe checks if requests for blocks of the piece at index may be served now.
+func (c *Client) CanServe(index int) bool {
+	return !c.Choking || c.Allowed.HasPiece(index)
+}
+
+func (c *Client) writeExtensionHandshake() error {
+	return c.WriteExtensionHandshake(extension.NewHandshake())
+}
+
+// WriteExtensionHandshake sends an extension handshake. The first one is sent on connection,
+// later ones update what the peer knows, e.g. the size of the metadata once we have it.
+func (c *Client) WriteExtensionHandshake(h *extension.Handshake) error {
+	payload, err := h.Marshal()
+	if err != nil {
+		return err
+	}
+	m := message.Extended(extension.HandshakeID, payload)
+	_, err = c.Conn.Write(message.Marshal(m))
+	return err
+}
+
+// ReadExtensionHandshake records the extensions advertised in the peer's extension handshake.
+func (c *Client) ReadExtensionHandshake(payload []byte) error {
+	h, err := extension.ParseHandshake(payload)
+	if err != nil {
+		return err
+	}
+	c.Extensions = h.M
+	if h.MetadataSize > 0 {
+		c.MetadataSize = h.MetadataSize
+	}
+	if h.Client != "" {
+		c.ClientName = h.Client
+	}
+	return nil
+}
+
+// SupportsExtension checks if the peer advertised the extension.
+func (c *Client) SupportsExtension(name string) bool {
+	// an id of 0 means the extension was disabled
+	return c.Extensions[name] > 0
+}
+
+// WriteExtended sends an extended message of the extension to the peer.
+func (c *Client) WriteExtended(name string, payload []byte) error {
+	if !c.SupportsExtension(name) {
+		return fmt.Errorf("peer does not support %s", name)
+	}
+	m := message.Extended(uint8(c.Extensions[name]), payload)
+	_, err := c.Conn.Write(message.Marshal(m))
+	return err
 }
 
 // Read unmarshals a message from the connection.
@@ -91,8 +460,17 @@ func (c *Client) Read() (*message.Message, error) {
 	return message.Unmarshal(c.Conn)
 }
 
+// WriteChoke sends a ChokeMsg to the peer.
+func (c *Client) WriteChoke() error {
+	c.Choking = true
+	m := &message.Message{ID: message.MsgChoke}
+	_, err := c.Conn.Write(message.Marshal(m))
+	return err
+}
+
 // WriteUnchoke sends an UnchokeMsg to the peer.
 func (c *Client) WriteUnchoke() error {
+	c.Choking = false
 	m := &message.Message{ID: message.MsgUnchoke}
 	_, err := c.Conn.Write(message.Marshal(m))
 	return err
@@ -121,3 +499,44 @@ func (c *Client) WriteRequest(index, begin, length int) error {
 	_, err := c.Conn.Write(message.Marshal(m))
 	return err
 }
+
+// WriteHashRequest asks the peer for hashes of a file's merkle tree.
+func (c *Client) WriteHashRequest(hr message.HashRequest) error {
+	_, err := c.Conn.Write(message.Marshal(message.RequestHashes(hr)))
+	return err
+}
+
+// WriteHashes fulfills a hash request.
+func (c *Client) WriteHashes(hr message.HashRequest, hashes [][32]byte) error {
+	_, err := c.Conn.Write(message.Marshal(message.Hashes(hr, hashes)))
+	return err
+}
+
+// WriteHashReject rejects a hash request.
+func (c *Client) WriteHashReject(hr message.HashRequest) error {
+	_, err := c.Conn.Write(message.Marshal(message.RejectHashes(hr)))
+	return err
+}
+
+// WritePiece sends a block of a piece the peer requested.
+func (c *Client) WritePiece(index, begin int, data []byte) error {
+	_, err := c.Conn.Write(message.Marshal(message.Piece(index, begin, data)))
+	return err
+}
+
+// WriteAllowedFast lets the peer request the pieces at indices while we choke it, Fast Extension.
+func (c *Client) WriteAllowedFast(indices []int) error {
+	for _, index := range indices {
+		c.Allowed.SetPiece(index)
+		if _, err := c.Conn.Write(message.Marshal(message.AllowedFast(index))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteReject tells the peer we will not serve its request, Fast Extension.
+func (c *Client) WriteReject(index, begin, length int) error {
+	_, err := c.Conn.Write(message.Marshal(message.Reject(index, begin, length)))
+	return err
+}
@@ -3,10 +3,16 @@ package client
 import (
 	"net"
 	"testing"
+	"time"
 
 	"github.com/VIVelev/bittorrent/bitfield"
+	"github.com/VIVelev/bittorrent/event"
 	"github.com/VIVelev/bittorrent/handshake"
 	"github.com/VIVelev/bittorrent/message"
+	"github.com/VIVelev/bittorrent/metrics"
+	"github.com/VIVelev/bittorrent/mse"
+	"github.com/VIVelev/bittorrent/peer"
+	"github.com/VIVelev/bittorrent/utp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -19,6 +25,7 @@ func createServerAndClient(t *testing.T) (serverConn, clientConn net.Conn) {
 	done := make(chan struct{})
 	go func() {
 		defer ln.Close()
+		var err error
 		serverConn, err = ln.Accept()
 		require.Nil(t, err)
 		done <- struct{}{}
@@ -59,7 +66,7 @@ func TestCompleteHandshake(t *testing.T) {
 	serverConn, clientConn := createServerAndClient(t)
 	for _, test := range tests {
 		serverConn.Write(test.serverHandshake[:])
-		hs, err := completeHandshake(clientConn, test.Infohash, test.PeerID)
+		hs, err := completeHandshake(clientConn, test.Infohash, test.PeerID, false)
 
 		if test.fails {
 			assert.NotNil(t, err)
@@ -73,6 +80,7 @@ func TestCompleteHandshake(t *testing.T) {
 func TestRecvBitfield(t *testing.T) {
 	tests := map[string]struct {
 		msg    []byte
+		fast   bool
 		output bitfield.Bitfield
 		fails  bool
 	}{
@@ -91,12 +99,29 @@ func TestRecvBitfield(t *testing.T) {
 			output: nil,
 			fails:  true,
 		},
+		"have all": {
+			msg:    []byte{0, 0, 0, 1, 0x0e},
+			fast:   true,
+			output: bitfield.Bitfield{0xff, 0xc0},
+			fails:  false,
+		},
+		"have none": {
+			msg:    []byte{0, 0, 0, 1, 0x0f},
+			fast:   true,
+			output: bitfield.Bitfield{0, 0},
+			fails:  false,
+		},
+		"have all without fast extension": {
+			msg:    []byte{0, 0, 0, 1, 0x0e},
+			output: nil,
+			fails:  true,
+		},
 	}
 
 	serverConn, clientConn := createServerAndClient(t)
 	for _, test := range tests {
 		serverConn.Write(test.msg)
-		bf, err := recvBitfield(clientConn)
+		bf, err := recvBitfield(clientConn, 10, test.fast)
 
 		if test.fails {
 			assert.NotNil(t, err)
@@ -222,3 +247,282 @@ func TestWriteRequest(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, buf, expected)
 }
+
+func TestChoking(t *testing.T) {
+	serverConn, clientConn := createServerAndClient(t)
+	client := &Client{Conn: clientConn, Allowed: bitfield.New(10)}
+
+	go func() {
+		assert.Nil(t, client.WriteChoke())
+		assert.Nil(t, client.WriteAllowedFast([]int{3, 7}))
+	}()
+	for _, expected := range []*message.Message{{ID: message.MsgChoke}, message.AllowedFast(3), message.AllowedFast(7)} {
+		msg, err := message.Unmarshal(serverConn)
+		require.Nil(t, err)
+		assert.Equal(t, message.Marshal(expected), message.Marshal(msg))
+	}
+	assert.True(t, client.Choking)
+	assert.True(t, client.CanServe(3))
+	assert.False(t, client.CanServe(4))
+
+	go func() { assert.Nil(t, client.WriteUnchoke()) }()
+	_, err := message.Unmarshal(serverConn)
+	require.Nil(t, err)
+	assert.False(t, client.Choking)
+	assert.True(t, client.CanServe(4))
+}
+
+func TestSuggest(t *testing.T) {
+	client := &Client{}
+	for _, index := range []int{4, 2, 4, 9} {
+		client.Suggest(index)
+	}
+	assert.Equal(t, []int{4, 2, 9}, client.Suggested)
+
+	suggested := client.Suggested
+	client.Unsuggest(2)
+	client.Unsuggest(5)
+	assert.Equal(t, []int{4, 9}, client.Suggested)
+	assert.Equal(t, []int{4, 2, 9}, suggested, "the previous slice is left alone")
+}
+
+func TestDialAccept(t *testing.T) {
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	tests := map[string]struct {
+		outbound mse.Policy
+		inbound  mse.Policy
+		fails    bool
+	}{
+		"encrypted":           {outbound: mse.PolicyRequire, inbound: mse.PolicyPrefer},
+		"plaintext":           {outbound: mse.PolicyDisable, inbound: mse.PolicyPrefer},
+		"fallback":            {outbound: mse.PolicyPrefer, inbound: mse.PolicyDisable},
+		"encryption required": {outbound: mse.PolicyDisable, inbound: mse.PolicyRequire, fails: true},
+	}
+
+	for name, test := range tests {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				c, _, err := Accept(conn, test.inbound, [20]byte{2}, map[[20]byte]int{infoHash: 10})
+				if err == nil {
+					defer c.Conn.Close()
+				}
+			}
+		}()
+
+		addr := ln.Addr().(*net.TCPAddr)
+		p := peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+		bus := event.NewBus()
+		sub := bus.Subscribe(1, event.Drop)
+		reg := metrics.NewRegistry()
+		d := &Dialer{Encryption: test.outbound, Timeout: time.Second, DisableUTP: true, V2: true, Events: bus, Metrics: reg}
+		c, err := d.Dial(p, infoHash, [20]byte{1}, 10)
+		dials := reg.Counter("bittorrent_peer_dials_total", "", "result")
+		if test.fails {
+			assert.NotNil(t, err, name)
+			assert.Empty(t, sub.Events(), name)
+			assert.Equal(t, 1.0, dials.With("handshake_failed").Value(), name)
+		} else {
+			assert.Equal(t, 1.0, dials.With("connected").Value(), name)
+			require.Nil(t, err, name)
+			assert.True(t, c.Fast, name)
+			assert.True(t, c.Extended, name)
+			assert.Equal(t, bitfield.New(10), c.Bitfield, name)
+			c.Conn.Close()
+			require.Len(t, sub.Events(), 1, name)
+			e := <-sub.Events()
+			assert.Equal(t, event.PeerConnected, e.Type, name)
+			assert.Equal(t, infoHash, e.InfoHash, name)
+			assert.Equal(t, p, e.Peer, name)
+		}
+		ln.Close()
+	}
+}
+
+func TestDialV2(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	// a peer that supports v2 and has nothing
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if _, err := handshake.Unmarshal(conn); err != nil {
+				conn.Close()
+				continue
+			}
+			hs := &handshake.Handshake{InfoHash: infoHash, PeerID: [20]byte{2}}
+			hs.Enable(handshake.ExtFast)
+			hs.Enable(handshake.ExtV2)
+			res := handshake.Marshal(hs)
+			conn.Write(res[:])
+			conn.Write(message.Marshal(message.HaveNone()))
+			defer conn.Close()
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	for _, v2 := range []bool{false, true} {
+		d := &Dialer{Encryption: mse.PolicyDisable, Timeout: time.Second, DisableUTP: true, V2: v2}
+		c, err := d.Dial(peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}, infoHash, [20]byte{1}, 10)
+		require.Nil(t, err)
+		assert.Equal(t, v2, c.V2)
+		c.Conn.Close()
+	}
+}
+
+func TestDialUTP(t *testing.T) {
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	ln, err := utp.Listen("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		Accept(conn, mse.PolicyPrefer, [20]byte{2}, map[[20]byte]int{infoHash: 10})
+	}()
+
+	addr := ln.Addr().(*net.UDPAddr)
+	d := &Dialer{Encryption: mse.PolicyRequire, Timeout: time.Second}
+	c, err := d.Dial(peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}, infoHash, [20]byte{1}, 10)
+	require.Nil(t, err)
+	defer c.Conn.Close()
+	assert.IsType(t, &utp.Conn{}, c.Conn.(*mse.Conn).Conn)
+}
+
+func TestExtensions(t *testing.T) {
+	serverConn, clientConn := createServerAndClient(t)
+	client := &Client{Conn: clientConn}
+
+	err := client.WriteExtended("ut_pex", []byte("de"))
+	assert.NotNil(t, err)
+
+	err = client.ReadExtensionHandshake([]byte("d1:md6:ut_pexi3e11:ut_metadatai0eee"))
+	require.Nil(t, err)
+	assert.True(t, client.SupportsExtension("ut_pex"))
+	assert.False(t, client.SupportsExtension("ut_metadata"))
+
+	err = client.WriteExtended("ut_pex", []byte("de"))
+	assert.Nil(t, err)
+
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x04,
+		20,
+		3, // the id the peer asked for
+		'd', 'e',
+	}
+	buf := make([]byte, len(expected))
+	_, err = serverConn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, buf)
+}
+
+func TestAcceptV2(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	tests := map[string]struct {
+		inbound, outbound bool
+	}{
+		"both":     {inbound: true, outbound: true},
+		"inbound":  {inbound: true},
+		"outbound": {outbound: true},
+		"neither":  {},
+	}
+
+	for name, test := range tests {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		accepted := make(chan *Client, 1)
+		go func(v2 bool) {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c, _, err := AcceptHave(conn, mse.PolicyDisable, [20]byte{2}, [][20]byte{infoHash}, func(ih [20]byte) (int, bitfield.Bitfield, bool, bool) {
+				return 10, nil, v2, ih == infoHash
+			})
+			assert.Nil(t, err, name)
+			accepted <- c
+		}(test.inbound)
+
+		addr := ln.Addr().(*net.TCPAddr)
+		d := &Dialer{Encryption: mse.PolicyDisable, Timeout: time.Second, DisableUTP: true, V2: test.outbound}
+		c, err := d.Dial(peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}, infoHash, [20]byte{1}, 10)
+		require.Nil(t, err, name)
+		ac := <-accepted
+		require.NotNil(t, ac, name)
+
+		both := test.inbound && test.outbound
+		assert.Equal(t, both, c.V2, name)
+		assert.Equal(t, both, ac.V2, name)
+		c.Conn.Close()
+		ac.Conn.Close()
+		ln.Close()
+	}
+}
+
+func TestDialHave(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	partial := bitfield.New(10)
+	partial.SetPiece(3)
+	full := bitfield.New(10)
+	for i := 0; i < 10; i++ {
+		full.SetPiece(i)
+	}
+
+	tests := map[string]struct {
+		inbound  bitfield.Bitfield
+		outbound bitfield.Bitfield
+	}{
+		"nothing":  {inbound: nil, outbound: bitfield.New(10)},
+		"partial":  {inbound: partial, outbound: full},
+		"complete": {inbound: full, outbound: partial},
+	}
+
+	for name, test := range tests {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		accepted := make(chan *Client, 1)
+		go func(have bitfield.Bitfield) {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c, _, err := AcceptHave(conn, mse.PolicyDisable, [20]byte{2}, [][20]byte{infoHash}, func(ih [20]byte) (int, bitfield.Bitfield, bool, bool) {
+				return 10, have, false, ih == infoHash
+			})
+			assert.Nil(t, err, name)
+			accepted <- c
+		}(test.inbound)
+
+		addr := ln.Addr().(*net.TCPAddr)
+		d := &Dialer{Encryption: mse.PolicyDisable, Timeout: time.Second, DisableUTP: true}
+		c, err := d.DialHave(peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}, infoHash, [20]byte{1}, 10, test.outbound)
+		require.Nil(t, err, name)
+		ac := <-accepted
+		require.NotNil(t, ac, name)
+
+		expected := test.inbound
+		if expected == nil {
+			expected = bitfield.New(10)
+		}
+		assert.Equal(t, expected, c.Bitfield, name)
+		assert.Equal(t, test.outbound, ac.Bitfield, name)
+		assert.Equal(t, test.outbound, c.Advertised, name)
+		assert.Equal(t, expected, ac.Advertised, name)
+		c.Conn.Close()
+		ac.Conn.Close()
+		ln.Close()
+	}
+}
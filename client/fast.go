@@ -0,0 +1,44 @@
+package client
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+)
+
+// AllowedFastSetSize is the number of pieces we let a choked peer request.
+const AllowedFastSetSize int = 10
+
+// AllowedFastSet computes the k pieces a peer at ip may request while choked,
+// as specified by the Fast Extension (BEP 6). Only IPv4 peers are supported,
+// nil is returned for any other address, and when there are no pieces.
+func AllowedFastSet(k, numPieces int, infoHash [20]byte, ip net.IP) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces <= 0 {
+		return nil
+	}
+	if k > numPieces {
+		k = numPieces
+	}
+
+	// x = (0xFFFFFF00 & ip) + infohash
+	x := make([]byte, 0, 4+len(infoHash))
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash[:]...)
+
+	set := make([]int, 0, k)
+	seen := make(map[int]bool, k)
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			y := binary.BigEndian.Uint32(x[i*4 : i*4+4])
+			index := int(y % uint32(numPieces))
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
@@ -0,0 +1,38 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	// test vectors from BEP 6
+	var infoHash [20]byte
+	copy(infoHash[:], bytes.Repeat([]byte{0xaa}, 20))
+	ip := net.IP{80, 4, 4, 200}
+
+	tests := map[string]struct {
+		k      int
+		output []int
+	}{
+		"seven pieces": {
+			k:      7,
+			output: []int{1059, 431, 808, 1217, 287, 376, 1188},
+		},
+		"nine pieces": {
+			k:      9,
+			output: []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508},
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.output, AllowedFastSet(test.k, 1313, infoHash, ip))
+	}
+
+	assert.Nil(t, AllowedFastSet(7, 1313, infoHash, net.ParseIP("::1")))
+	assert.Len(t, AllowedFastSet(7, 3, infoHash, ip), 3)
+	assert.Nil(t, AllowedFastSet(7, 0, infoHash, ip))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/VIVelev/bittorrent/daemon"
+	"github.com/VIVelev/bittorrent/logging"
+	"github.com/VIVelev/bittorrent/metrics"
+	"github.com/VIVelev/bittorrent/session"
+	"github.com/VIVelev/bittorrent/transmission"
+)
+
+// runDaemon runs a session driven over the HTTP API of package daemon, and over the Transmission
+// RPC protocol if asked to, until it is interrupted. Its metrics are served if asked to.
+func runDaemon(args []string) error {
+	fs := newFlagSet("daemon", "[flags]")
+	api := fs.String("api", "127.0.0.1:9080", "address of the HTTP API")
+	token := fs.String("token", os.Getenv("BITTORRENT_TOKEN"), "token of the HTTP API clients, $BITTORRENT_TOKEN by default")
+	rpc := fs.String("rpc", "", "address of the Transmission RPC endpoint, e.g. 127.0.0.1:9091, off when empty")
+	rpcUser := fs.String("rpc-user", "", "username of the Transmission RPC clients, required with -rpc")
+	rpcPassword := fs.String("rpc-password", os.Getenv("BITTORRENT_RPC_PASSWORD"),
+		"password of the Transmission RPC clients, required with -rpc, $BITTORRENT_RPC_PASSWORD by default")
+	metricsAddr := fs.String("metrics", "", "address of the Prometheus /metrics endpoint, e.g. 127.0.0.1:9100, off when empty")
+	listen := fs.String("listen", ":6881", "address peers connect to")
+	dataDir := fs.String("data", ".", "directory the torrents are stored in")
+	maxDownloads := fs.Int("max-downloads", 0, "torrents downloading at once, 0 is unlimited")
+	maxSeeds := fs.Int("max-seeds", 0, "torrents seeding at once, 0 is unlimited")
+	logLevel := fs.String("log-level", "info", "records logged to stderr: debug, info, warn or error")
+	logJSON := fs.Bool("log-json", false, "log as JSON lines")
+	if _, err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		return usageError{fmt.Sprintf("invalid -log-level: %s", err)}
+	}
+	logger := newLogger(level, *logJSON)
+	if *token == "" {
+		return usageError{"a token is required, see -token"}
+	}
+	// torrent-add reads local files and fetches URLs for whoever can reach the endpoint
+	if *rpc != "" && (*rpcUser == "" || *rpcPassword == "") {
+		return usageError{"-rpc requires a username and a password, see -rpc-user and -rpc-password"}
+	}
+
+	var reg *metrics.Registry
+	if *metricsAddr != "" {
+		reg = metrics.NewRegistry()
+	}
+	s, err := session.New(session.Config{
+		ListenAddr:         *listen,
+		DataDir:            *dataDir,
+		MaxActiveDownloads: *maxDownloads,
+		MaxActiveSeeds:     *maxSeeds,
+		Metrics:            reg,
+		Logger:             logger,
+	})
+	if err != nil {
+		return fmt.Errorf("session: %s", err)
+	}
+	defer s.Close()
+	srv, err := daemon.New(s, *token)
+	if err != nil {
+		return fmt.Errorf("daemon: %s", err)
+	}
+	defer srv.Close()
+
+	hs := &http.Server{Addr: *api, Handler: srv}
+	errc := make(chan error, 3) // of every server
+	go func() { errc <- hs.ListenAndServe() }()
+	logger.Info("serving the API", logging.String("addr", *api), logging.Int("port", int(s.Port())))
+	if *rpc != "" {
+		rs := transmission.New(s)
+		rs.Username, rs.Password = *rpcUser, *rpcPassword
+		mux := http.NewServeMux()
+		mux.Handle(transmission.Path, rs)
+		rhs := &http.Server{Addr: *rpc, Handler: mux}
+		go func() { errc <- rhs.ListenAndServe() }()
+		defer rhs.Shutdown(context.Background())
+		logger.Info("serving the Transmission RPC", logging.String("addr", *rpc), logging.String("path", transmission.Path))
+	}
+	if reg != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", reg)
+		mhs := &http.Server{Addr: *metricsAddr, Handler: mux}
+		go func() { errc <- mhs.ListenAndServe() }()
+		defer mhs.Shutdown(context.Background())
+		logger.Info("serving the metrics", logging.String("addr", *metricsAddr), logging.String("path", "/metrics"))
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		return fmt.Errorf("serve: %s", err)
+	case <-sig:
+	}
+	// the event streams end with the server
+	srv.Close()
+	return hs.Shutdown(context.Background())
+}
@@ -0,0 +1,284 @@
+package daemon
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/VIVelev/bittorrent/p2p"
+	"github.com/VIVelev/bittorrent/pex"
+	"github.com/VIVelev/bittorrent/session"
+)
+
+// ErrorResponse is the body of the requests that failed.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// AddRequest adds a torrent from either the contents of a .torrent file, base64 encoded,
+// or a magnet link.
+type AddRequest struct {
+	Torrent []byte `json:"torrent,omitempty"`
+	Magnet  string `json:"magnet,omitempty"`
+	// Dir is where the torrent is stored, the data directory of the daemon when empty.
+	Dir    string `json:"dir,omitempty"`
+	Paused bool   `json:"paused,omitempty"`
+}
+
+// QueueRequest moves a torrent to Position in the queue, 0 being the first to start.
+type QueueRequest struct {
+	Position int `json:"position"`
+}
+
+// PriorityRequest sets the priority of a file: skip, low, normal or high.
+type PriorityRequest struct {
+	Priority string `json:"priority"`
+}
+
+func parsePriority(s string) (p2p.Priority, error) {
+	for p := p2p.PrioritySkip; p <= p2p.PriorityHigh; p++ {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid priority %q", s)
+}
+
+// Torrent is the status of a torrent.
+type Torrent struct {
+	InfoHash      string  `json:"info_hash"`
+	Name          string  `json:"name"`
+	State         string  `json:"state"`
+	Error         string  `json:"error,omitempty"`
+	QueuePosition int     `json:"queue_position"`
+	Size          int64   `json:"size"`      // 0 until the metadata is fetched
+	Completed     int64   `json:"completed"` // verified bytes
+	Downloaded    int64   `json:"downloaded"`
+	Uploaded      int64   `json:"uploaded"`
+	Ratio         float64 `json:"ratio"`
+	SeedingTime   float64 `json:"seeding_time"` // in seconds
+	NumPeers      int     `json:"num_peers"`
+	// the rates are in bytes per second, see p2p.TorrentStats
+	DownloadRate float64 `json:"download_rate"`
+	UploadRate   float64 `json:"upload_rate"`
+	ETA          float64 `json:"eta"` // in seconds, -1 when unknown
+	Availability float64 `json:"availability"`
+	Wasted       int64   `json:"wasted"`
+	HashFailures int     `json:"hash_failures"`
+}
+
+func newTorrent(t *session.Torrent) Torrent {
+	st := t.Stats()
+	ret := Torrent{
+		InfoHash:      infoHash(t),
+		Name:          t.Name(),
+		State:         t.State().String(),
+		QueuePosition: t.QueuePosition(),
+		Size:          t.Size(),
+		Completed:     t.BytesCompleted(),
+		Downloaded:    t.Downloaded(),
+		Uploaded:      t.Uploaded(),
+		Ratio:         t.Ratio(),
+		SeedingTime:   t.SeedingTime().Seconds(),
+		NumPeers:      st.Peers,
+		DownloadRate:  st.DownloadRate,
+		UploadRate:    st.UploadRate,
+		ETA:           -1,
+		Availability:  st.Availability,
+		Wasted:        st.Wasted,
+		HashFailures:  st.HashFailures,
+	}
+	if st.ETA >= 0 {
+		ret.ETA = st.ETA.Seconds()
+	}
+	if err := t.Err(); err != nil {
+		ret.Error = err.Error()
+	}
+	return ret
+}
+
+func infoHash(t *session.Torrent) string {
+	ih := t.InfoHash()
+	return hex.EncodeToString(ih[:])
+}
+
+// TorrentDetail is the status of a torrent with its files, peers and trackers.
+type TorrentDetail struct {
+	Torrent
+	Files    []File    `json:"files"`
+	Peers    []Peer    `json:"peers"`
+	Trackers []Tracker `json:"trackers"`
+}
+
+// File is the status of a file of a torrent.
+type File struct {
+	Path      string `json:"path"`
+	Length    int64  `json:"length"`
+	Completed int64  `json:"completed"`
+	Priority  string `json:"priority"`
+	Padding   bool   `json:"padding,omitempty"`
+}
+
+// Peer is a connection of a torrent to a peer, see p2p.PeerStats.
+type Peer struct {
+	Addr           string    `json:"addr"`
+	Source         string    `json:"source"`
+	Encrypted      bool      `json:"encrypted"`
+	UTP            bool      `json:"utp"`
+	PeerID         string    `json:"peer_id"`
+	Client         string    `json:"client,omitempty"`
+	Connected      time.Time `json:"connected"`
+	Choked         bool      `json:"choked"` // the peer chokes us
+	Interested     bool      `json:"interested"`
+	PeerInterested bool      `json:"peer_interested"`
+	Pending        int       `json:"pending"` // requests
+	Downloaded     int64     `json:"downloaded"`
+	Uploaded       int64     `json:"uploaded"`
+	DownloadRate   float64   `json:"download_rate"`
+	UploadRate     float64   `json:"upload_rate"`
+	Progress       float64   `json:"progress"` // fraction of the pieces the peer has
+}
+
+// Tracker is the status of a tracker of a torrent.
+type Tracker struct {
+	URL          string     `json:"url"`
+	LastAnnounce *time.Time `json:"last_announce,omitempty"`
+	Peers        int        `json:"peers"`
+	Error        string     `json:"error,omitempty"`
+}
+
+func newTorrentDetail(t *session.Torrent) TorrentDetail {
+	ret := TorrentDetail{
+		Torrent:  newTorrent(t),
+		Files:    []File{},
+		Peers:    []Peer{},
+		Trackers: []Tracker{},
+	}
+	for _, f := range t.Files() {
+		ret.Files = append(ret.Files, File{
+			Path:      f.Path,
+			Length:    f.Length,
+			Completed: f.Completed,
+			Priority:  f.Priority.String(),
+			Padding:   f.Padding,
+		})
+	}
+	for _, p := range t.PeerStats() {
+		ret.Peers = append(ret.Peers, Peer{
+			Addr:           p.Peer.String(),
+			Source:         p.Source.String(),
+			Encrypted:      p.Flags&pex.FlagEncryption != 0,
+			UTP:            p.Flags&pex.FlagUTP != 0,
+			PeerID:         hex.EncodeToString(p.PeerID[:]),
+			Client:         p.Client,
+			Connected:      p.Connected,
+			Choked:         p.Choked,
+			Interested:     p.Interested,
+			PeerInterested: p.PeerInterested,
+			Pending:        p.Pending,
+			Downloaded:     p.Downloaded,
+			Uploaded:       p.Uploaded,
+			DownloadRate:   p.DownloadRate,
+			UploadRate:     p.UploadRate,
+			Progress:       p.Progress,
+		})
+	}
+	for _, tr := range t.Trackers() {
+		st := Tracker{URL: tr.URL, Peers: tr.Peers}
+		if !tr.LastAnnounce.IsZero() {
+			last := tr.LastAnnounce
+			st.LastAnnounce = &last
+		}
+		if tr.Err != nil {
+			st.Error = tr.Err.Error()
+		}
+		ret.Trackers = append(ret.Trackers, st)
+	}
+	return ret
+}
+
+// Settings are the settings of the session, rates in bytes per second, 0 being unlimited.
+type Settings struct {
+	DownloadRate       int       `json:"download_rate"`
+	UploadRate         int       `json:"upload_rate"`
+	MaxActiveDownloads int       `json:"max_active_downloads"`
+	MaxActiveSeeds     int       `json:"max_active_seeds"`
+	SeedGoals          SeedGoals `json:"seed_goals"`
+}
+
+// SeedGoals end seeding once any of the goals that is not 0 is reached, see session.SeedGoals.
+type SeedGoals struct {
+	Ratio    float64 `json:"ratio"`
+	Time     float64 `json:"time"` // in seconds
+	IdleTime float64 `json:"idle_time"`
+	// Action is pause or remove.
+	Action string `json:"action"`
+}
+
+func newSettings(st session.Settings) Settings {
+	action := "pause"
+	if st.SeedGoals.Action == session.GoalRemove {
+		action = "remove"
+	}
+	return Settings{
+		DownloadRate:       st.DownloadRate,
+		UploadRate:         st.UploadRate,
+		MaxActiveDownloads: st.MaxActiveDownloads,
+		MaxActiveSeeds:     st.MaxActiveSeeds,
+		SeedGoals: SeedGoals{
+			Ratio:    st.SeedGoals.Ratio,
+			Time:     st.SeedGoals.Time.Seconds(),
+			IdleTime: st.SeedGoals.Idle.Seconds(),
+			Action:   action,
+		},
+	}
+}
+
+// SettingsRequest changes the settings that are given.
+type SettingsRequest struct {
+	DownloadRate       *int       `json:"download_rate"`
+	UploadRate         *int       `json:"upload_rate"`
+	MaxActiveDownloads *int       `json:"max_active_downloads"`
+	MaxActiveSeeds     *int       `json:"max_active_seeds"`
+	SeedGoals          *SeedGoals `json:"seed_goals"`
+}
+
+// apply returns st changed by the request.
+func (req SettingsRequest) apply(st session.Settings) (session.Settings, error) {
+	for _, v := range []*int{req.DownloadRate, req.UploadRate, req.MaxActiveDownloads, req.MaxActiveSeeds} {
+		if v != nil && *v < 0 {
+			return st, fmt.Errorf("negative setting %d", *v)
+		}
+	}
+	if req.DownloadRate != nil {
+		st.DownloadRate = *req.DownloadRate
+	}
+	if req.UploadRate != nil {
+		st.UploadRate = *req.UploadRate
+	}
+	if req.MaxActiveDownloads != nil {
+		st.MaxActiveDownloads = *req.MaxActiveDownloads
+	}
+	if req.MaxActiveSeeds != nil {
+		st.MaxActiveSeeds = *req.MaxActiveSeeds
+	}
+	if g := req.SeedGoals; g != nil {
+		if g.Ratio < 0 || g.Time < 0 || g.IdleTime < 0 {
+			return st, errors.New("negative seeding goal")
+		}
+		st.SeedGoals = session.SeedGoals{
+			Ratio: g.Ratio,
+			Time:  time.Duration(g.Time * float64(time.Second)),
+			Idle:  time.Duration(g.IdleTime * float64(time.Second)),
+		}
+		switch g.Action {
+		case "", "pause":
+		case "remove":
+			st.SeedGoals.Action = session.GoalRemove
+		default:
+			return st, fmt.Errorf("invalid action %q", g.Action)
+		}
+	}
+	return st, nil
+}
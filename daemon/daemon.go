@@ -0,0 +1,265 @@
+// Package daemon serves a session over an authenticated HTTP JSON API, so that scripts and
+// deploy tooling can drive a long-running client.
+//
+// Every request carries the token of the server as "Authorization: Bearer <token>", or as
+// the token query parameter for clients that cannot set headers, e.g. EventSource.
+//
+//	GET    /api/torrents                       list the torrents in queue order
+//	POST   /api/torrents                       add a torrent, see AddRequest
+//	GET    /api/torrents/{info hash}           files, peers and trackers of a torrent
+//	DELETE /api/torrents/{info hash}           remove a torrent, ?delete_data=true deletes its files
+//	POST   /api/torrents/{info hash}/pause
+//	POST   /api/torrents/{info hash}/resume
+//	PUT    /api/torrents/{info hash}/queue     move a torrent in the queue, see QueueRequest
+//	PUT    /api/torrents/{info hash}/files/{i} set the priority of a file, see PriorityRequest
+//	GET    /api/settings
+//	PUT    /api/settings                       change the settings given, see SettingsRequest
+//	GET    /api/events                         Server-Sent Events, see Event
+//
+// Errors are answered with an ErrorResponse and an error status.
+package daemon
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/VIVelev/bittorrent/session"
+)
+
+// maxBodySize bounds the requests, .torrent files included.
+const maxBodySize int64 = 16 << 20 // 16MiB
+
+// Server is the API of a session. It is an http.Handler.
+type Server struct {
+	s      *session.Session
+	token  string
+	events *hub
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// New serves s to the clients that know token, which must not be empty.
+func New(s *session.Session, token string) (*Server, error) {
+	if token == "" {
+		return nil, errors.New("empty token")
+	}
+	srv := &Server{
+		s:      s,
+		token:  token,
+		events: newHub(),
+		done:   make(chan struct{}),
+	}
+	go srv.watch()
+	return srv, nil
+}
+
+// Close ends the event streams. The session is left running.
+func (srv *Server) Close() {
+	srv.closeOnce.Do(func() { close(srv.done) })
+}
+
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !srv.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="bittorrent"`)
+		writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) < 2 || parts[0] != "api":
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s not found", r.URL.Path))
+	case len(parts) == 2 && parts[1] == "torrents":
+		srv.handleTorrents(w, r)
+	case len(parts) >= 3 && parts[1] == "torrents":
+		srv.handleTorrent(w, r, parts[2], parts[3:])
+	case len(parts) == 2 && parts[1] == "settings":
+		srv.handleSettings(w, r)
+	case len(parts) == 2 && parts[1] == "events":
+		srv.handleEvents(w, r)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s not found", r.URL.Path))
+	}
+}
+
+// authorized reports whether r carries the token of the server.
+func (srv *Server) authorized(r *http.Request) bool {
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(srv.token)) == 1
+}
+
+func (srv *Server) handleTorrents(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		torrents := srv.s.Torrents()
+		ret := make([]Torrent, len(torrents))
+		for i, t := range torrents {
+			ret[i] = newTorrent(t)
+		}
+		writeJSON(w, http.StatusOK, ret)
+	case http.MethodPost:
+		var req AddRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		opts := session.AddOptions{Dir: req.Dir, Paused: req.Paused}
+		var t *session.Torrent
+		var err error
+		switch {
+		case len(req.Torrent) > 0 && req.Magnet == "":
+			t, err = srv.s.AddBytes(req.Torrent, opts)
+		case len(req.Torrent) == 0 && req.Magnet != "":
+			t, err = srv.s.AddMagnet(req.Magnet, opts)
+		default:
+			err = errors.New("either torrent or magnet must be given")
+		}
+		switch {
+		case err == session.ErrExists:
+			writeError(w, http.StatusConflict, err)
+		case err != nil:
+			writeError(w, http.StatusBadRequest, err)
+		default:
+			writeJSON(w, http.StatusCreated, newTorrent(t))
+		}
+	default:
+		notAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+func (srv *Server) handleTorrent(w http.ResponseWriter, r *http.Request, hash string, rest []string) {
+	var infoHash [20]byte
+	b, err := hex.DecodeString(hash)
+	if err != nil || len(b) != len(infoHash) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid info hash %q", hash))
+		return
+	}
+	copy(infoHash[:], b)
+	t, ok := srv.s.Get(infoHash)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("torrent %x not found", infoHash))
+		return
+	}
+
+	switch {
+	case len(rest) == 0:
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, newTorrentDetail(t))
+		case http.MethodDelete:
+			deleteData, _ := strconv.ParseBool(r.URL.Query().Get("delete_data"))
+			if err := srv.s.Remove(infoHash, deleteData); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			notAllowed(w, http.MethodGet, http.MethodDelete)
+		}
+	case len(rest) == 1 && (rest[0] == "pause" || rest[0] == "resume"):
+		if r.Method != http.MethodPost {
+			notAllowed(w, http.MethodPost)
+			return
+		}
+		if rest[0] == "pause" {
+			t.Pause()
+		} else {
+			t.Resume()
+		}
+		writeJSON(w, http.StatusOK, newTorrent(t))
+	case len(rest) == 1 && rest[0] == "queue":
+		if r.Method != http.MethodPut {
+			notAllowed(w, http.MethodPut)
+			return
+		}
+		var req QueueRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		t.SetQueuePosition(req.Position)
+		writeJSON(w, http.StatusOK, newTorrent(t))
+	case len(rest) == 2 && rest[0] == "files":
+		if r.Method != http.MethodPut {
+			notAllowed(w, http.MethodPut)
+			return
+		}
+		file, err := strconv.Atoi(rest[1])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid file %q", rest[1]))
+			return
+		}
+		var req PriorityRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		p, err := parsePriority(req.Priority)
+		if err == nil {
+			err = t.SetFilePriority(file, p)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, newTorrentDetail(t))
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s not found", r.URL.Path))
+	}
+}
+
+func (srv *Server) handleSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, newSettings(srv.s.Settings()))
+	case http.MethodPut:
+		var req SettingsRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		st, err := req.apply(srv.s.Settings())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		srv.s.SetSettings(st)
+		writeJSON(w, http.StatusOK, newSettings(srv.s.Settings()))
+	default:
+		notAllowed(w, http.MethodGet, http.MethodPut)
+	}
+}
+
+// readJSON decodes the body of r into v, or answers with an error.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("request: %s", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, ErrorResponse{Error: err.Error()})
+}
+
+func notAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+}
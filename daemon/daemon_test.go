@@ -0,0 +1,233 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VIVelev/bittorrent/internal/testswarm"
+	bio "github.com/VIVelev/bittorrent/io"
+	"github.com/VIVelev/bittorrent/session"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testToken = "secret"
+
+// apiClient calls the API of a daemon.
+type apiClient struct {
+	t     *testing.T
+	url   string
+	token string
+}
+
+// newTestServer starts a daemon storing the torrents in dataDir.
+func newTestServer(t *testing.T, dataDir string) (*apiClient, *session.Session) {
+	s := testswarm.NewSession(t, dataDir)
+	srv, err := New(s, testToken)
+	require.Nil(t, err)
+	ts := httptest.NewServer(srv)
+	t.Cleanup(func() {
+		// end the event streams first, the test server waits for them
+		srv.Close()
+		ts.Close()
+	})
+	return &apiClient{t: t, url: ts.URL, token: testToken}, s
+}
+
+// do sends body as JSON and decodes the response into v, returning the status code.
+func (c *apiClient) do(method, path string, body interface{}, v interface{}) int {
+	var r io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		require.Nil(c.t, err)
+		r = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, c.url+path, r)
+	require.Nil(c.t, err)
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(c.t, err)
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode < 300 {
+		require.Nil(c.t, json.NewDecoder(resp.Body).Decode(v))
+	}
+	return resp.StatusCode
+}
+
+func (c *apiClient) waitState(hash, state string) TorrentDetail {
+	var tr TorrentDetail
+	require.Eventually(c.t, func() bool {
+		return c.do(http.MethodGet, "/api/torrents/"+hash, nil, &tr) == http.StatusOK && tr.State == state
+	}, 10*time.Second, 20*time.Millisecond, "waiting for %s", state)
+	return tr
+}
+
+// events streams the events of the daemon until the test ends.
+func (c *apiClient) events() <-chan Event {
+	resp, err := http.Get(c.url + "/api/events?token=" + url.QueryEscape(c.token))
+	require.Nil(c.t, err)
+	require.Equal(c.t, http.StatusOK, resp.StatusCode)
+	require.Equal(c.t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	ch := make(chan Event, eventBuffer)
+	go func() {
+		defer close(ch)
+		defer resp.Body.Close()
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			if !strings.HasPrefix(sc.Text(), "data: ") {
+				continue
+			}
+			var e Event
+			if json.Unmarshal([]byte(strings.TrimPrefix(sc.Text(), "data: ")), &e) == nil {
+				ch <- e
+			}
+		}
+	}()
+	return ch
+}
+
+func waitEvent(t *testing.T, events <-chan Event, expected Event) {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case e, ok := <-events:
+			require.True(t, ok, "events ended before %v", expected)
+			if e.Type == expected.Type && e.InfoHash == expected.InfoHash && e.State == expected.State {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no event %v", expected)
+		}
+	}
+}
+
+func TestAuth(t *testing.T) {
+	c, _ := newTestServer(t, t.TempDir())
+	tests := map[string]struct {
+		token  string
+		path   string
+		status int
+	}{
+		"no token":     {path: "/api/torrents", status: http.StatusUnauthorized},
+		"wrong token":  {token: "guess", path: "/api/torrents", status: http.StatusUnauthorized},
+		"bearer token": {token: testToken, path: "/api/torrents", status: http.StatusOK},
+		"query token":  {path: "/api/settings?token=" + testToken, status: http.StatusOK},
+		"unknown path": {token: testToken, path: "/api/nothing", status: http.StatusNotFound},
+	}
+
+	for name, test := range tests {
+		c := &apiClient{t: t, url: c.url, token: test.token}
+		assert.Equal(t, test.status, c.do(http.MethodGet, test.path, nil, nil), name)
+	}
+
+	_, err := New(testswarm.NewSession(t, t.TempDir()), "")
+	assert.NotNil(t, err, "empty token")
+}
+
+func TestAPI(t *testing.T) {
+	data := make([]byte, 50000)
+	rand.New(rand.NewSource(1)).Read(data)
+	torrent := testswarm.Torrent(t, data, testswarm.Start(t, data))
+	dataDir := t.TempDir()
+	c, s := newTestServer(t, dataDir)
+	events := c.events()
+
+	var tr Torrent
+	require.Equal(t, http.StatusCreated, c.do(http.MethodPost, "/api/torrents", AddRequest{Torrent: torrent, Paused: true}, &tr))
+	assert.Equal(t, "file", tr.Name)
+	assert.Equal(t, "paused", tr.State)
+	assert.Equal(t, -1.0, tr.ETA)
+	assert.Equal(t, int64(len(data)), tr.Size)
+	hash := tr.InfoHash
+	waitEvent(t, events, Event{Type: EventAdded, InfoHash: hash, State: "paused"})
+
+	assert.Equal(t, http.StatusConflict, c.do(http.MethodPost, "/api/torrents", AddRequest{Torrent: torrent}, nil))
+	assert.Equal(t, http.StatusBadRequest, c.do(http.MethodPost, "/api/torrents", AddRequest{}, nil))
+	assert.Equal(t, http.StatusBadRequest, c.do(http.MethodPost, "/api/torrents", AddRequest{Magnet: "magnet:?xt=bogus"}, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, c.do(http.MethodPatch, "/api/torrents", nil, nil))
+	var list []Torrent
+	require.Equal(t, http.StatusOK, c.do(http.MethodGet, "/api/torrents", nil, &list))
+	require.Len(t, list, 1)
+	assert.Equal(t, hash, list[0].InfoHash)
+
+	var detail TorrentDetail
+	assert.Equal(t, http.StatusBadRequest, c.do(http.MethodPut, "/api/torrents/"+hash+"/files/0", PriorityRequest{Priority: "urgent"}, nil))
+	assert.Equal(t, http.StatusBadRequest, c.do(http.MethodPut, "/api/torrents/"+hash+"/files/1", PriorityRequest{Priority: "high"}, nil))
+	require.Equal(t, http.StatusOK, c.do(http.MethodPut, "/api/torrents/"+hash+"/files/0", PriorityRequest{Priority: "high"}, &detail))
+	require.Len(t, detail.Files, 1)
+	assert.Equal(t, File{Path: "file", Length: int64(len(data)), Priority: "high"}, detail.Files[0])
+
+	// the tracker leads to the seeder
+	require.Equal(t, http.StatusOK, c.do(http.MethodPost, "/api/torrents/"+hash+"/resume", nil, &tr))
+	waitEvent(t, events, Event{Type: EventState, InfoHash: hash, State: "seeding"})
+	detail = c.waitState(hash, "seeding")
+	assert.Equal(t, int64(len(data)), detail.Completed)
+	assert.Equal(t, int64(len(data)), detail.Downloaded)
+	assert.Equal(t, int64(len(data)), detail.Files[0].Completed)
+	assert.Greater(t, detail.DownloadRate, 0.0)
+	assert.Equal(t, 0.0, detail.ETA)
+	require.Len(t, detail.Trackers, 1)
+	assert.Equal(t, 1, detail.Trackers[0].Peers)
+	assert.NotNil(t, detail.Trackers[0].LastAnnounce)
+	assert.Empty(t, detail.Trackers[0].Error)
+
+	require.Equal(t, http.StatusOK, c.do(http.MethodPost, "/api/torrents/"+hash+"/pause", nil, &tr))
+	assert.Equal(t, "paused", tr.State)
+	waitEvent(t, events, Event{Type: EventState, InfoHash: hash, State: "paused"})
+	assert.Equal(t, http.StatusMethodNotAllowed, c.do(http.MethodGet, "/api/torrents/"+hash+"/pause", nil, nil))
+	require.Equal(t, http.StatusOK, c.do(http.MethodPut, "/api/torrents/"+hash+"/queue", QueueRequest{Position: 3}, &tr))
+	assert.Equal(t, 0, tr.QueuePosition)
+
+	var settings Settings
+	rate := 1000
+	require.Equal(t, http.StatusOK, c.do(http.MethodPut, "/api/settings", SettingsRequest{
+		DownloadRate: &rate,
+		SeedGoals:    &SeedGoals{Ratio: 2, IdleTime: 60, Action: "remove"},
+	}, &settings))
+	expected := Settings{DownloadRate: 1000, SeedGoals: SeedGoals{Ratio: 2, IdleTime: 60, Action: "remove"}}
+	assert.Equal(t, expected, settings)
+	assert.Equal(t, 1000, s.Settings().DownloadRate)
+	require.Equal(t, http.StatusOK, c.do(http.MethodGet, "/api/settings", nil, &settings))
+	assert.Equal(t, expected, settings)
+	negative := -1
+	assert.Equal(t, http.StatusBadRequest, c.do(http.MethodPut, "/api/settings", SettingsRequest{MaxActiveSeeds: &negative}, nil))
+	assert.Equal(t, http.StatusBadRequest, c.do(http.MethodPut, "/api/settings", map[string]int{"speed": 1}, nil))
+
+	assert.Equal(t, http.StatusBadRequest, c.do(http.MethodGet, "/api/torrents/xyz", nil, nil))
+	require.Equal(t, http.StatusNoContent, c.do(http.MethodDelete, "/api/torrents/"+hash+"?delete_data=true", nil, nil))
+	assert.Equal(t, http.StatusNotFound, c.do(http.MethodGet, "/api/torrents/"+hash, nil, nil))
+	waitEvent(t, events, Event{Type: EventRemoved, InfoHash: hash})
+	_, err := os.Stat(filepath.Join(dataDir, "file"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAddMagnet(t *testing.T) {
+	data := make([]byte, 50000)
+	rand.New(rand.NewSource(2)).Read(data)
+	tracker := testswarm.Start(t, data)
+	tf, err := bio.Parse(testswarm.Torrent(t, data, ""))
+	require.Nil(t, err)
+	c, _ := newTestServer(t, t.TempDir())
+
+	var tr Torrent
+	magnet := fmt.Sprintf("magnet:?xt=urn:btih:%x&tr=%s", tf.InfoHash, url.QueryEscape(tracker))
+	require.Equal(t, http.StatusCreated, c.do(http.MethodPost, "/api/torrents", AddRequest{Magnet: magnet}, &tr))
+	detail := c.waitState(tr.InfoHash, "seeding")
+	assert.Equal(t, "file", detail.Name)
+	assert.Equal(t, int64(len(data)), detail.Completed)
+}
@@ -0,0 +1,153 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/VIVelev/bittorrent/session"
+)
+
+const (
+	// watchInterval is how often the torrents are compared with their last known status.
+	watchInterval time.Duration = 200 * time.Millisecond
+	// eventBuffer is how many events a slow client may lag behind before it misses some.
+	eventBuffer int = 64
+)
+
+// The types of events.
+const (
+	EventAdded   = "added"
+	EventRemoved = "removed"
+	EventState   = "state"
+)
+
+// Event is a change to the torrents of the session, streamed from /api/events as
+// Server-Sent Events named after their type, with the event as JSON data.
+type Event struct {
+	Type     string `json:"type"`
+	InfoHash string `json:"info_hash"`
+	Name     string `json:"name,omitempty"`
+	State    string `json:"state,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// hub hands the events over to the clients streaming them.
+type hub struct {
+	mu   sync.Mutex
+	subs map[chan Event]bool
+}
+
+func newHub() *hub {
+	return &hub{subs: make(map[chan Event]bool)}
+}
+
+func (h *hub) subscribe() chan Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan Event, eventBuffer)
+	h.subs[ch] = true
+	return ch
+}
+
+func (h *hub) unsubscribe(ch chan Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.subs, ch)
+}
+
+// publish drops the event for the clients that lag behind, the others never wait for them.
+func (h *hub) publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// watch publishes the changes to the torrents of the session until the server is closed.
+func (srv *Server) watch() {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	known := make(map[[20]byte]Event) // the last state event of every torrent
+	for {
+		current := make(map[[20]byte]Event)
+		for _, t := range srv.s.Torrents() {
+			e := stateEvent(t)
+			old, ok := known[t.InfoHash()]
+			switch {
+			case !ok:
+				added := e
+				added.Type = EventAdded
+				srv.events.publish(added)
+			case old != e:
+				srv.events.publish(e)
+			}
+			current[t.InfoHash()] = e
+		}
+		for ih, old := range known {
+			if _, ok := current[ih]; !ok {
+				srv.events.publish(Event{Type: EventRemoved, InfoHash: old.InfoHash, Name: old.Name})
+			}
+		}
+		known = current
+
+		select {
+		case <-ticker.C:
+		case <-srv.done:
+			return
+		}
+	}
+}
+
+func stateEvent(t *session.Torrent) Event {
+	e := Event{Type: EventState, InfoHash: infoHash(t), Name: t.Name(), State: t.State().String()}
+	if err := t.Err(); err != nil {
+		e.Error = err.Error()
+	}
+	return e
+}
+
+func (srv *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		notAllowed(w, http.MethodGet)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	ch := srv.events.subscribe()
+	defer srv.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case e := <-ch:
+			data, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-srv.done:
+			return
+		}
+	}
+}
@@ -1,2 +1,129 @@
-// package discovery implements peer discovery
+// Package discovery implements peer discovery
 package discovery
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/VIVelev/bittorrent/event"
+	"github.com/VIVelev/bittorrent/logging"
+	"github.com/VIVelev/bittorrent/metrics"
+	"github.com/VIVelev/bittorrent/peer"
+)
+
+// Event tells a tracker why a torrent is announced, see BEP 3.
+type Event int
+
+const (
+	// EventNone announces are the regular ones.
+	EventNone Event = iota
+	// EventStarted is the first announce of a torrent.
+	EventStarted
+	// EventStopped is the last announce of a torrent, the tracker forgets us.
+	EventStopped
+	// EventCompleted is announced once the download completes, not if it was complete at the start.
+	EventCompleted
+)
+
+func (e Event) String() string {
+	switch e {
+	case EventNone:
+		return ""
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	case EventCompleted:
+		return "completed"
+	default:
+		return fmt.Sprintf("Event#%d", int(e))
+	}
+}
+
+// Progress is what we tell trackers about a torrent, in bytes.
+type Progress struct {
+	Uploaded   int64
+	Downloaded int64
+	// Left is how much we miss to complete the torrent.
+	Left int64
+	// Event is why the torrent is announced.
+	Event Event
+}
+
+// Reply is the answer of a tracker to an announce.
+type Reply struct {
+	Peers []peer.Peer
+	// Interval is how long the tracker wants us to wait before the next announce, 0 if it did not tell.
+	Interval time.Duration
+}
+
+// RequestPeers asks the tracker at announce about peers, over UDP or HTTP depending on its scheme.
+func RequestPeers(announce string, progress Progress, infoHash, peerId [20]byte, port uint16) ([]peer.Peer, error) {
+	return RequestPeersContext(context.Background(), announce, progress, infoHash, peerId, port)
+}
+
+// RequestPeersContext is RequestPeers, the request is abandoned once ctx is done.
+func RequestPeersContext(ctx context.Context, announce string, progress Progress, infoHash, peerId [20]byte, port uint16) ([]peer.Peer, error) {
+	reply, err := requestPeers(ctx, nil, announce, progress, infoHash, peerId, port)
+	return reply.Peers, err
+}
+
+func requestPeers(ctx context.Context, log *logging.Logger, announce string, progress Progress, infoHash, peerId [20]byte, port uint16) (Reply, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return Reply{}, err
+	}
+	switch u.Scheme {
+	case "udp":
+		return udpRequestPeers(ctx, log, announce, progress, infoHash, peerId, port)
+	case "http", "https":
+		return httpRequestPeers(ctx, announce, progress, infoHash, peerId, port)
+	default:
+		return Reply{}, fmt.Errorf("unsupported scheme: %s", u.Scheme)
+	}
+}
+
+// Announcer asks trackers for peers like RequestPeersContext, and tells the observers of
+// the torrents about it. The zero value is valid.
+type Announcer struct {
+	// Events receives an event.TrackerReply or an event.TrackerError for every request, none when nil.
+	Events *event.Bus
+	// Metrics receives the latency and the errors of the requests by tracker host, none when nil.
+	Metrics *metrics.Registry
+	// Logger receives the exchanges with UDP trackers at the debug level, none when nil.
+	Logger *logging.Logger
+}
+
+// RequestPeers asks the tracker at announce about peers, see RequestPeersContext.
+func (a *Announcer) RequestPeers(ctx context.Context, announce string, progress Progress, infoHash, peerId [20]byte, port uint16) ([]peer.Peer, error) {
+	reply, err := a.Announce(ctx, announce, progress, infoHash, peerId, port)
+	return reply.Peers, err
+}
+
+// Announce is RequestPeers, it returns the whole reply of the tracker.
+func (a *Announcer) Announce(ctx context.Context, announce string, progress Progress, infoHash, peerId [20]byte, port uint16) (Reply, error) {
+	start := time.Now()
+	reply, err := requestPeers(ctx, a.Logger.With(logging.InfoHash(infoHash)), announce, progress, infoHash, peerId, port)
+	host := trackerHost(announce)
+	a.Metrics.Histogram("bittorrent_tracker_announce_duration_seconds", "Latency of the announces to trackers.",
+		metrics.DefaultBuckets, "tracker").With(host).ObserveDuration(time.Since(start))
+	e := event.Event{Type: event.TrackerReply, InfoHash: infoHash, Tracker: announce, Peers: len(reply.Peers)}
+	if err != nil {
+		e = event.Event{Type: event.TrackerError, InfoHash: infoHash, Tracker: announce, Err: err}
+		a.Metrics.Counter("bittorrent_tracker_announce_errors_total", "Announces to trackers that failed.",
+			"tracker").With(host).Inc()
+	}
+	a.Events.Publish(e)
+	return reply, err
+}
+
+// trackerHost labels the metrics of the tracker at announce, without the path that may hold a passkey.
+func trackerHost(announce string) string {
+	u, err := url.Parse(announce)
+	if err != nil || u.Host == "" {
+		return "invalid"
+	}
+	return u.Host
+}
@@ -1,6 +1,7 @@
 package discovery
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -17,7 +18,7 @@ type bencodeHttpResponse struct {
 }
 
 // buildURL builds a HTTP request url.
-func buildURL(announce string, left int, infoHash, peerId [20]byte, port uint16) (string, error) {
+func buildURL(announce string, progress Progress, infoHash, peerId [20]byte, port uint16) (string, error) {
 	base, err := url.Parse(announce)
 	if err != nil {
 		return "", err
@@ -28,11 +29,13 @@ func buildURL(announce string, left int, infoHash, peerId [20]byte, port uint16)
 		"peer_id":   []string{string(peerId[:])},
 		// "ip":         []string{}, // optional
 		"port":       []string{strconv.Itoa(int(port))},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
-		"left":       []string{strconv.Itoa(left)},
-		// "event":      []string{"started"}, // optional, one of: started, completed, stopped
-		"compact": []string{"1"}, // BEP 23
+		"uploaded":   []string{strconv.FormatInt(progress.Uploaded, 10)},
+		"downloaded": []string{strconv.FormatInt(progress.Downloaded, 10)},
+		"left":       []string{strconv.FormatInt(progress.Left, 10)},
+		"compact":    []string{"1"}, // BEP 23
+	}
+	if progress.Event != EventNone {
+		params.Set("event", progress.Event.String())
 	}
 
 	base.RawQuery = params.Encode()
@@ -40,24 +43,32 @@ func buildURL(announce string, left int, infoHash, peerId [20]byte, port uint16)
 }
 
 // httpRequestPeers asks the tracker over HTTP at announce about peers, introducing itself with peerID and port.
-func httpRequestPeers(announce string, left int, infoHash, peerId [20]byte, port uint16) ([]peer.Peer, error) {
-	announceURL, err := buildURL(announce, left, infoHash, peerId, port)
+func httpRequestPeers(ctx context.Context, announce string, progress Progress, infoHash, peerId [20]byte, port uint16) (Reply, error) {
+	announceURL, err := buildURL(announce, progress, infoHash, peerId, port)
 	if err != nil {
-		return nil, fmt.Errorf("buildURL: %s", err)
+		return Reply{}, fmt.Errorf("buildURL: %s", err)
 	}
 
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, announceURL, nil)
+	if err != nil {
+		return Reply{}, fmt.Errorf("request: %s", err)
+	}
 	c := &http.Client{Timeout: 3 * time.Second}
-	resp, err := c.Get(announceURL)
+	resp, err := c.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("get: %s", err)
+		return Reply{}, fmt.Errorf("get: %s", err)
 	}
 
 	defer resp.Body.Close()
 	trackerResp := bencodeHttpResponse{}
 	err = bencode.Unmarshal(resp.Body, &trackerResp)
 	if err != nil {
-		return nil, fmt.Errorf("response: %s", err)
+		return Reply{}, fmt.Errorf("response: %s", err)
 	}
 
-	return peer.UnmarshalCompact([]byte(trackerResp.Peers))
+	peers, err := peer.UnmarshalCompact([]byte(trackerResp.Peers))
+	if err != nil {
+		return Reply{}, err
+	}
+	return Reply{Peers: peers, Interval: time.Duration(trackerResp.Interval) * time.Second}, nil
 }
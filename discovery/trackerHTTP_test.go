@@ -1,12 +1,16 @@
 package discovery
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/VIVelev/bittorrent/event"
 	"github.com/VIVelev/bittorrent/io"
+	"github.com/VIVelev/bittorrent/metrics"
 	"github.com/VIVelev/bittorrent/peer"
 	"github.com/stretchr/testify/assert"
 )
@@ -26,14 +30,20 @@ func TestBuildURL(t *testing.T) {
 	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
 	const port uint16 = 6881
 
-	url, err := buildURL(tf.Announce, tf.Length, tf.InfoHash, peerID, port)
-	expected := "http://bttracker.debian.org:6969/announce?compact=1&downloaded=0&info_hash=%D8%F79%CE%C3%28%95l%CC%5B%BF%1F%86%D9%FD%CF%DB%A8%CE%B6&left=351272960&peer_id=%01%02%03%04%05%06%07%08%09%0A%0B%0C%0D%0E%0F%10%11%12%13%14&port=6881&uploaded=0"
+	url, err := buildURL(tf.Announce, Progress{Uploaded: 1024, Downloaded: 2048, Left: int64(tf.Length)}, tf.InfoHash, peerID, port)
+	expected := "http://bttracker.debian.org:6969/announce?compact=1&downloaded=2048&info_hash=%D8%F79%CE%C3%28%95l%CC%5B%BF%1F%86%D9%FD%CF%DB%A8%CE%B6&left=351272960&peer_id=%01%02%03%04%05%06%07%08%09%0A%0B%0C%0D%0E%0F%10%11%12%13%14&port=6881&uploaded=1024"
 	assert.Nil(t, err)
 	assert.Equal(t, url, expected)
+
+	url, err = buildURL(tf.Announce, Progress{Left: 1, Event: EventStarted}, tf.InfoHash, peerID, port)
+	assert.Nil(t, err)
+	assert.Contains(t, url, "&event=started&")
 }
 
 func TestRequestPeers(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+	var events []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events = append(events, r.URL.Query().Get("event"))
 		response := []byte(
 			"d" +
 				"8:interval" + "i900e" +
@@ -60,11 +70,60 @@ func TestRequestPeers(t *testing.T) {
 	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
 	const port uint16 = 6881
 
-	p, err := httpRequestPeers(tf.Announce, tf.Length, tf.InfoHash, peerID, port)
+	p, err := httpRequestPeers(context.Background(), tf.Announce, Progress{Left: int64(tf.Length), Event: EventCompleted}, tf.InfoHash, peerID, port)
 	expected := []peer.Peer{
 		{IP: net.IP{192, 0, 2, 123}, Port: 6881},
 		{IP: net.IP{127, 0, 0, 1}, Port: 6889},
 	}
 	assert.Nil(t, err)
-	assert.Equal(t, p, expected)
+	assert.Equal(t, p.Peers, expected)
+	assert.Equal(t, 900*time.Second, p.Interval)
+
+	bus := event.NewBus()
+	sub := bus.Subscribe(2, event.Drop)
+	reg := metrics.NewRegistry()
+	a := &Announcer{Events: bus, Metrics: reg}
+	_, err = a.RequestPeers(context.Background(), tf.Announce, Progress{}, tf.InfoHash, peerID, port)
+	assert.Nil(t, err)
+	_, err = a.RequestPeers(context.Background(), "wss://tracker", Progress{}, tf.InfoHash, peerID, port)
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"completed", ""}, events)
+	reply, failure := <-sub.Events(), <-sub.Events()
+	assert.Equal(t, event.TrackerReply, reply.Type)
+	assert.Equal(t, tf.Announce, reply.Tracker)
+	assert.Equal(t, 2, reply.Peers)
+	assert.Equal(t, tf.InfoHash, reply.InfoHash)
+	assert.Equal(t, event.TrackerError, failure.Type)
+	assert.Equal(t, err, failure.Err)
+
+	host := ts.Listener.Addr().String()
+	latency := reg.Histogram("bittorrent_tracker_announce_duration_seconds", "", nil, "tracker")
+	errs := reg.Counter("bittorrent_tracker_announce_errors_total", "", "tracker")
+	assert.Equal(t, uint64(1), latency.With(host).Count())
+	assert.Equal(t, 0.0, errs.With(host).Value())
+	assert.Equal(t, uint64(1), latency.With("tracker").Count())
+	assert.Equal(t, 1.0, errs.With("tracker").Value())
+}
+
+func TestRequestPeersCanceled(t *testing.T) {
+	// neither tracker ever answers
+	block := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { <-block }))
+	defer ts.Close()
+	defer close(block)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	for name, announce := range map[string]string{
+		"http": ts.URL + "/announce",
+		"udp":  "udp://" + conn.LocalAddr().String(),
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		_, err := RequestPeersContext(ctx, announce, Progress{}, [20]byte{1}, [20]byte{2}, 6881)
+		cancel()
+		assert.NotNil(t, err, name)
+		assert.Less(t, int64(time.Since(start)), int64(time.Second), name)
+	}
 }
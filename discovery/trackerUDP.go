@@ -5,10 +5,10 @@ package discovery
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"log"
 	"math"
 	"math/rand"
 	"net"
@@ -16,6 +16,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/VIVelev/bittorrent/logging"
 	"github.com/VIVelev/bittorrent/peer"
 )
 
@@ -91,6 +92,14 @@ const (
 	stopped
 )
 
+// udpEvents encode the events of Progress, BEP 15.
+var udpEvents = map[Event]announceEvent{
+	EventNone:      none,
+	EventStarted:   started,
+	EventStopped:   stopped,
+	EventCompleted: completed,
+}
+
 type announceRequest struct {
 	connectionId  uint64
 	transactionId uint32
@@ -204,85 +213,100 @@ func timeoutSetter(conn *net.UDPConn) (func() time.Duration, func() time.Duratio
 
 }
 
-func UdpRequestPeers(announce string, left int, infoHash, peerId [20]byte, port uint16) ([]peer.Peer, error) {
+func UdpRequestPeers(announce string, progress Progress, infoHash, peerId [20]byte, port uint16) ([]peer.Peer, error) {
+	reply, err := udpRequestPeers(context.Background(), nil, announce, progress, infoHash, peerId, port)
+	return reply.Peers, err
+}
+
+// udpRequestPeers asks the tracker at announce about peers, the exchange is logged to log at the debug level.
+func udpRequestPeers(ctx context.Context, log *logging.Logger, announce string, progress Progress, infoHash, peerId [20]byte, port uint16) (Reply, error) {
 	// TODO: take into account connectionIdValidTime
 	// TODO: take into account possible error responses
 
 	// dial the announce url
 	u, err := url.Parse(announce)
 	if err != nil {
-		return nil, err
+		return Reply{}, err
 	}
 	if u.Scheme != "udp" {
-		return nil, fmt.Errorf("unsupported scheme: %s", u.Scheme)
+		return Reply{}, fmt.Errorf("unsupported scheme: %s", u.Scheme)
 	}
 
-	log.Printf("Dialing tracker %s.\n", u.Host)
+	log = log.With(logging.String("tracker", u.Host))
+	log.Debug("dialing tracker")
 	raddr, err := net.ResolveUDPAddr("udp", u.Host)
 	if err != nil {
-		return nil, err
+		return Reply{}, err
 	}
 	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: 0})
 	if err != nil {
-		return nil, err
+		return Reply{}, err
 	}
+	defer conn.Close()
+	// closing the connection ends the exchange when ctx is done
+	exchanged := make(chan struct{})
+	defer close(exchanged)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-exchanged:
+		}
+	}()
 
 	setTimeout, resetTimeout := timeoutSetter(conn)
 	t := setTimeout()
 
 	// make a connection request
-	log.Println("Make a connection request to the tracker.")
 	connReq := &connectRequest{
 		transactionId: rand.Uint32(),
 	}
 	var connRes *connectResponse
 	for t <= maxTimeout {
-		log.Println("Current timeout:", t)
-		log.Println("Requesting...")
+		log.Debug("sending connect request", logging.Duration("timeout", t))
 		err := connReq.marshal(conn, raddr)
 		if err != nil {
 			if errors.Is(err, os.ErrDeadlineExceeded) {
 				t = setTimeout()
 				continue
 			}
-			return nil, fmt.Errorf("connect request: %s", err)
+			return Reply{}, fmt.Errorf("connect request: %s", canceled(ctx, err))
 		}
 
-		log.Println("Waiting for a connection response...")
+		log.Debug("waiting for connect response")
 		connRes, err = new(connectResponse).unmarshal(conn)
 		if err != nil {
 			if errors.Is(err, os.ErrDeadlineExceeded) {
 				t = setTimeout()
 				continue
 			}
-			return nil, fmt.Errorf("connect response: %s", err)
+			return Reply{}, fmt.Errorf("connect response: %s", canceled(ctx, err))
 		}
 
 		if !connRes.validate(connReq) {
-			return nil, errors.New("the connect response is invalid")
+			return Reply{}, errors.New("the connect response is invalid")
 		}
 		break
 	}
 
 	if connRes == nil {
-		return nil, errors.New("connect: timeout exceeded")
+		return Reply{}, errors.New("connect: timeout exceeded")
 	}
 
 	t = resetTimeout()
 
-	log.Println("Connection Id:", connRes.connectionId)
+	log.Debug("connected to tracker", logging.Any("connection_id", connRes.connectionId))
 
 	// make an announce request
-	log.Println("Make an announce request to the tracker.")
 	announceReq := &announceRequest{
 		connectionId:  connRes.connectionId,
 		transactionId: rand.Uint32(),
 		infoHash:      infoHash,
 		peerId:        peerId,
-		downloaded:    0,
-		left:          uint64(left),
-		uploaded:      0,
-		event:         none,
+		downloaded:    uint64(progress.Downloaded),
+		left:          uint64(progress.Left),
+		uploaded:      uint64(progress.Uploaded),
+		event:         udpEvents[progress.Event],
 		ip:            0,
 		key:           42, // TODO: more robust implementation
 		numWant:       ^uint32(0),
@@ -290,38 +314,50 @@ func UdpRequestPeers(announce string, left int, infoHash, peerId [20]byte, port
 	}
 	var announceRes *announceResponse
 	for t <= maxTimeout {
-		log.Println("Current timeout:", t)
-		log.Println("Requesting...")
+		log.Debug("sending announce request", logging.Duration("timeout", t))
 		err := announceReq.marshal(conn, raddr)
 		if err != nil {
 			if errors.Is(err, os.ErrDeadlineExceeded) {
 				t = setTimeout()
 				continue
 			}
-			return nil, fmt.Errorf("announnce request: %s", err)
+			return Reply{}, fmt.Errorf("announnce request: %s", canceled(ctx, err))
 		}
 
-		log.Println("Waiting for an announce response...")
+		log.Debug("waiting for announce response")
 		announceRes, err = new(announceResponse).unmarshal(conn)
 		if err != nil {
 			if errors.Is(err, os.ErrDeadlineExceeded) {
 				t = setTimeout()
 				continue
 			}
-			return nil, fmt.Errorf("announce response: %s", err)
+			return Reply{}, fmt.Errorf("announce response: %s", canceled(ctx, err))
 		}
 
 		if !announceRes.validate(announceReq) {
-			return nil, errors.New("the announce response is invalid")
+			return Reply{}, errors.New("the announce response is invalid")
 		}
 		break
 	}
 
 	if announceRes == nil {
-		return nil, errors.New("announce: timeout exceeded")
+		return Reply{}, errors.New("announce: timeout exceeded")
 	}
 
-	log.Printf("Got an announce response:\n%s", announceRes)
+	log.Debug("announce response", logging.Int("leechers", int(announceRes.leechers)),
+		logging.Int("seeders", int(announceRes.seeders)), logging.Int("peers", len(announceRes.peers)/6))
+
+	peers, err := peer.UnmarshalCompact(announceRes.peers)
+	if err != nil {
+		return Reply{}, err
+	}
+	return Reply{Peers: peers, Interval: time.Duration(announceRes.interval) * time.Second}, nil
+}
 
-	return peer.UnmarshalCompact(announceRes.peers)
+// canceled returns the error of ctx once it is done, the connection failed because of it.
+func canceled(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
 }
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/VIVelev/bittorrent/io"
+	"github.com/VIVelev/bittorrent/logging"
+	"github.com/VIVelev/bittorrent/p2p"
+	"github.com/VIVelev/bittorrent/peer"
+	"github.com/VIVelev/bittorrent/session"
+	"github.com/VIVelev/bittorrent/storage"
+)
+
+// progressInterval is how often the progress of a torrent is shown.
+const progressInterval time.Duration = time.Second
+
+// kiB is the unit of the rate limit flags, in bytes.
+const kiB = 1024
+
+// sessionFlags are the flags of the commands that run a session.
+type sessionFlags struct {
+	port     *int
+	maxPeers *int
+	maxDown  *int
+	maxUp    *int
+	trackers stringList
+	json     *bool
+	verbose  *bool
+	logJSON  *bool
+}
+
+func addSessionFlags(fs *flag.FlagSet) *sessionFlags {
+	f := &sessionFlags{
+		port:     fs.Int("port", int(peer.DownloadPort), "port peers connect to, 0 picks a free one"),
+		maxPeers: fs.Int("max-peers", p2p.MaxPeers, "peers connected to at once"),
+		maxDown:  fs.Int("max-down", 0, "download rate limit in KiB/s, 0 is unlimited"),
+		maxUp:    fs.Int("max-up", 0, "upload rate limit in KiB/s, 0 is unlimited"),
+		json:     fs.Bool("json", false, "print the progress as JSON lines"),
+		verbose:  fs.Bool("v", false, "log the connections and the pieces to stderr"),
+		logJSON:  fs.Bool("log-json", false, "log as JSON lines, with -v"),
+	}
+	fs.Var(&f.trackers, "tracker", "announce to this tracker instead of those of the torrent, repeatable")
+	return f
+}
+
+// config returns the session config of the flags.
+func (f *sessionFlags) config() (session.Config, error) {
+	if *f.port < 0 || *f.port > 65535 {
+		return session.Config{}, usageError{fmt.Sprintf("invalid port %d", *f.port)}
+	}
+	if *f.maxPeers < 1 {
+		return session.Config{}, usageError{fmt.Sprintf("invalid peer limit %d", *f.maxPeers)}
+	}
+	if *f.maxDown < 0 || *f.maxUp < 0 {
+		return session.Config{}, usageError{"negative rate limit"}
+	}
+	cfg := session.Config{
+		ListenAddr:   fmt.Sprintf(":%d", *f.port),
+		MaxPeers:     *f.maxPeers,
+		DownloadRate: *f.maxDown * kiB,
+		UploadRate:   *f.maxUp * kiB,
+	}
+	if *f.verbose {
+		cfg.Logger = newLogger(logging.Debug, *f.logJSON)
+	}
+	return cfg, nil
+}
+
+func runDownload(args []string) error {
+	fs := newFlagSet("download", "[flags] <torrent file|magnet link>")
+	dir := fs.String("o", ".", "directory the torrent is downloaded to")
+	seed := fs.Bool("seed", false, "keep seeding once downloaded, until interrupted")
+	sf := addSessionFlags(fs)
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	cfg, err := sf.config()
+	if err != nil {
+		return err
+	}
+	cfg.DataDir = *dir
+
+	s, err := session.New(cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	opts := session.AddOptions{Trackers: sf.trackers}
+	var t *session.Torrent
+	if strings.HasPrefix(args[0], "magnet:") {
+		t, err = s.AddMagnet(args[0], opts)
+	} else {
+		t, err = s.AddFile(args[0], opts)
+	}
+	if err != nil {
+		return err
+	}
+	return watch(t, *sf.json, *seed)
+}
+
+func runSeed(args []string) error {
+	fs := newFlagSet("seed", "[flags] <torrent file>")
+	dir := fs.String("dir", ".", "directory the data of the torrent is in")
+	sf := addSessionFlags(fs)
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	cfg, err := sf.config()
+	if err != nil {
+		return err
+	}
+
+	tf, err := io.Open(args[0])
+	if err != nil {
+		return err
+	}
+	st, found, err := check(tf, *dir)
+	if err != nil {
+		return err
+	}
+	if total := numPieces(tf); found < total {
+		st.Close()
+		return fmt.Errorf("%w: %d of %d pieces are valid, see verify", errIncomplete, found, total)
+	}
+	// the session seeds the storage that is checked already
+	cfg.DataDir = *dir
+	cfg.Storage = func(*io.TorrentFile, string) (storage.Storage, error) { return st, nil }
+
+	s, err := session.New(cfg)
+	if err != nil {
+		st.Close()
+		return err
+	}
+	defer s.Close()
+	t, err := s.AddFile(args[0], session.AddOptions{Trackers: sf.trackers})
+	if err != nil {
+		return err
+	}
+	return watch(t, *sf.json, true)
+}
+
+// check opens the data of tf under dir and verifies it, returning its storage and how many
+// pieces are valid.
+func check(tf *io.TorrentFile, dir string) (storage.Storage, int, error) {
+	st, err := storage.NewFile(tf, dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	found, err := p2p.NewTorrent(tf, peer.RandID()).Check(st)
+	if err != nil {
+		st.Close()
+		return nil, 0, err
+	}
+	return st, found, nil
+}
+
+// numPieces returns how many pieces tf has.
+func numPieces(tf *io.TorrentFile) int {
+	return p2p.NewTorrent(tf, [20]byte{}).NumPieces()
+}
+
+// status is a snapshot of a torrent shown while it runs.
+type status struct {
+	Name         string `json:"name"`
+	InfoHash     string `json:"info_hash"`
+	State        string `json:"state"`
+	Size         int64  `json:"size"`      // 0 until the metadata is fetched
+	Completed    int64  `json:"completed"` // verified bytes
+	Downloaded   int64  `json:"downloaded"`
+	Uploaded     int64  `json:"uploaded"`
+	Peers        int    `json:"peers"`
+	DownloadRate int64  `json:"download_rate"` // bytes per second
+	UploadRate   int64  `json:"upload_rate"`
+	ETA          int64  `json:"eta"` // in seconds, -1 when unknown
+}
+
+// watch shows the progress of t until it is downloaded, or until it is interrupted if seed is set.
+func watch(t *session.Torrent, asJSON, seed bool) error {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	p := &progress{json: asJSON, tty: isTerminal(os.Stdout)}
+	defer p.end()
+	for {
+		p.show(t)
+		switch t.State() {
+		case session.StateSeeding:
+			if !seed {
+				return nil
+			}
+		case session.StateError:
+			return t.Err()
+		}
+		select {
+		case <-ticker.C:
+		case <-sig:
+			if seed && t.State() == session.StateSeeding {
+				return nil
+			}
+			return errInterrupt
+		}
+	}
+}
+
+// progress shows statuses: a line updated in place on terminals, one line per change otherwise.
+type progress struct {
+	json  bool
+	tty   bool
+	last  status
+	shown bool
+}
+
+func (p *progress) show(t *session.Torrent) {
+	ih := t.InfoHash()
+	stats := t.Stats()
+	st := status{
+		Name:         t.Name(),
+		InfoHash:     hex.EncodeToString(ih[:]),
+		State:        t.State().String(),
+		Size:         t.Size(),
+		Completed:    t.BytesCompleted(),
+		Downloaded:   stats.Downloaded,
+		Uploaded:     stats.Uploaded,
+		Peers:        stats.Peers,
+		DownloadRate: int64(stats.DownloadRate),
+		UploadRate:   int64(stats.UploadRate),
+		ETA:          -1,
+	}
+	if stats.ETA > 0 {
+		st.ETA = int64(stats.ETA.Seconds())
+	}
+	changed := !p.shown || st != p.last
+	p.last = st
+	if !changed && !p.tty {
+		return
+	}
+	p.shown = true
+
+	switch {
+	case p.json:
+		json.NewEncoder(os.Stdout).Encode(st)
+	case p.tty:
+		fmt.Printf("\r\x1b[K%s", st)
+	default:
+		fmt.Println(st)
+	}
+}
+
+// end finishes the line updated in place.
+func (p *progress) end() {
+	if p.shown && p.tty && !p.json {
+		fmt.Println()
+	}
+}
+
+func (st status) String() string {
+	percent := 0.0
+	if st.Size > 0 {
+		percent = float64(st.Completed) / float64(st.Size) * 100
+	}
+	s := fmt.Sprintf("%s  %s  %.1f%%  %s/%s  down %s/s  up %s/s  %d peers",
+		st.Name, st.State, percent, formatBytes(st.Completed), formatBytes(st.Size),
+		formatBytes(st.DownloadRate), formatBytes(st.UploadRate), st.Peers)
+	if st.ETA >= 0 {
+		s += fmt.Sprintf("  eta %s", time.Duration(st.ETA)*time.Second)
+	}
+	return s
+}
+
+// formatBytes formats n with a binary unit.
+func formatBytes(n int64) string {
+	const units = "KMGTPE"
+	if n < kiB {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(kiB), 0
+	for m := n / kiB; m >= kiB; m /= kiB {
+		div *= kiB
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), units[exp])
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
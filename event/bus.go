@@ -0,0 +1,150 @@
+package event
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Policy tells what happens to the events a subscription has no room for.
+type Policy int
+
+const (
+	// Drop discards them, see Subscription.Dropped. The torrents never wait for the subscriber.
+	Drop Policy = iota
+	// Block makes the publisher wait until the subscriber has room, slowing the torrents down.
+	// The subscriber must keep reading, or Close the subscription.
+	Block
+)
+
+// Bus hands events over to its subscribers. A nil *Bus discards every event,
+// so that publishers need not check for one.
+type Bus struct {
+	mu   sync.Mutex
+	subs map[*Subscription]bool
+}
+
+// NewBus returns a bus without subscribers.
+func NewBus() *Bus {
+	return &Bus{subs: make(map[*Subscription]bool)}
+}
+
+// Subscribe returns a subscription to the events of the given types, of every type when none
+// is given. It buffers up to size events, then applies policy.
+func (b *Bus) Subscribe(size int, policy Policy, types ...Type) *Subscription {
+	if size < 0 {
+		size = 0
+	}
+	s := &Subscription{
+		bus:    b,
+		policy: policy,
+		ch:     make(chan Event, size),
+		done:   make(chan struct{}),
+	}
+	for _, t := range types {
+		if t >= 0 && int(t) < numTypes {
+			s.types |= 1 << uint(t)
+		}
+	}
+	if len(types) == 0 {
+		s.types = 1<<uint(numTypes) - 1
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subs[s] = true
+	return s
+}
+
+// Publish hands e over to the subscribers of its type, setting its Time if it is zero.
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	subs := make([]*Subscription, 0, len(b.subs))
+	for s := range b.subs {
+		if s.wants(e.Type) {
+			subs = append(subs, s)
+		}
+	}
+	b.mu.Unlock()
+
+	// a blocking subscriber does not hold the others up with b.mu held
+	for _, s := range subs {
+		s.deliver(e)
+	}
+}
+
+func (b *Bus) remove(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.subs, s)
+}
+
+// Subscription receives the events of a bus, see Bus.Subscribe.
+type Subscription struct {
+	bus     *Bus
+	types   uint64 // bit t is set for the wanted types t
+	policy  Policy
+	dropped int64 // atomic
+
+	mu     sync.RWMutex // held for writing while ch is closed
+	ch     chan Event
+	closed bool
+	done   chan struct{} // closed by Close, it unblocks the publishers
+	once   sync.Once
+}
+
+// Events returns the channel the events are received on, it is closed by Close.
+func (s *Subscription) Events() <-chan Event {
+	return s.ch
+}
+
+// Dropped returns how many events were discarded because the buffer was full.
+func (s *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// Close ends the subscription. The events buffered already can still be received.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.bus.remove(s)
+		close(s.done)
+		s.mu.Lock()
+		s.closed = true
+		close(s.ch)
+		s.mu.Unlock()
+	})
+}
+
+func (s *Subscription) wants(t Type) bool {
+	return t >= 0 && int(t) < numTypes && s.types&(1<<uint(t)) != 0
+}
+
+func (s *Subscription) deliver(e Event) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return
+	}
+	if s.policy == Block {
+		select {
+		case s.ch <- e:
+		case <-s.done:
+		}
+		return
+	}
+	select {
+	case s.ch <- e:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
@@ -0,0 +1,101 @@
+package event
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/VIVelev/bittorrent/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBus(t *testing.T) {
+	b := NewBus()
+	all := b.Subscribe(10, Drop)
+	pieces := b.Subscribe(10, Drop, PieceVerified, PieceFailed)
+	small := b.Subscribe(1, Drop)
+
+	b.Publish(Event{Type: PieceVerified, Piece: 1})
+	b.Publish(Event{Type: TrackerReply, Tracker: "http://tracker", Peers: 3})
+	b.Publish(Event{Type: PieceFailed, Piece: 2})
+
+	require.Len(t, all.Events(), 3)
+	for _, typ := range []Type{PieceVerified, TrackerReply, PieceFailed} {
+		e := <-all.Events()
+		assert.Equal(t, typ, e.Type)
+		assert.False(t, e.Time.IsZero(), "the time is set")
+	}
+	require.Len(t, pieces.Events(), 2)
+	assert.Equal(t, 1, (<-pieces.Events()).Piece)
+	assert.Equal(t, 2, (<-pieces.Events()).Piece)
+	assert.Len(t, small.Events(), 1)
+	assert.Equal(t, int64(2), small.Dropped())
+
+	small.Close()
+	small.Close() // twice is fine
+	b.Publish(Event{Type: PieceVerified})
+	e, ok := <-small.Events()
+	assert.True(t, ok, "the buffered event is kept")
+	assert.Equal(t, PieceVerified, e.Type)
+	_, ok = <-small.Events()
+	assert.False(t, ok, "closed")
+
+	var nilBus *Bus
+	nilBus.Publish(Event{Type: PieceVerified}) // discarded
+}
+
+func TestBusBlock(t *testing.T) {
+	b := NewBus()
+	s := b.Subscribe(1, Block)
+	b.Publish(Event{Type: PieceVerified, Piece: 0})
+
+	published := make(chan struct{})
+	go func() {
+		b.Publish(Event{Type: PieceVerified, Piece: 1})
+		close(published)
+	}()
+	select {
+	case <-published:
+		t.Fatal("the publisher did not wait for room")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, 0, (<-s.Events()).Piece)
+	<-published
+	assert.Equal(t, 1, (<-s.Events()).Piece)
+	assert.Equal(t, int64(0), s.Dropped())
+
+	// closing the subscription releases the publisher
+	b.Publish(Event{Type: PieceVerified, Piece: 2})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.Close()
+	}()
+	done := make(chan struct{})
+	go func() {
+		b.Publish(Event{Type: PieceVerified, Piece: 3})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the publisher is still blocked")
+	}
+}
+
+func TestEventString(t *testing.T) {
+	p := peer.Peer{IP: net.IP{10, 0, 0, 1}, Port: 6881}
+	tests := map[string]struct {
+		e    Event
+		want string
+	}{
+		"piece":   {Event{Type: PieceFailed, InfoHash: [20]byte{0xab}, Piece: 3, Err: errors.New("bad hash")}, "piece-failed ab00000000000000000000000000000000000000 piece 3: bad hash"},
+		"tracker": {Event{Type: TrackerReply, Tracker: "udp://t:80", Peers: 2}, "tracker-reply 0000000000000000000000000000000000000000 udp://t:80: 2 peers"},
+		"peer":    {Event{Type: PeerBanned, Peer: p, Err: errors.New("bad pieces")}, "peer-banned 0000000000000000000000000000000000000000 10.0.0.1:6881: bad pieces"},
+		"unknown": {Event{Type: Type(42)}, "Type#42 0000000000000000000000000000000000000000"},
+	}
+	for name, test := range tests {
+		assert.Equal(t, test.want, test.e.String(), name)
+	}
+}
@@ -0,0 +1,102 @@
+// Package event publishes what happens to torrents to the code observing them.
+package event
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/VIVelev/bittorrent/peer"
+)
+
+// Type tells what an event is about, and which fields of the Event are set.
+type Type int
+
+const (
+	// PieceVerified pieces passed their hash check and were stored: Piece.
+	PieceVerified Type = iota
+	// PieceFailed pieces failed their hash check: Piece, Peer unless they came from a web seed, Err.
+	PieceFailed
+	// FileCompleted files have every piece stored: File.
+	FileCompleted
+	// StateChanged torrents of a session moved to State, Err is why when it is "error".
+	StateChanged
+	// TrackerReply trackers answered an announce: Tracker, Peers.
+	TrackerReply
+	// TrackerError trackers failed to answer an announce: Tracker, Err.
+	TrackerError
+	// PeerConnected peers completed a handshake with us: Peer.
+	PeerConnected
+	// PeerDisconnected peers were connected to and are not anymore: Peer, Err when it failed.
+	PeerDisconnected
+	// PeerBanned peers are never connected to again: Peer, Err is why.
+	PeerBanned
+	// StorageError storages failed to store a piece: Piece, Err.
+	StorageError
+)
+
+// numTypes bounds the types, see Subscription.
+const numTypes = int(StorageError) + 1
+
+func (t Type) String() string {
+	switch t {
+	case PieceVerified:
+		return "piece-verified"
+	case PieceFailed:
+		return "piece-failed"
+	case FileCompleted:
+		return "file-completed"
+	case StateChanged:
+		return "state-changed"
+	case TrackerReply:
+		return "tracker-reply"
+	case TrackerError:
+		return "tracker-error"
+	case PeerConnected:
+		return "peer-connected"
+	case PeerDisconnected:
+		return "peer-disconnected"
+	case PeerBanned:
+		return "peer-banned"
+	case StorageError:
+		return "storage-error"
+	default:
+		return fmt.Sprintf("Type#%d", int(t))
+	}
+}
+
+// Event is something that happened to the torrent with InfoHash.
+// The fields its Type does not mention are zero.
+type Event struct {
+	Type     Type
+	Time     time.Time
+	InfoHash [20]byte
+	Piece    int
+	File     int // index in the files of the torrent
+	State    string
+	Tracker  string // announce URL
+	Peers    int    // sent by the tracker
+	Peer     peer.Peer
+	Err      error
+}
+
+func (e Event) String() string {
+	s := fmt.Sprintf("%s %x", e.Type, e.InfoHash)
+	switch e.Type {
+	case PieceVerified, PieceFailed, StorageError:
+		s += fmt.Sprintf(" piece %d", e.Piece)
+	case FileCompleted:
+		s += fmt.Sprintf(" file %d", e.File)
+	case StateChanged:
+		s += " " + e.State
+	case TrackerReply:
+		s += fmt.Sprintf(" %s: %d peers", e.Tracker, e.Peers)
+	case TrackerError:
+		s += " " + e.Tracker
+	case PeerConnected, PeerDisconnected, PeerBanned:
+		s += " " + e.Peer.String()
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
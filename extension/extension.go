@@ -0,0 +1,64 @@
+// Package extension implements the Extension Protocol, BEP 10.
+// reference: https://www.bittorrent.org/beps/bep_0010.html
+package extension
+
+import (
+	"bytes"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// HandshakeID is the extended message id of the extension handshake.
+const HandshakeID uint8 = 0
+
+// Names of the extensions we support.
+const (
+	// PEX is Peer Exchange, BEP 11.
+	PEX string = "ut_pex"
+	// Metadata is the exchange of the info dictionary of magnet links, BEP 9.
+	Metadata string = "ut_metadata"
+)
+
+// Local maps the extensions we support to the extended message ids we receive them under.
+var Local = map[string]int{
+	PEX:      1,
+	Metadata: 2,
+}
+
+// ClientName is advertised in the v field of our handshake.
+const ClientName string = "VIVelev/bittorrent"
+
+// Handshake is the payload of the extension handshake.
+type Handshake struct {
+	// M maps the extensions supported by the sender to their extended message ids.
+	M      map[string]int `bencode:"m"`
+	Port   int            `bencode:"p,omitempty"`
+	Client string         `bencode:"v,omitempty"`
+	YourIP string         `bencode:"yourip,omitempty"`
+	Reqq   int            `bencode:"reqq,omitempty"`
+	// MetadataSize is the size of the info dictionary, BEP 9.
+	MetadataSize int `bencode:"metadata_size,omitempty"`
+}
+
+// NewHandshake creates the handshake advertising the extensions we support.
+func NewHandshake() *Handshake {
+	return &Handshake{M: Local, Client: ClientName}
+}
+
+// Marshal serializes the handshake.
+func (h *Handshake) Marshal() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := bencode.Marshal(buf, *h); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ParseHandshake parses the payload of an extension handshake.
+func ParseHandshake(payload []byte) (*Handshake, error) {
+	h := new(Handshake)
+	if err := bencode.Unmarshal(bytes.NewReader(payload), h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
@@ -0,0 +1,66 @@
+package extension
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshake(t *testing.T) {
+	b, err := NewHandshake().Marshal()
+	require.Nil(t, err)
+	assert.Equal(t, "d1:md11:ut_metadatai2e6:ut_pexi1ee1:v18:VIVelev/bittorrente", string(b))
+
+	h, err := ParseHandshake([]byte("d1:md11:ut_metadatai3e6:ut_pexi2ee13:metadata_sizei31235e1:pi6881e4:reqqi250e1:v12:uTorrent 3.5e"))
+	require.Nil(t, err)
+	assert.Equal(t, &Handshake{
+		M:      map[string]int{"ut_metadata": 3, "ut_pex": 2},
+		Port:   6881,
+		Client: "uTorrent 3.5",
+		Reqq:   250,
+
+		MetadataSize: 31235,
+	}, h)
+
+	_, err = ParseHandshake([]byte("d1:m"))
+	assert.NotNil(t, err)
+}
+
+func TestMetadata(t *testing.T) {
+	tests := map[string]struct {
+		m    MetadataMessage
+		data []byte
+		raw  string
+	}{
+		"request": {
+			m:   MetadataMessage{Type: MetadataRequest, Piece: 0},
+			raw: "d8:msg_typei0e5:piecei0ee",
+		},
+		"data": {
+			m:    MetadataMessage{Type: MetadataData, Piece: 1, TotalSize: 16390},
+			data: []byte("d6:lengthe"),
+			raw:  "d8:msg_typei1e5:piecei1e10:total_sizei16390eed6:lengthe",
+		},
+		"reject": {
+			m:   MetadataMessage{Type: MetadataReject, Piece: 2},
+			raw: "d8:msg_typei2e5:piecei2ee",
+		},
+	}
+
+	for name, test := range tests {
+		b, err := MarshalMetadata(test.m, test.data)
+		require.Nil(t, err, name)
+		assert.Equal(t, test.raw, string(b), name)
+
+		m, data, err := ParseMetadata(b)
+		require.Nil(t, err, name)
+		assert.Equal(t, test.m, m, name)
+		assert.Equal(t, len(test.data), len(data), name)
+		assert.Equal(t, string(test.data), string(data), name)
+	}
+
+	_, _, err := ParseMetadata([]byte("d5:piecei0ee"))
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, NumMetadataPieces(MetadataPieceSize+1))
+}
@@ -0,0 +1,108 @@
+package extension
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// MetadataPieceSize is the size of every piece of the metadata but the last, BEP 9.
+// reference: https://www.bittorrent.org/beps/bep_0009.html
+const MetadataPieceSize int = 16384 // 16KiB
+
+// Types of metadata messages.
+const (
+	MetadataRequest int = iota
+	MetadataData
+	MetadataReject
+)
+
+// MetadataMessage is a ut_metadata message. Data messages carry the piece after the dictionary.
+type MetadataMessage struct {
+	Type      int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"` // of data messages
+}
+
+// MarshalMetadata serializes a metadata message followed by data.
+func MarshalMetadata(m MetadataMessage, data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := bencode.Marshal(buf, m); err != nil {
+		return nil, err
+	}
+	buf.Write(data)
+	return buf.Bytes(), nil
+}
+
+// ParseMetadata parses a metadata message and returns the data after it.
+func ParseMetadata(payload []byte) (MetadataMessage, []byte, error) {
+	var m MetadataMessage
+	// the decoder reads ahead, find where the dictionary ends first
+	end, err := skipValue(payload, 0)
+	if err != nil {
+		return m, nil, fmt.Errorf("metadata message: %s", err)
+	}
+	v, err := bencode.Decode(bytes.NewReader(payload[:end]))
+	if err != nil {
+		return m, nil, fmt.Errorf("metadata message: %s", err)
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return m, nil, errors.New("metadata message: not a dictionary")
+	}
+	msgType, ok1 := dict["msg_type"].(int64)
+	piece, ok2 := dict["piece"].(int64)
+	if !ok1 || !ok2 || piece < 0 {
+		return m, nil, errors.New("metadata message: missing msg_type or piece")
+	}
+	totalSize, _ := dict["total_size"].(int64)
+	m = MetadataMessage{Type: int(msgType), Piece: int(piece), TotalSize: int(totalSize)}
+	return m, payload[end:], nil
+}
+
+// skipValue returns the offset right after the bencoded value starting at i.
+func skipValue(b []byte, i int) (int, error) {
+	if i >= len(b) {
+		return 0, errors.New("unexpected end")
+	}
+	switch c := b[i]; {
+	case c == 'i':
+		end := bytes.IndexByte(b[i:], 'e')
+		if end < 0 {
+			return 0, errors.New("unterminated integer")
+		}
+		return i + end + 1, nil
+	case c == 'l' || c == 'd':
+		i++
+		for i < len(b) && b[i] != 'e' {
+			var err error
+			if i, err = skipValue(b, i); err != nil {
+				return 0, err
+			}
+		}
+		if i >= len(b) {
+			return 0, errors.New("unterminated list or dictionary")
+		}
+		return i + 1, nil
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(b[i:], ':')
+		if colon < 0 {
+			return 0, errors.New("malformed string")
+		}
+		n, err := strconv.Atoi(string(b[i : i+colon]))
+		if err != nil || n < 0 || i+colon+1+n > len(b) {
+			return 0, errors.New("malformed string")
+		}
+		return i + colon + 1 + n, nil
+	default:
+		return 0, fmt.Errorf("unexpected %q", c)
+	}
+}
+
+// NumMetadataPieces returns the number of pieces of metadata of the given size.
+func NumMetadataPieces(size int) int {
+	return (size + MetadataPieceSize - 1) / MetadataPieceSize
+}
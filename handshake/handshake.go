@@ -19,6 +19,29 @@ type Handshake struct {
 	PeerID        [20]byte // idetifies ourselves
 }
 
+// Extension identifies a protocol extension advertised in the reserved bytes,
+// encoded as <byte index> << 8 | <bit mask>.
+type Extension uint16
+
+const (
+	// ExtFast is the Fast Extension (BEP 6).
+	ExtFast Extension = 7<<8 | 0x04
+	// ExtExtended is the Extension Protocol (BEP 10).
+	ExtExtended Extension = 5<<8 | 0x10
+	// ExtV2 is support for BitTorrent v2 (BEP 52).
+	ExtV2 Extension = 7<<8 | 0x10
+)
+
+// Enable advertises support for the extension e.
+func (hs *Handshake) Enable(e Extension) {
+	hs.ReservedBytes[e>>8] |= byte(e)
+}
+
+// Supports checks if the extension e is advertised.
+func (hs *Handshake) Supports(e Extension) bool {
+	return hs.ReservedBytes[e>>8]&byte(e) != 0
+}
+
 func Marshal(hs *Handshake) (ret [1 + Len + 48]byte) {
 	ret[0] = byte(Len)
 	curr := 1
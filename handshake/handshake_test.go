@@ -68,3 +68,21 @@ func TestUnmarshal(t *testing.T) {
 		assert.Equal(t, hs, test.output)
 	}
 }
+
+func TestExtensions(t *testing.T) {
+	hs := new(Handshake)
+	assert.False(t, hs.Supports(ExtFast))
+
+	hs.Enable(ExtFast)
+	assert.True(t, hs.Supports(ExtFast))
+	assert.Equal(t, [8]byte{0, 0, 0, 0, 0, 0, 0, 0x04}, hs.ReservedBytes)
+
+	hs.Enable(ExtExtended)
+	assert.True(t, hs.Supports(ExtExtended))
+	assert.Equal(t, [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0x04}, hs.ReservedBytes)
+
+	assert.False(t, hs.Supports(ExtV2))
+	hs.Enable(ExtV2)
+	assert.True(t, hs.Supports(ExtV2))
+	assert.Equal(t, [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0x14}, hs.ReservedBytes)
+}
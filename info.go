@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/VIVelev/bittorrent/io"
+	"github.com/VIVelev/bittorrent/p2p"
+)
+
+// torrentInfo is the metadata of a torrent, or what a magnet link tells of it.
+type torrentInfo struct {
+	Name        string     `json:"name"`
+	InfoHash    string     `json:"info_hash"`
+	InfoHashV2  string     `json:"info_hash_v2,omitempty"`
+	Magnet      string     `json:"magnet"`
+	Size        int64      `json:"size,omitempty"`
+	PieceLength int        `json:"piece_length,omitempty"`
+	Pieces      int        `json:"pieces,omitempty"`
+	Trackers    []string   `json:"trackers"`
+	WebSeeds    []string   `json:"web_seeds"`
+	Files       []fileInfo `json:"files,omitempty"`
+}
+
+// fileInfo is a file of a torrent, Completed is only set by verify.
+type fileInfo struct {
+	Path      string `json:"path"` // slash separated, starting with the name of the torrent
+	Length    int64  `json:"length"`
+	Completed *int64 `json:"completed,omitempty"`
+	Padding   bool   `json:"padding,omitempty"`
+}
+
+func newTorrentInfo(tf *io.TorrentFile) torrentInfo {
+	info := torrentInfo{
+		Name:        tf.Name,
+		InfoHash:    hex.EncodeToString(tf.InfoHash[:]),
+		Magnet:      tf.Magnet().String(),
+		Size:        int64(tf.Length),
+		PieceLength: tf.PieceLength,
+		Pieces:      numPieces(tf),
+		Trackers:    nonNil(tf.Trackers()),
+		WebSeeds:    nonNil(tf.URLList),
+		Files:       files(tf),
+	}
+	if tf.MetaVersion == 2 {
+		info.InfoHashV2 = hex.EncodeToString(tf.InfoHashV2[:])
+	}
+	return info
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+func files(tf *io.TorrentFile) []fileInfo {
+	if !tf.IsMultiFile {
+		return []fileInfo{{Path: tf.Name, Length: int64(tf.Length)}}
+	}
+	ret := make([]fileInfo, len(tf.Files))
+	for i, f := range tf.Files {
+		ret[i] = fileInfo{
+			Path:    path.Join(append([]string{tf.Name}, f.Path...)...),
+			Length:  int64(f.Length),
+			Padding: f.IsPadding(),
+		}
+	}
+	return ret
+}
+
+func (info torrentInfo) print() {
+	fmt.Printf("Name:       %s\n", info.Name)
+	fmt.Printf("Info hash:  %s\n", info.InfoHash)
+	if info.InfoHashV2 != "" {
+		fmt.Printf("Info hash v2: %s\n", info.InfoHashV2)
+	}
+	if info.Files != nil {
+		fmt.Printf("Size:       %s (%d bytes)\n", formatBytes(info.Size), info.Size)
+		fmt.Printf("Pieces:     %d of %s\n", info.Pieces, formatBytes(int64(info.PieceLength)))
+	}
+	fmt.Printf("Magnet:     %s\n", info.Magnet)
+	fmt.Println("Trackers:")
+	for _, tr := range info.Trackers {
+		fmt.Printf("  %s\n", tr)
+	}
+	if len(info.WebSeeds) > 0 {
+		fmt.Println("Web seeds:")
+		for _, ws := range info.WebSeeds {
+			fmt.Printf("  %s\n", ws)
+		}
+	}
+	if info.Files != nil {
+		fmt.Println("Files:")
+		for _, f := range info.Files {
+			if !f.Padding {
+				fmt.Printf("  %10s  %s\n", formatBytes(f.Length), f.Path)
+			}
+		}
+	}
+}
+
+func runInfo(args []string) error {
+	fs := newFlagSet("info", "[flags] <torrent file|magnet link>")
+	asJSON := fs.Bool("json", false, "print the metadata as JSON")
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	var info torrentInfo
+	if strings.HasPrefix(args[0], "magnet:") {
+		m, err := io.ParseMagnet(args[0])
+		if err != nil {
+			return err
+		}
+		info = torrentInfo{
+			Name:     m.Name,
+			InfoHash: hex.EncodeToString(m.InfoHash[:]),
+			Magnet:   m.String(),
+			Trackers: nonNil(m.Trackers),
+			WebSeeds: nonNil(m.WebSeeds),
+		}
+	} else {
+		tf, err := io.Open(args[0])
+		if err != nil {
+			return err
+		}
+		info = newTorrentInfo(tf)
+	}
+	if *asJSON {
+		return printJSON(info)
+	}
+	info.print()
+	return nil
+}
+
+func runMagnet(args []string) error {
+	fs := newFlagSet("magnet", "[flags] <torrent file>")
+	asJSON := fs.Bool("json", false, "print the magnet link as JSON")
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	tf, err := io.Open(args[0])
+	if err != nil {
+		return err
+	}
+	link := tf.Magnet().String()
+	if *asJSON {
+		return printJSON(map[string]string{"magnet": link})
+	}
+	fmt.Println(link)
+	return nil
+}
+
+func runCreate(args []string) error {
+	fs := newFlagSet("create", "[flags] <file|directory>")
+	out := fs.String("o", "", "path of the torrent file, the name of the file or directory with .torrent when empty")
+	pieceLength := fs.Int("piece-length", 0, "piece length in bytes, a power of two of at least 16384, picked from the size when 0")
+	comment := fs.String("comment", "", "comment of the torrent")
+	asJSON := fs.Bool("json", false, "print the created torrent as JSON")
+	var trackers, webSeeds stringList
+	fs.Var(&trackers, "tracker", "tracker to announce to, repeatable")
+	fs.Var(&webSeeds, "web-seed", "URL of a web seed, repeatable")
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	data, err := io.Create(args[0], io.CreateOptions{
+		PieceLength: *pieceLength,
+		Trackers:    trackers,
+		WebSeeds:    webSeeds,
+		Comment:     *comment,
+	})
+	if err != nil {
+		return err
+	}
+	tf, err := io.Parse(data)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		*out = filepath.Base(filepath.Clean(args[0])) + ".torrent"
+	}
+	if err := ioutil.WriteFile(*out, data, 0644); err != nil {
+		return err
+	}
+
+	info := newTorrentInfo(tf)
+	if *asJSON {
+		return printJSON(struct {
+			Path string `json:"path"`
+			torrentInfo
+		}{*out, info})
+	}
+	fmt.Printf("Created %s\n", *out)
+	info.print()
+	return nil
+}
+
+func runVerify(args []string) error {
+	fs := newFlagSet("verify", "[flags] <torrent file>")
+	dir := fs.String("dir", ".", "directory the data of the torrent is in")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	tf, err := io.Open(args[0])
+	if err != nil {
+		return err
+	}
+
+	st, found, err := check(tf, *dir)
+	if err != nil {
+		return err
+	}
+	completed := st.Completed()
+	st.Close()
+	result := struct {
+		Name   string     `json:"name"`
+		Pieces int        `json:"pieces"`
+		Valid  int        `json:"valid"`
+		Files  []fileInfo `json:"files"`
+	}{tf.Name, numPieces(tf), found, files(tf)}
+	for i, c := range p2p.FilesCompleted(tf, completed) {
+		c := c
+		result.Files[i].Completed = &c
+	}
+
+	if *asJSON {
+		if err := printJSON(result); err != nil {
+			return err
+		}
+	} else {
+		for _, f := range result.Files {
+			if f.Padding {
+				continue
+			}
+			percent := 100.0
+			if f.Length > 0 {
+				percent = float64(*f.Completed) / float64(f.Length) * 100
+			}
+			fmt.Printf("  %5.1f%%  %s\n", percent, f.Path)
+		}
+		fmt.Printf("%d of %d pieces are valid.\n", result.Valid, result.Pieces)
+	}
+	if result.Valid < result.Pieces {
+		return fmt.Errorf("%w: %d pieces are missing or corrupt", errIncomplete, result.Pieces-result.Valid)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+// Package testswarm runs sessions and a tracker for the tests of the packages that drive a
+// session.
+package testswarm
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/VIVelev/bittorrent/internal/testtorrent"
+	"github.com/VIVelev/bittorrent/session"
+	"github.com/jackpal/bencode-go"
+	"github.com/stretchr/testify/require"
+)
+
+// PieceLength is the piece length of the torrents of Torrent.
+const PieceLength = 16384
+
+// Torrent returns a single-file torrent named file with the given contents,
+// announced to tracker unless it is empty.
+func Torrent(t testing.TB, data []byte, tracker string) []byte {
+	return testtorrent.Torrent{Name: "file", PieceLength: PieceLength, Announce: tracker}.Bytes(t, data)
+}
+
+// NewSession returns a session storing its torrents in dataDir, closed when the test ends.
+func NewSession(t testing.TB, dataDir string) *session.Session {
+	s, err := session.New(session.Config{ListenAddr: "127.0.0.1:0", DataDir: dataDir, DisableLSD: true})
+	require.Nil(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// Start starts a seeder of the torrent of data and a tracker that knows it only, and returns
+// the announce URL of the tracker.
+func Start(t testing.TB, data []byte) string {
+	dir := t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "file"), data, 0644))
+	seeder := NewSession(t, dir)
+	st, err := seeder.AddBytes(Torrent(t, data, ""), session.AddOptions{})
+	require.Nil(t, err)
+	require.Eventually(t, func() bool { return st.State() == session.StateSeeding }, 10*time.Second, 10*time.Millisecond)
+
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		peers := make([]byte, 6)
+		copy(peers, net.IPv4(127, 0, 0, 1).To4())
+		binary.BigEndian.PutUint16(peers[4:], seeder.Port())
+		bencode.Marshal(w, map[string]interface{}{"interval": 900, "peers": string(peers)})
+	}))
+	t.Cleanup(tracker.Close)
+	return tracker.URL + "/announce"
+}
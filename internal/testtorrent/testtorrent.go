@@ -0,0 +1,70 @@
+// Package testtorrent builds the metadata of v1 torrents for the tests of the other packages.
+package testtorrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"testing"
+
+	"github.com/VIVelev/bittorrent/io"
+	"github.com/jackpal/bencode-go"
+	"github.com/stretchr/testify/require"
+)
+
+// File is a file of a multi-file torrent, see BEP 47 for Attr and SymlinkPath.
+type File struct {
+	Length      int      `bencode:"length"`
+	Path        []string `bencode:"path"`
+	Attr        string   `bencode:"attr,omitempty"`
+	SymlinkPath []string `bencode:"symlink path,omitempty"`
+}
+
+// Torrent describes a torrent of some data.
+type Torrent struct {
+	Name        string
+	PieceLength int
+	// Files make a multi-file torrent, the data being their contents in order.
+	// A single-file torrent is built when there are none.
+	Files []File
+	// Announce is the URL of the tracker, none when empty.
+	Announce string
+}
+
+// Bytes returns the .torrent file of data.
+func (tt Torrent) Bytes(t testing.TB, data []byte) []byte {
+	var pieces []byte
+	for begin := 0; begin < len(data); begin += tt.PieceLength {
+		end := begin + tt.PieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha1.Sum(data[begin:end])
+		pieces = append(pieces, hash[:]...)
+	}
+
+	info := map[string]interface{}{
+		"name":         tt.Name,
+		"piece length": tt.PieceLength,
+		"pieces":       string(pieces),
+	}
+	if tt.Files == nil {
+		info["length"] = len(data)
+	} else {
+		info["files"] = tt.Files
+	}
+	torrent := map[string]interface{}{"info": info}
+	if tt.Announce != "" {
+		torrent["announce"] = tt.Announce
+	}
+
+	buf := new(bytes.Buffer)
+	require.Nil(t, bencode.Marshal(buf, torrent))
+	return buf.Bytes()
+}
+
+// Parse returns the metadata of the torrent of data.
+func (tt Torrent) Parse(t testing.TB, data []byte) *io.TorrentFile {
+	tf, err := io.Parse(tt.Bytes(t, data))
+	require.Nil(t, err)
+	return tf
+}
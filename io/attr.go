@@ -0,0 +1,61 @@
+package io
+
+import (
+	"strings"
+)
+
+// File attributes, BEP 47.
+// reference: https://www.bittorrent.org/beps/bep_0047.html
+const (
+	// AttrPadding marks a file of zeros that aligns the next file to a piece boundary.
+	AttrPadding byte = 'p'
+	// AttrExecutable marks an executable file.
+	AttrExecutable byte = 'x'
+	// AttrHidden marks a hidden file.
+	AttrHidden byte = 'h'
+	// AttrSymlink marks a symbolic link, see SymlinkPath.
+	AttrSymlink byte = 'l'
+)
+
+func hasAttr(attr string, a byte) bool {
+	return strings.IndexByte(attr, a) >= 0
+}
+
+// IsPadding checks if the file is a padding file, which is not written to disk.
+func (f bencodeFile) IsPadding() bool {
+	return hasAttr(f.Attr, AttrPadding)
+}
+
+// IsExecutable checks if the file is executable.
+func (f bencodeFile) IsExecutable() bool {
+	return hasAttr(f.Attr, AttrExecutable)
+}
+
+// IsHidden checks if the file is hidden.
+func (f bencodeFile) IsHidden() bool {
+	return hasAttr(f.Attr, AttrHidden)
+}
+
+// IsSymlink checks if the file is a symbolic link.
+func (f bencodeFile) IsSymlink() bool {
+	return hasAttr(f.Attr, AttrSymlink) && len(f.SymlinkPath) > 0
+}
+
+// ZeroPadding zeroes the bytes of buf that belong to padding files.
+// buf holds the contents of the torrent starting at offset.
+func (tf *TorrentFile) ZeroPadding(offset int, buf []byte) {
+	if !tf.IsMultiFile {
+		return
+	}
+
+	n := 0
+	for _, s := range tf.Spans(offset, len(buf)) {
+		if tf.Files[s.File].IsPadding() {
+			zero := buf[n : n+s.Length]
+			for i := range zero {
+				zero[i] = 0
+			}
+		}
+		n += s.Length
+	}
+}
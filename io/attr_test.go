@@ -0,0 +1,54 @@
+package io
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttributes(t *testing.T) {
+	input := "d4:infod5:filesl" +
+		"d4:attr1:x6:lengthi3e4:pathl3:runee" +
+		"d4:attr1:p6:lengthi5e4:pathl4:.pad1:5ee" +
+		"d4:attr2:hl6:lengthi0e4:pathl4:linke12:symlink pathl3:runee" +
+		"d6:lengthi2e4:pathl5:plaine4:sha120:01234567890123456789e" +
+		"e4:name3:dir12:piece lengthi16e6:pieces20:01234567890123456789ee"
+	tf, err := Parse([]byte(input))
+	require.Nil(t, err)
+	require.Len(t, tf.Files, 4)
+
+	run, pad, link, plain := tf.Files[0], tf.Files[1], tf.Files[2], tf.Files[3]
+	assert.True(t, run.IsExecutable())
+	assert.False(t, run.IsPadding())
+	assert.True(t, pad.IsPadding())
+	assert.True(t, link.IsSymlink())
+	assert.True(t, link.IsHidden())
+	assert.Equal(t, []string{"run"}, link.SymlinkPath)
+	assert.False(t, plain.IsSymlink() || plain.IsHidden() || plain.IsExecutable() || plain.IsPadding())
+	assert.Equal(t, "01234567890123456789", plain.SHA1)
+
+	// the attributes are part of the info hash
+	withoutAttr, err := Parse([]byte(
+		"d4:infod5:filesld6:lengthi3e4:pathl3:runeee4:name3:dir12:piece lengthi16e6:pieces20:01234567890123456789ee"))
+	require.Nil(t, err)
+	assert.NotEqual(t, withoutAttr.InfoHash, tf.InfoHash)
+
+	single, err := Parse([]byte("d4:infod4:attr1:x6:lengthi3e4:name3:run12:piece lengthi16e6:pieces20:01234567890123456789ee"))
+	require.Nil(t, err)
+	assert.Equal(t, "x", single.Attr)
+}
+
+func TestZeroPadding(t *testing.T) {
+	tf := &TorrentFile{
+		IsMultiFile: true,
+		Files: []bencodeFile{
+			{Length: 3, Path: []string{"a"}},
+			{Length: 5, Path: []string{".pad", "5"}, Attr: "p"},
+			{Length: 4, Path: []string{"b"}},
+		},
+	}
+	buf := []byte{1, 1, 1, 1, 1, 1, 1, 1}
+	tf.ZeroPadding(2, buf)
+	assert.Equal(t, []byte{1, 0, 0, 0, 0, 0, 1, 1}, buf)
+}
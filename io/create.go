@@ -0,0 +1,204 @@
+package io
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// the piece lengths Create picks from, for about targetPieces pieces
+const (
+	minPieceLength = 16 << 10 // 16KiB
+	maxPieceLength = 16 << 20 // 16MiB
+	targetPieces   = 1500
+)
+
+// CreateOptions tune Create. The zero value is valid.
+type CreateOptions struct {
+	// PieceLength is a power of two of at least 16KiB, picked from the size of the contents when 0.
+	PieceLength int
+	// Trackers are announced to in order, the first being the announce URL, see BEP 12.
+	Trackers []string
+	// WebSeeds are the URLs of the url-list, see BEP 19.
+	WebSeeds []string
+	Comment  string
+}
+
+// Create returns the contents of a v1 .torrent file of the file or the directory at path.
+// The files of a directory are taken in lexical order, and symlinks and other special
+// files are left out. Executable files are marked so, see BEP 47.
+func Create(path string, opts CreateOptions) ([]byte, error) {
+	path = filepath.Clean(path)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		files []bencodeFile
+		paths []string // on disk, of files
+	)
+	if fi.IsDir() {
+		err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(path, p)
+			if err != nil {
+				return err
+			}
+			files = append(files, bencodeFile{
+				Length: int(info.Size()),
+				Path:   splitPath(rel),
+				Attr:   executableAttr(info.Mode()),
+			})
+			paths = append(paths, p)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("%s has no files", path)
+		}
+	} else if fi.Mode().IsRegular() {
+		files = []bencodeFile{{Length: int(fi.Size()), Attr: executableAttr(fi.Mode())}}
+		paths = []string{path}
+	} else {
+		return nil, fmt.Errorf("%s is not a file or a directory", path)
+	}
+
+	var length int
+	for _, f := range files {
+		length += f.Length
+	}
+	if length == 0 {
+		return nil, errors.New("nothing to share, the files are empty")
+	}
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = choosePieceLength(length)
+	}
+	if pieceLength < minPieceLength || pieceLength&(pieceLength-1) != 0 {
+		return nil, fmt.Errorf("invalid piece length %d, it must be a power of two of at least %d", pieceLength, minPieceLength)
+	}
+	pieces, err := hashPieces(paths, pieceLength)
+	if err != nil {
+		return nil, err
+	}
+
+	info := map[string]interface{}{
+		"name":         fi.Name(),
+		"piece length": pieceLength,
+		"pieces":       string(pieces),
+	}
+	if fi.IsDir() {
+		list := make([]interface{}, len(files))
+		for i, f := range files {
+			file := map[string]interface{}{"length": f.Length, "path": f.Path}
+			if f.Attr != "" {
+				file["attr"] = f.Attr
+			}
+			list[i] = file
+		}
+		info["files"] = list
+	} else {
+		info["length"] = files[0].Length
+		if files[0].Attr != "" {
+			info["attr"] = files[0].Attr
+		}
+	}
+	torrent := map[string]interface{}{"info": info}
+	if len(opts.Trackers) > 0 {
+		torrent["announce"] = opts.Trackers[0]
+	}
+	if len(opts.Trackers) > 1 {
+		tiers := make([]interface{}, len(opts.Trackers))
+		for i, tr := range opts.Trackers {
+			tiers[i] = []string{tr}
+		}
+		torrent["announce-list"] = tiers
+	}
+	if len(opts.WebSeeds) > 0 {
+		torrent["url-list"] = opts.WebSeeds
+	}
+	if opts.Comment != "" {
+		torrent["comment"] = opts.Comment
+	}
+
+	buf := new(bytes.Buffer)
+	if err := bencode.Marshal(buf, torrent); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// choosePieceLength returns the power of two piece length that splits length in about targetPieces.
+func choosePieceLength(length int) int {
+	pieceLength := minPieceLength
+	for pieceLength < maxPieceLength && length/pieceLength > targetPieces {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+func executableAttr(mode fs.FileMode) string {
+	if mode&0111 != 0 {
+		return string(AttrExecutable)
+	}
+	return ""
+}
+
+// splitPath splits a relative path on disk into the components of a torrent path.
+func splitPath(rel string) []string {
+	dir, file := filepath.Split(rel)
+	if dir == "" {
+		return []string{file}
+	}
+	return append(splitPath(filepath.Clean(dir)), file)
+}
+
+// hashPieces returns the SHA-1 hashes of the pieces of the files one after another.
+func hashPieces(paths []string, pieceLength int) ([]byte, error) {
+	var hashes []byte
+	piece := make([]byte, 0, pieceLength)
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			n, err := io.ReadFull(f, piece[len(piece):cap(piece)])
+			piece = piece[:len(piece)+n]
+			if len(piece) == cap(piece) {
+				hash := sha1.Sum(piece)
+				hashes = append(hashes, hash[:]...)
+				piece = piece[:0]
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%s: %s", p, err)
+			}
+		}
+		f.Close()
+	}
+	if len(piece) > 0 {
+		hash := sha1.Sum(piece)
+		hashes = append(hashes, hash[:]...)
+	}
+	return hashes, nil
+}
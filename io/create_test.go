@@ -0,0 +1,88 @@
+package io
+
+import (
+	"crypto/sha1"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreate(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "dir")
+	a := make([]byte, 20000)
+	b := make([]byte, 30000)
+	rnd := rand.New(rand.NewSource(1))
+	rnd.Read(a)
+	rnd.Read(b)
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a"), a, 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "sub", "b"), b, 0644))
+	require.Nil(t, os.Symlink("a", filepath.Join(dir, "link")))
+	empty := filepath.Join(t.TempDir(), "empty")
+	require.Nil(t, os.MkdirAll(empty, 0755))
+
+	tests := map[string]struct {
+		path     string
+		opts     CreateOptions
+		data     []byte
+		files    []bencodeFile
+		pieceLen int
+		fails    bool
+	}{
+		"directory": {
+			path:     dir,
+			opts:     CreateOptions{Trackers: []string{"http://a/announce", "udp://b:80"}, WebSeeds: []string{"http://c/"}},
+			data:     append(append([]byte{}, a...), b...),
+			files:    []bencodeFile{{Length: 20000, Path: []string{"a"}, Attr: "x"}, {Length: 30000, Path: []string{"sub", "b"}}},
+			pieceLen: minPieceLength,
+		},
+		"file": {
+			path:     filepath.Join(dir, "sub", "b"),
+			opts:     CreateOptions{PieceLength: 32 << 10},
+			data:     b,
+			pieceLen: 32 << 10,
+		},
+		"piece length":   {path: dir, opts: CreateOptions{PieceLength: 20000}, fails: true},
+		"no files":       {path: empty, fails: true},
+		"does not exist": {path: filepath.Join(dir, "nothing"), fails: true},
+	}
+
+	for name, test := range tests {
+		data, err := Create(test.path, test.opts)
+		if test.fails {
+			assert.NotNil(t, err, name)
+			continue
+		}
+		require.Nil(t, err, name)
+		tf, err := Parse(data)
+		require.Nil(t, err, name)
+
+		assert.Equal(t, filepath.Base(test.path), tf.Name, name)
+		assert.Equal(t, len(test.data), tf.Length, name)
+		assert.Equal(t, test.files, tf.Files, name)
+		assert.Equal(t, test.files != nil, tf.IsMultiFile, name)
+		assert.Equal(t, test.pieceLen, tf.PieceLength, name)
+		require.Len(t, tf.PieceHashes, (len(test.data)+tf.PieceLength-1)/tf.PieceLength, name)
+		for i, h := range tf.PieceHashes {
+			end := (i + 1) * tf.PieceLength
+			if end > len(test.data) {
+				end = len(test.data)
+			}
+			assert.Equal(t, sha1.Sum(test.data[i*tf.PieceLength:end]), h, "%s: piece %d", name, i)
+		}
+		if trackers := test.opts.Trackers; len(trackers) > 0 {
+			assert.Equal(t, trackers[0], tf.Announce, name)
+			assert.Equal(t, [][]string{{trackers[0]}, {trackers[1]}}, tf.AnnounceList, name)
+		}
+		assert.Equal(t, test.opts.WebSeeds, tf.URLList, name)
+	}
+
+	assert.Equal(t, minPieceLength, choosePieceLength(1000))
+	assert.Equal(t, 1<<20, choosePieceLength(1500<<20))
+	assert.Equal(t, maxPieceLength, choosePieceLength(1<<40))
+}
@@ -0,0 +1,199 @@
+package io
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxNameLength is the longest file name, in bytes, that most file systems accept.
+const MaxNameLength int = 255
+
+// reserved are the names Windows does not allow for files, with or without an extension.
+var reserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// LayoutFile is a file of a torrent mapped to a path on disk.
+type LayoutFile struct {
+	Path    string // on disk, under the root of the layout
+	Offset  int    // of the file's first byte in the torrent
+	Length  int
+	Attr    string // BEP 47, see attr.go
+	Symlink string // target of a symlink, relative to the directory of Path
+}
+
+// IsPadding checks if the file is a padding file, which is not written to disk.
+func (f LayoutFile) IsPadding() bool {
+	return hasAttr(f.Attr, AttrPadding)
+}
+
+// Mode returns the permissions of the file on disk.
+func (f LayoutFile) Mode() fs.FileMode {
+	return fileMode(f.Attr)
+}
+
+// Layout maps the files of a torrent under a root directory.
+// Every path of a layout is sanitized, unique and within the root.
+type Layout struct {
+	Root  string
+	Dir   string // of the torrent, the root itself for single-file torrents
+	Files []LayoutFile
+}
+
+// Layout maps the files of the torrent under root. Single-file torrents are
+// stored as root/name, multi-file torrents within the directory root/name.
+// Path components are sanitized and it fails when one would leave the root.
+func (tf *TorrentFile) Layout(root string) (*Layout, error) {
+	name, err := sanitizeName(tf.Name)
+	if err != nil {
+		return nil, fmt.Errorf("torrent name: %s", err)
+	}
+	l := &Layout{Root: filepath.Clean(root)}
+
+	if !tf.IsMultiFile {
+		l.Dir = l.Root
+		l.Files = []LayoutFile{{Path: filepath.Join(l.Root, name), Length: tf.Length, Attr: tf.Attr}}
+		return l, nil
+	}
+
+	l.Dir = filepath.Join(l.Root, name)
+	used := make(map[string]bool) // lowercase paths of files, case-insensitive file systems would merge the rest
+	dirs := make(map[string]bool)
+	offset := 0
+	for _, f := range tf.Files {
+		lf := LayoutFile{Offset: offset, Length: f.Length, Attr: f.Attr}
+		offset += f.Length
+		if f.IsPadding() {
+			// never written, it needs no path
+			l.Files = append(l.Files, lf)
+			continue
+		}
+
+		path, err := sanitizePath(f.Path)
+		if err != nil {
+			return nil, fmt.Errorf("file %q: %s", strings.Join(f.Path, "/"), err)
+		}
+		for i := 1; i < len(path); i++ {
+			dir := strings.ToLower(filepath.Join(path[:i]...))
+			if used[dir] {
+				return nil, fmt.Errorf("file %q: directory %q is a file", strings.Join(f.Path, "/"), filepath.Join(path[:i]...))
+			}
+			dirs[dir] = true
+		}
+		rel := filepath.Join(path...)
+		leaf := path[len(path)-1]
+		for n := 1; used[strings.ToLower(rel)] || dirs[strings.ToLower(rel)]; n++ {
+			// a duplicate, keep the first one
+			path[len(path)-1] = numbered(leaf, n)
+			rel = filepath.Join(path...)
+		}
+		used[strings.ToLower(rel)] = true
+		lf.Path = filepath.Join(l.Dir, rel)
+
+		if f.IsSymlink() {
+			target, err := sanitizePath(f.SymlinkPath)
+			if err != nil {
+				return nil, fmt.Errorf("symlink %q: target: %s", strings.Join(f.Path, "/"), err)
+			}
+			lf.Symlink, err = filepath.Rel(filepath.Dir(rel), filepath.Join(target...))
+			if err != nil {
+				return nil, fmt.Errorf("symlink %q: %s", strings.Join(f.Path, "/"), err)
+			}
+		}
+		l.Files = append(l.Files, lf)
+	}
+	return l, nil
+}
+
+// sanitizeName sanitizes the name of a torrent, which must be a single component.
+func sanitizeName(name string) (string, error) {
+	path, err := sanitizePath([]string{name})
+	if err != nil {
+		return "", err
+	}
+	return path[0], nil
+}
+
+// sanitizePath validates the components of a path relative to the torrent's directory
+// and returns them fit for any file system. It fails on components that traverse
+// the tree, that is empty, ".", ".." or absolute ones.
+func sanitizePath(components []string) ([]string, error) {
+	if len(components) == 0 {
+		return nil, errors.New("empty path")
+	}
+
+	path := make([]string, len(components))
+	for i, c := range components {
+		if c == "" || c == "." || c == ".." {
+			return nil, fmt.Errorf("invalid path component %q", c)
+		}
+		if filepath.IsAbs(c) || strings.ContainsAny(c, `/\`) || filepath.VolumeName(c) != "" {
+			return nil, fmt.Errorf("path component %q has separators", c)
+		}
+		path[i] = sanitizeComponent(c)
+	}
+	return path, nil
+}
+
+// sanitizeComponent replaces invalid UTF-8 and the characters some file systems
+// forbid, renames reserved names and truncates overlong names, keeping their extension.
+func sanitizeComponent(c string) string {
+	c = strings.ToValidUTF8(c, "�")
+	c = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, c)
+	// Windows drops trailing dots and spaces
+	if trimmed := strings.TrimRight(c, ". "); trimmed != c {
+		c = trimmed + "_"
+	}
+
+	base := c
+	if i := strings.IndexByte(c, '.'); i >= 0 {
+		base = c[:i]
+	}
+	if reserved[strings.ToUpper(base)] {
+		c = "_" + c
+	}
+
+	if len(c) > MaxNameLength {
+		ext := filepath.Ext(c)
+		if len(ext) > MaxNameLength/2 {
+			ext = ""
+		}
+		c = truncate(c[:len(c)-len(ext)], MaxNameLength-len(ext)) + ext
+	}
+	return c
+}
+
+// truncate cuts s to at most n bytes without splitting a rune.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// numbered inserts the number n before the extension of name.
+func numbered(name string, n int) string {
+	ext := filepath.Ext(name)
+	if len(ext) == len(name) {
+		ext = ""
+	}
+	suffix := "." + strconv.Itoa(n)
+	return truncate(name[:len(name)-len(ext)], MaxNameLength-len(suffix)-len(ext)) + suffix + ext
+}
@@ -0,0 +1,152 @@
+package io
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLayout(t *testing.T) {
+	long := strings.Repeat("a", 300) + ".txt"
+	tests := map[string]struct {
+		name     string
+		files    []bencodeFile
+		expected []string // paths relative to the root
+		fails    bool
+	}{
+		"nested": {
+			name:     "dir",
+			files:    []bencodeFile{{Length: 1, Path: []string{"a", "b", "c"}}, {Length: 1, Path: []string{"d"}}},
+			expected: []string{"dir/a/b/c", "dir/d"},
+		},
+		"parent directory": {
+			name:  "dir",
+			files: []bencodeFile{{Length: 1, Path: []string{"..", "..", "etc", "passwd"}}},
+			fails: true,
+		},
+		"absolute": {
+			name:  "dir",
+			files: []bencodeFile{{Length: 1, Path: []string{"/etc/passwd"}}},
+			fails: true,
+		},
+		"separator": {
+			name:  "dir",
+			files: []bencodeFile{{Length: 1, Path: []string{`a\..\..\b`}}},
+			fails: true,
+		},
+		"empty component": {
+			name:  "dir",
+			files: []bencodeFile{{Length: 1, Path: []string{"a", ""}}},
+			fails: true,
+		},
+		"empty path": {
+			name:  "dir",
+			files: []bencodeFile{{Length: 1}},
+			fails: true,
+		},
+		"traversing name": {
+			name:  "..",
+			files: []bencodeFile{{Length: 1, Path: []string{"a"}}},
+			fails: true,
+		},
+		"reserved": {
+			name:     "dir",
+			files:    []bencodeFile{{Length: 1, Path: []string{"con"}}, {Length: 1, Path: []string{"LPT1.txt"}}},
+			expected: []string{"dir/_con", "dir/_LPT1.txt"},
+		},
+		"forbidden characters": {
+			name:     "dir",
+			files:    []bencodeFile{{Length: 1, Path: []string{"a:b?\x01", "c. "}}},
+			expected: []string{"dir/a_b__/c_"},
+		},
+		"invalid utf-8": {
+			name:     "dir",
+			files:    []bencodeFile{{Length: 1, Path: []string{"a\xffb"}}},
+			expected: []string{"dir/a�b"},
+		},
+		"overlong": {
+			name:     "dir",
+			files:    []bencodeFile{{Length: 1, Path: []string{long}}},
+			expected: []string{"dir/" + long[:MaxNameLength-4] + ".txt"},
+		},
+		"duplicates": {
+			name: "dir",
+			files: []bencodeFile{
+				{Length: 1, Path: []string{"a.txt"}},
+				{Length: 1, Path: []string{"A.txt"}},
+				{Length: 1, Path: []string{"a.txt"}},
+				{Length: 1, Path: []string{"a?txt"}},
+				{Length: 1, Path: []string{"a_txt"}},
+			},
+			expected: []string{"dir/a.txt", "dir/A.1.txt", "dir/a.2.txt", "dir/a_txt", "dir/a_txt.1"},
+		},
+		"file as directory": {
+			name:  "dir",
+			files: []bencodeFile{{Length: 1, Path: []string{"a"}}, {Length: 1, Path: []string{"a", "b"}}},
+			fails: true,
+		},
+		"directory as file": {
+			name:     "dir",
+			files:    []bencodeFile{{Length: 1, Path: []string{"a", "b"}}, {Length: 1, Path: []string{"a"}}},
+			expected: []string{"dir/a/b", "dir/a.1"},
+		},
+		"padding": {
+			name:     "dir",
+			files:    []bencodeFile{{Length: 1, Path: []string{"a"}}, {Length: 1, Path: []string{".pad", "1"}, Attr: "p"}, {Length: 1, Path: []string{"b"}}},
+			expected: []string{"dir/a", "", "dir/b"},
+		},
+		"unsafe symlink": {
+			name:  "dir",
+			files: []bencodeFile{{Path: []string{"link"}, Attr: "l", SymlinkPath: []string{"..", "etc", "passwd"}}},
+			fails: true,
+		},
+	}
+
+	root := filepath.Join("some", "root")
+	for name, test := range tests {
+		tf := &TorrentFile{Name: test.name, IsMultiFile: true, Files: test.files}
+		l, err := tf.Layout(root)
+		if test.fails {
+			assert.NotNil(t, err, name)
+			continue
+		}
+		require.Nil(t, err, name)
+		require.Len(t, l.Files, len(test.expected), name)
+		for i, f := range l.Files {
+			assert.Equal(t, i, f.Offset, name)
+			if test.expected[i] == "" {
+				assert.True(t, f.IsPadding(), name)
+				continue
+			}
+			assert.Equal(t, filepath.Join(root, filepath.FromSlash(test.expected[i])), f.Path, name)
+		}
+	}
+}
+
+func TestLayoutSymlink(t *testing.T) {
+	tf := &TorrentFile{
+		Name:        "dir",
+		IsMultiFile: true,
+		Files: []bencodeFile{
+			{Length: 1, Path: []string{"a", "b"}},
+			{Path: []string{"c", "link"}, Attr: "l", SymlinkPath: []string{"a", "b"}},
+		},
+	}
+	l, err := tf.Layout("root")
+	require.Nil(t, err)
+	assert.Equal(t, filepath.Join("..", "a", "b"), l.Files[1].Symlink)
+}
+
+func TestLayoutSingleFile(t *testing.T) {
+	tf := &TorrentFile{Name: "a/../../b", Length: 3}
+	_, err := tf.Layout("root")
+	assert.NotNil(t, err)
+
+	tf.Name = "nul"
+	l, err := tf.Layout("root")
+	require.Nil(t, err)
+	assert.Equal(t, filepath.Join("root", "_nul"), l.Files[0].Path)
+}
@@ -0,0 +1,98 @@
+package io
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Magnet represents the parameters of a magnet link.
+// reference: https://www.bittorrent.org/beps/bep_0009.html
+type Magnet struct {
+	InfoHash [20]byte
+	Name     string   // dn, the display name
+	Trackers []string // tr
+	WebSeeds []string // ws, BEP 19
+}
+
+// ParseMagnet parses a magnet link of a BitTorrent v1 torrent.
+func ParseMagnet(link string) (*Magnet, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("not a magnet link: %q", link)
+	}
+
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("query: %s", err)
+	}
+
+	m := &Magnet{
+		Name:     q.Get("dn"),
+		Trackers: q["tr"],
+		WebSeeds: q["ws"],
+	}
+	found := false
+	for _, xt := range q["xt"] {
+		if !strings.HasPrefix(xt, "urn:btih:") {
+			continue
+		}
+		if m.InfoHash, err = parseInfoHash(strings.TrimPrefix(xt, "urn:btih:")); err != nil {
+			return nil, err
+		}
+		found = true
+		break
+	}
+	if !found {
+		return nil, errors.New("magnet link without urn:btih")
+	}
+
+	return m, nil
+}
+
+// parseInfoHash decodes a hex or base32 encoded info hash.
+func parseInfoHash(s string) ([20]byte, error) {
+	var ih [20]byte
+	var b []byte
+	var err error
+	switch len(s) {
+	case 2 * hashLen:
+		b, err = hex.DecodeString(s)
+	case 32:
+		b, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return ih, fmt.Errorf("info hash of length %d", len(s))
+	}
+	if err != nil {
+		return ih, fmt.Errorf("info hash: %s", err)
+	}
+	copy(ih[:], b)
+	return ih, nil
+}
+
+// Magnet returns the magnet link of the torrent.
+func (tf *TorrentFile) Magnet() *Magnet {
+	return &Magnet{InfoHash: tf.InfoHash, Name: tf.Name, Trackers: tf.Trackers(), WebSeeds: tf.URLList}
+}
+
+// String returns the magnet link, the info hash hex encoded.
+func (m *Magnet) String() string {
+	var b strings.Builder
+	b.WriteString("magnet:?xt=urn:btih:" + hex.EncodeToString(m.InfoHash[:]))
+	if m.Name != "" {
+		b.WriteString("&dn=" + url.QueryEscape(m.Name))
+	}
+	for _, tr := range m.Trackers {
+		b.WriteString("&tr=" + url.QueryEscape(tr))
+	}
+	for _, ws := range m.WebSeeds {
+		b.WriteString("&ws=" + url.QueryEscape(ws))
+	}
+	return b.String()
+}
@@ -0,0 +1,70 @@
+package io
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMagnet(t *testing.T) {
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	tests := map[string]struct {
+		input  string
+		output *Magnet
+		fails  bool
+	}{
+		"hex info hash with trackers and web seeds": {
+			input: "magnet:?xt=urn:btih:86d4c80024a469be4c50bc5a102cf71780310074&dn=debian.iso" +
+				"&tr=http%3A%2F%2Ftracker.example.com%2Fannounce&tr=udp%3A%2F%2Ftracker.example.org%3A6969" +
+				"&ws=http%3A%2F%2Fmirror.example.com%2Fdebian.iso",
+			output: &Magnet{
+				InfoHash: infoHash,
+				Name:     "debian.iso",
+				Trackers: []string{"http://tracker.example.com/announce", "udp://tracker.example.org:6969"},
+				WebSeeds: []string{"http://mirror.example.com/debian.iso"},
+			},
+		},
+		"base32 info hash": {
+			input:  "magnet:?xt=urn:btih:q3kmqabeuru34tcqxrnbalhxc6adcadu",
+			output: &Magnet{InfoHash: infoHash},
+		},
+		"no info hash": {
+			input: "magnet:?dn=debian.iso",
+			fails: true,
+		},
+		"malformed info hash": {
+			input: "magnet:?xt=urn:btih:86d4c8",
+			fails: true,
+		},
+		"not a magnet link": {
+			input: "http://example.com/?xt=urn:btih:86d4c80024a469be4c50bc5a102cf71780310074",
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		m, err := ParseMagnet(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.output, m, name)
+	}
+}
+
+func TestMagnetString(t *testing.T) {
+	m := &Magnet{
+		InfoHash: [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116},
+		Name:     "debian 10.iso",
+		Trackers: []string{"http://tracker.example.com/announce", "udp://tracker.example.org:6969"},
+		WebSeeds: []string{"http://mirror.example.com/debian.iso"},
+	}
+	link := m.String()
+	assert.Equal(t, "magnet:?xt=urn:btih:86d4c80024a469be4c50bc5a102cf71780310074&dn=debian+10.iso"+
+		"&tr=http%3A%2F%2Ftracker.example.com%2Fannounce&tr=udp%3A%2F%2Ftracker.example.org%3A6969"+
+		"&ws=http%3A%2F%2Fmirror.example.com%2Fdebian.iso", link)
+	parsed, err := ParseMagnet(link)
+	assert.Nil(t, err)
+	assert.Equal(t, m, parsed)
+}
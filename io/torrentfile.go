@@ -6,17 +6,21 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"os"
+	"io/ioutil"
 	"strings"
 
+	"github.com/VIVelev/bittorrent/merkle"
 	"github.com/jackpal/bencode-go"
 )
 
 const hashLen int = 20
 
 type bencodeFile struct {
-	Length int      `bencode:"length"`
-	Path   []string `bencode:"path"`
+	Length      int      `bencode:"length"`
+	Path        []string `bencode:"path"`
+	Attr        string   `bencode:"attr,omitempty"`         // BEP 47, see attr.go
+	SymlinkPath []string `bencode:"symlink path,omitempty"` // target of a symlink, relative to the torrent's directory
+	SHA1        string   `bencode:"sha1,omitempty"`         // checksum of the file's contents
 }
 
 type bencodeInfo struct {
@@ -24,7 +28,9 @@ type bencodeInfo struct {
 	Length      int           `bencode:"length"` // present in the single-file case
 	Files       []bencodeFile `bencode:"files"`  // present in the multi-file case
 	PieceLength int           `bencode:"piece length"`
-	Pieces      string        `bencode:"pieces"` // sha1 checksums of the pieces
+	Pieces      string        `bencode:"pieces"`       // sha1 checksums of the pieces
+	MetaVersion int           `bencode:"meta version"` // 2 for v2 and hybrid torrents
+	Attr        string        `bencode:"attr"`         // of the file in the single-file case
 }
 
 func (i bencodeInfo) hash() ([hashLen]byte, error) {
@@ -76,11 +82,22 @@ type bencodeTorrent struct {
 	Announce     string      `bencode:"announce"`
 	AnnounceList [][]string  `bencode:"announce-list"` // BEP 12
 	Info         bencodeInfo `bencode:"info"`
+	URLList      []string    `bencode:"-"`         // BEP 19, either a string or a list, see Parse
+	HTTPSeeds    []string    `bencode:"httpseeds"` // BEP 17
+
+	// decoded by hand in Parse
+	rawInfo     []byte                        `bencode:"-"` // the info dictionary as it is hashed
+	fileTree    []V2File                      `bencode:"-"` // BEP 52
+	pieceLayers map[merkle.Hash][]merkle.Hash `bencode:"-"`
+	infoOnly    bool                          `bencode:"-"` // without the piece layers, see ParseInfo
 }
 
 func (bto bencodeTorrent) toTorrentFile() (*TorrentFile, error) {
-	h, err := bto.Info.hash()
-	if err != nil {
+	var h [hashLen]byte
+	var err error
+	if bto.rawInfo != nil {
+		h = sha1.Sum(bto.rawInfo)
+	} else if h, err = bto.Info.hash(); err != nil {
 		return &TorrentFile{}, err
 	}
 
@@ -98,7 +115,7 @@ func (bto bencodeTorrent) toTorrentFile() (*TorrentFile, error) {
 		length = bto.Info.Length
 	}
 
-	return &TorrentFile{
+	tf := &TorrentFile{
 		Announce:     bto.Announce,
 		AnnounceList: bto.AnnounceList,
 		InfoHash:     h,
@@ -106,9 +123,54 @@ func (bto bencodeTorrent) toTorrentFile() (*TorrentFile, error) {
 		IsMultiFile:  bto.Info.Files != nil,
 		Length:       length,
 		Files:        bto.Info.Files,
+		Attr:         bto.Info.Attr,
 		PieceLength:  bto.Info.PieceLength,
 		PieceHashes:  hashes,
-	}, nil
+		URLList:      bto.URLList,
+		HTTPSeeds:    bto.HTTPSeeds,
+		InfoBytes:    bto.rawInfo,
+	}
+	if bto.Info.MetaVersion > 2 {
+		return &TorrentFile{}, fmt.Errorf("unsupported meta version %d", bto.Info.MetaVersion)
+	}
+	if bto.Info.MetaVersion == 2 {
+		if err := bto.toV2(tf); err != nil {
+			return &TorrentFile{}, err
+		}
+	} else if len(hashes) == 0 {
+		return &TorrentFile{}, errors.New("no pieces")
+	}
+	return tf, nil
+}
+
+// toV2 adds the v2 metadata to tf. Torrents without v1 metadata take their layout from the file tree.
+func (bto bencodeTorrent) toV2(tf *TorrentFile) error {
+	tf.MetaVersion = 2
+	tf.InfoHashV2 = hashV2(bto.rawInfo)
+	tf.FileTree = bto.fileTree
+	tf.PieceLayers = bto.pieceLayers
+	if err := tf.checkV2(bto.infoOnly); err != nil {
+		return err
+	}
+	if tf.IsV1() {
+		return nil
+	}
+
+	tf.InfoHash = tf.TruncatedInfoHash()
+	tf.Length = 0
+	for _, f := range tf.FileTree {
+		tf.Length += f.Length
+	}
+	// a single file named like the torrent
+	if len(tf.FileTree) == 1 && len(tf.FileTree[0].Path) == 1 && tf.FileTree[0].Path[0] == tf.Name {
+		tf.Attr = tf.FileTree[0].Attr
+		return nil
+	}
+	tf.IsMultiFile = true
+	for _, f := range tf.FileTree {
+		tf.Files = append(tf.Files, bencodeFile{Length: f.Length, Path: f.Path, Attr: f.Attr, SymlinkPath: f.SymlinkPath})
+	}
+	return nil
 }
 
 // TorrentFile represents the metadata from the .torrent file.
@@ -120,23 +182,150 @@ type TorrentFile struct {
 	IsMultiFile  bool
 	Length       int
 	Files        []bencodeFile
+	Attr         string // of the file of a single-file torrent
 	PieceLength  int
 	PieceHashes  [][hashLen]byte
+	URLList      []string // web seeds
+	HTTPSeeds    []string // seeding scripts
+	InfoBytes    []byte   `json:"-"` // the bencoded info dictionary, served to magnet links
+
+	// BEP 52, InfoHash is the truncated InfoHashV2 of torrents without v1 metadata
+	MetaVersion int
+	InfoHashV2  [32]byte
+	FileTree    []V2File
+	PieceLayers map[merkle.Hash][]merkle.Hash // by pieces root
+}
+
+// NumFiles returns the number of files of the torrent, padding files included.
+func (tf *TorrentFile) NumFiles() int {
+	if !tf.IsMultiFile {
+		return 1
+	}
+	return len(tf.Files)
+}
+
+// Trackers lists the trackers of the torrent once each, the announce URL first, see BEP 12.
+func (tf *TorrentFile) Trackers() []string {
+	seen := make(map[string]bool)
+	var ret []string
+	for _, tier := range append([][]string{{tf.Announce}}, tf.AnnounceList...) {
+		for _, tr := range tier {
+			if tr != "" && !seen[tr] {
+				seen[tr] = true
+				ret = append(ret, tr)
+			}
+		}
+	}
+	return ret
+}
+
+// Span is a byte range within one of the files of a torrent.
+type Span struct {
+	File   int // index into Files, always 0 for single-file torrents
+	Offset int // offset within the file
+	Length int
+}
+
+// Spans maps length bytes of the torrent's contents starting at offset to the files they belong to.
+func (tf *TorrentFile) Spans(offset, length int) []Span {
+	if !tf.IsMultiFile {
+		return []Span{{File: 0, Offset: offset, Length: length}}
+	}
+
+	var spans []Span
+	begin := 0 // of the current file within the contents
+	for i, f := range tf.Files {
+		end := begin + f.Length
+		if length > 0 && offset < end && f.Length > 0 {
+			n := end - offset
+			if n > length {
+				n = length
+			}
+			spans = append(spans, Span{File: i, Offset: offset - begin, Length: n})
+			offset += n
+			length -= n
+		}
+		begin = end
+	}
+	return spans
 }
 
 // Open parses a torrent file.
 func Open(path string) (*TorrentFile, error) {
-	f, err := os.Open(path)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return &TorrentFile{}, err
+	}
+
+	return Parse(data)
+}
+
+// Parse parses the contents of a torrent file.
+func Parse(data []byte) (*TorrentFile, error) {
+	return parse(data, false)
+}
+
+func parse(data []byte, infoOnly bool) (*TorrentFile, error) {
+	bto := bencodeTorrent{infoOnly: infoOnly}
+	err := bencode.Unmarshal(bytes.NewReader(data), &bto)
 	if err != nil {
 		return &TorrentFile{}, err
 	}
-	defer f.Close()
 
-	bto := bencodeTorrent{}
-	err = bencode.Unmarshal(f, &bto)
+	// url-list is a string or a list of strings, decode it by hand
+	raw, err := bencode.Decode(bytes.NewReader(data))
 	if err != nil {
 		return &TorrentFile{}, err
 	}
+	if dict, ok := raw.(map[string]interface{}); ok {
+		bto.URLList = stringList(dict["url-list"])
+
+		// hash the info dictionary with every key, whether we know it or not
+		if info, ok := dict["info"].(map[string]interface{}); ok {
+			buf := new(bytes.Buffer)
+			if err := bencode.Marshal(buf, info); err != nil {
+				return &TorrentFile{}, err
+			}
+			bto.rawInfo = buf.Bytes()
+
+			if bto.Info.MetaVersion == 2 {
+				if err := parseFileTree(info["file tree"], nil, &bto.fileTree); err != nil {
+					return &TorrentFile{}, err
+				}
+				if bto.pieceLayers, err = parsePieceLayers(dict["piece layers"]); err != nil {
+					return &TorrentFile{}, err
+				}
+			}
+		}
+	}
 
 	return bto.toTorrentFile()
 }
+
+// ParseInfo parses a bencoded info dictionary, as fetched for a magnet link.
+// The piece layers of v2 torrents are outside of it, see HasPieceLayer.
+func ParseInfo(info []byte) (*TorrentFile, error) {
+	data := append([]byte("d4:info"), info...)
+	return parse(append(data, 'e'), true)
+}
+
+// stringList converts a decoded bencode string or list of strings to a slice.
+func stringList(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		if v == "" {
+			return nil
+		}
+		return []string{v}
+	case []interface{}:
+		var ret []string
+		for _, item := range v {
+			if s, ok := item.(string); ok && s != "" {
+				ret = append(ret, s)
+			}
+		}
+		return ret
+	default:
+		return nil
+	}
+}
@@ -1,6 +1,7 @@
 package io
 
 import (
+	"crypto/sha1"
 	"encoding/json"
 	"io/ioutil"
 	"testing"
@@ -19,6 +20,9 @@ func TestOpen(t *testing.T) {
 	err = json.Unmarshal(data, expected)
 	require.Nil(t, err)
 
+	// the info dictionary is what the info hash is computed from
+	assert.Equal(t, expected.InfoHash, sha1.Sum(torrent.InfoBytes))
+	torrent.InfoBytes = nil
 	assert.Equal(t, torrent, expected)
 }
 
@@ -64,6 +68,16 @@ func TestToTorrentFile(t *testing.T) {
 			output: &TorrentFile{},
 			fails:  true,
 		},
+		"no pieces": {
+			input: bencodeTorrent{
+				Info: bencodeInfo{
+					Name:        "empty",
+					PieceLength: 262144,
+				},
+			},
+			output: &TorrentFile{},
+			fails:  true,
+		},
 	}
 
 	for _, test := range tests {
@@ -76,3 +90,73 @@ func TestToTorrentFile(t *testing.T) {
 		assert.Equal(t, test.output, to)
 	}
 }
+
+func TestSpans(t *testing.T) {
+	tf := &TorrentFile{
+		IsMultiFile: true,
+		Files: []bencodeFile{
+			{Length: 10, Path: []string{"a"}},
+			{Length: 0, Path: []string{"empty"}},
+			{Length: 5, Path: []string{"b"}},
+			{Length: 20, Path: []string{"c", "d"}},
+		},
+		Length: 35,
+	}
+	tests := map[string]struct {
+		offset int
+		length int
+		output []Span
+	}{
+		"within one file": {
+			offset: 2,
+			length: 5,
+			output: []Span{{File: 0, Offset: 2, Length: 5}},
+		},
+		"across files": {
+			offset: 8,
+			length: 10,
+			output: []Span{{File: 0, Offset: 8, Length: 2}, {File: 2, Offset: 0, Length: 5}, {File: 3, Offset: 0, Length: 3}},
+		},
+		"up to the end": {
+			offset: 15,
+			length: 20,
+			output: []Span{{File: 3, Offset: 0, Length: 20}},
+		},
+	}
+
+	for name, test := range tests {
+		assert.Equal(t, test.output, tf.Spans(test.offset, test.length), name)
+	}
+
+	single := &TorrentFile{Length: 100}
+	assert.Equal(t, []Span{{File: 0, Offset: 40, Length: 60}}, single.Spans(40, 60))
+}
+
+func TestParseSeeds(t *testing.T) {
+	info := "4:infod6:lengthi10e4:name4:file12:piece lengthi16e6:pieces20:01234567890123456789e"
+	tests := map[string]struct {
+		input     string
+		urlList   []string
+		httpSeeds []string
+	}{
+		"url-list string": {
+			input:   "d" + info + "8:url-list18:http://example.come",
+			urlList: []string{"http://example.com"},
+		},
+		"url-list list and httpseeds": {
+			input:     "d9:httpseedsl19:http://example.org/e" + info + "8:url-listl18:http://example.com0:ee",
+			urlList:   []string{"http://example.com"},
+			httpSeeds: []string{"http://example.org/"},
+		},
+		"neither": {
+			input: "d" + info + "e",
+		},
+	}
+
+	for name, test := range tests {
+		tf, err := Parse([]byte(test.input))
+		require.Nil(t, err, name)
+		assert.Equal(t, test.urlList, tf.URLList, name)
+		assert.Equal(t, test.httpSeeds, tf.HTTPSeeds, name)
+	}
+}
@@ -0,0 +1,199 @@
+package io
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/VIVelev/bittorrent/merkle"
+)
+
+// V2File is a file of the file tree of a v2 torrent, BEP 52.
+// reference: https://www.bittorrent.org/beps/bep_0052.html
+type V2File struct {
+	Path        []string
+	Length      int
+	PiecesRoot  merkle.Hash // root of the file's merkle tree, zero for empty files
+	Attr        string      // BEP 47, see attr.go
+	SymlinkPath []string
+}
+
+// parseFileTree flattens the file tree dictionary rooted at path into files.
+func parseFileTree(v interface{}, path []string, files *[]V2File) error {
+	dir, ok := v.(map[string]interface{})
+	if !ok {
+		return errors.New("file tree: not a dictionary")
+	}
+
+	names := make([]string, 0, len(dir))
+	for name := range dir {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name != "" {
+			if err := parseFileTree(dir[name], append(path[:len(path):len(path)], name), files); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// the empty key marks a file
+		if len(path) == 0 {
+			return errors.New("file tree: file without a name")
+		}
+		f, ok := dir[name].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("file tree: %v is not a dictionary", path)
+		}
+		length, ok := f["length"].(int64)
+		if !ok || length < 0 {
+			return fmt.Errorf("file tree: %v has no valid length", path)
+		}
+		file := V2File{Path: path, Length: int(length), SymlinkPath: stringList(f["symlink path"])}
+		file.Attr, _ = f["attr"].(string)
+		if length > 0 {
+			root, _ := f["pieces root"].(string)
+			if len(root) != len(file.PiecesRoot) {
+				return fmt.Errorf("file tree: %v has no valid pieces root", path)
+			}
+			copy(file.PiecesRoot[:], root)
+		}
+		*files = append(*files, file)
+	}
+	return nil
+}
+
+// parsePieceLayers decodes the piece layers dictionary.
+func parsePieceLayers(v interface{}) (map[merkle.Hash][]merkle.Hash, error) {
+	layers := make(map[merkle.Hash][]merkle.Hash)
+	if v == nil {
+		return layers, nil
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("piece layers: not a dictionary")
+	}
+
+	for key, val := range dict {
+		var root merkle.Hash
+		hashes, ok := val.(string)
+		if len(key) != len(root) || !ok || len(hashes)%len(root) != 0 {
+			return nil, fmt.Errorf("piece layers: malformed layer of %x", key)
+		}
+		copy(root[:], key)
+		layer := make([]merkle.Hash, len(hashes)/len(root))
+		for i := range layer {
+			copy(layer[i][:], hashes[i*len(root):])
+		}
+		layers[root] = layer
+	}
+	return layers, nil
+}
+
+// checkV2 validates the v2 metadata of a torrent. Unless infoOnly is set,
+// every file larger than a piece must have its piece layer.
+func (tf *TorrentFile) checkV2(infoOnly bool) error {
+	if tf.PieceLength < merkle.BlockSize || merkle.Width(tf.PieceLength) != tf.PieceLength {
+		return fmt.Errorf("piece length %d is not a power of two of at least %d", tf.PieceLength, merkle.BlockSize)
+	}
+	if len(tf.FileTree) == 0 {
+		return errors.New("empty file tree")
+	}
+	length := 0
+	for _, f := range tf.FileTree {
+		length += f.Length
+	}
+	if length == 0 {
+		return errors.New("no pieces, every file is empty")
+	}
+
+	for _, f := range tf.FileTree {
+		if f.Length <= tf.PieceLength {
+			// the pieces root is the only hash of the file
+			continue
+		}
+		layer, ok := tf.PieceLayers[f.PiecesRoot]
+		if !ok && infoOnly {
+			continue
+		}
+		if !ok {
+			return fmt.Errorf("missing piece layer of %v", f.Path)
+		}
+		if len(layer) != (f.Length+tf.PieceLength-1)/tf.PieceLength {
+			return fmt.Errorf("piece layer of %v has %d hashes", f.Path, len(layer))
+		}
+		if merkle.FileRoot(layer, tf.PieceLength) != f.PiecesRoot {
+			return fmt.Errorf("piece layer of %v does not match its pieces root", f.Path)
+		}
+	}
+	return nil
+}
+
+// IsV1 reports whether the torrent carries v1 metadata.
+func (tf *TorrentFile) IsV1() bool {
+	return len(tf.PieceHashes) > 0
+}
+
+// IsV2 reports whether the torrent carries v2 metadata.
+func (tf *TorrentFile) IsV2() bool {
+	return tf.MetaVersion == 2
+}
+
+// IsHybrid reports whether the torrent carries both v1 and v2 metadata.
+func (tf *TorrentFile) IsHybrid() bool {
+	return tf.IsV1() && tf.IsV2()
+}
+
+// TruncatedInfoHash returns the v2 info hash truncated to 20 bytes, as used in handshakes and announces.
+func (tf *TorrentFile) TruncatedInfoHash() [20]byte {
+	var ih [20]byte
+	copy(ih[:], tf.InfoHashV2[:])
+	return ih
+}
+
+// NumPiecesV2 returns the number of pieces of a file of the file tree.
+func (tf *TorrentFile) NumPiecesV2(file int) int {
+	return (tf.FileTree[file].Length + tf.PieceLength - 1) / tf.PieceLength
+}
+
+// HasPieceLayer reports whether the pieces of a file of the file tree can be verified whole.
+// Torrents parsed from their info dictionary alone lack the piece layers, the blocks of
+// the pieces of their files larger than a piece are verified against their leaf hashes instead.
+func (tf *TorrentFile) HasPieceLayer(file int) bool {
+	f := tf.FileTree[file]
+	if f.Length <= tf.PieceLength {
+		return true
+	}
+	_, ok := tf.PieceLayers[f.PiecesRoot]
+	return ok
+}
+
+// VerifyPieceV2 checks the 16KiB blocks of a piece of a file of the file tree against its merkle tree.
+func (tf *TorrentFile) VerifyPieceV2(file, piece int, data []byte) bool {
+	if file < 0 || file >= len(tf.FileTree) || piece < 0 || piece >= tf.NumPiecesV2(file) {
+		return false
+	}
+	f := tf.FileTree[file]
+	length := f.Length - piece*tf.PieceLength
+	if length > tf.PieceLength {
+		length = tf.PieceLength
+	}
+	if len(data) != length {
+		return false
+	}
+
+	if f.Length <= tf.PieceLength {
+		return merkle.DataRoot(data) == f.PiecesRoot
+	}
+	if !tf.HasPieceLayer(file) {
+		return false
+	}
+	return merkle.PieceRoot(data, tf.PieceLength) == tf.PieceLayers[f.PiecesRoot][piece]
+}
+
+func hashV2(info []byte) merkle.Hash {
+	return sha256.Sum256(info)
+}
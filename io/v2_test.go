@@ -0,0 +1,182 @@
+package io
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/VIVelev/bittorrent/merkle"
+	"github.com/jackpal/bencode-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPieceLength = 2 * merkle.BlockSize
+
+func testData(n int, seed byte) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i%251) ^ seed
+	}
+	return data
+}
+
+// pieceLayer hashes the pieces of a file.
+func pieceLayer(data []byte) []merkle.Hash {
+	var layer []merkle.Hash
+	for begin := 0; begin < len(data); begin += testPieceLength {
+		end := begin + testPieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		layer = append(layer, merkle.PieceRoot(data[begin:end], testPieceLength))
+	}
+	return layer
+}
+
+// v2Torrent builds a v2 torrent holding dir/big and dir/sub/small, and a hybrid one if hybrid is set.
+func v2Torrent(t *testing.T, big, small []byte, hybrid bool) ([]byte, map[string]interface{}) {
+	layer := pieceLayer(big)
+	bigRoot := merkle.FileRoot(layer, testPieceLength)
+	smallRoot := merkle.DataRoot(small)
+	var layerBytes []byte
+	for _, h := range layer {
+		layerBytes = append(layerBytes, h[:]...)
+	}
+
+	info := map[string]interface{}{
+		"name":         "dir",
+		"piece length": testPieceLength,
+		"meta version": 2,
+		"file tree": map[string]interface{}{
+			"big": map[string]interface{}{"": map[string]interface{}{"length": len(big), "pieces root": string(bigRoot[:])}},
+			"sub": map[string]interface{}{
+				"small": map[string]interface{}{"": map[string]interface{}{"length": len(small), "pieces root": string(smallRoot[:])}},
+				"empty": map[string]interface{}{"": map[string]interface{}{"length": 0}},
+			},
+		},
+	}
+	if hybrid {
+		// v1 pieces of the concatenated files, big is a whole number of pieces
+		var pieces []byte
+		data := append(append([]byte(nil), big...), small...)
+		for begin := 0; begin < len(data); begin += testPieceLength {
+			end := begin + testPieceLength
+			if end > len(data) {
+				end = len(data)
+			}
+			h := sha1.Sum(data[begin:end])
+			pieces = append(pieces, h[:]...)
+		}
+		info["pieces"] = string(pieces)
+		info["files"] = []interface{}{
+			map[string]interface{}{"length": len(big), "path": []string{"big"}},
+			map[string]interface{}{"length": 0, "path": []string{"sub", "empty"}},
+			map[string]interface{}{"length": len(small), "path": []string{"sub", "small"}},
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	require.Nil(t, bencode.Marshal(buf, map[string]interface{}{
+		"info":         info,
+		"piece layers": map[string]interface{}{string(bigRoot[:]): string(layerBytes)},
+	}))
+	return buf.Bytes(), info
+}
+
+func TestParseV2(t *testing.T) {
+	big := testData(3*testPieceLength, 1)
+	small := testData(merkle.BlockSize+10, 2)
+
+	for _, hybrid := range []bool{false, true} {
+		data, info := v2Torrent(t, big, small, hybrid)
+		tf, err := Parse(data)
+		require.Nil(t, err)
+
+		buf := new(bytes.Buffer)
+		require.Nil(t, bencode.Marshal(buf, info))
+		assert.Equal(t, [32]byte(sha256.Sum256(buf.Bytes())), tf.InfoHashV2)
+		assert.True(t, tf.IsV2())
+		assert.Equal(t, hybrid, tf.IsV1())
+		assert.Equal(t, hybrid, tf.IsHybrid())
+		if hybrid {
+			assert.Equal(t, [20]byte(sha1.Sum(buf.Bytes())), tf.InfoHash)
+		} else {
+			assert.Equal(t, tf.TruncatedInfoHash(), tf.InfoHash)
+		}
+		assert.True(t, tf.IsMultiFile)
+		assert.Equal(t, len(big)+len(small), tf.Length)
+		require.Len(t, tf.FileTree, 3)
+		assert.Equal(t, []string{"big"}, tf.FileTree[0].Path)
+		assert.Equal(t, []string{"sub", "empty"}, tf.FileTree[1].Path)
+		assert.Equal(t, []string{"sub", "small"}, tf.FileTree[2].Path)
+		require.Len(t, tf.Files, 3)
+		assert.Equal(t, len(small), tf.Files[2].Length)
+
+		// verify pieces of both files
+		assert.Equal(t, 3, tf.NumPiecesV2(0))
+		assert.True(t, tf.VerifyPieceV2(0, 1, big[testPieceLength:2*testPieceLength]))
+		assert.False(t, tf.VerifyPieceV2(0, 2, big[testPieceLength:2*testPieceLength]))
+		assert.True(t, tf.VerifyPieceV2(2, 0, small))
+		assert.False(t, tf.VerifyPieceV2(2, 0, small[1:]))
+		assert.False(t, tf.VerifyPieceV2(2, 1, small))
+		assert.False(t, tf.VerifyPieceV2(1, 0, nil))
+	}
+}
+
+func TestParseInfoV2(t *testing.T) {
+	big := testData(3*testPieceLength, 1)
+	small := testData(merkle.BlockSize+10, 2)
+
+	for _, hybrid := range []bool{false, true} {
+		data, _ := v2Torrent(t, big, small, hybrid)
+		full, err := Parse(data)
+		require.Nil(t, err)
+
+		// the piece layers are outside of the info dictionary
+		tf, err := ParseInfo(full.InfoBytes)
+		require.Nil(t, err)
+		assert.Equal(t, full.InfoHash, tf.InfoHash)
+		assert.Equal(t, full.InfoHashV2, tf.InfoHashV2)
+		assert.Equal(t, full.FileTree, tf.FileTree)
+		assert.Empty(t, tf.PieceLayers)
+		assert.True(t, full.HasPieceLayer(0))
+		assert.False(t, tf.HasPieceLayer(0), "big")
+		assert.True(t, tf.HasPieceLayer(2), "small")
+		assert.False(t, tf.VerifyPieceV2(0, 1, big[testPieceLength:2*testPieceLength]))
+		assert.True(t, tf.VerifyPieceV2(2, 0, small))
+	}
+}
+
+func TestParseV2Fails(t *testing.T) {
+	big := testData(3*testPieceLength, 1)
+	small := testData(10, 2)
+
+	data, _ := v2Torrent(t, big, small, false)
+	// corrupt the last byte of the piece layer
+	i := bytes.Index(data, []byte("12:piece layers"))
+	require.True(t, i > 0)
+	corrupted := append([]byte(nil), data...)
+	corrupted[len(corrupted)-3] ^= 0xFF
+	_, err := Parse(corrupted)
+	assert.NotNil(t, err, "piece layer does not match")
+
+	wrongVersion := bytes.Replace(data, []byte("12:meta versioni2e"), []byte("12:meta versioni3e"), 1)
+	_, err = Parse(wrongVersion)
+	assert.NotNil(t, err, "unsupported meta version")
+
+	badLength := bytes.Replace(data, []byte("12:piece lengthi32768e"), []byte("12:piece lengthi30000e"), 1)
+	_, err = Parse(badLength)
+	assert.NotNil(t, err, "piece length not a power of two")
+
+	buf := new(bytes.Buffer)
+	require.Nil(t, bencode.Marshal(buf, map[string]interface{}{"info": map[string]interface{}{
+		"name":         "empty",
+		"piece length": testPieceLength,
+		"meta version": 2,
+		"file tree":    map[string]interface{}{"empty": map[string]interface{}{"": map[string]interface{}{"length": 0}}},
+	}}))
+	_, err = Parse(buf.Bytes())
+	assert.EqualError(t, err, "no pieces, every file is empty")
+}
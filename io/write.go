@@ -1,50 +1,62 @@
 package io
 
 import (
+	"fmt"
 	"io/fs"
 	"io/ioutil"
 	"os"
-	"strings"
+	"path/filepath"
 )
 
-const perm fs.FileMode = 0755
+const (
+	perm     fs.FileMode = 0755
+	filePerm fs.FileMode = 0644
+)
 
+// WriteToFile writes the data of the torrent to the working directory.
 func (tf *TorrentFile) WriteToFile(data []byte) error {
-	if tf.IsMultiFile {
-		return writeMultiFile(tf.Name, tf.Files, data)
-	}
-
-	return writeSingleFile(tf.Name, data)
-}
-
-func writeSingleFile(name string, data []byte) error {
-	return ioutil.WriteFile(name, data, perm)
+	return tf.WriteToDir(".", data)
 }
 
-func writeMultiFile(dirname string, files []bencodeFile, data []byte) error {
-	if err := os.Mkdir(dirname, perm); err != nil {
-		return err
-	}
-	if err := os.Chdir(dirname); err != nil {
+// WriteToDir writes the data of the torrent under root, see Layout.
+func (tf *TorrentFile) WriteToDir(root string, data []byte) error {
+	l, err := tf.Layout(root)
+	if err != nil {
 		return err
 	}
+	return l.Write(data)
+}
 
-	begin := 0
-	for _, f := range files {
-		buf := make([]byte, f.Length)
-		copy(buf, data[begin:begin+f.Length])
-		begin += f.Length
+// fileMode returns the permissions of a file with the attributes.
+func fileMode(attr string) fs.FileMode {
+	if hasAttr(attr, AttrExecutable) {
+		return perm
+	}
+	return filePerm
+}
 
-		l := len(f.Path) - 1
-		fileName := f.Path[l]
-		pathToFile := strings.Join(f.Path[:l], "/")
-		if _, err := os.Stat(pathToFile + fileName); os.IsNotExist(err) {
-			os.MkdirAll(pathToFile, perm)
+// Write writes the data of the whole torrent to the files of the layout.
+func (l *Layout) Write(data []byte) error {
+	for _, f := range l.Files {
+		if f.IsPadding() {
+			// padding only aligns the pieces, it is never written
+			continue
 		}
-		if err := ioutil.WriteFile(pathToFile+fileName, buf, perm); err != nil {
+		if f.Offset+f.Length > len(data) {
+			return fmt.Errorf("%s: data is too short", f.Path)
+		}
+		if err := os.MkdirAll(filepath.Dir(f.Path), perm); err != nil {
+			return err
+		}
+		if f.Symlink != "" {
+			if err := os.Symlink(f.Symlink, f.Path); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := ioutil.WriteFile(f.Path, data[f.Offset:f.Offset+f.Length], fileMode(f.Attr)); err != nil {
 			return err
 		}
 	}
-
 	return nil
 }
@@ -0,0 +1,64 @@
+package io
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteMultiFile(t *testing.T) {
+	tf := &TorrentFile{
+		Name:        "dir",
+		IsMultiFile: true,
+		Files: []bencodeFile{
+			{Length: 3, Path: []string{"bin", "run"}, Attr: "x"},
+			{Length: 5, Path: []string{".pad", "5"}, Attr: "p"},
+			{Length: 0, Path: []string{"link"}, Attr: "l", SymlinkPath: []string{"bin", "run"}},
+			{Length: 2, Path: []string{"plain"}},
+		},
+	}
+	data := []byte("abc\x00\x00\x00\x00\x00de")
+
+	wd, err := os.Getwd()
+	require.Nil(t, err)
+	dir := t.TempDir()
+	require.Nil(t, tf.WriteToDir(dir, data))
+	root := filepath.Join(dir, "dir")
+
+	after, err := os.Getwd()
+	require.Nil(t, err)
+	assert.Equal(t, wd, after, "working directory")
+
+	info, err := os.Stat(filepath.Join(root, "bin", "run"))
+	require.Nil(t, err)
+	assert.NotZero(t, info.Mode()&0100, "executable")
+	info, err = os.Stat(filepath.Join(root, "plain"))
+	require.Nil(t, err)
+	assert.Zero(t, info.Mode()&0111, "not executable")
+	content, err := ioutil.ReadFile(filepath.Join(root, "plain"))
+	require.Nil(t, err)
+	assert.Equal(t, "de", string(content))
+
+	_, err = os.Stat(filepath.Join(root, ".pad"))
+	assert.True(t, os.IsNotExist(err), "padding is not written")
+
+	target, err := os.Readlink(filepath.Join(root, "link"))
+	require.Nil(t, err)
+	assert.Equal(t, filepath.Join("bin", "run"), target)
+	content, err = ioutil.ReadFile(filepath.Join(root, "link"))
+	require.Nil(t, err)
+	assert.Equal(t, "abc", string(content))
+}
+
+func TestWriteSingleFile(t *testing.T) {
+	tf := &TorrentFile{Name: "file", Length: 3}
+	dir := t.TempDir()
+	require.Nil(t, tf.WriteToDir(dir, []byte("abc")))
+	content, err := ioutil.ReadFile(filepath.Join(dir, "file"))
+	require.Nil(t, err)
+	assert.Equal(t, "abc", string(content))
+}
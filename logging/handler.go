@@ -0,0 +1,113 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"unicode"
+)
+
+// timeFormat is that of the time of the records.
+const timeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// writer writes the records of a level and above to w, one per line.
+type writer struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+	enc   func(*bytes.Buffer, Record)
+}
+
+func (h *writer) Enabled(level Level) bool {
+	return level >= h.level
+}
+
+func (h *writer) Handle(r Record) {
+	var buf bytes.Buffer
+	h.enc(&buf, r)
+	buf.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.w.Write(buf.Bytes())
+}
+
+// NewTextHandler returns a handler writing the records of level and above to w in logfmt:
+//
+//	time=2021-03-04T05:06:07.089Z level=info msg="download started" infohash=0a1b...
+func NewTextHandler(w io.Writer, level Level) Handler {
+	return &writer{w: w, level: level, enc: encodeText}
+}
+
+// NewJSONHandler returns a handler writing the records of level and above to w as JSON objects:
+//
+//	{"time":"2021-03-04T05:06:07.089Z","level":"info","msg":"download started","infohash":"0a1b..."}
+func NewJSONHandler(w io.Writer, level Level) Handler {
+	return &writer{w: w, level: level, enc: encodeJSON}
+}
+
+func encodeText(buf *bytes.Buffer, r Record) {
+	buf.WriteString("time=" + r.Time.Format(timeFormat))
+	buf.WriteString(" level=" + r.Level.String())
+	buf.WriteString(" msg=" + quote(r.Msg))
+	for _, f := range r.Fields {
+		buf.WriteString(" " + f.Key + "=")
+		if v := value(f.Value); v != nil {
+			buf.WriteString(quote(fmt.Sprint(v)))
+		}
+	}
+}
+
+// quote quotes s when it is empty or holds spaces, quotes, equal signs or unprintable characters.
+func quote(s string) string {
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if r == '"' || r == '=' || r == '\\' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+func encodeJSON(buf *bytes.Buffer, r Record) {
+	buf.WriteString(`{"time":`)
+	writeJSON(buf, r.Time.Format(timeFormat))
+	buf.WriteString(`,"level":`)
+	writeJSON(buf, r.Level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSON(buf, r.Msg)
+	for _, f := range r.Fields {
+		buf.WriteByte(',')
+		writeJSON(buf, f.Key)
+		buf.WriteByte(':')
+		writeJSON(buf, value(f.Value))
+	}
+	buf.WriteByte('}')
+}
+
+// writeJSON writes v, or its string form when it cannot be marshaled.
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+// value returns what is written of v: the message of errors and the string of fmt.Stringers.
+func value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return v
+	}
+}
@@ -0,0 +1,171 @@
+// Package logging writes leveled records with key-value fields. The packages of the library log
+// through a *Logger they are given, and say nothing without one.
+package logging
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Level tells how important a record is.
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+func (l Level) String() string {
+	switch l {
+	case Debug:
+		return "debug"
+	case Info:
+		return "info"
+	case Warn:
+		return "warn"
+	case Error:
+		return "error"
+	default:
+		return fmt.Sprintf("Level#%d", int(l))
+	}
+}
+
+// ParseLevel returns the level with the given name, e.g. "info".
+func ParseLevel(s string) (Level, error) {
+	for l := Debug; l <= Error; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown level %q", s)
+}
+
+// Field is a key-value pair of a record.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns a field with a string value.
+func String(key, value string) Field {
+	return Field{key, value}
+}
+
+// Int returns a field with an integer value.
+func Int(key string, value int) Field {
+	return Field{key, value}
+}
+
+// Duration returns a field with a duration value, written like "1.5s".
+func Duration(key string, value time.Duration) Field {
+	return Field{key, value.String()}
+}
+
+// Any returns a field with any value. Errors and fmt.Stringers are written as strings.
+func Any(key string, value interface{}) Field {
+	return Field{key, value}
+}
+
+// Err returns the "error" field, of the error that caused the record.
+func Err(err error) Field {
+	if err == nil {
+		return Field{"error", nil}
+	}
+	return Field{"error", err.Error()}
+}
+
+// InfoHash returns the "infohash" field, of the torrent a record is about, in hex.
+func InfoHash(infoHash [20]byte) Field {
+	return Field{"infohash", hex.EncodeToString(infoHash[:])}
+}
+
+// Peer returns the "peer" field, of the peer a record is about.
+func Peer(p fmt.Stringer) Field {
+	return Field{"peer", p.String()}
+}
+
+// Piece returns the "piece" field, of the index of the piece a record is about.
+func Piece(index int) Field {
+	return Field{"piece", index}
+}
+
+// Record is what is logged at once.
+type Record struct {
+	Time   time.Time
+	Level  Level
+	Msg    string
+	Fields []Field
+}
+
+// Handler writes records, to a writer as with NewTextHandler and NewJSONHandler,
+// or to another logging library. It must be safe for concurrent use.
+type Handler interface {
+	// Enabled reports whether the records of the level are written, the others are not built.
+	Enabled(Level) bool
+	Handle(Record)
+}
+
+// Logger hands records over to a handler, with the fields it was given by With first.
+// A nil *Logger discards every record, so that the packages need not check for one.
+type Logger struct {
+	h      Handler
+	fields []Field
+}
+
+// New returns a logger writing to h.
+func New(h Handler) *Logger {
+	return &Logger{h: h}
+}
+
+// With returns a logger that adds the fields to every record, after those of l.
+func (l *Logger) With(fields ...Field) *Logger {
+	if l == nil {
+		return nil
+	}
+	all := make([]Field, 0, len(l.fields)+len(fields))
+	all = append(append(all, l.fields...), fields...)
+	return &Logger{h: l.h, fields: all}
+}
+
+// Enabled reports whether the records of the level are written, e.g. to skip building
+// expensive fields.
+func (l *Logger) Enabled(level Level) bool {
+	return l != nil && l.h.Enabled(level)
+}
+
+// Log writes a record of the level.
+func (l *Logger) Log(level Level, msg string, fields ...Field) {
+	if !l.Enabled(level) {
+		return
+	}
+	all := fields
+	if len(l.fields) > 0 {
+		all = make([]Field, 0, len(l.fields)+len(fields))
+		all = append(append(all, l.fields...), fields...)
+	}
+	l.h.Handle(Record{Time: time.Now(), Level: level, Msg: msg, Fields: all})
+}
+
+// Debug writes a record of what the library is doing, e.g. the connections to peers.
+func (l *Logger) Debug(msg string, fields ...Field) {
+	l.Log(Debug, msg, fields...)
+}
+
+// Info writes a record of a milestone, e.g. a download that starts.
+func (l *Logger) Info(msg string, fields ...Field) {
+	l.Log(Info, msg, fields...)
+}
+
+// Warn writes a record of a failure that is recovered from, e.g. a peer sending a corrupt piece.
+func (l *Logger) Warn(msg string, fields ...Field) {
+	l.Log(Warn, msg, fields...)
+}
+
+// Error writes a record of a failure that is not recovered from, e.g. of the storage.
+func (l *Logger) Error(msg string, fields ...Field) {
+	l.Log(Error, msg, fields...)
+}
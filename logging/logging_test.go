@@ -0,0 +1,114 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// records keeps the records it is handed.
+type records struct {
+	level Level
+	all   []Record
+}
+
+func (h *records) Enabled(level Level) bool {
+	return level >= h.level
+}
+
+func (h *records) Handle(r Record) {
+	h.all = append(h.all, r)
+}
+
+func TestLogger(t *testing.T) {
+	h := &records{level: Info}
+	l := New(h).With(InfoHash([20]byte{0xab}))
+	peer := l.With(String("peer", "1.2.3.4:6881"))
+
+	l.Debug("dropped")
+	peer.Warn("corrupt piece", Piece(3))
+	l.Info("started", Int("pieces", 2))
+
+	require.Len(t, h.all, 2)
+	assert.Equal(t, Warn, h.all[0].Level)
+	assert.Equal(t, "corrupt piece", h.all[0].Msg)
+	assert.Equal(t, []Field{
+		{"infohash", "ab00000000000000000000000000000000000000"},
+		{"peer", "1.2.3.4:6881"},
+		{"piece", 3},
+	}, h.all[0].Fields)
+	assert.Equal(t, []Field{
+		{"infohash", "ab00000000000000000000000000000000000000"},
+		{"pieces", 2},
+	}, h.all[1].Fields)
+	assert.False(t, l.Enabled(Debug))
+	assert.True(t, l.Enabled(Error))
+}
+
+func TestNilLogger(t *testing.T) {
+	var l *Logger
+	l.With(Piece(1)).Error("dropped", Err(errors.New("x")))
+	assert.Nil(t, l.With(Piece(1)))
+	assert.False(t, l.Enabled(Error))
+}
+
+func TestTextHandler(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(NewTextHandler(&buf, Debug))
+	l.Info("download started", Peer(&net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881}),
+		String("name", "a b"), String("empty", ""), Duration("took", 1500*time.Millisecond),
+		Err(errors.New(`bad "piece"`)), Any("none", nil))
+
+	line := buf.String()
+	require.True(t, strings.HasSuffix(line, "\n"))
+	prefix := line[:strings.Index(line, " ")]
+	assert.True(t, strings.HasPrefix(prefix, "time="), prefix)
+	_, err := time.Parse(timeFormat, strings.TrimPrefix(prefix, "time="))
+	assert.Nil(t, err)
+	assert.Equal(t, ` level=info msg="download started" peer=1.2.3.4:6881 name="a b" empty="" took=1.5s error="bad \"piece\"" none=`+"\n",
+		strings.TrimPrefix(line, prefix))
+}
+
+func TestJSONHandler(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(NewJSONHandler(&buf, Warn))
+	l.Info("dropped")
+	l.Warn("corrupt piece", Piece(3), Err(errors.New("hash mismatch")), Any("ch", make(chan int)))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 1)
+	assert.True(t, strings.HasPrefix(lines[0], `{"time":`), lines[0])
+	var got map[string]interface{}
+	require.Nil(t, json.Unmarshal([]byte(lines[0]), &got))
+	delete(got, "time")
+	assert.Equal(t, "warn", got["level"])
+	assert.Equal(t, "corrupt piece", got["msg"])
+	assert.Equal(t, 3.0, got["piece"])
+	assert.Equal(t, "hash mismatch", got["error"])
+	assert.IsType(t, "", got["ch"])
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := map[string]struct {
+		s     string
+		level Level
+		err   bool
+	}{
+		"debug":      {"debug", Debug, false},
+		"upper case": {"WARN", Warn, false},
+		"error":      {"error", Error, false},
+		"unknown":    {"verbose", 0, true},
+	}
+	for name, test := range tests {
+		level, err := ParseLevel(test.s)
+		assert.Equal(t, test.err, err != nil, name)
+		assert.Equal(t, test.level, level, name)
+	}
+}
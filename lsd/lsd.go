@@ -0,0 +1,322 @@
+// Package lsd implements Local Service Discovery, BEP 14.
+// reference: https://www.bittorrent.org/beps/bep_0014.html
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VIVelev/bittorrent/logging"
+	"github.com/VIVelev/bittorrent/peer"
+)
+
+const (
+	// AnnounceInterval is how often every torrent is announced.
+	AnnounceInterval time.Duration = 5 * time.Minute
+	// MinAnnounceInterval is the minimum time between two announcements of a torrent.
+	MinAnnounceInterval time.Duration = time.Minute
+
+	maxPacketSize int = 1400
+)
+
+var (
+	// Group4 is the IPv4 multicast group.
+	Group4 = &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: 6771}
+	// Group6 is the IPv6 multicast group.
+	Group6 = &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: 6771}
+)
+
+// Announce is a BT-SEARCH message.
+type Announce struct {
+	Host       string
+	Port       uint16
+	InfoHashes [][20]byte
+	Cookie     string
+}
+
+// Marshal serializes the announcement.
+func (a *Announce) Marshal() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(buf, "Host: %s\r\n", a.Host)
+	fmt.Fprintf(buf, "Port: %d\r\n", a.Port)
+	for _, ih := range a.InfoHashes {
+		fmt.Fprintf(buf, "Infohash: %x\r\n", ih)
+	}
+	if a.Cookie != "" {
+		fmt.Fprintf(buf, "cookie: %s\r\n", a.Cookie)
+	}
+	buf.WriteString("\r\n\r\n")
+	return buf.Bytes()
+}
+
+// split divides the announcement into the fewest ones whose packets fit in maxPacketSize bytes.
+func (a *Announce) split() []*Announce {
+	empty := *a
+	empty.InfoHashes = nil
+	base := len(empty.Marshal())
+	// every info hash takes a line of the same length
+	line := len(fmt.Sprintf("Infohash: %x\r\n", [20]byte{}))
+	perPacket := (maxPacketSize - base) / line
+	if perPacket < 1 {
+		perPacket = 1
+	}
+
+	var ret []*Announce
+	for begin := 0; begin < len(a.InfoHashes); begin += perPacket {
+		end := begin + perPacket
+		if end > len(a.InfoHashes) {
+			end = len(a.InfoHashes)
+		}
+		part := *a
+		part.InfoHashes = a.InfoHashes[begin:end]
+		ret = append(ret, &part)
+	}
+	return ret
+}
+
+// Unmarshal parses a BT-SEARCH message. Malformed info hashes are skipped.
+func Unmarshal(b []byte) (*Announce, error) {
+	r := bufio.NewReader(bytes.NewReader(b))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("request line: %s", err)
+	}
+	if strings.TrimRight(line, "\r\n") != "BT-SEARCH * HTTP/1.1" {
+		return nil, fmt.Errorf("not a BT-SEARCH request: %q", line)
+	}
+
+	a := new(Announce)
+	for {
+		line, err := r.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("malformed header: %q", line)
+		}
+		value := strings.TrimSpace(line[i+1:])
+		switch http.CanonicalHeaderKey(strings.TrimSpace(line[:i])) {
+		case "Host":
+			a.Host = value
+		case "Port":
+			port, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("port: %s", err)
+			}
+			a.Port = uint16(port)
+		case "Infohash":
+			var ih [20]byte
+			if n, err := hex.Decode(ih[:], []byte(value)); err == nil && n == len(ih) {
+				a.InfoHashes = append(a.InfoHashes, ih)
+			}
+		case "Cookie":
+			a.Cookie = value
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if a.Port == 0 {
+		return nil, errors.New("missing port")
+	}
+	return a, nil
+}
+
+type torrent struct {
+	found         func(peer.Peer)
+	lastAnnounced time.Time
+}
+
+// Service announces torrents on the local network and listens for the announcements of others.
+type Service struct {
+	port   uint16
+	cookie string
+	groups []*net.UDPAddr
+	conns  []*net.UDPConn // one per group
+	log    *logging.Logger
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*torrent
+	closed   chan struct{}
+}
+
+// New joins the IPv4 and IPv6 multicast groups and starts announcing
+// that we accept connections on port. Only one of the groups has to be available.
+// The announcements that fail are logged to log, if any.
+func New(port uint16, log *logging.Logger) (*Service, error) {
+	return newService(port, log, []*net.UDPAddr{Group4, Group6}, func(group *net.UDPAddr) (*net.UDPConn, error) {
+		network := "udp4"
+		if group.IP.To4() == nil {
+			network = "udp6"
+		}
+		return net.ListenMulticastUDP(network, nil, group)
+	})
+}
+
+func newService(port uint16, log *logging.Logger, groups []*net.UDPAddr, listen func(*net.UDPAddr) (*net.UDPConn, error)) (*Service, error) {
+	var cookie [8]byte
+	if _, err := rand.Read(cookie[:]); err != nil {
+		return nil, err
+	}
+
+	s := &Service{
+		port:     port,
+		cookie:   hex.EncodeToString(cookie[:]),
+		log:      log,
+		torrents: make(map[[20]byte]*torrent),
+		closed:   make(chan struct{}),
+	}
+
+	var errs []string
+	for _, group := range groups {
+		conn, err := listen(group)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", group, err))
+			continue
+		}
+		s.groups = append(s.groups, group)
+		s.conns = append(s.conns, conn)
+	}
+	if len(s.conns) == 0 {
+		return nil, fmt.Errorf("lsd: no multicast group available: %s", strings.Join(errs, ", "))
+	}
+
+	for _, conn := range s.conns {
+		go s.listen(conn)
+	}
+	go s.announceLoop()
+	return s, nil
+}
+
+// Add starts announcing the torrent. found is called for every peer
+// on the local network that announces the same torrent.
+func (s *Service) Add(infoHash [20]byte, found func(peer.Peer)) {
+	s.mu.Lock()
+	s.torrents[infoHash] = &torrent{found: found}
+	s.mu.Unlock()
+
+	s.announce(false)
+}
+
+// Remove stops announcing the torrent.
+func (s *Service) Remove(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.torrents, infoHash)
+}
+
+// Close leaves the multicast groups.
+func (s *Service) Close() error {
+	select {
+	case <-s.closed:
+		return nil
+	default:
+	}
+	close(s.closed)
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+func (s *Service) announceLoop() {
+	ticker := time.NewTicker(AnnounceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.announce(true)
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// announce sends the torrents that are due to every group, in as many packets as needed.
+// Unless all is set, only the torrents that were never announced are due.
+func (s *Service) announce(all bool) {
+	now := time.Now()
+	s.mu.Lock()
+	var due [][20]byte
+	for ih, t := range s.torrents {
+		if now.Sub(t.lastAnnounced) < MinAnnounceInterval || !all && !t.lastAnnounced.IsZero() {
+			continue
+		}
+		t.lastAnnounced = now
+		due = append(due, ih)
+	}
+	s.mu.Unlock()
+	if len(due) == 0 {
+		return
+	}
+
+	for i, group := range s.groups {
+		a := &Announce{
+			Host:       group.String(),
+			Port:       s.port,
+			InfoHashes: due,
+			Cookie:     s.cookie,
+		}
+		for _, part := range a.split() {
+			if _, err := s.conns[i].WriteToUDP(part.Marshal(), group); err != nil {
+				s.log.Warn("could not announce on the local network", logging.String("group", group.String()), logging.Err(err))
+				break
+			}
+		}
+	}
+}
+
+func (s *Service) listen(conn *net.UDPConn) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// e.g. a timeout, or the ICMP error of an earlier packet, the socket still works
+			continue
+		}
+		s.handle(buf[:n], addr)
+	}
+}
+
+// handle processes an announcement received from addr.
+func (s *Service) handle(b []byte, addr *net.UDPAddr) {
+	a, err := Unmarshal(b)
+	if err != nil || a.Cookie == s.cookie {
+		// garbage or our own announcement
+		return
+	}
+
+	p := peer.Peer{IP: addr.IP, Port: a.Port}
+	for _, ih := range a.InfoHashes {
+		s.mu.Lock()
+		t, ok := s.torrents[ih]
+		s.mu.Unlock()
+		if ok {
+			t.found(p)
+		}
+	}
+}
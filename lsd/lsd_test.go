@@ -0,0 +1,186 @@
+package lsd
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VIVelev/bittorrent/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var infoHash = [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+
+func TestMarshal(t *testing.T) {
+	a := &Announce{
+		Host:       Group4.String(),
+		Port:       6881,
+		InfoHashes: [][20]byte{infoHash},
+		Cookie:     "abc",
+	}
+	expected := "BT-SEARCH * HTTP/1.1\r\n" +
+		"Host: 239.192.152.143:6771\r\n" +
+		"Port: 6881\r\n" +
+		"Infohash: 86d4c80024a469be4c50bc5a102cf71780310074\r\n" +
+		"cookie: abc\r\n" +
+		"\r\n\r\n"
+	assert.Equal(t, expected, string(a.Marshal()))
+
+	parsed, err := Unmarshal(a.Marshal())
+	require.Nil(t, err)
+	assert.Equal(t, a, parsed)
+}
+
+func TestUnmarshal(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output *Announce
+		fails  bool
+	}{
+		"ipv6 announce with two torrents": {
+			input: "BT-SEARCH * HTTP/1.1\r\nHost: [ff15::efc0:988f]:6771\r\nPort: 1234\r\n" +
+				"Infohash: 86d4c80024a469be4c50bc5a102cf71780310074\r\nInfohash: not-a-hash\r\n" +
+				"Infohash: 0000000000000000000000000000000000000001\r\n\r\n\r\n",
+			output: &Announce{
+				Host:       "[ff15::efc0:988f]:6771",
+				Port:       1234,
+				InfoHashes: [][20]byte{infoHash, {19: 1}},
+			},
+		},
+		"not a search": {
+			input: "NOTIFY * HTTP/1.1\r\nPort: 1234\r\n\r\n",
+			fails: true,
+		},
+		"missing port": {
+			input: "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\n\r\n",
+			fails: true,
+		},
+		"empty": {
+			input: "",
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		a, err := Unmarshal([]byte(test.input))
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.output, a, name)
+	}
+}
+
+func TestService(t *testing.T) {
+	// two services that see each other's announcements over unicast
+	connA, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	connB, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	listen := func(conn *net.UDPConn) func(*net.UDPAddr) (*net.UDPConn, error) {
+		return func(*net.UDPAddr) (*net.UDPConn, error) { return conn, nil }
+	}
+
+	a, err := newService(1111, nil, []*net.UDPAddr{connB.LocalAddr().(*net.UDPAddr)}, listen(connA))
+	require.Nil(t, err)
+	defer a.Close()
+	b, err := newService(2222, nil, []*net.UDPAddr{connA.LocalAddr().(*net.UDPAddr)}, listen(connB))
+	require.Nil(t, err)
+	defer b.Close()
+
+	found := make(chan peer.Peer, 1)
+	a.Add(infoHash, func(p peer.Peer) { found <- p })
+	b.Add([20]byte{1}, func(peer.Peer) { t.Error("nobody announced this torrent") })
+	b.Add(infoHash, func(peer.Peer) {})
+
+	select {
+	case p := <-found:
+		assert.Equal(t, uint16(2222), p.Port)
+		assert.True(t, p.IP.Equal(net.IPv4(127, 0, 0, 1)))
+	case <-time.After(time.Second):
+		t.Fatal("announcement not received")
+	}
+
+	// our own announcements are ignored
+	own := &Announce{Port: 1111, InfoHashes: [][20]byte{infoHash}, Cookie: a.cookie}
+	a.handle(own.Marshal(), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	select {
+	case p := <-found:
+		t.Fatalf("own announcement accepted: %s", p)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestSplit(t *testing.T) {
+	a := &Announce{Host: "[ff15::efc0:988f]:6771", Port: 6881, Cookie: "abc"}
+	for i := 0; i < 100; i++ {
+		a.InfoHashes = append(a.InfoHashes, [20]byte{byte(i)})
+	}
+
+	parts := a.split()
+	assert.Greater(t, len(parts), 1)
+	var infoHashes [][20]byte
+	for _, part := range parts {
+		b := part.Marshal()
+		assert.LessOrEqual(t, len(b), maxPacketSize)
+		parsed, err := Unmarshal(b)
+		require.Nil(t, err)
+		infoHashes = append(infoHashes, parsed.InfoHashes...)
+	}
+	assert.Equal(t, a.InfoHashes, infoHashes)
+	assert.Empty(t, (&Announce{Port: 6881}).split())
+}
+
+func TestServiceManyTorrents(t *testing.T) {
+	connA, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	connB, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	listen := func(conn *net.UDPConn) func(*net.UDPAddr) (*net.UDPConn, error) {
+		return func(*net.UDPAddr) (*net.UDPConn, error) { return conn, nil }
+	}
+	a, err := newService(1111, nil, []*net.UDPAddr{connB.LocalAddr().(*net.UDPAddr)}, listen(connA))
+	require.Nil(t, err)
+	defer a.Close()
+	b, err := newService(2222, nil, []*net.UDPAddr{connA.LocalAddr().(*net.UDPAddr)}, listen(connB))
+	require.Nil(t, err)
+	defer b.Close()
+
+	// b announces its torrents before a looks for them, a hears of them in the periodic announce
+	const n = 100
+	for i := 0; i < n; i++ {
+		b.Add([20]byte{byte(i), 1}, func(peer.Peer) {})
+	}
+	var mu sync.Mutex
+	found := make(map[[20]byte]bool)
+	for i := 0; i < n; i++ {
+		ih := [20]byte{byte(i), 1}
+		a.Add(ih, func(peer.Peer) {
+			mu.Lock()
+			defer mu.Unlock()
+			found[ih] = true
+		})
+	}
+	b.mu.Lock()
+	for _, tr := range b.torrents {
+		tr.lastAnnounced = time.Now().Add(-AnnounceInterval)
+	}
+	b.mu.Unlock()
+	b.announce(true)
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(found) == n
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestNewFails(t *testing.T) {
+	_, err := newService(1111, nil, []*net.UDPAddr{Group4}, func(*net.UDPAddr) (*net.UDPConn, error) {
+		return nil, &net.AddrError{Err: "unavailable"}
+	})
+	assert.NotNil(t, err)
+}
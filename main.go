@@ -1,38 +1,161 @@
 package main
 
 import (
-	"log"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"os"
+	"strings"
 
-	"github.com/VIVelev/bittorrent/discovery"
-	"github.com/VIVelev/bittorrent/io"
-	"github.com/VIVelev/bittorrent/p2p"
-	"github.com/VIVelev/bittorrent/peer"
+	"github.com/VIVelev/bittorrent/logging"
 )
 
+// the exit codes of the commands
+const (
+	exitOK         = 0
+	exitError      = 1 // the command failed
+	exitUsage      = 2 // invalid arguments, as with the flag package
+	exitIncomplete = 3 // the data of a torrent is missing or corrupt, see verify
+	exitInterrupt  = 130
+)
+
+var (
+	// errIncomplete fails the commands that found missing or corrupt pieces.
+	errIncomplete = errors.New("incomplete data")
+	// errInterrupt fails the commands that were interrupted before they were done.
+	errInterrupt = errors.New("interrupted")
+	// errFlags is returned when the flags of a command do not parse, the flag package reports why.
+	errFlags = errors.New("invalid flags")
+)
+
+// usageError is returned for invalid arguments.
+type usageError struct {
+	msg string
+}
+
+func (e usageError) Error() string {
+	return e.msg
+}
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"download", "download a torrent", runDownload},
+	{"seed", "seed a torrent from data on disk", runSeed},
+	{"create", "create a torrent file", runCreate},
+	{"info", "print the metadata of a torrent", runInfo},
+	{"verify", "check the data of a torrent on disk", runVerify},
+	{"magnet", "print the magnet link of a torrent", runMagnet},
+	{"daemon", "run a session driven over HTTP", runDaemon},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: bittorrent <command> [flags] [arguments]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-9s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun bittorrent <command> -h for the flags of a command.")
+}
+
 func main() {
-	tf, err := io.Open(os.Args[1])
-	if err != nil {
-		panic(err)
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(exitUsage)
+	}
+	name := os.Args[1]
+	if name == "-h" || name == "-help" || name == "--help" || name == "help" {
+		usage()
+		os.Exit(exitOK)
 	}
+	for _, c := range commands {
+		if c.name == name {
+			os.Exit(exit(c.name, c.run(os.Args[2:])))
+		}
+	}
+	fmt.Fprintf(os.Stderr, "bittorrent: unknown command %q\n", name)
+	usage()
+	os.Exit(exitUsage)
+}
 
-	peerID := peer.RandID()
-	port := peer.DownloadPort
-	peers, err := discovery.UdpRequestPeers(tf.Announce, tf.Length, tf.InfoHash, peerID, port)
-	if err != nil {
-		panic(err)
+// exit reports the error of a command, and returns its exit code.
+func exit(name string, err error) int {
+	var ue usageError
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.As(err, &ue):
+		fmt.Fprintf(os.Stderr, "bittorrent %s: %s\n", name, err)
+		return exitUsage
+	case errors.Is(err, errFlags):
+		return exitUsage
+	case errors.Is(err, errInterrupt):
+		fmt.Fprintf(os.Stderr, "bittorrent %s: %s\n", name, err)
+		return exitInterrupt
+	case errors.Is(err, errIncomplete):
+		fmt.Fprintf(os.Stderr, "bittorrent %s: %s\n", name, err)
+		return exitIncomplete
+	default:
+		fmt.Fprintf(os.Stderr, "bittorrent %s: %s\n", name, err)
+		return exitError
 	}
-	if len(peers) == 0 {
-		panic("0 peers were found")
+}
+
+// newFlagSet returns the flag set of a command that takes args.
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: bittorrent %s %s\n", name, args)
+		fs.PrintDefaults()
 	}
+	return fs
+}
 
-	data := p2p.Download(tf, peerID, peers)
-	if data == nil {
-		panic("download failed")
+// parse parses the flags of a command, and returns its arguments if there are n of them.
+func parse(fs *flag.FlagSet, args []string, n int) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, err
+		}
+		return nil, errFlags
+	}
+	if fs.NArg() != n {
+		fs.Usage()
+		return nil, errFlags
 	}
-	log.Println("Writing to disk...")
-	err = tf.WriteToFile(data)
-	if err != nil {
-		panic(err)
+	return fs.Args(), nil
+}
+
+// newLogger returns a logger writing the records of level and above to stderr, as JSON lines
+// if asked to.
+func newLogger(level logging.Level, asJSON bool) *logging.Logger {
+	if asJSON {
+		return logging.New(logging.NewJSONHandler(os.Stderr, level))
 	}
+	return logging.New(logging.NewTextHandler(os.Stderr, level))
+}
+
+// printJSON writes v to stdout, indented.
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// stringList is a flag that can be given more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
 }
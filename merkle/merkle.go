@@ -0,0 +1,196 @@
+// Package merkle implements the SHA-256 merkle trees of BitTorrent v2, BEP 52.
+// reference: https://www.bittorrent.org/beps/bep_0052.html
+package merkle
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// BlockSize is the size of the data hashed by every leaf of a tree.
+const BlockSize int = 16384 // 16KiB
+
+// Hash is a node of a tree.
+type Hash [32]byte
+
+// join returns the parent of two nodes.
+func join(left, right Hash) Hash {
+	var buf [64]byte
+	copy(buf[:32], left[:])
+	copy(buf[32:], right[:])
+	return sha256.Sum256(buf[:])
+}
+
+// Blocks returns the leaves of the blocks of data. The last block may be short.
+func Blocks(data []byte) []Hash {
+	leaves := make([]Hash, 0, (len(data)+BlockSize-1)/BlockSize)
+	for begin := 0; begin < len(data); begin += BlockSize {
+		end := begin + BlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		leaves = append(leaves, sha256.Sum256(data[begin:end]))
+	}
+	return leaves
+}
+
+// Pad returns the root of a tree of the given width that is made only of zero leaves.
+func Pad(width int) Hash {
+	var h Hash
+	for ; width > 1; width /= 2 {
+		h = join(h, h)
+	}
+	return h
+}
+
+// Root returns the root of the tree with the given nodes at the bottom,
+// padded with pad up to width, which must be a power of two.
+func Root(nodes []Hash, width int, pad Hash) Hash {
+	layer := make([]Hash, width)
+	copy(layer, nodes)
+	for i := len(nodes); i < width; i++ {
+		layer[i] = pad
+	}
+
+	for len(layer) > 1 {
+		next := layer[:len(layer)/2]
+		for i := range next {
+			next[i] = join(layer[2*i], layer[2*i+1])
+		}
+		layer = next
+	}
+	return layer[0]
+}
+
+// Width returns the smallest power of two that is at least n.
+func Width(n int) int {
+	w := 1
+	for w < n {
+		w *= 2
+	}
+	return w
+}
+
+// PieceRoot returns the hash of a piece, the root of the subtree covering pieceLength bytes.
+func PieceRoot(data []byte, pieceLength int) Hash {
+	return Root(Blocks(data), pieceLength/BlockSize, Hash{})
+}
+
+// FileRoot returns the pieces root of a file given its piece layer.
+func FileRoot(layer []Hash, pieceLength int) Hash {
+	return Root(layer, Width(len(layer)), Pad(pieceLength/BlockSize))
+}
+
+// DataRoot returns the pieces root of a file given all of its data.
+func DataRoot(data []byte) Hash {
+	leaves := Blocks(data)
+	return Root(leaves, Width(len(leaves)), Hash{})
+}
+
+// Tree holds the layers of a merkle tree from some layer up to the root.
+type Tree struct {
+	base   int      // the layer of the file's tree at the bottom of layers
+	layers [][]Hash // padded, the last one holds the root
+}
+
+// NewTree builds the tree above the given nodes of layer base, padded with pad up to width.
+func NewTree(nodes []Hash, base, width int, pad Hash) *Tree {
+	layer := make([]Hash, width)
+	copy(layer, nodes)
+	for i := len(nodes); i < width; i++ {
+		layer[i] = pad
+	}
+
+	t := &Tree{base: base, layers: [][]Hash{layer}}
+	for len(layer) > 1 {
+		next := make([]Hash, len(layer)/2)
+		for i := range next {
+			next[i] = join(layer[2*i], layer[2*i+1])
+		}
+		t.layers = append(t.layers, next)
+		layer = next
+	}
+	return t
+}
+
+// Root returns the root of the tree.
+func (t *Tree) Root() Hash {
+	return t.layers[len(t.layers)-1][0]
+}
+
+// Height returns the number of layers above the leaves of the file's tree.
+func (t *Tree) Height() int {
+	return t.base + len(t.layers) - 1
+}
+
+// log2 returns the exponent of a power of two, or -1.
+func log2(n int) int {
+	if n <= 0 || n&(n-1) != 0 {
+		return -1
+	}
+	k := 0
+	for ; n > 1; n /= 2 {
+		k++
+	}
+	return k
+}
+
+// numUncles returns how many uncles prove length nodes of layer base in a tree of the given height.
+func numUncles(height, base, length, proofLayers int) int {
+	n := height - base - log2(length)
+	if proofLayers < n {
+		n = proofLayers
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n
+}
+
+// Proof returns length nodes of layer base starting at index, followed by the uncles
+// of their subtree for at most proofLayers layers, lowest first.
+// length must be a power of two and index a multiple of it.
+func (t *Tree) Proof(base, index, length, proofLayers int) ([]Hash, error) {
+	k := log2(length)
+	if k < 0 || index%length != 0 || base < t.base || base-t.base+k >= len(t.layers) {
+		return nil, fmt.Errorf("invalid range of %d nodes at %d of layer %d", length, index, base)
+	}
+	layer := t.layers[base-t.base]
+	if index+length > len(layer) {
+		return nil, fmt.Errorf("range of %d nodes at %d is out of layer %d", length, index, base)
+	}
+
+	proof := append([]Hash(nil), layer[index:index+length]...)
+	i := index / length // of the subtree root
+	for l := base - t.base + k; l < base-t.base+k+numUncles(t.Height(), base, length, proofLayers); l++ {
+		proof = append(proof, t.layers[l][i^1])
+		i /= 2
+	}
+	return proof, nil
+}
+
+// Verify checks the nodes and uncles returned by Proof against the root of a tree of the given height.
+// The proof must reach the root.
+func Verify(root Hash, height, base, index, length int, proof []Hash) bool {
+	k := log2(length)
+	if k < 0 || index%length != 0 || base+k > height || len(proof) != length+height-base-k {
+		return false
+	}
+
+	sub := Root(proof[:length], length, Hash{})
+	i := index / length
+	for _, uncle := range proof[length:] {
+		if i%2 == 0 {
+			sub = join(sub, uncle)
+		} else {
+			sub = join(uncle, sub)
+		}
+		i /= 2
+	}
+	return i == 0 && sub == root
+}
+
+// FileHeight returns the height of the tree of a file of the given length.
+func FileHeight(length int) int {
+	return log2(Width((length + BlockSize - 1) / BlockSize))
+}
@@ -0,0 +1,133 @@
+package merkle
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+func TestDataRoot(t *testing.T) {
+	root := DataRoot(testData(100000))
+	assert.Equal(t, "505fc9a922f60ae071450b07256a4ba760612bffc38c27584ed03fd96c69841b", hex.EncodeToString(root[:]))
+	assert.Equal(t, Hash{}, DataRoot(nil))
+}
+
+func TestPieceRoot(t *testing.T) {
+	// the piece is padded with zero leaves up to its full width
+	root := PieceRoot(testData(2*BlockSize), 4*BlockSize)
+	assert.Equal(t, "6eac16f8e1173aec68172b782a397057313d076436c09cc9366df0ee825503d0", hex.EncodeToString(root[:]))
+}
+
+func TestFileRoot(t *testing.T) {
+	tests := map[string]struct {
+		length      int
+		pieceLength int
+	}{
+		"pieces fill the tree": {length: 8 * BlockSize, pieceLength: 2 * BlockSize},
+		"short last piece":     {length: 5*BlockSize + 100, pieceLength: 2 * BlockSize},
+		"padded with pieces":   {length: 9 * BlockSize, pieceLength: 4 * BlockSize},
+	}
+
+	for name, test := range tests {
+		data := testData(test.length)
+		var layer []Hash
+		for begin := 0; begin < len(data); begin += test.pieceLength {
+			end := begin + test.pieceLength
+			if end > len(data) {
+				end = len(data)
+			}
+			layer = append(layer, PieceRoot(data[begin:end], test.pieceLength))
+		}
+		assert.Equal(t, DataRoot(data), FileRoot(layer, test.pieceLength), name)
+	}
+}
+
+func TestWidth(t *testing.T) {
+	assert.Equal(t, 1, Width(0))
+	assert.Equal(t, 1, Width(1))
+	assert.Equal(t, 4, Width(3))
+	assert.Equal(t, 8, Width(8))
+}
+
+func TestProof(t *testing.T) {
+	data := testData(11 * BlockSize)
+	leaves := Blocks(data)
+	height := FileHeight(len(data))
+	assert.Equal(t, 4, height)
+	tree := NewTree(leaves, 0, Width(len(leaves)), Hash{})
+	assert.Equal(t, DataRoot(data), tree.Root())
+
+	tests := map[string]struct {
+		base        int
+		index       int
+		length      int
+		proofLayers int
+		hashes      int
+		fails       bool
+	}{
+		"leaves up to the root":  {base: 0, index: 4, length: 4, proofLayers: 10, hashes: 4 + 2},
+		"a pair of leaves":       {base: 0, index: 10, length: 2, proofLayers: 3, hashes: 2 + 3},
+		"the whole layer":        {base: 1, index: 0, length: 8, proofLayers: 1, hashes: 8},
+		"too few proof layers":   {base: 0, index: 0, length: 2, proofLayers: 1, hashes: 2 + 1},
+		"length not a power":     {base: 0, index: 0, length: 3, fails: true},
+		"misaligned index":       {base: 0, index: 2, length: 4, fails: true},
+		"out of the layer":       {base: 1, index: 8, length: 2, fails: true},
+		"below the stored layer": {base: -1, index: 0, length: 2, fails: true},
+	}
+
+	for name, test := range tests {
+		proof, err := tree.Proof(test.base, test.index, test.length, test.proofLayers)
+		if test.fails {
+			assert.NotNil(t, err, name)
+			continue
+		}
+		assert.Nil(t, err, name)
+		assert.Len(t, proof, test.hashes, name)
+		complete := test.hashes == test.length+height-test.base-log2(test.length)
+		assert.Equal(t, complete, Verify(tree.Root(), height, test.base, test.index, test.length, proof), name)
+	}
+
+	// tampered proofs are rejected
+	proof, err := tree.Proof(0, 4, 2, height)
+	assert.Nil(t, err)
+	assert.True(t, Verify(tree.Root(), height, 0, 4, 2, proof))
+	assert.False(t, Verify(tree.Root(), height, 0, 6, 2, proof))
+	proof[len(proof)-1][0] ^= 1
+	assert.False(t, Verify(tree.Root(), height, 0, 4, 2, proof))
+}
+
+func TestPieceLayerTree(t *testing.T) {
+	// a tree built from the piece layer serves the same proofs above it
+	pieceLength := 2 * BlockSize
+	data := testData(5*BlockSize + 7)
+	var layer []Hash
+	for begin := 0; begin < len(data); begin += pieceLength {
+		end := begin + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		layer = append(layer, PieceRoot(data[begin:end], pieceLength))
+	}
+	leaves := Blocks(data)
+	full := NewTree(leaves, 0, Width(len(leaves)), Hash{})
+	upper := NewTree(layer, 1, Width(len(layer)), Pad(pieceLength/BlockSize))
+
+	assert.Equal(t, full.Root(), upper.Root())
+	assert.Equal(t, full.Height(), upper.Height())
+	want, err := full.Proof(1, 2, 2, 3)
+	assert.Nil(t, err)
+	got, err := upper.Proof(1, 2, 2, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, want, got)
+	_, err = upper.Proof(0, 0, 2, 3)
+	assert.NotNil(t, err)
+}
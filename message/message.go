@@ -29,6 +29,33 @@ const (
 	MsgCancel
 )
 
+// Fast Extension (BEP 6) messages.
+const (
+	// MsgSuggest advises the receiver to download a piece.
+	MsgSuggest messageID = iota + 0x0D
+	// MsgHaveAll replaces the bitfield when the sender has every piece.
+	MsgHaveAll
+	// MsgHaveNone replaces the bitfield when the sender has no pieces.
+	MsgHaveNone
+	// MsgReject tells the receiver that a request will not be fulfilled.
+	MsgReject
+	// MsgAllowedFast lets the receiver request a piece even while choked.
+	MsgAllowedFast
+)
+
+// MsgExtended carries an Extension Protocol (BEP 10) message.
+const MsgExtended messageID = 20
+
+// BitTorrent v2 (BEP 52) messages.
+const (
+	// MsgHashRequest requests hashes of a file's merkle tree.
+	MsgHashRequest messageID = iota + 21
+	// MsgHashes delivers hashes to fulfill a hash request.
+	MsgHashes
+	// MsgHashReject tells the receiver that a hash request will not be fulfilled.
+	MsgHashReject
+)
+
 // Message stores ID and payload of a message.
 type Message struct {
 	ID      messageID
@@ -102,6 +129,24 @@ func (m *Message) name() string {
 		return "Piece"
 	case MsgCancel:
 		return "Cancel"
+	case MsgSuggest:
+		return "Suggest"
+	case MsgHaveAll:
+		return "HaveAll"
+	case MsgHaveNone:
+		return "HaveNone"
+	case MsgReject:
+		return "Reject"
+	case MsgAllowedFast:
+		return "AllowedFast"
+	case MsgExtended:
+		return "Extended"
+	case MsgHashRequest:
+		return "HashRequest"
+	case MsgHashes:
+		return "Hashes"
+	case MsgHashReject:
+		return "HashReject"
 	default:
 		return fmt.Sprintf("Unknown#%d", m.ID)
 	}
@@ -7,30 +7,197 @@ import (
 
 // Have creates a Have message.
 func Have(index int) *Message {
-	var payload [4]byte
-	binary.BigEndian.PutUint32(payload[:], uint32(index))
-	return &Message{ID: MsgHave, Payload: payload[:]}
+	return indexMessage(MsgHave, index)
 }
 
 // Request creates a Request message.
 func Request(index, begin, length int) *Message {
+	return blockMessage(MsgRequest, index, begin, length)
+}
+
+// Bitfield creates a Bitfield message.
+func Bitfield(bf []byte) *Message {
+	return &Message{ID: MsgBitfield, Payload: bf}
+}
+
+// Suggest creates a Suggest Piece message.
+func Suggest(index int) *Message {
+	return indexMessage(MsgSuggest, index)
+}
+
+// HaveAll creates a Have All message.
+func HaveAll() *Message {
+	return &Message{ID: MsgHaveAll}
+}
+
+// HaveNone creates a Have None message.
+func HaveNone() *Message {
+	return &Message{ID: MsgHaveNone}
+}
+
+// Reject creates a Reject Request message.
+func Reject(index, begin, length int) *Message {
+	return blockMessage(MsgReject, index, begin, length)
+}
+
+// AllowedFast creates an Allowed Fast message.
+func AllowedFast(index int) *Message {
+	return indexMessage(MsgAllowedFast, index)
+}
+
+// Extended creates an Extension Protocol message with the extended message id.
+func Extended(id uint8, payload []byte) *Message {
+	buf := make([]byte, 1+len(payload))
+	buf[0] = id
+	copy(buf[1:], payload)
+	return &Message{ID: MsgExtended, Payload: buf}
+}
+
+// HashRequest identifies hashes of the merkle tree of a file, BEP 52.
+type HashRequest struct {
+	PiecesRoot  [32]byte // the root of the tree
+	BaseLayer   int      // the lowest requested layer, 0 for the leaves
+	Index       int      // of the first requested hash in the base layer
+	Length      int      // the number of hashes requested from the base layer
+	ProofLayers int      // the number of ancestor layers to include uncles of
+}
+
+const hashRequestLen int = 32 + 4*4
+
+// RequestHashes creates a Hash Request message.
+func RequestHashes(hr HashRequest) *Message {
+	return &Message{ID: MsgHashRequest, Payload: hr.marshal()}
+}
+
+// Hashes creates a Hashes message with the base layer hashes followed by the uncles.
+func Hashes(hr HashRequest, hashes [][32]byte) *Message {
+	payload := hr.marshal()
+	for _, h := range hashes {
+		payload = append(payload, h[:]...)
+	}
+	return &Message{ID: MsgHashes, Payload: payload}
+}
+
+// RejectHashes creates a Hash Reject message.
+func RejectHashes(hr HashRequest) *Message {
+	return &Message{ID: MsgHashReject, Payload: hr.marshal()}
+}
+
+func (hr HashRequest) marshal() []byte {
+	payload := make([]byte, hashRequestLen)
+	copy(payload, hr.PiecesRoot[:])
+	binary.BigEndian.PutUint32(payload[32:36], uint32(hr.BaseLayer))
+	binary.BigEndian.PutUint32(payload[36:40], uint32(hr.Index))
+	binary.BigEndian.PutUint32(payload[40:44], uint32(hr.Length))
+	binary.BigEndian.PutUint32(payload[44:48], uint32(hr.ProofLayers))
+	return payload
+}
+
+func indexMessage(id messageID, index int) *Message {
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], uint32(index))
+	return &Message{ID: id, Payload: payload[:]}
+}
+
+func blockMessage(id messageID, index, begin, length int) *Message {
 	var payload [12]byte
 	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
 	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
 	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
-	return &Message{ID: MsgRequest, Payload: payload[:]}
+	return &Message{ID: id, Payload: payload[:]}
 }
 
 // Piece creates a Piece message.
 func Piece(index, begin int, data []byte) *Message {
-	// TODO:
-	return nil
+	payload := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], data)
+	return &Message{ID: MsgPiece, Payload: payload}
 }
 
 // ParseHave converts a Have message to the index from the payload.
 func ParseHave(msg *Message) (int, error) {
-	if msg.ID != MsgHave {
-		return 0, fmt.Errorf("expected a Have message (ID %d), got ID %d", MsgHave, msg.ID)
+	return parseIndex(msg, MsgHave, "Have")
+}
+
+// ParseRequest converts a Request message to the index, begin, length from the payload.
+func ParseRequest(msg *Message) (int, int, int, error) {
+	return parseBlock(msg, MsgRequest, "Request")
+}
+
+// ParseSuggest converts a Suggest Piece message to the index from the payload.
+func ParseSuggest(msg *Message) (int, error) {
+	return parseIndex(msg, MsgSuggest, "Suggest")
+}
+
+// ParseReject converts a Reject Request message to the index, begin, length from the payload.
+func ParseReject(msg *Message) (int, int, int, error) {
+	return parseBlock(msg, MsgReject, "Reject")
+}
+
+// ParseAllowedFast converts an Allowed Fast message to the index from the payload.
+func ParseAllowedFast(msg *Message) (int, error) {
+	return parseIndex(msg, MsgAllowedFast, "AllowedFast")
+}
+
+// ParseExtended converts an Extension Protocol message to the extended message id and payload.
+func ParseExtended(msg *Message) (uint8, []byte, error) {
+	if msg.ID != MsgExtended {
+		return 0, nil, fmt.Errorf("expected an Extended message (ID %d), got ID %d", MsgExtended, msg.ID)
+	}
+	if len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("payload too short, expected 1+ bytes, got %d", len(msg.Payload))
+	}
+	return msg.Payload[0], msg.Payload[1:], nil
+}
+
+// ParseHashRequest converts a Hash Request message to the request from the payload.
+func ParseHashRequest(msg *Message) (HashRequest, error) {
+	return parseHashRequest(msg, MsgHashRequest, "HashRequest", true)
+}
+
+// ParseHashReject converts a Hash Reject message to the rejected request from the payload.
+func ParseHashReject(msg *Message) (HashRequest, error) {
+	return parseHashRequest(msg, MsgHashReject, "HashReject", true)
+}
+
+// ParseHashes converts a Hashes message to the request it fulfills and the hashes from the payload.
+func ParseHashes(msg *Message) (HashRequest, [][32]byte, error) {
+	hr, err := parseHashRequest(msg, MsgHashes, "Hashes", false)
+	if err != nil {
+		return hr, nil, err
+	}
+	rest := msg.Payload[hashRequestLen:]
+	if len(rest)%32 != 0 {
+		return hr, nil, fmt.Errorf("expected hashes of 32 bytes, got %d bytes", len(rest))
+	}
+	hashes := make([][32]byte, len(rest)/32)
+	for i := range hashes {
+		copy(hashes[i][:], rest[i*32:])
+	}
+	return hr, hashes, nil
+}
+
+func parseHashRequest(msg *Message, id messageID, name string, exact bool) (HashRequest, error) {
+	if msg.ID != id {
+		return HashRequest{}, fmt.Errorf("expected a %s message (ID %d), got ID %d", name, id, msg.ID)
+	}
+	if len(msg.Payload) < hashRequestLen || exact && len(msg.Payload) != hashRequestLen {
+		return HashRequest{}, fmt.Errorf("expected payload with length %d, got length %d", hashRequestLen, len(msg.Payload))
+	}
+	var hr HashRequest
+	copy(hr.PiecesRoot[:], msg.Payload[:32])
+	hr.BaseLayer = int(binary.BigEndian.Uint32(msg.Payload[32:36]))
+	hr.Index = int(binary.BigEndian.Uint32(msg.Payload[36:40]))
+	hr.Length = int(binary.BigEndian.Uint32(msg.Payload[40:44]))
+	hr.ProofLayers = int(binary.BigEndian.Uint32(msg.Payload[44:48]))
+	return hr, nil
+}
+
+func parseIndex(msg *Message, id messageID, name string) (int, error) {
+	if msg.ID != id {
+		return 0, fmt.Errorf("expected a %s message (ID %d), got ID %d", name, id, msg.ID)
 	}
 	if len(msg.Payload) != 4 {
 		return 0, fmt.Errorf("expected payload with length 4, got length %d", len(msg.Payload))
@@ -38,32 +205,45 @@ func ParseHave(msg *Message) (int, error) {
 	return int(binary.BigEndian.Uint32(msg.Payload)), nil
 }
 
-// ParseRequest converts a Request message to the index, begin, length from the payload.
-func ParseRequest(msg *Message) (int, int, int, error) {
-	// TODO:
-	return 0, 0, 0, nil
+func parseBlock(msg *Message, id messageID, name string) (int, int, int, error) {
+	if msg.ID != id {
+		return 0, 0, 0, fmt.Errorf("expected a %s message (ID %d), got ID %d", name, id, msg.ID)
+	}
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("expected payload with length 12, got length %d", len(msg.Payload))
+	}
+	index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length := int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
 }
 
-// ParsePiece converts a Piece message to index, begin, data and writes data to buf.
-func ParsePiece(msg *Message, index int, buf []byte) (int, error) {
+// ParsePieceData converts a Piece message to index, begin and data, a slice of its payload.
+func ParsePieceData(msg *Message) (int, int, []byte, error) {
 	if msg.ID != MsgPiece {
-		return 0, fmt.Errorf("expected a Piece message (ID %d), got ID %d", MsgPiece, msg.ID)
+		return 0, 0, nil, fmt.Errorf("expected a Piece message (ID %d), got ID %d", MsgPiece, msg.ID)
 	}
 	if len(msg.Payload) < 8 {
-		return 0, fmt.Errorf("payload too short, expected 8+ bytes, got %d", len(msg.Payload))
+		return 0, 0, nil, fmt.Errorf("payload too short, expected 8+ bytes, got %d", len(msg.Payload))
 	}
+	index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	return index, begin, msg.Payload[8:], nil
+}
 
-	parsedIndex := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+// ParsePiece converts a Piece message to index, begin, data and writes data to buf.
+func ParsePiece(msg *Message, index int, buf []byte) (int, error) {
+	parsedIndex, begin, data, err := ParsePieceData(msg)
+	if err != nil {
+		return 0, err
+	}
 	if parsedIndex != index {
 		return 0, fmt.Errorf("expected index %d, got %d", index, parsedIndex)
 	}
 
-	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
 	if begin >= len(buf) {
 		return 0, fmt.Errorf("offset begin too high")
 	}
-
-	data := msg.Payload[8:]
 	if begin+len(data) > len(buf) {
 		return 0, fmt.Errorf("not enough space in buf (%d) to write data (%d) from offset begin (%d)", len(buf), len(data), begin)
 	}
@@ -70,6 +70,25 @@ func TestParseHave(t *testing.T) {
 
 }
 
+func TestPiece(t *testing.T) {
+	msg := Piece(4, 567, []byte{0xAA, 0xBB})
+	expected := &Message{
+		ID: MsgPiece,
+		Payload: []byte{
+			0x00, 0x00, 0x00, 0x04, // index
+			0x00, 0x00, 0x02, 0x37, // begin
+			0xAA, 0xBB, // data
+		},
+	}
+	assert.Equal(t, expected, msg)
+
+	buf := make([]byte, 600)
+	n, err := ParsePiece(msg, 4, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []byte{0xAA, 0xBB}, buf[567:569])
+}
+
 func TestParsePiece(t *testing.T) {
 	tests := map[string]struct {
 		msg       *Message
@@ -178,3 +197,165 @@ func TestParsePiece(t *testing.T) {
 		assert.Equal(t, test.buf, test.targetBuf)
 	}
 }
+
+func TestParsePieceData(t *testing.T) {
+	index, begin, data, err := ParsePieceData(Piece(4, 567, []byte{0xAA, 0xBB}))
+	assert.Nil(t, err)
+	assert.Equal(t, []int{4, 567}, []int{index, begin})
+	assert.Equal(t, []byte{0xAA, 0xBB}, data)
+
+	_, _, _, err = ParsePieceData(&Message{ID: MsgPiece, Payload: []byte{0, 0, 0, 4}})
+	assert.NotNil(t, err)
+	_, _, _, err = ParsePieceData(Have(4))
+	assert.NotNil(t, err)
+}
+
+func TestFastMessages(t *testing.T) {
+	tests := map[string]struct {
+		input  *Message
+		output *Message
+	}{
+		"suggest": {
+			input:  Suggest(4),
+			output: &Message{ID: MsgSuggest, Payload: []byte{0, 0, 0, 4}},
+		},
+		"have all": {
+			input:  HaveAll(),
+			output: &Message{ID: MsgHaveAll},
+		},
+		"have none": {
+			input:  HaveNone(),
+			output: &Message{ID: MsgHaveNone},
+		},
+		"reject": {
+			input: Reject(4, 567, 4321),
+			output: &Message{ID: MsgReject, Payload: []byte{
+				0x00, 0x00, 0x00, 0x04, // index
+				0x00, 0x00, 0x02, 0x37, // begin
+				0x00, 0x00, 0x10, 0xe1, // length
+			}},
+		},
+		"allowed fast": {
+			input:  AllowedFast(1),
+			output: &Message{ID: MsgAllowedFast, Payload: []byte{0, 0, 0, 1}},
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.output, test.input)
+	}
+}
+
+func TestParseReject(t *testing.T) {
+	tests := map[string]struct {
+		input  *Message
+		index  int
+		begin  int
+		length int
+		fails  bool
+	}{
+		"parse valid message": {
+			input:  Reject(4, 567, 4321),
+			index:  4,
+			begin:  567,
+			length: 4321,
+		},
+		"wrong message type": {
+			input: Request(4, 567, 4321),
+			fails: true,
+		},
+		"payload too short": {
+			input: &Message{ID: MsgReject, Payload: []byte{0x00, 0x00, 0x04}},
+			fails: true,
+		},
+	}
+
+	for _, test := range tests {
+		index, begin, length, err := ParseReject(test.input)
+		if test.fails {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, test.index, index)
+		assert.Equal(t, test.begin, begin)
+		assert.Equal(t, test.length, length)
+	}
+}
+
+func TestParseAllowedFast(t *testing.T) {
+	index, err := ParseAllowedFast(AllowedFast(1313))
+	assert.Nil(t, err)
+	assert.Equal(t, 1313, index)
+
+	_, err = ParseAllowedFast(Suggest(1313))
+	assert.NotNil(t, err)
+}
+
+func TestExtended(t *testing.T) {
+	msg := Extended(1, []byte("de"))
+	assert.Equal(t, &Message{ID: MsgExtended, Payload: []byte{1, 'd', 'e'}}, msg)
+
+	id, payload, err := ParseExtended(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(1), id)
+	assert.Equal(t, []byte("de"), payload)
+
+	_, _, err = ParseExtended(&Message{ID: MsgExtended})
+	assert.NotNil(t, err)
+}
+
+func TestHashMessages(t *testing.T) {
+	hr := HashRequest{PiecesRoot: [32]byte{0: 0xAA, 31: 0xBB}, BaseLayer: 1, Index: 4, Length: 2, ProofLayers: 3}
+	header := append(append([]byte{0xAA}, make([]byte, 30)...), 0xBB,
+		0, 0, 0, 1, // base layer
+		0, 0, 0, 4, // index
+		0, 0, 0, 2, // length
+		0, 0, 0, 3, // proof layers
+	)
+
+	msg := RequestHashes(hr)
+	assert.Equal(t, &Message{ID: MsgHashRequest, Payload: header}, msg)
+	parsed, err := ParseHashRequest(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, hr, parsed)
+
+	parsed, err = ParseHashReject(RejectHashes(hr))
+	assert.Nil(t, err)
+	assert.Equal(t, hr, parsed)
+
+	hashes := [][32]byte{{1}, {2}, {3}}
+	msg = Hashes(hr, hashes)
+	assert.Equal(t, MsgHashes, msg.ID)
+	assert.Len(t, msg.Payload, len(header)+3*32)
+	parsed, parsedHashes, err := ParseHashes(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, hr, parsed)
+	assert.Equal(t, hashes, parsedHashes)
+
+	tests := map[string]struct {
+		input *Message
+		parse func(*Message) error
+	}{
+		"wrong message type": {
+			input: RequestHashes(hr),
+			parse: func(m *Message) error { _, err := ParseHashReject(m); return err },
+		},
+		"request too long": {
+			input: &Message{ID: MsgHashRequest, Payload: append(header, 0)},
+			parse: func(m *Message) error { _, err := ParseHashRequest(m); return err },
+		},
+		"hashes too short": {
+			input: &Message{ID: MsgHashes, Payload: header[:20]},
+			parse: func(m *Message) error { _, _, err := ParseHashes(m); return err },
+		},
+		"partial hash": {
+			input: &Message{ID: MsgHashes, Payload: append(header, 1, 2, 3)},
+			parse: func(m *Message) error { _, _, err := ParseHashes(m); return err },
+		},
+	}
+
+	for name, test := range tests {
+		assert.NotNil(t, test.parse(test.input), name)
+	}
+}
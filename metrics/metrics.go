@@ -0,0 +1,403 @@
+// Package metrics keeps counters, gauges and histograms, and serves them in the Prometheus
+// text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds of the histograms of latencies in seconds,
+// those of the Prometheus clients.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	nameRE  = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+type kind int
+
+const (
+	counterKind kind = iota
+	gaugeKind
+	histogramKind
+)
+
+func (k kind) String() string {
+	switch k {
+	case counterKind:
+		return "counter"
+	case gaugeKind:
+		return "gauge"
+	case histogramKind:
+		return "histogram"
+	default:
+		return fmt.Sprintf("kind#%d", int(k))
+	}
+}
+
+// Registry holds metrics by name. A nil *Registry hands out nil metrics, which discard
+// what they are given, so that instrumented code need not check for one.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// CollectFunc reports the samples of a metric when the registry is written, by calling
+// observe once for every set of label values.
+type CollectFunc func(observe func(value float64, labelValues ...string))
+
+// family is a metric with every set of its label values.
+type family struct {
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64 // of histograms
+
+	mu     sync.Mutex
+	series map[string]*series // by their joined label values
+	funcs  []CollectFunc
+}
+
+// series is a metric with one set of label values.
+type series struct {
+	values []string
+
+	mu     sync.Mutex
+	value  float64  // of counters and gauges
+	counts []uint64 // of histograms, by bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// family returns the metric with the given name, registering it first if needed.
+// It panics when the metric is registered already with another kind or other labels,
+// or when the names are invalid.
+func (r *Registry) family(name, help string, k kind, labels []string, buckets []float64) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f, ok := r.families[name]; ok {
+		if f.kind != k || strings.Join(f.labels, ",") != strings.Join(labels, ",") {
+			panic(fmt.Sprintf("metrics: %s registered as a %s with labels %v", name, f.kind, f.labels))
+		}
+		return f
+	}
+	if !nameRE.MatchString(name) {
+		panic(fmt.Sprintf("metrics: invalid name %q", name))
+	}
+	for _, l := range labels {
+		if !labelRE.MatchString(l) || strings.HasPrefix(l, "__") || k == histogramKind && l == "le" {
+			panic(fmt.Sprintf("metrics: invalid label %q of %s", l, name))
+		}
+	}
+	if k == histogramKind {
+		buckets = append([]float64(nil), buckets...)
+		sort.Float64s(buckets)
+	}
+	f := &family{
+		name:    name,
+		help:    help,
+		kind:    k,
+		labels:  append([]string(nil), labels...),
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.families[name] = f
+	return f
+}
+
+// vec returns the metric with the given name like family. Without labels, its only series is
+// created, to be shown as 0 before anything happens.
+func (r *Registry) vec(name, help string, k kind, labels []string, buckets []float64) *family {
+	f := r.family(name, help, k, labels, buckets)
+	if len(labels) == 0 {
+		f.with(nil)
+	}
+	return f
+}
+
+// with returns the series with the given label values, creating it first if needed.
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s has labels %v, got values %q", f.name, f.labels, values))
+	}
+	key := strings.Join(values, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		if f.kind == histogramKind {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// delete forgets the series with the given label values, reporting whether it existed.
+func (f *family) delete(values []string) bool {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s has labels %v, got values %q", f.name, f.labels, values))
+	}
+	key := strings.Join(values, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, ok := f.series[key]
+	delete(f.series, key)
+	return ok
+}
+
+func (r *Registry) collect(name, help string, k kind, labels []string, collect CollectFunc) {
+	if r == nil {
+		return
+	}
+	f := r.family(name, help, k, labels, nil)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.funcs = append(f.funcs, collect)
+}
+
+// Counter returns the counter with the given name and label names, registering it first if
+// needed. A counter only goes up.
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	if r == nil {
+		return nil
+	}
+	return &CounterVec{r.vec(name, help, counterKind, labels, nil)}
+}
+
+// CounterFunc registers collect, which reports the values of a counter kept elsewhere.
+// Many funcs may report the same counter, with distinct label values.
+func (r *Registry) CounterFunc(name, help string, labels []string, collect CollectFunc) {
+	r.collect(name, help, counterKind, labels, collect)
+}
+
+// Gauge returns the gauge with the given name and label names, registering it first if needed.
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	if r == nil {
+		return nil
+	}
+	return &GaugeVec{r.vec(name, help, gaugeKind, labels, nil)}
+}
+
+// GaugeFunc registers collect, which reports the values of a gauge kept elsewhere, see CounterFunc.
+func (r *Registry) GaugeFunc(name, help string, labels []string, collect CollectFunc) {
+	r.collect(name, help, gaugeKind, labels, collect)
+}
+
+// Histogram returns the histogram with the given name, bucket upper bounds and label names,
+// registering it first if needed. The buckets of a registered histogram are kept.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if r == nil {
+		return nil
+	}
+	return &HistogramVec{r.vec(name, help, histogramKind, labels, buckets)}
+}
+
+// CounterVec is a counter with labels.
+type CounterVec struct {
+	f *family
+}
+
+// With returns the counter with the given label values, in the order of the label names.
+func (v *CounterVec) With(values ...string) *Counter {
+	if v == nil {
+		return nil
+	}
+	return (*Counter)(v.f.with(values))
+}
+
+// Delete forgets the counter with the given label values, so that it is not written anymore,
+// and reports whether it existed. The counter keeps working for those holding it.
+func (v *CounterVec) Delete(values ...string) bool {
+	if v == nil {
+		return false
+	}
+	return v.f.delete(values)
+}
+
+// Counter is a value that only goes up. A nil *Counter discards what it is given.
+type Counter series
+
+// Inc adds 1.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds v, negative values are ignored.
+func (c *Counter) Add(v float64) {
+	if c == nil || v < 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.value += v
+}
+
+// Value returns the current value.
+func (c *Counter) Value() float64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.value
+}
+
+// GaugeVec is a gauge with labels.
+type GaugeVec struct {
+	f *family
+}
+
+// With returns the gauge with the given label values, in the order of the label names.
+func (v *GaugeVec) With(values ...string) *Gauge {
+	if v == nil {
+		return nil
+	}
+	return (*Gauge)(v.f.with(values))
+}
+
+// Delete forgets the gauge with the given label values, so that it is not written anymore,
+// and reports whether it existed. The gauge keeps working for those holding it.
+func (v *GaugeVec) Delete(values ...string) bool {
+	if v == nil {
+		return false
+	}
+	return v.f.delete(values)
+}
+
+// Gauge is a value that goes up and down. A nil *Gauge discards what it is given.
+type Gauge series
+
+// Set sets the value to v.
+func (g *Gauge) Set(v float64) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.value = v
+}
+
+// Add adds v, which may be negative.
+func (g *Gauge) Add(v float64) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.value += v
+}
+
+// Inc adds 1.
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+// Dec subtracts 1.
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+// Value returns the current value.
+func (g *Gauge) Value() float64 {
+	if g == nil {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.value
+}
+
+// HistogramVec is a histogram with labels.
+type HistogramVec struct {
+	f *family
+}
+
+// With returns the histogram with the given label values, in the order of the label names.
+func (v *HistogramVec) With(values ...string) *Histogram {
+	if v == nil {
+		return nil
+	}
+	return &Histogram{s: v.f.with(values), buckets: v.f.buckets}
+}
+
+// Delete forgets the histogram with the given label values, so that it is not written anymore,
+// and reports whether it existed. The histogram keeps working for those holding it.
+func (v *HistogramVec) Delete(values ...string) bool {
+	if v == nil {
+		return false
+	}
+	return v.f.delete(values)
+}
+
+// Histogram counts observations in buckets. A nil *Histogram discards what it is given.
+type Histogram struct {
+	s       *series
+	buckets []float64
+}
+
+// Observe records v.
+func (h *Histogram) Observe(v float64) {
+	if h == nil {
+		return
+	}
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		h.s.counts[i]++
+	}
+	h.s.sum += v
+	h.s.count++
+}
+
+// ObserveDuration records d in seconds.
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	if h == nil {
+		return 0
+	}
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+
+	return h.s.count
+}
+
+// Sum returns the sum of the observations.
+func (h *Histogram) Sum() float64 {
+	if h == nil {
+		return 0
+	}
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+
+	return h.s.sum
+}
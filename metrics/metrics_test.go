@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("test_requests_total", "Requests by code.", "code", "method").With("200", "get").Add(3)
+	r.Counter("test_requests_total", "Requests by code.", "code", "method").With("404", "get").Inc()
+	r.Counter("test_requests_total", "", "code", "method").With("200", "get").Add(-1) // ignored
+	g := r.Gauge("test_temperature", "Line\nand \\ in help.").With()
+	g.Set(20)
+	g.Dec()
+	r.Gauge("test_labels", "Escaped values.", "v").With("a\"b\\c\nd").Set(math.Inf(1))
+	h := r.Histogram("test_latency_seconds", "Latency.", []float64{1, 0.1})
+	h.With().Observe(0.05)
+	h.With().Observe(0.1)
+	h.With().ObserveDuration(2 * time.Second)
+	r.GaugeFunc("test_func", "Collected.", []string{"k"}, func(observe func(float64, ...string)) {
+		observe(2, "b")
+		observe(1, "a")
+		observe(3) // wrong labels, dropped
+	})
+	r.Counter("test_unused", "Has no series.", "k")
+
+	var buf bytes.Buffer
+	n, err := r.WriteTo(&buf)
+	require.Nil(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+	assert.Equal(t, `# HELP test_func Collected.
+# TYPE test_func gauge
+test_func{k="a"} 1
+test_func{k="b"} 2
+# HELP test_labels Escaped values.
+# TYPE test_labels gauge
+test_labels{v="a\"b\\c\nd"} +Inf
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 2
+test_latency_seconds_bucket{le="1"} 2
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 2.15
+test_latency_seconds_count 3
+# HELP test_requests_total Requests by code.
+# TYPE test_requests_total counter
+test_requests_total{code="200",method="get"} 3
+test_requests_total{code="404",method="get"} 1
+# HELP test_temperature Line\nand \\ in help.
+# TYPE test_temperature gauge
+test_temperature 19
+`, buf.String())
+	assert.Equal(t, uint64(3), h.With().Count())
+	assert.Equal(t, 2.15, h.With().Sum())
+}
+
+func TestDelete(t *testing.T) {
+	r := NewRegistry()
+	v := r.Counter("test_bytes_total", "Bytes by torrent.", "torrent")
+	kept := v.With("a")
+	kept.Add(1)
+	v.With("b").Add(2)
+
+	assert.True(t, v.Delete("a"))
+	assert.False(t, v.Delete("a"))
+	kept.Inc()
+	assert.Equal(t, 2.0, kept.Value())
+	assert.Panics(t, func() { v.Delete() })
+	assert.False(t, r.Gauge("test_gauge", "", "k").Delete("x"))
+
+	var buf bytes.Buffer
+	_, err := r.WriteTo(&buf)
+	require.Nil(t, err)
+	assert.NotContains(t, buf.String(), `torrent="a"`)
+	assert.Contains(t, buf.String(), `test_bytes_total{torrent="b"} 2`)
+}
+
+func TestRegistryMisuse(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("test_total", "", "a")
+
+	tests := map[string]func(){
+		"kind":         func() { r.Gauge("test_total", "", "a") },
+		"labels":       func() { r.Counter("test_total", "", "b") },
+		"values":       func() { r.Counter("test_total", "", "a").With("x", "y") },
+		"name":         func() { r.Counter("test-total", "") },
+		"label":        func() { r.Counter("test_other_total", "", "0a") },
+		"reserved":     func() { r.Counter("test_other_total", "", "__a") },
+		"bucket label": func() { r.Histogram("test_seconds", "", DefaultBuckets, "le") },
+	}
+	for name, f := range tests {
+		assert.Panics(t, f, name)
+	}
+}
+
+func TestNilRegistry(t *testing.T) {
+	var r *Registry
+	r.Counter("test_total", "", "a").With("x").Inc()
+	r.Gauge("test_gauge", "").With().Set(1)
+	r.Histogram("test_seconds", "", DefaultBuckets).With().Observe(1)
+	r.GaugeFunc("test_func", "", nil, func(func(float64, ...string)) { t.Fatal("collected") })
+	assert.Equal(t, 0.0, r.Counter("test_total", "").With().Value())
+	assert.False(t, r.Counter("test_total", "", "a").Delete("x"))
+	n, err := r.WriteTo(new(bytes.Buffer))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("test_total", "Help.").With().Inc()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, ContentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, "# HELP test_total Help.\n# TYPE test_total counter\ntest_total 1\n", w.Body.String())
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
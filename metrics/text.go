@@ -0,0 +1,177 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ContentType is that of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// sample is a line of the text format.
+type sample struct {
+	suffix string // of the name, e.g. _bucket
+	values []string
+	le     string // bucket bound, if any
+	value  float64
+}
+
+// WriteTo writes every metric in the text exposition format, sorted by name and label values.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	if r == nil {
+		return 0, nil
+	}
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, f := range families {
+		samples := f.samples()
+		if len(samples) == 0 {
+			continue
+		}
+		bw.WriteString("# HELP " + f.name + " " + escape(f.help, false) + "\n")
+		bw.WriteString("# TYPE " + f.name + " " + f.kind.String() + "\n")
+		for _, s := range samples {
+			bw.WriteString(f.name + s.suffix)
+			writeLabels(bw, f.labels, s.values, s.le)
+			bw.WriteString(" " + formatFloat(s.value) + "\n")
+		}
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP writes every metric in the text exposition format, see WriteTo.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	if req.Method == http.MethodHead {
+		return
+	}
+	r.WriteTo(w)
+}
+
+// samples returns the lines of the metric, sorted by label values. The funcs are called
+// without any lock held, they may take their own.
+func (f *family) samples() []sample {
+	f.mu.Lock()
+	all := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		all = append(all, s)
+	}
+	funcs := append([]CollectFunc(nil), f.funcs...)
+	f.mu.Unlock()
+
+	var ret []sample
+	for _, collect := range funcs {
+		collect(func(value float64, values ...string) {
+			if len(values) != len(f.labels) {
+				return
+			}
+			ret = append(ret, sample{values: append([]string(nil), values...), value: value})
+		})
+	}
+	sort.Slice(all, func(i, j int) bool { return less(all[i].values, all[j].values) })
+	for _, s := range all {
+		s.mu.Lock()
+		if f.kind != histogramKind {
+			ret = append(ret, sample{values: s.values, value: s.value})
+			s.mu.Unlock()
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range f.buckets {
+			cumulative += s.counts[i]
+			ret = append(ret, sample{suffix: "_bucket", values: s.values, le: formatFloat(bound), value: float64(cumulative)})
+		}
+		ret = append(ret,
+			sample{suffix: "_bucket", values: s.values, le: "+Inf", value: float64(s.count)},
+			sample{suffix: "_sum", values: s.values, value: s.sum},
+			sample{suffix: "_count", values: s.values, value: float64(s.count)},
+		)
+		s.mu.Unlock()
+	}
+	// the samples of the funcs are mixed with the others
+	sort.SliceStable(ret, func(i, j int) bool { return less(ret[i].values, ret[j].values) })
+	return ret
+}
+
+// less orders label values.
+func less(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+func writeLabels(w *bufio.Writer, names, values []string, le string) {
+	if len(names) == 0 && le == "" {
+		return
+	}
+	w.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		w.WriteString(name + `="` + escape(values[i], true) + `"`)
+	}
+	if le != "" {
+		if len(names) > 0 {
+			w.WriteByte(',')
+		}
+		w.WriteString(`le="` + le + `"`)
+	}
+	w.WriteByte('}')
+}
+
+// escape escapes the backslashes and the line feeds of s, and its double quotes in label values.
+func escape(s string, quotes bool) string {
+	r := strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	if quotes {
+		r = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	}
+	return r.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,416 @@
+// Package mse implements Message Stream Encryption, also known as Protocol Encryption.
+// reference: https://wiki.vuze.com/w/Message_Stream_Encryption
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// CryptoMethod is a bitmask of the methods used for crypto_provide and crypto_select.
+type CryptoMethod uint32
+
+const (
+	CryptoPlaintext CryptoMethod = 0x01
+	CryptoRC4       CryptoMethod = 0x02
+)
+
+// Policy decides whether connections are encrypted.
+type Policy int
+
+const (
+	// PolicyPrefer encrypts when the peer supports it and falls back to plaintext otherwise.
+	PolicyPrefer Policy = iota
+	// PolicyRequire refuses any connection that is not RC4 encrypted.
+	PolicyRequire
+	// PolicyDisable never encrypts, peers that insist on encryption are refused.
+	PolicyDisable
+)
+
+func (p Policy) String() string {
+	switch p {
+	case PolicyPrefer:
+		return "prefer"
+	case PolicyRequire:
+		return "require"
+	case PolicyDisable:
+		return "disable"
+	default:
+		return fmt.Sprintf("Policy#%d", int(p))
+	}
+}
+
+// Methods returns the crypto methods acceptable under the policy.
+func (p Policy) Methods() CryptoMethod {
+	switch p {
+	case PolicyRequire:
+		return CryptoRC4
+	case PolicyDisable:
+		return CryptoPlaintext
+	default:
+		return CryptoRC4 | CryptoPlaintext
+	}
+}
+
+const (
+	keyLen    int = 96  // length of the public keys and the shared secret
+	maxPadLen int = 512 // upper bound of PadA, PadB, PadC and PadD
+)
+
+var (
+	// 768-bit safe prime from the specification
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+	vc        [8]byte // verification constant, all zeros
+
+	pstr = []byte("\x13BitTorrent protocol")
+)
+
+// ErrPlaintext is returned by Accept when the peer starts a plaintext handshake
+// but the policy requires encryption.
+var ErrPlaintext = errors.New("mse: plaintext connection refused")
+
+// Conn is a net.Conn that transparently encrypts and decrypts the stream.
+type Conn struct {
+	net.Conn
+	// Method is the crypto method negotiated for the payload stream.
+	Method CryptoMethod
+
+	r       io.Reader
+	pending []byte // already decrypted bytes, returned before the stream
+	dec     *rc4.Cipher
+
+	wmu sync.Mutex
+	enc *rc4.Cipher
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+
+	n, err := c.r.Read(b)
+	if c.dec != nil {
+		c.dec.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func xor(a, b []byte) []byte {
+	ret := make([]byte, len(a))
+	for i := range a {
+		ret[i] = a[i] ^ b[i]
+	}
+	return ret
+}
+
+// newKeyPair generates a 160 bit private key and its public key.
+func newKeyPair() (*big.Int, []byte, error) {
+	var buf [20]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return nil, nil, err
+	}
+	x := new(big.Int).SetBytes(buf[:])
+	y := new(big.Int).Exp(generator, x, prime)
+	return x, leftPad(y.Bytes()), nil
+}
+
+func sharedSecret(y []byte, x *big.Int) []byte {
+	s := new(big.Int).Exp(new(big.Int).SetBytes(y), x, prime)
+	return leftPad(s.Bytes())
+}
+
+// leftPad pads b with zeros up to keyLen bytes.
+func leftPad(b []byte) []byte {
+	ret := make([]byte, keyLen)
+	copy(ret[keyLen-len(b):], b)
+	return ret
+}
+
+// newCipher creates an RC4 cipher that has discarded the first 1024 bytes.
+func newCipher(name string, s []byte, skey [20]byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(hash([]byte(name), s, skey[:]))
+	var discard [1024]byte
+	c.XORKeyStream(discard[:], discard[:])
+	return c
+}
+
+func randPad() ([]byte, error) {
+	var n [2]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return nil, err
+	}
+	pad := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(maxPadLen+1))
+	if _, err := rand.Read(pad); err != nil {
+		return nil, err
+	}
+	return pad, nil
+}
+
+// synchronize reads from r until pattern is found, reading at most limit bytes.
+func synchronize(r io.ByteReader, pattern []byte, limit int) error {
+	window := make([]byte, 0, limit)
+	for len(window) < limit {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return errors.New("synchronization pattern not found")
+}
+
+// selectMethod picks the strongest method both sides accept.
+func selectMethod(provided, allowed CryptoMethod) (CryptoMethod, error) {
+	switch both := provided & allowed; {
+	case both&CryptoRC4 != 0:
+		return CryptoRC4, nil
+	case both&CryptoPlaintext != 0:
+		return CryptoPlaintext, nil
+	default:
+		return 0, fmt.Errorf("no common crypto method, provided: %#x, allowed: %#x", provided, allowed)
+	}
+}
+
+// Initiate performs the handshake of the connecting side, A.
+// infoHash is the shared secret SKEY and provide lists the acceptable crypto methods.
+func Initiate(conn net.Conn, infoHash [20]byte, provide CryptoMethod) (*Conn, error) {
+	// 1 A->B: Diffie Hellman Ya, PadA
+	xa, ya, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	padA, err := randPad()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(ya, padA...)); err != nil {
+		return nil, fmt.Errorf("write Ya: %s", err)
+	}
+
+	// 2 B->A: Diffie Hellman Yb, PadB
+	r := bufio.NewReader(conn)
+	yb := make([]byte, keyLen)
+	if _, err := io.ReadFull(r, yb); err != nil {
+		return nil, fmt.Errorf("read Yb: %s", err)
+	}
+	s := sharedSecret(yb, xa)
+
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	enc := newCipher("keyA", s, infoHash)
+	dec := newCipher("keyB", s, infoHash)
+
+	plain := new(bytes.Buffer)
+	plain.Write(vc[:])
+	binary.Write(plain, binary.BigEndian, uint32(provide))
+	binary.Write(plain, binary.BigEndian, uint16(0)) // len(PadC)
+	binary.Write(plain, binary.BigEndian, uint16(0)) // len(IA)
+	encrypted := make([]byte, plain.Len())
+	enc.XORKeyStream(encrypted, plain.Bytes())
+
+	req := new(bytes.Buffer)
+	req.Write(hash([]byte("req1"), s))
+	req.Write(xor(hash([]byte("req2"), infoHash[:]), hash([]byte("req3"), s)))
+	req.Write(encrypted)
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		return nil, fmt.Errorf("write crypto_provide: %s", err)
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD), ENCRYPT2(Payload Stream)
+	encryptedVC := make([]byte, len(vc))
+	newCipher("keyB", s, infoHash).XORKeyStream(encryptedVC, vc[:])
+	if err := synchronize(r, encryptedVC, maxPadLen+len(vc)); err != nil {
+		return nil, fmt.Errorf("find VC: %s", err)
+	}
+	dec.XORKeyStream(encryptedVC, encryptedVC) // keep dec in sync with the stream
+
+	var res [6]byte
+	if _, err := io.ReadFull(r, res[:]); err != nil {
+		return nil, fmt.Errorf("read crypto_select: %s", err)
+	}
+	dec.XORKeyStream(res[:], res[:])
+	method := CryptoMethod(binary.BigEndian.Uint32(res[0:4]))
+	padLen := int(binary.BigEndian.Uint16(res[4:6]))
+	if method != CryptoRC4 && method != CryptoPlaintext || method&provide == 0 {
+		return nil, fmt.Errorf("peer selected unprovided crypto method: %#x", method)
+	}
+	if padLen > maxPadLen {
+		return nil, fmt.Errorf("PadD too long: %d", padLen)
+	}
+	padD := make([]byte, padLen)
+	if _, err := io.ReadFull(r, padD); err != nil {
+		return nil, fmt.Errorf("read PadD: %s", err)
+	}
+	dec.XORKeyStream(padD, padD)
+
+	// 5 A->B: ENCRYPT2(Payload Stream)
+	c := &Conn{Conn: conn, Method: method, r: r}
+	if method == CryptoRC4 {
+		c.enc, c.dec = enc, dec
+	}
+	return c, nil
+}
+
+// Receive performs the handshake of the receiving side, B.
+// infoHashes are the acceptable values of SKEY and allow lists the acceptable crypto methods.
+// Returns the connection and the info hash the peer asked for.
+func Receive(conn net.Conn, infoHashes [][20]byte, allow CryptoMethod) (*Conn, [20]byte, error) {
+	return receive(conn, bufio.NewReader(conn), infoHashes, allow)
+}
+
+func receive(conn net.Conn, r *bufio.Reader, infoHashes [][20]byte, allow CryptoMethod) (*Conn, [20]byte, error) {
+	var skey [20]byte
+
+	// 1 A->B: Diffie Hellman Ya, PadA
+	ya := make([]byte, keyLen)
+	if _, err := io.ReadFull(r, ya); err != nil {
+		return nil, skey, fmt.Errorf("read Ya: %s", err)
+	}
+
+	// 2 B->A: Diffie Hellman Yb, PadB
+	xb, yb, err := newKeyPair()
+	if err != nil {
+		return nil, skey, err
+	}
+	padB, err := randPad()
+	if err != nil {
+		return nil, skey, err
+	}
+	if _, err := conn.Write(append(yb, padB...)); err != nil {
+		return nil, skey, fmt.Errorf("write Yb: %s", err)
+	}
+	s := sharedSecret(ya, xb)
+
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	if err := synchronize(r, hash([]byte("req1"), s), maxPadLen+sha1.Size); err != nil {
+		return nil, skey, fmt.Errorf("find req1: %s", err)
+	}
+	obfuscated := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(r, obfuscated); err != nil {
+		return nil, skey, fmt.Errorf("read req2: %s", err)
+	}
+	req2 := xor(obfuscated, hash([]byte("req3"), s))
+	found := false
+	for _, ih := range infoHashes {
+		if bytes.Equal(req2, hash([]byte("req2"), ih[:])) {
+			skey, found = ih, true
+			break
+		}
+	}
+	if !found {
+		return nil, skey, errors.New("peer requested an unknown info hash")
+	}
+
+	dec := newCipher("keyA", s, skey)
+	enc := newCipher("keyB", s, skey)
+
+	var req [14]byte
+	if _, err := io.ReadFull(r, req[:]); err != nil {
+		return nil, skey, fmt.Errorf("read crypto_provide: %s", err)
+	}
+	dec.XORKeyStream(req[:], req[:])
+	if !bytes.Equal(req[0:8], vc[:]) {
+		return nil, skey, errors.New("invalid VC")
+	}
+	provide := CryptoMethod(binary.BigEndian.Uint32(req[8:12]))
+	padLen := int(binary.BigEndian.Uint16(req[12:14]))
+	if padLen > maxPadLen {
+		return nil, skey, fmt.Errorf("PadC too long: %d", padLen)
+	}
+	padC := make([]byte, padLen+2) // PadC, len(IA)
+	if _, err := io.ReadFull(r, padC); err != nil {
+		return nil, skey, fmt.Errorf("read PadC: %s", err)
+	}
+	dec.XORKeyStream(padC, padC)
+	ia := make([]byte, binary.BigEndian.Uint16(padC[padLen:]))
+	if _, err := io.ReadFull(r, ia); err != nil {
+		return nil, skey, fmt.Errorf("read IA: %s", err)
+	}
+	dec.XORKeyStream(ia, ia)
+
+	method, err := selectMethod(provide, allow)
+	if err != nil {
+		return nil, skey, err
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD), ENCRYPT2(Payload Stream)
+	res := new(bytes.Buffer)
+	res.Write(vc[:])
+	binary.Write(res, binary.BigEndian, uint32(method))
+	binary.Write(res, binary.BigEndian, uint16(0)) // len(PadD)
+	encrypted := make([]byte, res.Len())
+	enc.XORKeyStream(encrypted, res.Bytes())
+	if _, err := conn.Write(encrypted); err != nil {
+		return nil, skey, fmt.Errorf("write crypto_select: %s", err)
+	}
+
+	c := &Conn{Conn: conn, Method: method, r: r, pending: ia}
+	if method == CryptoRC4 {
+		c.enc, c.dec = enc, dec
+	}
+	return c, skey, nil
+}
+
+// Accept handles an inbound connection under the policy. Plaintext BitTorrent
+// handshakes are detected and passed through unless encryption is required.
+// The returned info hash is zero for plaintext connections.
+func Accept(conn net.Conn, policy Policy, infoHashes [][20]byte) (net.Conn, [20]byte, error) {
+	r := bufio.NewReader(conn)
+	prefix, err := r.Peek(len(pstr))
+	if err != nil {
+		return nil, [20]byte{}, fmt.Errorf("peek: %s", err)
+	}
+
+	if bytes.Equal(prefix, pstr) {
+		if policy == PolicyRequire {
+			return nil, [20]byte{}, ErrPlaintext
+		}
+		return &Conn{Conn: conn, Method: CryptoPlaintext, r: r}, [20]byte{}, nil
+	}
+	if policy == PolicyDisable {
+		return nil, [20]byte{}, errors.New("mse: encrypted connection refused")
+	}
+
+	c, skey, err := receive(conn, r, infoHashes, policy.Methods())
+	if err != nil {
+		return nil, skey, err
+	}
+	return c, skey, nil
+}
@@ -0,0 +1,152 @@
+package mse
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var infoHash = [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+
+func createServerAndClient(t *testing.T) (serverConn, clientConn net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	// make sure we don't return before serverConn is ready
+	done := make(chan struct{})
+	go func() {
+		defer ln.Close()
+		var err error
+		serverConn, err = ln.Accept()
+		require.Nil(t, err)
+		done <- struct{}{}
+	}()
+	clientConn, err = net.Dial("tcp", ln.Addr().String())
+	<-done
+
+	return
+}
+
+type result struct {
+	conn     net.Conn
+	infoHash [20]byte
+	err      error
+}
+
+func TestHandshake(t *testing.T) {
+	tests := map[string]struct {
+		provide    CryptoMethod
+		policy     Policy
+		infoHashes [][20]byte
+		method     CryptoMethod
+		fails      bool
+	}{
+		"rc4": {
+			provide:    CryptoRC4 | CryptoPlaintext,
+			policy:     PolicyPrefer,
+			infoHashes: [][20]byte{{1}, infoHash},
+			method:     CryptoRC4,
+		},
+		"encryption disabled": {
+			provide:    CryptoRC4 | CryptoPlaintext,
+			policy:     PolicyDisable,
+			infoHashes: [][20]byte{infoHash},
+			fails:      true, // encrypted handshakes are refused outright
+		},
+		"plaintext provided": {
+			provide:    CryptoPlaintext,
+			policy:     PolicyPrefer,
+			infoHashes: [][20]byte{infoHash},
+			method:     CryptoPlaintext,
+		},
+		"rc4 required": {
+			provide:    CryptoPlaintext,
+			policy:     PolicyRequire,
+			infoHashes: [][20]byte{infoHash},
+			fails:      true,
+		},
+		"unknown info hash": {
+			provide:    CryptoRC4,
+			policy:     PolicyPrefer,
+			infoHashes: [][20]byte{{1}},
+			fails:      true,
+		},
+	}
+
+	for name, test := range tests {
+		serverConn, clientConn := createServerAndClient(t)
+
+		results := make(chan result)
+		go func() {
+			conn, ih, err := Accept(serverConn, test.policy, test.infoHashes)
+			if err != nil {
+				serverConn.Close()
+			}
+			results <- result{conn, ih, err}
+		}()
+
+		c, err := Initiate(clientConn, infoHash, test.provide)
+		res := <-results
+		if test.fails {
+			assert.NotNil(t, res.err, name)
+			assert.NotNil(t, err, name)
+			clientConn.Close()
+			continue
+		}
+		require.Nil(t, err, name)
+		require.Nil(t, res.err, name)
+		assert.Equal(t, infoHash, res.infoHash, name)
+		assert.Equal(t, test.method, c.Method, name)
+		assert.Equal(t, test.method, res.conn.(*Conn).Method, name)
+
+		// the payload stream flows both ways
+		go c.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(res.conn, buf)
+		assert.Nil(t, err, name)
+		assert.Equal(t, "ping", string(buf), name)
+
+		go res.conn.Write([]byte("pong"))
+		_, err = io.ReadFull(c, buf)
+		assert.Nil(t, err, name)
+		assert.Equal(t, "pong", string(buf), name)
+
+		c.Close()
+		res.conn.Close()
+	}
+}
+
+func TestAcceptPlaintext(t *testing.T) {
+	tests := map[string]struct {
+		policy Policy
+		fails  bool
+	}{
+		"prefer":  {policy: PolicyPrefer},
+		"disable": {policy: PolicyDisable},
+		"require": {policy: PolicyRequire, fails: true},
+	}
+
+	for name, test := range tests {
+		serverConn, clientConn := createServerAndClient(t)
+		msg := append([]byte("\x13BitTorrent protocol"), make([]byte, 48)...)
+		_, err := clientConn.Write(msg)
+		require.Nil(t, err)
+
+		conn, _, err := Accept(serverConn, test.policy, [][20]byte{infoHash})
+		if test.fails {
+			assert.Equal(t, ErrPlaintext, err, name)
+		} else {
+			require.Nil(t, err, name)
+			// nothing is lost while sniffing the protocol
+			buf := make([]byte, len(msg))
+			_, err = io.ReadFull(conn, buf)
+			assert.Nil(t, err, name)
+			assert.Equal(t, msg, buf, name)
+		}
+		serverConn.Close()
+		clientConn.Close()
+	}
+}
@@ -0,0 +1,340 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/VIVelev/bittorrent/client"
+	"github.com/VIVelev/bittorrent/extension"
+	"github.com/VIVelev/bittorrent/logging"
+	"github.com/VIVelev/bittorrent/message"
+	"github.com/VIVelev/bittorrent/mse"
+	"github.com/VIVelev/bittorrent/peer"
+	"github.com/VIVelev/bittorrent/pex"
+	"github.com/VIVelev/bittorrent/utp"
+)
+
+const (
+	// keepAliveInterval is how long an idle connection stays silent before we send a keep-alive.
+	keepAliveInterval time.Duration = 2 * time.Minute
+	// messageTimeout is how long the rest of a message may take once it started arriving.
+	messageTimeout time.Duration = 30 * time.Second
+)
+
+// peerConn is a connection to a peer taking part in a download.
+type peerConn struct {
+	*client.Client
+	t     *Torrent
+	peer  peer.Peer
+	pex   pex.State
+	haves int             // completions of the picker the peer was told about
+	log   *logging.Logger // of the torrent, with the peer
+	stats *connStats
+}
+
+func newPeerConn(c *client.Client, t *Torrent, p peer.Peer) *peerConn {
+	return &peerConn{Client: c, t: t, peer: p, log: t.log.With(logging.Peer(p)), stats: newConnStats(c.PeerID)}
+}
+
+func (pc *peerConn) has(index int) bool { return pc.Bitfield.HasPiece(index) }
+func (pc *peerConn) suggested() []int   { return pc.Suggested }
+
+// canRequest also leaves the pieces that need leaf hashes to the v2 peers.
+func (pc *peerConn) canRequest(index int) bool {
+	return pc.CanRequest(index) && (pc.V2 || !pc.t.needsLeaves(pc.t.pk.work[index]))
+}
+
+// setChoked records whether the peer chokes us.
+func (pc *peerConn) setChoked(choked bool) {
+	if choked != pc.Choked {
+		m := pc.t.m
+		m.chokeState(pc.Choked).Dec()
+		m.chokeState(choked).Inc()
+	}
+	pc.Choked = choked
+	pc.stats.update(func(s *connStats) { s.choked = choked })
+}
+
+// setInterested tells the peer whether we are interested in its pieces.
+func (pc *peerConn) setInterested(interested bool) {
+	if interested {
+		pc.WriteInterested()
+	} else {
+		pc.WriteNotInterested()
+	}
+	pc.stats.update(func(s *connStats) { s.interested = interested })
+}
+
+// flags describes the connection for PEX.
+func (pc *peerConn) flags() pex.Flags {
+	// we dialed the peer, so it accepts incoming connections
+	flags := pex.FlagReachable
+	conn := pc.Conn
+	if ec, ok := conn.(*mse.Conn); ok {
+		if ec.Method == mse.CryptoRC4 {
+			flags |= pex.FlagEncryption
+		}
+		conn = ec.Conn
+	}
+	if _, ok := conn.(*utp.Conn); ok {
+		flags |= pex.FlagUTP
+	}
+	return flags
+}
+
+// handleMessage processes the messages that are not tied to the piece being downloaded.
+func (pc *peerConn) handleMessage(msg *message.Message) error {
+	switch msg.ID {
+	case message.MsgChoke:
+		pc.setChoked(true)
+	case message.MsgUnchoke:
+		pc.setChoked(false)
+	case message.MsgInterested, message.MsgNotInterested:
+		interested := msg.ID == message.MsgInterested
+		pc.stats.update(func(s *connStats) { s.peerInterested = interested })
+	case message.MsgHave:
+		index, err := message.ParseHave(msg)
+		if err != nil {
+			return err
+		}
+		// the bitfield is read by Torrent.unavailable too
+		pc.t.connsMu.Lock()
+		pc.Bitfield.SetPiece(index)
+		pc.t.connsMu.Unlock()
+	case message.MsgSuggest:
+		index, err := message.ParseSuggest(msg)
+		if err != nil {
+			return err
+		}
+		if !pc.t.pk.isDone(index) {
+			pc.Suggest(index)
+		}
+	case message.MsgAllowedFast:
+		index, err := message.ParseAllowedFast(msg)
+		if err != nil {
+			return err
+		}
+		pc.AllowedFast.SetPiece(index)
+	case message.MsgExtended:
+		id, payload, err := message.ParseExtended(msg)
+		if err != nil {
+			return err
+		}
+		return pc.handleExtended(id, payload)
+	case message.MsgHashRequest:
+		return pc.handleHashRequest(msg)
+	case message.MsgRequest:
+		return pc.handleRequest(msg)
+	}
+	return nil
+}
+
+// handleRequest serves a block of a piece we have from the storage.
+func (pc *peerConn) handleRequest(msg *message.Message) error {
+	index, begin, length, err := message.ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+
+	t := pc.t
+	if t.storage == nil || length <= 0 || length > MaxBlockSize || !t.pk.isDone(index) || !pc.CanServe(index) {
+		if pc.Fast {
+			return pc.WriteReject(index, begin, length)
+		}
+		return nil
+	}
+	buf := make([]byte, length)
+	if _, err := t.storage.ReadAt(buf, index, begin); err != nil {
+		pc.log.Error("could not read block", logging.Piece(index), logging.Int("begin", begin), logging.Err(err))
+		if pc.Fast {
+			return pc.WriteReject(index, begin, length)
+		}
+		return nil
+	}
+	if err := pc.WritePiece(index, begin, buf); err != nil {
+		return err
+	}
+	t.statsMu.Lock()
+	t.uploaded += int64(length)
+	t.lastUpload = time.Now()
+	t.statsMu.Unlock()
+	t.up.Add(length)
+	pc.stats.up.Add(length)
+	t.m.uploaded.Add(float64(length))
+	return nil
+}
+
+func (pc *peerConn) handleExtended(id uint8, payload []byte) error {
+	switch int(id) {
+	case int(extension.HandshakeID):
+		if err := pc.ReadExtensionHandshake(payload); err != nil {
+			return fmt.Errorf("extension handshake: %s", err)
+		}
+		if pc.ClientName != "" {
+			pc.stats.update(func(s *connStats) { s.client = pc.ClientName })
+		}
+		pc.sendPEX()
+	case extension.Local[extension.Metadata]:
+		return pc.handleMetadata(payload)
+	case extension.Local[extension.PEX]:
+		if !pc.pex.Accept(time.Now()) {
+			// flooding, ignore it
+			return nil
+		}
+		m, err := pex.Unmarshal(payload)
+		if err != nil {
+			return fmt.Errorf("pex: %s", err)
+		}
+		peers := make([]peer.Peer, len(m.Added))
+		flags := make([]pex.Flags, len(m.Added))
+		for i, e := range m.Added {
+			peers[i], flags[i] = e.Peer, e.Flags
+		}
+		pc.t.swarm.add(peers, SourcePEX, flags)
+	}
+	return nil
+}
+
+// sendPEX tells the peer about the peers we are connected to, at most once per pex.Interval.
+func (pc *peerConn) sendPEX() {
+	if !pc.SupportsExtension(extension.PEX) {
+		return
+	}
+	m := pc.pex.Next(time.Now(), pc.t.swarm.entries(pc.peer.String()))
+	if m == nil {
+		return
+	}
+	payload, err := m.Marshal()
+	if err != nil {
+		pc.log.Error("could not marshal PEX message", logging.Err(err))
+		return
+	}
+	pc.WriteExtended(extension.PEX, payload)
+}
+
+// sendAllowedFast lets the peer request the pieces of its allowed fast set while we choke it.
+func (pc *peerConn) sendAllowedFast() {
+	if !pc.Fast {
+		return
+	}
+	set := client.AllowedFastSet(client.AllowedFastSetSize, len(pc.t.pk.work), pc.t.tf.InfoHash, pc.peer.IP)
+	pc.WriteAllowedFast(set)
+}
+
+// sendHaves tells the peer about the pieces we completed since we last told it,
+// and forgets the suggestions of the peer for them.
+func (pc *peerConn) sendHaves() {
+	pk := pc.t.pk
+	n := pk.numCompletions()
+	if n == pc.haves {
+		return
+	}
+	pc.haves = n
+	for index := range pk.work {
+		if !pk.isDone(index) {
+			continue
+		}
+		pc.Unsuggest(index)
+		if pc.Advertised.HasPiece(index) {
+			continue
+		}
+		pc.Advertised.SetPiece(index)
+		if !pc.Bitfield.HasPiece(index) {
+			pc.WriteHave(index)
+		}
+	}
+}
+
+// serve answers the requests of the peer until it disconnects or has every piece too.
+func (pc *peerConn) serve() {
+	for !pc.complete() {
+		if err := pc.idle(nil); err != nil {
+			pc.log.Debug("disconnecting", logging.Err(err))
+			return
+		}
+	}
+}
+
+// idle handles the messages of the peer, sending keep-alives while it is silent, until wake
+// is closed or a message tells what more the peer can give us. A nil wake is never closed.
+func (pc *peerConn) idle(wake <-chan struct{}) error {
+	// wake interrupts the wait for a message, not a message that is arriving
+	var mu sync.Mutex
+	waiting, woken := false, false
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-wake:
+		case <-stop:
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		woken = true
+		if waiting {
+			pc.Conn.SetReadDeadline(time.Now())
+		}
+	}()
+	defer pc.Conn.SetReadDeadline(time.Time{})
+
+	for {
+		mu.Lock()
+		if woken {
+			mu.Unlock()
+			return nil
+		}
+		waiting = true
+		pc.Conn.SetReadDeadline(time.Now().Add(keepAliveInterval))
+		mu.Unlock()
+
+		var first [1]byte
+		_, err := io.ReadFull(pc.Conn, first[:])
+		mu.Lock()
+		waiting = false
+		mu.Unlock()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if _, err := pc.Conn.Write(message.Marshal(nil)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		pc.Conn.SetReadDeadline(time.Now().Add(messageTimeout))
+		msg, err := message.Unmarshal(io.MultiReader(bytes.NewReader(first[:]), pc.Conn))
+		if err != nil {
+			return err
+		}
+		if msg != nil {
+			if err := pc.handleMessage(msg); err != nil {
+				return err
+			}
+		}
+		pc.sendPEX()
+		pc.sendHaves()
+		if msg != nil {
+			switch msg.ID {
+			case message.MsgUnchoke, message.MsgHave, message.MsgSuggest, message.MsgAllowedFast:
+				return nil
+			}
+		}
+	}
+}
+
+// complete reports whether the peer has every piece.
+func (pc *peerConn) complete() bool {
+	for index := range pc.t.pk.work {
+		if !pc.Bitfield.HasPiece(index) {
+			return false
+		}
+	}
+	return true
+}
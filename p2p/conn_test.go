@@ -0,0 +1,264 @@
+package p2p
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/VIVelev/bittorrent/bitfield"
+	"github.com/VIVelev/bittorrent/client"
+	"github.com/VIVelev/bittorrent/handshake"
+	"github.com/VIVelev/bittorrent/internal/testtorrent"
+	"github.com/VIVelev/bittorrent/io"
+	"github.com/VIVelev/bittorrent/message"
+	"github.com/VIVelev/bittorrent/mse"
+	"github.com/VIVelev/bittorrent/peer"
+	"github.com/VIVelev/bittorrent/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleRequest(t *testing.T) {
+	data := randomData(100)
+	tf := newTestTorrent(t, "file", 32, []testtorrent.File{{Length: len(data)}}, data)
+	tr := NewTorrent(tf, [20]byte{})
+	tr.storage = storage.NewMemory(tf)
+	_, err := tr.storage.WriteAt(data[32:64], 1, 0)
+	require.Nil(t, err)
+	require.Nil(t, tr.storage.MarkComplete(1))
+	tr.pk.done(tr.pk.work[1])
+
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+	pc := newPeerConn(&client.Client{Conn: ours, Fast: true}, tr, peer.Peer{})
+
+	tests := map[string]struct {
+		index, begin, length int
+		choking, allowed     bool
+		reject               bool
+	}{
+		"block":         {index: 1, begin: 4, length: 16},
+		"choked":        {index: 1, begin: 4, length: 16, choking: true, reject: true},
+		"allowed fast":  {index: 1, begin: 4, length: 16, choking: true, allowed: true},
+		"missing piece": {index: 0, begin: 0, length: 16, reject: true},
+		"out of piece":  {index: 1, begin: 24, length: 16, reject: true},
+		"too large":     {index: 1, begin: 0, length: MaxBlockSize + 1, reject: true},
+		"no such piece": {index: 7, begin: 0, length: 16, reject: true},
+	}
+
+	for name, test := range tests {
+		pc.Choking = test.choking
+		pc.Allowed = bitfield.New(len(tf.PieceHashes))
+		if test.allowed {
+			pc.Allowed.SetPiece(test.index)
+		}
+		go func(index, begin, length int) {
+			assert.Nil(t, pc.handleRequest(message.Request(index, begin, length)))
+		}(test.index, test.begin, test.length)
+		msg, err := message.Unmarshal(theirs)
+		require.Nil(t, err, name)
+		if test.reject {
+			require.Equal(t, message.MsgReject, msg.ID, name)
+			index, begin, length, err := message.ParseReject(msg)
+			require.Nil(t, err, name)
+			assert.Equal(t, []int{test.index, test.begin, test.length}, []int{index, begin, length}, name)
+			continue
+		}
+		require.Equal(t, message.MsgPiece, msg.ID, name)
+		buf := make([]byte, 32)
+		n, err := message.ParsePiece(msg, test.index, buf)
+		require.Nil(t, err, name)
+		assert.Equal(t, test.length, n, name)
+		assert.Equal(t, data[32+test.begin:][:test.length], buf[test.begin:][:test.length], name)
+	}
+}
+
+func TestRunWithComplete(t *testing.T) {
+	data := randomData(100)
+	tf := newTestTorrent(t, "file", 32, []testtorrent.File{{Length: len(data)}}, data)
+	s := storage.NewMemory(tf)
+	for i := range tf.PieceHashes {
+		require.Nil(t, s.MarkComplete(i))
+	}
+
+	// there is no source, every piece is complete already
+	tr := NewTorrent(tf, [20]byte{})
+	assert.Nil(t, tr.RunWith(s))
+}
+
+// startSeeder seeds tf from s to the peers that connect to the returned address.
+func startSeeder(t *testing.T, tf *io.TorrentFile, s storage.Storage) (*Torrent, peer.Peer) {
+	seeder := NewTorrent(tf, [20]byte{2})
+	seeder.Seed = true
+	require.Nil(t, seeder.RunWith(s))
+	return seeder, listen(t, seeder)
+}
+
+// listen hands the connections to the returned address over to seeder.
+func listen(t *testing.T, seeder *Torrent) peer.Peer {
+	tf := seeder.tf
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c, _, err := client.AcceptHave(conn, mse.PolicyPrefer, [20]byte{2}, [][20]byte{tf.InfoHash},
+					func([20]byte) (int, bitfield.Bitfield, bool, bool) {
+						return len(tf.PieceHashes), seeder.Completed(), tf.IsV2(), true
+					})
+				if err != nil {
+					return
+				}
+				seeder.AddConn(c, peer.Peer{IP: net.IPv4(127, 0, 0, 1), Port: uint16(conn.RemoteAddr().(*net.TCPAddr).Port)})
+			}()
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+var testDialer = &client.Dialer{Encryption: mse.PolicyDisable, Timeout: time.Second, DisableUTP: true}
+
+func TestSeed(t *testing.T) {
+	data := randomData(100000)
+	tf := newTestTorrent(t, "file", 16384, []testtorrent.File{{Length: len(data)}}, data)
+	s := storage.NewMemory(tf)
+	copy(s.Bytes(), data)
+
+	// the data is there, but not known to be complete until it is checked
+	tr := NewTorrent(tf, [20]byte{2})
+	found, err := tr.Check(s)
+	require.Nil(t, err)
+	assert.Equal(t, len(tf.PieceHashes), found)
+	seeder, p := startSeeder(t, tf, s)
+	defer seeder.Stop()
+
+	leecher := NewTorrent(tf, [20]byte{1})
+	leecher.Dialer = testDialer
+	leecher.AddPeers([]peer.Peer{p}, SourceTracker)
+	done := make(chan []byte)
+	go func() { done <- leecher.Run() }()
+	select {
+	case got := <-done:
+		assert.True(t, bytes.Equal(data, got))
+	case <-time.After(10 * time.Second):
+		t.Fatal("download did not finish")
+	}
+	assert.Equal(t, int64(len(data)), leecher.Downloaded())
+	// the seeder counts a block once it is written, possibly after the leecher got it
+	assert.Eventually(t, func() bool { return seeder.Uploaded() == int64(len(data)) }, time.Second, 10*time.Millisecond)
+	assert.False(t, seeder.LastUpload().IsZero())
+}
+
+func TestIdlePeer(t *testing.T) {
+	data := randomData(100)
+	tf := newTestTorrent(t, "file", 128, []testtorrent.File{{Length: len(data)}}, data)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	// the peer has nothing at first, and gets the piece while the connection is idle
+	allowed := make(chan int, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := handshake.Unmarshal(conn); err != nil {
+			return
+		}
+		hs := &handshake.Handshake{InfoHash: tf.InfoHash, PeerID: [20]byte{9}}
+		hs.Enable(handshake.ExtFast)
+		res := handshake.Marshal(hs)
+		conn.Write(res[:])
+		conn.Write(message.Marshal(message.HaveNone()))
+		conn.Write(message.Marshal(&message.Message{ID: message.MsgUnchoke}))
+		time.Sleep(100 * time.Millisecond)
+		conn.Write(message.Marshal(message.Have(0)))
+		for {
+			msg, err := message.Unmarshal(conn)
+			if err != nil {
+				return
+			}
+			if msg != nil && msg.ID == message.MsgAllowedFast {
+				index, err := message.ParseAllowedFast(msg)
+				if err == nil {
+					allowed <- index
+				}
+			}
+			if msg == nil || msg.ID != message.MsgRequest {
+				continue
+			}
+			index, begin, length, err := message.ParseRequest(msg)
+			if err != nil {
+				return
+			}
+			conn.Write(message.Marshal(message.Piece(index, begin, data[begin:][:length])))
+		}
+	}()
+
+	leecher := NewTorrent(tf, [20]byte{1})
+	leecher.Dialer = testDialer
+	addr := ln.Addr().(*net.TCPAddr)
+	leecher.AddPeers([]peer.Peer{{IP: addr.IP, Port: uint16(addr.Port)}}, SourceTracker)
+	done := make(chan []byte)
+	go func() { done <- leecher.Run() }()
+	select {
+	case got := <-done:
+		assert.True(t, bytes.Equal(data, got))
+	case <-time.After(5 * time.Second):
+		leecher.Stop()
+		t.Fatal("the have of the idle peer was not handled")
+	}
+	select {
+	case index := <-allowed:
+		assert.Equal(t, 0, index, "the allowed fast set of the only piece")
+	default:
+		t.Fatal("the allowed fast set was not sent")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	data := randomData(100)
+	tf := newTestTorrent(t, "file", 32, []testtorrent.File{{Length: len(data)}}, data)
+	s := storage.NewMemory(tf)
+	copy(s.Bytes(), data)
+	s.Bytes()[40] ^= 0xff // corrupts piece 1
+	require.Nil(t, s.MarkComplete(3))
+
+	found, err := NewTorrent(tf, [20]byte{}).Check(s)
+	require.Nil(t, err)
+	assert.Equal(t, 2, found, "pieces 0 and 2")
+	completed := s.Completed()
+	for index, ok := range []bool{true, false, true, true} {
+		assert.Equal(t, ok, completed.HasPiece(index), index)
+	}
+}
+
+func TestStop(t *testing.T) {
+	data := randomData(100)
+	tf := newTestTorrent(t, "file", 32, []testtorrent.File{{Length: len(data)}}, data)
+	tr := NewTorrent(tf, [20]byte{})
+
+	// there is no source, the download waits until it is stopped
+	res := make(chan error)
+	go func() { res <- tr.RunWith(storage.NewMemory(tf)) }()
+	time.Sleep(10 * time.Millisecond)
+	tr.Stop()
+	select {
+	case err := <-res:
+		assert.Equal(t, ErrStopped, err)
+	case <-time.After(time.Second):
+		t.Fatal("download did not stop")
+	}
+	assert.Nil(t, tr.pk.next(&fakeSource{}))
+	assert.Equal(t, ErrStopped, tr.RunWith(storage.NewMemory(tf)))
+	tr.Stop() // twice is fine
+}
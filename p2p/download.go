@@ -0,0 +1,263 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/VIVelev/bittorrent/client"
+	"github.com/VIVelev/bittorrent/discovery"
+	"github.com/VIVelev/bittorrent/event"
+	"github.com/VIVelev/bittorrent/io"
+	"github.com/VIVelev/bittorrent/logging"
+	"github.com/VIVelev/bittorrent/metrics"
+	"github.com/VIVelev/bittorrent/peer"
+	"github.com/VIVelev/bittorrent/storage"
+)
+
+const (
+	// DefaultStallTimeout is how long a download goes without receiving a block before it fails.
+	DefaultStallTimeout time.Duration = time.Minute
+	// stallCheckInterval is how often a download checks whether it stalled.
+	stallCheckInterval time.Duration = 100 * time.Millisecond
+)
+
+// Options configure a download, see Download.
+type Options struct {
+	// Peers are connected to first, more are learned from the trackers and over PEX.
+	Peers []peer.Peer
+	// Trackers are asked for peers once the download starts, see io.TorrentFile.Trackers.
+	Trackers []string
+	// Port is the one we tell the trackers peers can connect to.
+	Port uint16
+	// Storage receives the pieces, they are kept in memory when nil, see Handle.Bytes.
+	// It is left open.
+	Storage storage.Storage
+	// Dialer, HTTPClient, MaxPeers, Events, Metrics and Logger are those of the Torrent.
+	// Events receives the replies and the errors of the trackers too, Metrics their latency
+	// and that of the Storage, and Logger the exchanges with UDP trackers.
+	Dialer     *client.Dialer
+	HTTPClient *http.Client
+	MaxPeers   int
+	Events     *event.Bus
+	Metrics    *metrics.Registry
+	Logger     *logging.Logger
+	// StallTimeout fails the download when no block is received for that long,
+	// DefaultStallTimeout when 0.
+	StallTimeout time.Duration
+}
+
+// Stats are the counters of a download.
+type Stats struct {
+	Downloaded int64 // bytes of the verified pieces
+	Uploaded   int64 // bytes served to peers
+	Peers      int   // connected to
+}
+
+// Handle controls a download started with Download.
+type Handle struct {
+	t       *Torrent
+	mem     *storage.Memory // when Options.Storage is nil
+	storage storage.Storage
+	stall   time.Duration
+	cancel  context.CancelFunc
+	done    chan struct{}
+	err     error
+}
+
+// Download starts downloading every piece of tf, introducing ourselves with peerID.
+// It runs until every piece is stored, the download fails, or ctx is done. Either way
+// every connection and goroutine of the download is gone once Wait returns.
+func Download(ctx context.Context, tf *io.TorrentFile, peerID [20]byte, opts Options) *Handle {
+	ctx, cancel := context.WithCancel(ctx)
+	t := NewTorrent(tf, peerID)
+	t.Dialer = opts.Dialer
+	t.HTTPClient = opts.HTTPClient
+	t.MaxPeers = opts.MaxPeers
+	t.Events = opts.Events
+	t.Metrics = opts.Metrics
+	t.Logger = opts.Logger
+	h := &Handle{
+		t:       t,
+		storage: storage.WithMetrics(opts.Storage, opts.Metrics),
+		stall:   opts.StallTimeout,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	if opts.Storage == nil {
+		h.mem = storage.NewMemory(tf)
+		h.storage = h.mem
+	}
+	if h.stall <= 0 {
+		h.stall = DefaultStallTimeout
+	}
+	t.AddPeers(opts.Peers, SourceTracker)
+	go h.run(ctx, opts.Trackers, opts.Port)
+	return h
+}
+
+// Wait blocks until the download ends and returns why it failed, nil once every piece is stored.
+// It returns the error of the context when it is done first.
+func (h *Handle) Wait() error {
+	<-h.done
+	return h.err
+}
+
+// Done returns a channel that is closed once the download ended, see Wait.
+func (h *Handle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Stop cancels the download and waits for it to end.
+func (h *Handle) Stop() {
+	h.cancel()
+	<-h.done
+}
+
+// Progress returns the number of pieces stored and of the pieces of the torrent.
+func (h *Handle) Progress() (int, int) {
+	return h.t.pk.progress()
+}
+
+// Stats returns the counters of the download.
+func (h *Handle) Stats() Stats {
+	return Stats{
+		Downloaded: h.t.Downloaded(),
+		Uploaded:   h.t.Uploaded(),
+		Peers:      h.t.swarm.numConnected(),
+	}
+}
+
+// Bytes returns the contents of the torrent once it is downloaded into memory, nil otherwise.
+func (h *Handle) Bytes() []byte {
+	select {
+	case <-h.done:
+	default:
+		return nil
+	}
+	if h.err != nil || h.mem == nil {
+		return nil
+	}
+	return h.mem.Bytes()
+}
+
+func (h *Handle) run(ctx context.Context, trackers []string, port uint16) {
+	defer close(h.done)
+	defer h.cancel()
+	t := h.t
+
+	res := make(chan error, 1)
+	go func() { res <- t.RunWith(h.storage) }()
+	announced := make(chan error, 1)
+	go func() { announced <- h.announce(ctx, trackers, port) }()
+
+	ticker := time.NewTicker(stallCheckInterval)
+	defer ticker.Stop()
+	var err, trackerErr error
+	announcing, running, returned := true, true, false
+	// a piece can take longer than the timeout with slow peers, the blocks received are what counts
+	received, since := int64(0), time.Now()
+	for running {
+		select {
+		case err = <-res:
+			running, returned = false, true
+		case <-ctx.Done():
+			err = ctx.Err()
+			running = false
+		case trackerErr = <-announced:
+			// the peers of the trackers get their time to send pieces
+			announcing, since = false, time.Now()
+		case <-ticker.C:
+			if n := t.down.Total(); n != received {
+				received, since = n, time.Now()
+			} else if !announcing && time.Since(since) >= h.stall {
+				err = h.stalled(trackerErr)
+				running = false
+			}
+		}
+	}
+
+	t.Stop()
+	h.cancel()
+	if announcing {
+		<-announced
+	}
+	if !returned {
+		// it fails with ErrStopped, unless the storage failed first
+		if runErr := <-res; !errors.Is(runErr, ErrStopped) && err == nil {
+			err = runErr
+		}
+	}
+	t.Wait()
+	h.err = err
+}
+
+// announce asks the trackers for peers and adds them to the swarm. It fails if every tracker does.
+func (h *Handle) announce(ctx context.Context, trackers []string, port uint16) error {
+	if len(trackers) == 0 {
+		return nil
+	}
+	t := h.t
+	a := &discovery.Announcer{Events: t.Events, Metrics: t.Metrics, Logger: t.Logger}
+	progress := discovery.Progress{Left: h.left()}
+	errs := make(chan error, len(trackers))
+	for _, tr := range trackers {
+		go func(tr string) {
+			peers, err := a.RequestPeers(ctx, tr, progress, t.tf.InfoHash, t.peerID, port)
+			if err != nil {
+				errs <- fmt.Errorf("%s: %s", tr, err)
+				return
+			}
+			t.AddPeers(peers, SourceTracker)
+			errs <- nil
+		}(tr)
+	}
+
+	var failed []string
+	for range trackers {
+		if err := <-errs; err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) == len(trackers) {
+		return fmt.Errorf("all trackers failed: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// left returns how many bytes of the torrent the storage misses.
+func (h *Handle) left() int64 {
+	completed := h.storage.Completed()
+	var left int64
+	for _, pw := range h.t.pk.work {
+		if !completed.HasPiece(pw.index) {
+			left += int64(pw.length)
+		}
+	}
+	return left
+}
+
+// stalled explains why no block was received for the stall timeout.
+func (h *Handle) stalled(trackerErr error) error {
+	t := h.t
+	connected := t.swarm.numConnected()
+	added := t.swarm.numAdded()
+	switch {
+	case len(t.tf.URLList) > 0 || len(t.tf.HTTPSeeds) > 0:
+		return fmt.Errorf("nothing from %d peers and the web seeds in %s", connected, h.stall)
+	case connected > 0:
+		if index := t.unavailable(); index >= 0 {
+			return fmt.Errorf("no peers with piece %d", index)
+		}
+		return fmt.Errorf("nothing from %d peers in %s", connected, h.stall)
+	case added > 0:
+		return fmt.Errorf("could not connect to any of %d peers", added)
+	case trackerErr != nil:
+		return fmt.Errorf("no peers, %s", trackerErr)
+	default:
+		return errors.New("no peers")
+	}
+}
@@ -0,0 +1,278 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/VIVelev/bittorrent/event"
+	"github.com/VIVelev/bittorrent/internal/testtorrent"
+	"github.com/VIVelev/bittorrent/io"
+	"github.com/VIVelev/bittorrent/metrics"
+	"github.com/VIVelev/bittorrent/peer"
+	"github.com/VIVelev/bittorrent/ratelimit"
+	"github.com/VIVelev/bittorrent/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startPartialSeeder seeds the first file of tf from data, it skips the second one.
+func startPartialSeeder(t *testing.T, tf *io.TorrentFile, data []byte) (*Torrent, peer.Peer) {
+	s := storage.NewMemory(tf)
+	copy(s.Bytes(), data[:tf.Files[0].Length])
+	seeder := NewTorrent(tf, [20]byte{2})
+	seeder.Seed = true
+	require.Nil(t, seeder.SetFilePriority(1, PrioritySkip))
+	_, err := seeder.Check(s)
+	require.Nil(t, err)
+	require.Nil(t, seeder.RunWith(s))
+	t.Cleanup(seeder.Stop)
+	return seeder, listen(t, seeder)
+}
+
+// partialTorrent has a first file of 3 pieces and a second one of 1 piece.
+func partialTorrent(t *testing.T) (*io.TorrentFile, []byte) {
+	data := randomData(4 * 16384)
+	files := []testtorrent.File{{Length: 3 * 16384, Path: []string{"a"}}, {Length: 16384, Path: []string{"b"}}}
+	return newTestTorrent(t, "dir", 16384, files, data), data
+}
+
+func TestDownload(t *testing.T) {
+	data := randomData(100000)
+	tf := newTestTorrent(t, "file", 16384, []testtorrent.File{{Length: len(data)}}, data)
+	s := storage.NewMemory(tf)
+	copy(s.Bytes(), data)
+	_, err := NewTorrent(tf, [20]byte{2}).Check(s)
+	require.Nil(t, err)
+	seeder, p := startSeeder(t, tf, s)
+	defer seeder.Stop()
+
+	h := Download(context.Background(), tf, [20]byte{1}, Options{Peers: []peer.Peer{p}, Dialer: testDialer})
+	assert.Nil(t, h.Wait())
+	assert.True(t, bytes.Equal(data, h.Bytes()))
+	done, total := h.Progress()
+	assert.Equal(t, len(tf.PieceHashes), done)
+	assert.Equal(t, len(tf.PieceHashes), total)
+	assert.Equal(t, Stats{Downloaded: int64(len(data))}, h.Stats(), "disconnected once done")
+	h.Stop() // once done is fine
+}
+
+func TestDownloadErrors(t *testing.T) {
+	tf, data := partialTorrent(t)
+	_, partial := startPartialSeeder(t, tf, data)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	closed := peer.Peer{IP: net.IP{127, 0, 0, 1}, Port: uint16(ln.Addr().(*net.TCPAddr).Port)}
+	ln.Close()
+
+	tests := map[string]struct {
+		opts Options
+		err  string
+	}{
+		"no peers":       {err: "no peers"},
+		"trackers":       {opts: Options{Trackers: []string{"http://" + closed.String() + "/announce"}}, err: "no peers, all trackers failed: http://"},
+		"unreachable":    {opts: Options{Peers: []peer.Peer{closed}}, err: "could not connect to any of 1 peers"},
+		"missing piece":  {opts: Options{Peers: []peer.Peer{partial}}, err: "no peers with piece 3"},
+		"invalid scheme": {opts: Options{Trackers: []string{"wss://tracker"}}, err: "all trackers failed: wss://tracker: unsupported scheme: wss"},
+	}
+
+	for name, test := range tests {
+		test.opts.Dialer = testDialer
+		test.opts.StallTimeout = 200 * time.Millisecond
+		h := Download(context.Background(), tf, [20]byte{1}, test.opts)
+		err := h.Wait()
+		require.NotNil(t, err, name)
+		assert.Contains(t, err.Error(), test.err, name)
+		assert.Nil(t, h.Bytes(), name)
+	}
+}
+
+func TestDownloadSlowPiece(t *testing.T) {
+	// a single piece of 8 blocks, received at 4 blocks per second past the first second's worth
+	data := randomData(8 * 16384)
+	tf := newTestTorrent(t, "file", len(data), []testtorrent.File{{Length: len(data)}}, data)
+	s := storage.NewMemory(tf)
+	copy(s.Bytes(), data)
+	_, err := NewTorrent(tf, [20]byte{2}).Check(s)
+	require.Nil(t, err)
+	seeder, p := startSeeder(t, tf, s)
+	defer seeder.Stop()
+
+	dialer := *testDialer
+	down := ratelimit.NewLimiter(4 * 16384)
+	dialer.WrapConn = func(conn net.Conn) net.Conn { return ratelimit.NewConn(conn, down, nil) }
+	h := Download(context.Background(), tf, [20]byte{1}, Options{
+		Peers:        []peer.Peer{p},
+		Dialer:       &dialer,
+		StallTimeout: 500 * time.Millisecond,
+	})
+	assert.Nil(t, h.Wait(), "the piece takes longer than the stall timeout, its blocks do not")
+	assert.True(t, bytes.Equal(data, h.Bytes()))
+}
+
+func TestDownloadStop(t *testing.T) {
+	tf, data := partialTorrent(t)
+	seeder, partial := startPartialSeeder(t, tf, data)
+	before := runtime.NumGoroutine()
+
+	h := Download(context.Background(), tf, [20]byte{1}, Options{Peers: []peer.Peer{partial}, Dialer: testDialer})
+	h.Stop()
+	assert.True(t, errors.Is(h.Wait(), context.Canceled))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h = Download(ctx, tf, [20]byte{1}, Options{Peers: []peer.Peer{partial}, Dialer: testDialer})
+	require.Eventually(t, func() bool { done, _ := h.Progress(); return done == 3 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, h.Stats().Peers)
+	select {
+	case <-h.Done():
+		t.Fatal("the download ended before it was canceled")
+	default:
+	}
+
+	cancel()
+	assert.True(t, errors.Is(h.Wait(), context.Canceled))
+	assert.Empty(t, h.t.conns)
+	assert.Equal(t, 0, h.Stats().Peers)
+	seeder.Stop()
+	seeder.Wait()
+	// not with Eventually, which runs the condition in a goroutine
+	for start := time.Now(); runtime.NumGoroutine() > before && time.Since(start) < time.Second; {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before, "every goroutine ended")
+}
+
+func TestDownloadEvents(t *testing.T) {
+	tf, data := partialTorrent(t)
+	s := storage.NewMemory(tf)
+	copy(s.Bytes(), data)
+	_, err := NewTorrent(tf, [20]byte{2}).Check(s)
+	require.Nil(t, err)
+	seeder, p := startSeeder(t, tf, s)
+	defer seeder.Stop()
+
+	bus := event.NewBus()
+	sub := bus.Subscribe(100, event.Drop)
+	h := Download(context.Background(), tf, [20]byte{1}, Options{
+		Peers:    []peer.Peer{p},
+		Trackers: []string{"wss://tracker"},
+		Dialer:   testDialer,
+		Events:   bus,
+	})
+	require.Nil(t, h.Wait())
+	sub.Close()
+
+	counts := make(map[event.Type]int)
+	var files []int
+	for e := range sub.Events() {
+		assert.Equal(t, tf.InfoHash, e.InfoHash, e.Type)
+		counts[e.Type]++
+		switch e.Type {
+		case event.FileCompleted:
+			files = append(files, e.File)
+		case event.PeerConnected, event.PeerDisconnected:
+			assert.Equal(t, p, e.Peer)
+		case event.TrackerError:
+			assert.Equal(t, "wss://tracker", e.Tracker)
+		}
+	}
+	assert.Equal(t, map[event.Type]int{
+		event.PieceVerified:    4,
+		event.FileCompleted:    2,
+		event.PeerConnected:    1,
+		event.PeerDisconnected: 1,
+		event.TrackerError:     1,
+	}, counts)
+	assert.ElementsMatch(t, []int{0, 1}, files)
+	assert.Equal(t, int64(0), sub.Dropped())
+}
+
+func TestDownloadMetrics(t *testing.T) {
+	tf, data := partialTorrent(t)
+	s := storage.NewMemory(tf)
+	copy(s.Bytes(), data)
+	_, err := NewTorrent(tf, [20]byte{2}).Check(s)
+	require.Nil(t, err)
+	seeds := metrics.NewRegistry()
+	seeder := NewTorrent(tf, [20]byte{2})
+	seeder.Seed = true
+	seeder.Metrics = seeds
+	require.Nil(t, seeder.RunWith(s))
+	defer seeder.Stop()
+	p := listen(t, seeder)
+
+	reg := metrics.NewRegistry()
+	h := Download(context.Background(), tf, [20]byte{1}, Options{
+		Peers:   []peer.Peer{p},
+		Storage: storage.NewMemory(tf),
+		Dialer:  testDialer,
+		Metrics: reg,
+	})
+	require.Nil(t, h.Wait())
+
+	ih := hex.EncodeToString(tf.InfoHash[:])
+	assert.Equal(t, float64(len(data)), reg.Counter("bittorrent_downloaded_bytes_total", "", "info_hash").With(ih).Value())
+	assert.Equal(t, 4.0, reg.Counter("bittorrent_pieces_verified_total", "").With().Value())
+	assert.Equal(t, 0.0, reg.Counter("bittorrent_pieces_failed_total", "").With().Value())
+	assert.Equal(t, 1.0, reg.Counter("bittorrent_peer_dials_total", "", "result").With("connected").Value())
+	assert.Equal(t, uint64(4), reg.Histogram("bittorrent_storage_duration_seconds", "", nil, "op").With("write").Count())
+	// every connection ended
+	assert.Equal(t, 0.0, reg.Gauge("bittorrent_requests_pending", "").With().Value())
+	choke := reg.Gauge("bittorrent_peer_choke_state", "", "state")
+	assert.Equal(t, 0.0, choke.With("choked").Value())
+	assert.Equal(t, 0.0, choke.With("unchoked").Value())
+	assert.Equal(t, 0.0, reg.Gauge("bittorrent_peers_connected", "", "source").With("tracker").Value())
+
+	uploaded := seeds.Counter("bittorrent_uploaded_bytes_total", "", "info_hash").With(ih)
+	assert.Eventually(t, func() bool { return uploaded.Value() == float64(len(data)) }, time.Second, 10*time.Millisecond)
+	var buf bytes.Buffer
+	_, err = reg.WriteTo(&buf)
+	require.Nil(t, err)
+	assert.Contains(t, buf.String(), "bittorrent_downloaded_bytes_total{info_hash=\""+ih+"\"} 65536\n")
+}
+
+func TestBan(t *testing.T) {
+	data := randomData(4 * 16384)
+	tf := newTestTorrent(t, "file", 16384, []testtorrent.File{{Length: len(data)}}, data)
+	// the seeder believes it has every piece, but they are corrupt
+	s := storage.NewMemory(tf)
+	for i := range tf.PieceHashes {
+		require.Nil(t, s.MarkComplete(i))
+	}
+	seeder, p := startSeeder(t, tf, s)
+	defer seeder.Stop()
+
+	bus := event.NewBus()
+	sub := bus.Subscribe(100, event.Drop, event.PieceFailed, event.PeerBanned)
+	h := Download(context.Background(), tf, [20]byte{1}, Options{
+		Peers:        []peer.Peer{p},
+		Dialer:       testDialer,
+		Events:       bus,
+		StallTimeout: 500 * time.Millisecond,
+	})
+	assert.NotNil(t, h.Wait())
+	sub.Close()
+
+	var failed int
+	var banned []event.Event
+	for e := range sub.Events() {
+		if e.Type == event.PieceFailed {
+			failed++
+			assert.Equal(t, p, e.Peer)
+		} else {
+			banned = append(banned, e)
+		}
+	}
+	assert.Equal(t, maxBadPieces, failed)
+	require.Len(t, banned, 1)
+	assert.Equal(t, p, banned[0].Peer)
+	assert.True(t, h.t.swarm.banned[p.IP.String()])
+	st := h.t.Stats()
+	assert.Equal(t, maxBadPieces, st.HashFailures)
+	assert.Equal(t, int64(maxBadPieces*16384), st.Wasted)
+}
@@ -0,0 +1,148 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ftpTimeout bounds a whole FTP session, from the dial to the last byte read.
+const ftpTimeout = 30 * time.Second
+
+// ftpGet reads len(buf) bytes of the file at u starting at offset, over a new FTP session
+// that logs in anonymously unless u has a user. The transfer resumes at offset with REST.
+// reference: https://www.rfc-editor.org/rfc/rfc959, https://www.rfc-editor.org/rfc/rfc3659
+func ftpGet(ctx context.Context, u *url.URL, offset int, buf []byte) error {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "21")
+	}
+	ctx, cancel := context.WithTimeout(ctx, ftpTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	c := textproto.NewConn(conn)
+	defer c.Close()
+
+	// a canceled context interrupts the reads in progress
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	if _, _, err := c.ReadResponse(2); err != nil {
+		return ftpError(u, "greeting", err)
+	}
+	user, pass := "anonymous", "anonymous@"
+	if u.User != nil {
+		user = u.User.Username()
+		if p, ok := u.User.Password(); ok {
+			pass = p
+		}
+	}
+	code, _, err := ftpCmd(c, 2, "USER %s", user)
+	if code == 331 {
+		_, _, err = ftpCmd(c, 2, "PASS %s", pass)
+	}
+	if err != nil {
+		return ftpError(u, "login", err)
+	}
+	if _, _, err := ftpCmd(c, 2, "TYPE I"); err != nil {
+		return ftpError(u, "TYPE", err)
+	}
+
+	dataAddr, err := ftpPassive(c, conn.RemoteAddr().(*net.TCPAddr).IP)
+	if err != nil {
+		return ftpError(u, "passive mode", err)
+	}
+	if offset > 0 {
+		if _, _, err := ftpCmd(c, 3, "REST %d", offset); err != nil {
+			return ftpError(u, "REST", err)
+		}
+	}
+	data, err := d.DialContext(ctx, "tcp", dataAddr)
+	if err != nil {
+		return ftpError(u, "data connection", err)
+	}
+	defer data.Close()
+	data.SetDeadline(deadline)
+
+	// the path is relative to the login directory
+	path := strings.TrimPrefix(u.Path, "/")
+	if _, _, err := ftpCmd(c, 1, "RETR %s", path); err != nil {
+		return ftpError(u, "RETR", err)
+	}
+	if _, err := io.ReadFull(data, buf); err != nil {
+		return fmt.Errorf("read %s: %s", u.Redacted(), err)
+	}
+	// the rest of the file is not needed, closing the sessions aborts the transfer
+	return nil
+}
+
+// ftpCmd sends a command and reads its reply, which must start with expectCode.
+func ftpCmd(c *textproto.Conn, expectCode int, format string, args ...interface{}) (int, string, error) {
+	if _, err := c.Cmd(format, args...); err != nil {
+		return 0, "", err
+	}
+	return c.ReadResponse(expectCode)
+}
+
+// ftpPassive asks the server for the address of a data connection, with EPSV and then PASV.
+// The address of EPSV is on the host of the control connection.
+func ftpPassive(c *textproto.Conn, host net.IP) (string, error) {
+	if _, msg, err := ftpCmd(c, 229, "EPSV"); err == nil {
+		// e.g. "Entering Extended Passive Mode (|||6446|)"
+		start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+		if start < 0 || end < start+4 {
+			return "", fmt.Errorf("malformed EPSV reply %q", msg)
+		}
+		port, err := strconv.Atoi(msg[start+4 : end])
+		if err != nil {
+			return "", fmt.Errorf("malformed EPSV reply %q", msg)
+		}
+		return net.JoinHostPort(host.String(), strconv.Itoa(port)), nil
+	}
+
+	_, msg, err := ftpCmd(c, 227, "PASV")
+	if err != nil {
+		return "", err
+	}
+	// e.g. "Entering Passive Mode (192,168,1,2,25,46)"
+	start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+	if start < 0 || end < start {
+		return "", fmt.Errorf("malformed PASV reply %q", msg)
+	}
+	var b [6]int
+	if n, _ := fmt.Sscanf(msg[start+1:end], "%d,%d,%d,%d,%d,%d", &b[0], &b[1], &b[2], &b[3], &b[4], &b[5]); n != 6 {
+		return "", fmt.Errorf("malformed PASV reply %q", msg)
+	}
+	// the address in the reply is often a private one behind NAT, the host is trusted instead
+	return net.JoinHostPort(host.String(), strconv.Itoa(b[4]<<8|b[5])), nil
+}
+
+// ftpError wraps err of the step, a "421 Service not available" becomes a retryError.
+func ftpError(u *url.URL, step string, err error) error {
+	var te *textproto.Error
+	if errors.As(err, &te) && te.Code == 421 {
+		return &retryError{status: te.Error(), after: MinWebSeedBackoff}
+	}
+	return fmt.Errorf("%s %s: %s", step, u.Redacted(), err)
+}
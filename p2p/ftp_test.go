@@ -0,0 +1,148 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/VIVelev/bittorrent/internal/testtorrent"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ftpServer serves files over FTP, with passive mode and REST only.
+type ftpServer struct {
+	l     net.Listener
+	files map[string][]byte
+	epsv  bool // whether EPSV is supported, PASV always is
+
+	mu    sync.Mutex
+	users []string
+	rests []int
+}
+
+func newFTPServer(t *testing.T, files map[string][]byte, epsv bool) *ftpServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	s := &ftpServer{l: l, files: files, epsv: epsv}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *ftpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprint(conn, "220 ready\r\n")
+
+	var data net.Listener
+	defer func() {
+		if data != nil {
+			data.Close()
+		}
+	}()
+	rest := 0
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, arg := strings.TrimSpace(line), ""
+		if i := strings.IndexByte(cmd, ' '); i >= 0 {
+			cmd, arg = cmd[:i], cmd[i+1:]
+		}
+
+		switch cmd {
+		case "USER":
+			s.mu.Lock()
+			s.users = append(s.users, arg)
+			s.mu.Unlock()
+			fmt.Fprint(conn, "331 password please\r\n")
+		case "PASS":
+			fmt.Fprint(conn, "230 logged in\r\n")
+		case "TYPE":
+			fmt.Fprint(conn, "200 binary\r\n")
+		case "EPSV", "PASV":
+			if cmd == "EPSV" && !s.epsv {
+				fmt.Fprint(conn, "500 unknown command\r\n")
+				continue
+			}
+			if data, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				return
+			}
+			port := data.Addr().(*net.TCPAddr).Port
+			if cmd == "EPSV" {
+				fmt.Fprintf(conn, "229 Entering Extended Passive Mode (|||%d|)\r\n", port)
+			} else {
+				// a private address, as behind NAT
+				fmt.Fprintf(conn, "227 Entering Passive Mode (10,0,0,1,%d,%d)\r\n", port>>8, port&0xff)
+			}
+		case "REST":
+			rest, _ = strconv.Atoi(arg)
+			s.mu.Lock()
+			s.rests = append(s.rests, rest)
+			s.mu.Unlock()
+			fmt.Fprint(conn, "350 restarting\r\n")
+		case "RETR":
+			content, ok := s.files[arg]
+			if !ok || data == nil {
+				fmt.Fprint(conn, "550 no such file\r\n")
+				continue
+			}
+			fmt.Fprint(conn, "150 opening data connection\r\n")
+			dc, err := data.Accept()
+			if err != nil {
+				return
+			}
+			dc.Write(content[rest:])
+			dc.Close()
+			fmt.Fprint(conn, "226 transfer complete\r\n")
+		default:
+			fmt.Fprint(conn, "500 unknown command\r\n")
+		}
+	}
+}
+
+func TestFTPWebSeedDownload(t *testing.T) {
+	data := randomData(100000)
+	tf := newTestTorrent(t, "single.bin", 16384, []testtorrent.File{{Length: len(data)}}, data)
+
+	tests := map[string]struct {
+		epsv bool
+		url  string // of the server, without the scheme and the host
+		user string
+	}{
+		"extended passive": {epsv: true, url: "/pub/", user: "anonymous"},
+		"passive":          {url: "/pub/single.bin", user: "anonymous"},
+		"with user":        {epsv: true, url: "/pub/", user: "me"},
+	}
+
+	for name, test := range tests {
+		s := newFTPServer(t, map[string][]byte{"pub/single.bin": data}, test.epsv)
+		userinfo := ""
+		if test.user != "anonymous" {
+			userinfo = test.user + ":secret@"
+		}
+		tf.URLList = []string{"ftp://" + userinfo + s.l.Addr().String() + test.url}
+		tr := NewTorrent(tf, [20]byte{})
+		assert.True(t, bytes.Equal(data, tr.Run()), name)
+		s.l.Close()
+
+		s.mu.Lock()
+		assert.Contains(t, s.users, test.user, name)
+		assert.Contains(t, s.rests, 16384, name)
+		s.mu.Unlock()
+	}
+}
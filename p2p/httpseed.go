@@ -0,0 +1,103 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/VIVelev/bittorrent/logging"
+)
+
+// maxHTTPSeedAttempts is how many requests are made for a piece before giving up on it.
+// Requests after the first one only ask for the bytes that are still missing.
+const maxHTTPSeedAttempts int = 3
+
+// httpSeed downloads pieces from a seeding script, BEP 17.
+// reference: https://www.bittorrent.org/beps/bep_0017.html
+type httpSeed struct {
+	httpSource
+}
+
+// pieceURL returns the URL that asks for the piece, or the range [begin, end) of it.
+func (hs *httpSeed) pieceURL(index, begin, end, length int) string {
+	q := url.Values{}
+	q.Set("info_hash", string(hs.t.tf.InfoHash[:]))
+	q.Set("piece", strconv.Itoa(index))
+	if begin > 0 || end < length {
+		q.Set("ranges", fmt.Sprintf("%d-%d", begin, end-1))
+	}
+
+	sep := "?"
+	if strings.Contains(hs.url, "?") {
+		sep = "&"
+	}
+	return hs.url + sep + q.Encode()
+}
+
+// downloadPiece fetches the piece, resuming from where a short response ended.
+func (hs *httpSeed) downloadPiece(pw *pieceWork) ([]byte, error) {
+	buf := make([]byte, pw.length)
+	n := 0
+	var err error
+	for attempt := 0; attempt < maxHTTPSeedAttempts && n < pw.length; attempt++ {
+		var read int
+		read, err = hs.get(hs.pieceURL(pw.index, n, pw.length, pw.length), buf[n:])
+		n += read
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, err
+		}
+	}
+	if n < pw.length {
+		return nil, fmt.Errorf("piece %d: %s", pw.index, err)
+	}
+	return buf, nil
+}
+
+// get reads the response to u into buf and returns the number of bytes read.
+func (hs *httpSeed) get(u string, buf []byte) (int, error) {
+	req, err := http.NewRequestWithContext(hs.t.ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := hs.t.httpClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusServiceUnavailable, http.StatusTooManyRequests:
+		// the body of a 503 holds the number of seconds to wait, the Retry-After header wins
+		after := MinWebSeedBackoff
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 32))
+			after = retryAfter(strings.TrimSpace(string(body)))
+		}
+		if value := resp.Header.Get("Retry-After"); value != "" {
+			after = retryAfter(value)
+		}
+		return 0, &retryError{status: resp.Status, after: after}
+	default:
+		return 0, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+
+	n, err := io.ReadFull(resp.Body, buf)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (t *Torrent) startHTTPSeed(u string) {
+	if !isHTTP(u) {
+		t.log.Warn("skipping HTTP seed, only HTTP is supported", logging.String("url", u))
+		return
+	}
+	hs := &httpSeed{httpSource{t: t, url: u}}
+	hs.run(hs.downloadPiece)
+}
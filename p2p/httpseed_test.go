@@ -0,0 +1,132 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VIVelev/bittorrent/internal/testtorrent"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPieceURL(t *testing.T) {
+	tf := newTestTorrent(t, "single.bin", 16, []testtorrent.File{{Length: 10}}, make([]byte, 10))
+	tf.InfoHash = [20]byte{0: 0xAB, 1: '&', 19: 1}
+	hs := &httpSeed{httpSource{t: &Torrent{tf: tf}, url: "http://example.com/seed.php"}}
+	ih := "%AB%26%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%01"
+
+	assert.Equal(t, "http://example.com/seed.php?info_hash="+ih+"&piece=3", hs.pieceURL(3, 0, 16, 16))
+	assert.Equal(t, "http://example.com/seed.php?info_hash="+ih+"&piece=3&ranges=4-15", hs.pieceURL(3, 4, 16, 16))
+
+	hs.url = "http://example.com/seed.php?key=1"
+	assert.Equal(t, "http://example.com/seed.php?key=1&info_hash="+ih+"&piece=0", hs.pieceURL(0, 0, 16, 16))
+}
+
+func TestHTTPSeedDownload(t *testing.T) {
+	data := randomData(50000)
+	pieceLength := 16384
+	tf := newTestTorrent(t, "single.bin", pieceLength, []testtorrent.File{{Length: len(data)}}, data)
+
+	var mu sync.Mutex
+	requests := 0
+	var ranges []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		first := requests == 1
+		mu.Unlock()
+		if first {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, "0")
+			return
+		}
+
+		q := r.URL.Query()
+		if q.Get("info_hash") != string(tf.InfoHash[:]) {
+			http.NotFound(w, r)
+			return
+		}
+		index, err := strconv.Atoi(q.Get("piece"))
+		if err != nil || index*pieceLength >= len(data) {
+			http.Error(w, "bad piece", http.StatusBadRequest)
+			return
+		}
+		end := index*pieceLength + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		piece := data[index*pieceLength : end]
+
+		if rg := q.Get("ranges"); rg != "" {
+			mu.Lock()
+			ranges = append(ranges, rg)
+			mu.Unlock()
+			var begin, last int
+			fmt.Sscanf(rg, "%d-%d", &begin, &last)
+			w.Write(piece[begin : last+1])
+			return
+		}
+		if index == 1 {
+			// the connection breaks halfway through the piece
+			w.Write(piece[:len(piece)/2])
+			return
+		}
+		w.Write(piece)
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	tf.HTTPSeeds = []string{server.URL + "/seed"}
+	tr := NewTorrent(tf, [20]byte{})
+	assert.True(t, bytes.Equal(data, tr.Run()))
+	mu.Lock()
+	assert.Equal(t, []string{"8192-16383"}, ranges)
+	mu.Unlock()
+}
+
+func TestHTTPSeedErrors(t *testing.T) {
+	tests := map[string]struct {
+		status     int
+		retryAfter string
+		body       string
+		after      time.Duration // of the retry error, none when 0
+	}{
+		"unavailable":             {status: http.StatusServiceUnavailable, body: "7", after: 7 * time.Second},
+		"unavailable with header": {status: http.StatusServiceUnavailable, body: "7", retryAfter: "3", after: 3 * time.Second},
+		"too many requests":       {status: http.StatusTooManyRequests, retryAfter: "3", after: 3 * time.Second},
+		"too many, no header":     {status: http.StatusTooManyRequests, after: MinWebSeedBackoff},
+		"not found":               {status: http.StatusNotFound},
+	}
+
+	data := make([]byte, 10)
+	tf := newTestTorrent(t, "single.bin", 16, []testtorrent.File{{Length: len(data)}}, data)
+	for name, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if test.retryAfter != "" {
+				w.Header().Set("Retry-After", test.retryAfter)
+			}
+			w.WriteHeader(test.status)
+			fmt.Fprint(w, test.body)
+		}))
+		hs := &httpSeed{httpSource{t: NewTorrent(tf, [20]byte{}), url: server.URL}}
+		u := hs.pieceURL(0, 4, 10, 10)
+		_, err := hs.get(u, make([]byte, 6))
+		server.Close()
+
+		var re *retryError
+		if test.after == 0 {
+			assert.False(t, errors.As(err, &re), name)
+			assert.Contains(t, err.Error(), u, name)
+			continue
+		}
+		if assert.True(t, errors.As(err, &re), name) {
+			assert.Equal(t, test.after, re.after, name)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/VIVelev/bittorrent/client"
+	"github.com/VIVelev/bittorrent/extension"
+	"github.com/VIVelev/bittorrent/io"
+	"github.com/VIVelev/bittorrent/logging"
+	"github.com/VIVelev/bittorrent/message"
+	"github.com/VIVelev/bittorrent/peer"
+)
+
+// MaxMetadataSize is the largest info dictionary we fetch from peers.
+const MaxMetadataSize int = 8 << 20 // 8MiB
+
+// sendMetadataSize repeats the extension handshake with the size of the metadata,
+// so that the peers that joined from a magnet link can fetch it from us, BEP 9.
+func (pc *peerConn) sendMetadataSize() {
+	info := pc.t.tf.InfoBytes
+	if !pc.Extended || len(info) == 0 {
+		return
+	}
+	h := extension.NewHandshake()
+	h.MetadataSize = len(info)
+	pc.WriteExtensionHandshake(h)
+}
+
+// handleMetadata serves the pieces of the metadata the peer requests.
+func (pc *peerConn) handleMetadata(payload []byte) error {
+	m, _, err := extension.ParseMetadata(payload)
+	if err != nil {
+		return err
+	}
+	if m.Type != extension.MetadataRequest {
+		return nil
+	}
+
+	info := pc.t.tf.InfoBytes
+	begin := m.Piece * extension.MetadataPieceSize
+	reply := extension.MetadataMessage{Type: extension.MetadataReject, Piece: m.Piece}
+	var data []byte
+	if begin < len(info) {
+		end := begin + extension.MetadataPieceSize
+		if end > len(info) {
+			end = len(info)
+		}
+		reply.Type, reply.TotalSize, data = extension.MetadataData, len(info), info[begin:end]
+	}
+	buf, err := extension.MarshalMetadata(reply, data)
+	if err != nil {
+		return err
+	}
+	return pc.WriteExtended(extension.Metadata, buf)
+}
+
+// MetadataFetcher downloads the info dictionary of a torrent known by its info hash only,
+// as from a magnet link, from the peers of its swarm, BEP 9.
+type MetadataFetcher struct {
+	// Dialer connects to peers, client.DefaultDialer is used when nil.
+	Dialer *client.Dialer
+	// Logger receives the failures of the peers at the debug level, none when nil.
+	Logger *logging.Logger
+
+	infoHash [20]byte
+	peerID   [20]byte
+	swarm    *swarm
+	fetched  chan []byte
+
+	connsMu  sync.Mutex
+	conns    map[*client.Client]bool
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// NewMetadataFetcher prepares the download of the metadata of the torrent with infoHash,
+// introducing ourselves with peerID.
+func NewMetadataFetcher(infoHash, peerID [20]byte) *MetadataFetcher {
+	f := &MetadataFetcher{
+		infoHash: infoHash,
+		peerID:   peerID,
+		fetched:  make(chan []byte, 1),
+		conns:    make(map[*client.Client]bool),
+		stopped:  make(chan struct{}),
+	}
+	f.swarm = newSwarm(f.fetchFrom)
+	return f
+}
+
+// AddPeers adds peers learned from src to the swarm. It is safe to call while the fetcher runs.
+func (f *MetadataFetcher) AddPeers(peers []peer.Peer, src Source) {
+	f.swarm.add(peers, src, nil)
+}
+
+// Run connects to the peers until one of them sends metadata that matches the info hash,
+// and returns it parsed. It fails with ErrStopped once Stop is called.
+func (f *MetadataFetcher) Run() (*io.TorrentFile, error) {
+	f.swarm.start()
+	defer f.Stop()
+
+	select {
+	case info := <-f.fetched:
+		tf, err := io.ParseInfo(info)
+		if err != nil {
+			return nil, fmt.Errorf("metadata: %s", err)
+		}
+		return tf, nil
+	case <-f.stopped:
+		return nil, ErrStopped
+	}
+}
+
+// Stop disconnects from every peer, Run returns ErrStopped unless it is done already.
+func (f *MetadataFetcher) Stop() {
+	f.stopOnce.Do(func() {
+		f.connsMu.Lock()
+		close(f.stopped)
+		for c := range f.conns {
+			c.Conn.Close()
+		}
+		f.connsMu.Unlock()
+		f.swarm.stop()
+	})
+}
+
+func (f *MetadataFetcher) fetchFrom(cand candidate) {
+	defer f.swarm.drop(cand)
+
+	d := client.DefaultDialer
+	if f.Dialer != nil {
+		d = f.Dialer
+	}
+	// the number of pieces is unknown until we have the metadata
+	c, err := d.Dial(cand.peer, f.infoHash, f.peerID, 0)
+	if err != nil {
+		f.Logger.Debug("could not handshake", logging.InfoHash(f.infoHash), logging.Peer(cand.peer), logging.Err(err))
+		return
+	}
+	defer c.Conn.Close()
+
+	f.connsMu.Lock()
+	select {
+	case <-f.stopped:
+		f.connsMu.Unlock()
+		return
+	default:
+	}
+	f.conns[c] = true
+	f.connsMu.Unlock()
+	defer func() {
+		f.connsMu.Lock()
+		delete(f.conns, c)
+		f.connsMu.Unlock()
+	}()
+
+	info, err := f.fetch(c)
+	if err != nil {
+		f.Logger.Debug("could not fetch metadata", logging.InfoHash(f.infoHash), logging.Peer(cand.peer), logging.Err(err))
+		return
+	}
+	select {
+	case f.fetched <- info:
+	default:
+		// another peer was faster
+	}
+}
+
+// fetch requests every piece of the metadata from the peer and verifies them against the info hash.
+func (f *MetadataFetcher) fetch(c *client.Client) ([]byte, error) {
+	if !c.Extended {
+		return nil, errors.New("no extension protocol")
+	}
+	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer c.Conn.SetDeadline(time.Time{}) // disable the deadline
+
+	var info []byte
+	var received []bool
+	remaining := -1 // until the peer tells the size
+	for remaining != 0 {
+		msg, err := c.Read()
+		if err != nil {
+			return nil, fmt.Errorf("read message: %s", err)
+		}
+		if msg == nil || msg.ID != message.MsgExtended {
+			continue
+		}
+		id, payload, err := message.ParseExtended(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		switch int(id) {
+		case int(extension.HandshakeID):
+			if err := c.ReadExtensionHandshake(payload); err != nil {
+				return nil, fmt.Errorf("extension handshake: %s", err)
+			}
+			if info != nil {
+				continue
+			}
+			if !c.SupportsExtension(extension.Metadata) {
+				return nil, errors.New("no metadata exchange")
+			}
+			if c.MetadataSize <= 0 {
+				// a later handshake may tell the size once the peer has the metadata
+				continue
+			}
+			if c.MetadataSize > MaxMetadataSize {
+				return nil, fmt.Errorf("metadata of %d bytes is too large", c.MetadataSize)
+			}
+			info = make([]byte, c.MetadataSize)
+			remaining = extension.NumMetadataPieces(c.MetadataSize)
+			received = make([]bool, remaining)
+			for i := 0; i < remaining; i++ {
+				req, err := extension.MarshalMetadata(extension.MetadataMessage{Type: extension.MetadataRequest, Piece: i}, nil)
+				if err != nil {
+					return nil, err
+				}
+				if err := c.WriteExtended(extension.Metadata, req); err != nil {
+					return nil, fmt.Errorf("write request: %s", err)
+				}
+			}
+		case extension.Local[extension.Metadata]:
+			if info == nil {
+				continue
+			}
+			m, data, err := extension.ParseMetadata(payload)
+			if err != nil {
+				return nil, err
+			}
+			if m.Type == extension.MetadataReject {
+				return nil, fmt.Errorf("piece %d of the metadata was rejected", m.Piece)
+			}
+			if m.Type != extension.MetadataData || m.Piece >= len(received) || received[m.Piece] {
+				continue
+			}
+			begin := m.Piece * extension.MetadataPieceSize
+			length := len(info) - begin
+			if length > extension.MetadataPieceSize {
+				length = extension.MetadataPieceSize
+			}
+			if len(data) != length {
+				return nil, fmt.Errorf("piece %d of the metadata has %d bytes, expected %d", m.Piece, len(data), length)
+			}
+			copy(info[begin:], data)
+			received[m.Piece] = true
+			remaining--
+		}
+	}
+
+	hash := sha1.Sum(info)
+	if !bytes.Equal(hash[:], f.infoHash[:]) {
+		return nil, errors.New("metadata does not match the info hash")
+	}
+	return info, nil
+}
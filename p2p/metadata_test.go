@@ -0,0 +1,66 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/VIVelev/bittorrent/internal/testtorrent"
+	"github.com/VIVelev/bittorrent/io"
+	"github.com/VIVelev/bittorrent/peer"
+	"github.com/VIVelev/bittorrent/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataFetcher(t *testing.T) {
+	// more than one piece of metadata
+	data := randomData(1000 * 1024)
+	tf := newTestTorrent(t, "file", 1024, []testtorrent.File{{Length: len(data)}}, data)
+	require.Greater(t, len(tf.InfoBytes), 16384)
+	seeder, p := startSeeder(t, tf, completeStorage(t, tf, data))
+	defer seeder.Stop()
+
+	f := NewMetadataFetcher(tf.InfoHash, [20]byte{1})
+	f.Dialer = testDialer
+	f.AddPeers([]peer.Peer{p}, SourceTracker)
+	got, err := f.Run()
+	require.Nil(t, err)
+	assert.Equal(t, tf.InfoHash, got.InfoHash)
+	assert.Equal(t, tf.PieceHashes, got.PieceHashes)
+	assert.Equal(t, tf.InfoBytes, got.InfoBytes)
+}
+
+func TestMetadataFetcherMismatch(t *testing.T) {
+	data := randomData(100)
+	tf := newTestTorrent(t, "file", 32, []testtorrent.File{{Length: len(data)}}, data)
+	seeder, p := startSeeder(t, tf, completeStorage(t, tf, data))
+	defer seeder.Stop()
+
+	// the seeder serves metadata of another torrent
+	f := NewMetadataFetcher([20]byte{9}, [20]byte{1})
+	f.Dialer = testDialer
+	f.AddPeers([]peer.Peer{p}, SourceTracker)
+	res := make(chan error)
+	go func() {
+		_, err := f.Run()
+		res <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	f.Stop()
+	select {
+	case err := <-res:
+		assert.Equal(t, ErrStopped, err)
+	case <-time.After(time.Second):
+		t.Fatal("fetcher did not stop")
+	}
+}
+
+// completeStorage returns a storage that has every piece of tf.
+func completeStorage(t *testing.T, tf *io.TorrentFile, data []byte) *storage.Memory {
+	s := storage.NewMemory(tf)
+	copy(s.Bytes(), data)
+	for i := range tf.PieceHashes {
+		require.Nil(t, s.MarkComplete(i))
+	}
+	return s
+}
@@ -0,0 +1,60 @@
+package p2p
+
+import (
+	"encoding/hex"
+
+	"github.com/VIVelev/bittorrent/metrics"
+)
+
+// torrentMetrics are updated by a running torrent, see Torrent.Metrics.
+// They are shared by the torrents of a registry, except for the bytes.
+type torrentMetrics struct {
+	downloaded *metrics.Counter
+	uploaded   *metrics.Counter
+	verified   *metrics.Counter
+	failed     *metrics.Counter
+	requests   *metrics.Gauge    // blocks requested and not received yet
+	peers      *metrics.GaugeVec // established connections by source
+	choked     *metrics.Gauge    // connections the peer chokes
+	unchoked   *metrics.Gauge
+}
+
+// the counters of the bytes by torrent, see DeleteMetrics
+func downloadedBytes(r *metrics.Registry) *metrics.CounterVec {
+	return r.Counter("bittorrent_downloaded_bytes_total", "Bytes of the verified pieces stored by torrent.", "info_hash")
+}
+
+func uploadedBytes(r *metrics.Registry) *metrics.CounterVec {
+	return r.Counter("bittorrent_uploaded_bytes_total", "Bytes of the blocks served to peers by torrent.", "info_hash")
+}
+
+func newTorrentMetrics(r *metrics.Registry, infoHash [20]byte) *torrentMetrics {
+	ih := hex.EncodeToString(infoHash[:])
+	choke := r.Gauge("bittorrent_peer_choke_state", "Connections to peers by whether the peer chokes us.", "state")
+	return &torrentMetrics{
+		downloaded: downloadedBytes(r).With(ih),
+		uploaded:   uploadedBytes(r).With(ih),
+		verified:   r.Counter("bittorrent_pieces_verified_total", "Pieces that passed verification and were stored.").With(),
+		failed:     r.Counter("bittorrent_pieces_failed_total", "Pieces that failed verification.").With(),
+		requests:   r.Gauge("bittorrent_requests_pending", "Block requests sent to peers and not answered yet.").With(),
+		peers:      r.Gauge("bittorrent_peers_connected", "Connections to peers by where the peers were learned from.", "source"),
+		choked:     choke.With("choked"),
+		unchoked:   choke.With("unchoked"),
+	}
+}
+
+// chokeState returns the gauge of the connections in the given choke state.
+func (m *torrentMetrics) chokeState(choked bool) *metrics.Gauge {
+	if choked {
+		return m.choked
+	}
+	return m.unchoked
+}
+
+// DeleteMetrics forgets the metrics of the torrent with the given info hash in r, to be called
+// once it is stopped for good so that the series of removed torrents do not pile up.
+func DeleteMetrics(r *metrics.Registry, infoHash [20]byte) {
+	ih := hex.EncodeToString(infoHash[:])
+	downloadedBytes(r).Delete(ih)
+	uploadedBytes(r).Delete(ih)
+}
@@ -2,16 +2,25 @@ package p2p
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"errors"
 	"fmt"
-	"log"
-	"runtime"
+	"net/http"
+	"sync"
 	"time"
 
+	"github.com/VIVelev/bittorrent/bitfield"
 	"github.com/VIVelev/bittorrent/client"
+	"github.com/VIVelev/bittorrent/event"
 	"github.com/VIVelev/bittorrent/io"
+	"github.com/VIVelev/bittorrent/logging"
+	"github.com/VIVelev/bittorrent/merkle"
 	"github.com/VIVelev/bittorrent/message"
+	"github.com/VIVelev/bittorrent/metrics"
 	"github.com/VIVelev/bittorrent/peer"
+	"github.com/VIVelev/bittorrent/ratelimit"
+	"github.com/VIVelev/bittorrent/storage"
 )
 
 const (
@@ -21,81 +30,251 @@ const (
 	MaxBlockSize int = 16384 // 16KiB
 )
 
+// maxBadPieces is how many pieces that fail verification a peer may send before it is banned.
+const maxBadPieces int = 3
+
+// ErrStopped is returned by the downloads of a stopped torrent.
+var ErrStopped = errors.New("torrent stopped")
+
 type pieceWork struct {
 	index    int
+	offset   int // within the contents of the torrent
 	length   int
 	checksum [20]byte
+	// location in the file tree of pieces with v2 hashes, file is -1 for the others
+	file      int
+	filePiece int
 }
 
 type downloadedPiece struct {
 	index int
-	data  []byte
+	err   error // of the storage, which ends the download
 }
 
-func attemptDownloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
-	// backloged requests to peer
-	// requested bytes from peer
-	// downloaded bytes from peer
-	var backloged, requested, downloaded int
-	// store the bytes in-memory
-	buf := make([]byte, pw.length)
+type blockState uint8
 
-	// setting a deadline helps get unresponsive peers unstuck
-	// 30 seconds is more than enough to download a 262kB piece
-	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer c.Conn.SetDeadline(time.Time{}) // disable the deadline
-
-	for downloaded < pw.length {
-		if !c.Choked {
-			// make at most MaxBacklog requests
-			for backloged < MaxBacklog && requested < pw.length {
-				blockSize := MaxBlockSize
-				// the last block may have less than MaxBlockSize bytes
-				if val := pw.length - requested; val < MaxBlockSize {
-					blockSize = val
-				}
-
-				if err := c.WriteRequest(pw.index, requested, blockSize); err != nil {
-					return nil, fmt.Errorf("write request: %s", err)
-				}
-
-				backloged++
-				requested += blockSize
-			}
+const (
+	blockMissing blockState = iota
+	blockRequested
+	blockReceived
+)
+
+// pieceProgress tracks the blocks of a piece while it is being downloaded.
+type pieceProgress struct {
+	pw         *pieceWork
+	data       [][]byte // of the received blocks that are not stored yet
+	blocks     []blockState
+	backloged  int // unfulfilled requests to peer
+	downloaded int // downloaded bytes from peer
+
+	// v2 blocks are verified one by one once the peer sent their hashes, and stored right away
+	hashReq   *message.HashRequest // unanswered
+	firstLeaf int                  // of the piece among the requested hashes
+	leaves    []merkle.Hash
+	badBlocks int
+
+	log *logging.Logger // of the connection
+}
+
+func newPieceProgress(pw *pieceWork) *pieceProgress {
+	n := (pw.length + MaxBlockSize - 1) / MaxBlockSize
+	return &pieceProgress{
+		pw:     pw,
+		data:   make([][]byte, n),
+		blocks: make([]blockState, n),
+	}
+}
+
+// blockBounds returns the offset and size of block i.
+func (state *pieceProgress) blockBounds(i int) (int, int) {
+	begin := i * MaxBlockSize
+	// the last block may have less than MaxBlockSize bytes
+	size := MaxBlockSize
+	if val := state.pw.length - begin; val < MaxBlockSize {
+		size = val
+	}
+	return begin, size
+}
+
+// requestBlocks makes at most MaxBacklog requests for missing blocks.
+func (state *pieceProgress) requestBlocks(c *client.Client) error {
+	for i := 0; i < len(state.blocks) && state.backloged < MaxBacklog; i++ {
+		if state.blocks[i] != blockMissing {
+			continue
 		}
+		begin, size := state.blockBounds(i)
+		if err := c.WriteRequest(state.pw.index, begin, size); err != nil {
+			return fmt.Errorf("write request: %s", err)
+		}
+		state.blocks[i] = blockRequested
+		state.backloged++
+	}
+	return nil
+}
+
+// release marks the requested block at begin as missing again.
+func (state *pieceProgress) release(begin int) {
+	i := begin / MaxBlockSize
+	if begin%MaxBlockSize != 0 || i >= len(state.blocks) || state.blocks[i] != blockRequested {
+		return
+	}
+	state.blocks[i] = blockMissing
+	state.backloged--
+}
+
+// releaseAll marks every requested block as missing again.
+func (state *pieceProgress) releaseAll() {
+	for i := range state.blocks {
+		if state.blocks[i] == blockRequested {
+			state.blocks[i] = blockMissing
+		}
+	}
+	state.backloged = 0
+}
 
-		msg, err := c.Read()
+func (state *pieceProgress) readMessage(pc *peerConn) error {
+	msg, err := pc.Read()
+	if err != nil {
+		return fmt.Errorf("read message: %s", err)
+	}
+
+	if msg == nil {
+		// keep-alive message
+		return nil
+	}
+
+	switch msg.ID {
+	case message.MsgChoke:
+		pc.setChoked(true)
+		if !pc.Fast {
+			// without the Fast Extension a choke discards all pending requests
+			state.releaseAll()
+		}
+	case message.MsgPiece:
+		index, begin, data, err := message.ParsePieceData(msg)
+		if err != nil {
+			return fmt.Errorf("parse piece: %s", err)
+		}
+		i := begin / MaxBlockSize
+		if index != state.pw.index || begin%MaxBlockSize != 0 || i >= len(state.blocks) {
+			return fmt.Errorf("parse piece: unexpected block at %d of piece %d", begin, index)
+		}
+		n := len(data)
+		if _, size := state.blockBounds(i); n != size {
+			return fmt.Errorf("parse piece: expected %d bytes at %d of piece %d, got %d", size, begin, index, n)
+		}
+		pc.t.received(pc, n)
+		if state.blocks[i] == blockRequested {
+			state.backloged--
+		}
+		if state.blocks[i] == blockReceived {
+			pc.t.waste(n, false)
+			break
+		}
+		if !state.verifyBlock(i, data) {
+			state.log.Warn("block failed integrity check", logging.Piece(state.pw.index), logging.Int("begin", begin))
+			pc.t.waste(n, false)
+			state.blocks[i] = blockMissing
+			if state.badBlocks++; state.badBlocks > maxBadBlocks {
+				return fmt.Errorf("%d blocks of piece %d failed integrity check", state.badBlocks, state.pw.index)
+			}
+			break
+		}
+		state.blocks[i] = blockReceived
+		state.downloaded += n
+		if err := state.keep(pc.t, i, data); err != nil {
+			return err
+		}
+	case message.MsgReject:
+		index, begin, _, err := message.ParseReject(msg)
 		if err != nil {
-			return nil, fmt.Errorf("read message: %s", err)
+			return err
 		}
+		if index == state.pw.index {
+			state.release(begin)
+		}
+	case message.MsgHashes, message.MsgHashReject:
+		return state.readHashes(pc, msg)
+	default:
+		return pc.handleMessage(msg)
+	}
+	return nil
+}
 
-		if msg == nil {
-			// keep-alive message
-			continue
+// keep stores block i once it is verified against its leaf hash, and holds it until then.
+func (state *pieceProgress) keep(t *Torrent, i int, data []byte) error {
+	if !state.verified() {
+		state.data[i] = data
+		return nil
+	}
+	state.data[i] = nil
+	begin, _ := state.blockBounds(i)
+	return t.writeBlock(state.pw, begin, data)
+}
+
+// piece returns the contents of the piece from the blocks that are not stored yet.
+func (state *pieceProgress) piece() []byte {
+	buf := make([]byte, state.pw.length)
+	for i, data := range state.data {
+		begin, _ := state.blockBounds(i)
+		copy(buf[begin:], data)
+	}
+	return buf
+}
+
+// attemptDownloadPiece downloads a piece from the peer. Once its blocks were verified they are
+// stored already, and nil is returned in place of its contents.
+func attemptDownloadPiece(pc *peerConn, pw *pieceWork) ([]byte, bool, error) {
+	state := newPieceProgress(pw)
+	state.log = pc.log
+
+	// setting a deadline helps get unresponsive peers unstuck
+	// 30 seconds is more than enough to download a 262kB piece
+	pc.Conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer pc.Conn.SetDeadline(time.Time{}) // disable the deadline
+
+	if err := state.requestHashes(pc); err != nil {
+		return nil, false, err
+	}
+
+	// the requests of the piece count towards the queue depth until it returns
+	requests, pending := pc.t.m.requests, 0
+	defer func() {
+		requests.Add(float64(-pending))
+		pc.stats.update(func(s *connStats) { s.pending = 0 })
+	}()
+	count := func() {
+		if state.backloged == pending {
+			return
 		}
+		requests.Add(float64(state.backloged - pending))
+		pending = state.backloged
+		pc.stats.update(func(s *connStats) { s.pending = pending })
+	}
 
-		switch msg.ID {
-		case message.MsgChoke:
-			c.Choked = true
-		case message.MsgUnchoke:
-			c.Choked = false
-		case message.MsgHave:
-			index, err := message.ParseHave(msg)
-			if err != nil {
-				return nil, err
-			}
-			c.Bitfield.SetPiece(index)
-		case message.MsgPiece:
-			n, err := message.ParsePiece(msg, pw.index, buf)
+	// wait for the hashes too, to accept the blocks one by one
+	for state.downloaded < pw.length || state.hashReq != nil {
+		if pc.CanRequest(pw.index) {
+			err := state.requestBlocks(pc.Client)
+			count()
 			if err != nil {
-				return nil, fmt.Errorf("parse piece: %s", err)
+				return nil, false, err
 			}
-			backloged--
-			downloaded += n
 		}
+
+		err := state.readMessage(pc)
+		count()
+		if err != nil {
+			return nil, false, err
+		}
+		pc.sendPEX()
+		pc.sendHaves()
 	}
 
-	return buf, nil
+	if state.verified() {
+		return nil, true, nil
+	}
+	return state.piece(), false, nil
 }
 
 func checkIntegrity(pw *pieceWork, buf []byte) bool {
@@ -103,90 +282,626 @@ func checkIntegrity(pw *pieceWork, buf []byte) bool {
 	return bytes.Equal(hash[:], pw.checksum[:])
 }
 
-func startDownloadWorker(p peer.Peer, infoHash, peerID [20]byte, workQ chan *pieceWork, piecesQ chan *downloadedPiece) {
-	c, err := client.New(p, infoHash, peerID)
+// Torrent is the download of a torrent from a swarm of peers.
+type Torrent struct {
+	// Dialer connects to peers, client.DefaultDialer is used when nil.
+	Dialer *client.Dialer
+	// HTTPClient downloads from web seeds, http.DefaultClient is used when nil.
+	HTTPClient *http.Client
+	// Seed keeps the connections open once every wanted piece is downloaded,
+	// to upload to the peers until Stop.
+	Seed bool
+	// MaxPeers is how many peers are connected to at once, the MaxPeers constant when 0.
+	MaxPeers int
+	// Events receives what happens to the pieces, the files and the peers of the torrent,
+	// none when nil. The outgoing connections are published by the Dialer.
+	Events *event.Bus
+	// Metrics receives the bytes, the pieces, the requests and the peers of the torrent once
+	// it runs, none when nil. The dials are recorded by the Dialer.
+	Metrics *metrics.Registry
+	// Logger receives what the torrent does once it runs, with its info hash, none when nil.
+	Logger *logging.Logger
+
+	tf      *io.TorrentFile
+	peerID  [20]byte
+	pk      *picker
+	swarm   *swarm
+	piecesQ chan *downloadedPiece
+	storage storage.Storage
+	m       *torrentMetrics // of Metrics once RunWith is called
+	log     *logging.Logger // Logger with the info hash once RunWith is called
+
+	filesMu        sync.Mutex
+	filePriorities []Priority
+	fileRemaining  []int         // pieces of every file that are not stored, see FileCompleted
+	changed        chan struct{} // wakes Run up when the priorities change
+
+	treesMu   sync.Mutex
+	trees     map[merkle.Hash]*merkle.Tree // by pieces root, served to v2 peers
+	fullTrees map[merkle.Hash]*merkle.Tree // of the complete files, down to the leaves
+
+	connsMu  sync.Mutex
+	conns    map[*peerConn]bool // their bitfields are updated with connsMu held
+	stopped  chan struct{}
+	stopOnce sync.Once
+	ctx      context.Context // of the HTTP requests, canceled by Stop
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup // of the web and HTTP seeds, see spawn
+
+	statsMu      sync.Mutex
+	downloaded   int64 // bytes of the verified pieces stored
+	uploaded     int64 // bytes of the blocks served
+	lastUpload   time.Time
+	wasted       int64 // see TorrentStats
+	hashFailures int
+	down, up     *ratelimit.Meter // of the blocks received and served
+}
+
+// newWork lays out the pieces of tf.
+func newWork(tf *io.TorrentFile) []*pieceWork {
+	if !tf.IsV1() {
+		return v2Work(tf)
+	}
+	totalPieces := len(tf.PieceHashes)
+	work := make([]*pieceWork, totalPieces)
+	for i, hash := range tf.PieceHashes {
+		length := tf.PieceLength
+		if i == totalPieces-1 {
+			length = tf.Length - tf.PieceLength*i
+		}
+		work[i] = &pieceWork{index: i, offset: i * tf.PieceLength, length: length, checksum: hash}
+		locateV2(tf, work[i])
+	}
+	return work
+}
+
+// FilesCompleted returns how many bytes of every file of tf the pieces in completed hold.
+func FilesCompleted(tf *io.TorrentFile, completed bitfield.Bitfield) []int64 {
+	ret := make([]int64, tf.NumFiles())
+	for _, pw := range newWork(tf) {
+		if !completed.HasPiece(pw.index) {
+			continue
+		}
+		for _, s := range tf.Spans(pw.offset, pw.length) {
+			ret[s.File] += int64(s.Length)
+		}
+	}
+	return ret
+}
+
+// NewTorrent prepares the download of tf, introducing ourselves with peerID.
+func NewTorrent(tf *io.TorrentFile, peerID [20]byte) *Torrent {
+	work := newWork(tf)
+	t := &Torrent{
+		tf:     tf,
+		peerID: peerID,
+		pk:     newPicker(work),
+		// every piece is stored once, workers never wait for Run
+		piecesQ:        make(chan *downloadedPiece, len(work)),
+		filePriorities: make([]Priority, tf.NumFiles()),
+		changed:        make(chan struct{}, 1),
+		conns:          make(map[*peerConn]bool),
+		stopped:        make(chan struct{}),
+		m:              newTorrentMetrics(nil, tf.InfoHash),
+		down:           ratelimit.NewMeter(ratelimit.DefaultWindow),
+		up:             ratelimit.NewMeter(ratelimit.DefaultWindow),
+	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	for i := range t.filePriorities {
+		t.filePriorities[i] = PriorityNormal
+	}
+	t.swarm = newSwarm(t.startDownloadWorker)
+	return t
+}
+
+// TorrentFile returns the metadata of the torrent.
+func (t *Torrent) TorrentFile() *io.TorrentFile {
+	return t.tf
+}
+
+// NumPieces returns the number of pieces of the torrent.
+func (t *Torrent) NumPieces() int {
+	return len(t.pk.work)
+}
+
+// AddPeers adds peers learned from src to the swarm. It is safe to call while the download runs.
+func (t *Torrent) AddPeers(peers []peer.Peer, src Source) {
+	t.swarm.add(peers, src, nil)
+}
+
+// Peers lists the peers the torrent is connected to.
+func (t *Torrent) Peers() []PeerInfo {
+	return t.swarm.peers()
+}
+
+// AddConn takes over a connection that p opened to us, see client.AcceptHave.
+// The connection is closed when the torrent is not running or has no free slot.
+func (t *Torrent) AddConn(c *client.Client, p peer.Peer) {
+	cand := candidate{peer: p, source: SourceIncoming}
+	run := func() {
+		t.publish(event.Event{Type: event.PeerConnected, Peer: p})
+		t.runConn(newPeerConn(c, t, p))
+	}
+	if !t.swarm.accept(cand, run) {
+		c.Conn.Close()
+		return
+	}
+	t.log.Debug("accepted connection", logging.Peer(p))
+}
+
+// Completed returns the bitfield of the pieces we have, empty until the torrent runs.
+func (t *Torrent) Completed() bitfield.Bitfield {
+	t.filesMu.Lock()
+	s := t.storage
+	t.filesMu.Unlock()
+	if s == nil {
+		return bitfield.New(len(t.pk.work))
+	}
+	return s.Completed()
+}
+
+// Downloaded returns how many bytes of verified pieces the torrent downloaded so far.
+func (t *Torrent) Downloaded() int64 {
+	t.statsMu.Lock()
+	defer t.statsMu.Unlock()
+
+	return t.downloaded
+}
+
+// Uploaded returns how many bytes of pieces the torrent served to peers so far.
+func (t *Torrent) Uploaded() int64 {
+	t.statsMu.Lock()
+	defer t.statsMu.Unlock()
+
+	return t.uploaded
+}
+
+// LastUpload returns when a block was last served to a peer, zero if never.
+func (t *Torrent) LastUpload() time.Time {
+	t.statsMu.Lock()
+	defer t.statsMu.Unlock()
+
+	return t.lastUpload
+}
+
+// Stop disconnects from every peer and ends the download, RunWith returns ErrStopped.
+// The storage is left open. A stopped torrent cannot run again.
+// Its goroutines end shortly after, a dial in progress within the timeout of the Dialer.
+func (t *Torrent) Stop() {
+	t.stopOnce.Do(func() {
+		t.connsMu.Lock()
+		close(t.stopped)
+		for pc := range t.conns {
+			pc.Conn.Close()
+		}
+		t.connsMu.Unlock()
+		t.cancel()
+		t.swarm.stop()
+		t.pk.stop()
+	})
+}
+
+// Wait blocks until every goroutine of a stopped torrent ended, the connections to its peers
+// included. Its storage is not used anymore once it returns.
+func (t *Torrent) Wait() {
+	t.swarm.wait()
+	t.wg.Wait()
+}
+
+// spawn runs f in a goroutine that wait waits for, unless the torrent is stopped.
+func (t *Torrent) spawn(f func()) {
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+
+	select {
+	case <-t.stopped:
+		return
+	default:
+	}
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		f()
+	}()
+}
+
+// unavailable returns a wanted piece that is not done and that no connected peer has, or -1.
+func (t *Torrent) unavailable() int {
+	missing := t.pk.missing()
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+
+	for _, index := range missing {
+		found := false
+		for pc := range t.conns {
+			if pc.Bitfield.HasPiece(index) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return index
+		}
+	}
+	return -1
+}
+
+// track records an open connection so that Stop closes it. It fails once the torrent stopped.
+func (t *Torrent) track(pc *peerConn) bool {
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+
+	select {
+	case <-t.stopped:
+		return false
+	default:
+	}
+	t.conns[pc] = true
+	return true
+}
+
+func (t *Torrent) untrack(pc *peerConn) {
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+
+	delete(t.conns, pc)
+}
+
+func (t *Torrent) dialer() *client.Dialer {
+	d := client.DefaultDialer
+	if t.Dialer != nil {
+		d = t.Dialer
+	}
+	if t.tf.IsV2() && !d.V2 || t.Events != nil && d.Events == nil || t.Metrics != nil && d.Metrics == nil ||
+		t.Logger != nil && d.Logger == nil {
+		own := *d
+		own.V2 = own.V2 || t.tf.IsV2()
+		if own.Events == nil {
+			own.Events = t.Events
+		}
+		if own.Metrics == nil {
+			own.Metrics = t.Metrics
+		}
+		if own.Logger == nil {
+			own.Logger = t.log
+		}
+		return &own
+	}
+	return d
+}
+
+// publish hands an event about the torrent over to Events.
+func (t *Torrent) publish(e event.Event) {
+	e.InfoHash = t.tf.InfoHash
+	t.Events.Publish(e)
+}
+
+func (t *Torrent) httpClient() *http.Client {
+	if t.HTTPClient != nil {
+		return t.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (t *Torrent) startDownloadWorker(cand candidate) {
+	p := cand.peer
+	c, err := t.dialer().DialHave(p, t.tf.InfoHash, t.peerID, len(t.pk.work), t.Completed())
 	if err != nil {
-		log.Printf("Could not handshake with %s. Error: %s. Disconnecting.\n", p, err)
+		t.log.Debug("could not handshake", logging.Peer(p), logging.Err(err))
+		return
+	}
+	t.log.Debug("completed handshake", logging.Peer(p), logging.String("source", cand.source.String()))
+
+	pc := newPeerConn(c, t, p)
+	t.swarm.establish(cand, pc.flags())
+	t.runConn(pc)
+}
+
+// runConn downloads the wanted pieces the peer has, then keeps serving it when seeding.
+// It returns once the connection is closed.
+func (t *Torrent) runConn(pc *peerConn) {
+	c := pc.Client
+	var reason error // of the disconnection
+	defer func() {
+		c.Conn.Close()
+		t.publish(event.Event{Type: event.PeerDisconnected, Peer: pc.peer, Err: reason})
+	}()
+	if !t.track(pc) {
+		reason = ErrStopped
 		return
 	}
-	log.Printf("Completed handshake with %s.\n", p)
-	defer c.Conn.Close()
+	defer t.untrack(pc)
+	t.m.chokeState(pc.Choked).Inc()
+	defer func() { t.m.chokeState(pc.Choked).Dec() }()
 
+	pc.sendMetadataSize()
+	pc.sendAllowedFast()
 	c.WriteUnchoke()
-	c.WriteInterested()
+	interested := !t.pk.finished()
+	if interested {
+		pc.setInterested(true)
+	}
 
-	for pw := range workQ {
-		if !c.Bitfield.HasPiece(pw.index) {
-			workQ <- pw // put back in the queue
+	badPieces := 0
+	for {
+		pw, wake := t.pk.tryNext(pc)
+		if pw == nil && wake == nil {
+			break
+		}
+		if pw == nil {
+			// the peer has nothing we need for now, keep up with what it gets meanwhile
+			if err := pc.idle(wake); err != nil {
+				pc.log.Debug("disconnecting", logging.Err(err))
+				reason = err
+				return
+			}
 			continue
 		}
 
-		buf, err := attemptDownloadPiece(c, pw)
+		buf, verified, err := attemptDownloadPiece(pc, pw)
+		if err == nil && !verified && t.needsLeaves(pw) {
+			err = fmt.Errorf("no hashes for the blocks of piece %d", pw.index)
+		}
 		if err != nil {
 			// this peer does not want to talk ;(
-			log.Println("Exiting.", err)
-			workQ <- pw // put back in the queue
+			pc.log.Debug("disconnecting", logging.Err(err))
+			t.pk.putBack(pw)
+			reason = err
 			return
 		}
 
-		if !checkIntegrity(pw, buf) {
-			log.Printf("Piece %d failed integrity check.\n", pw.index)
-			workQ <- pw // put back in the queue
+		if !verified {
+			t.tf.ZeroPadding(pw.offset, buf)
+		}
+		if !verified && !t.verify(pw, buf) {
+			pc.log.Warn("piece failed integrity check", logging.Piece(pw.index))
+			t.pk.putBack(pw)
+			err := fmt.Errorf("piece %d failed integrity check", pw.index)
+			t.waste(pw.length, true)
+			t.m.failed.Inc()
+			t.publish(event.Event{Type: event.PieceFailed, Piece: pw.index, Peer: pc.peer, Err: err})
+			if badPieces++; badPieces >= maxBadPieces {
+				reason = fmt.Errorf("%d pieces failed integrity check", badPieces)
+				t.swarm.ban(pc.peer)
+				t.publish(event.Event{Type: event.PeerBanned, Peer: pc.peer, Err: reason})
+				return
+			}
 			continue
 		}
 
-		c.WriteHave(pw.index)
-		piecesQ <- &downloadedPiece{index: pw.index, data: buf}
+		if err := t.store(pw, buf); err != nil {
+			reason = err
+			return
+		}
+		pc.sendHaves()
+	}
+
+	if t.Seed {
+		if interested {
+			pc.setInterested(false)
+		}
+		pc.serve()
 	}
 }
 
-func Download(tf *io.TorrentFile, peerID [20]byte, peers []peer.Peer) []byte {
-	log.Println("Starting download for", tf.Name)
-	totalPieces := len(tf.PieceHashes)
+// storageFailed returns the piece to the missing set and fails Run with err, which it returns.
+func (t *Torrent) storageFailed(pw *pieceWork, err error) error {
+	t.pk.putBack(pw)
+	t.publish(event.Event{Type: event.StorageError, Piece: pw.index, Err: err})
+	select {
+	case t.piecesQ <- &downloadedPiece{index: pw.index, err: err}:
+	default:
+		// Run is failing already
+	}
+	return err
+}
 
-	// init work and pieces queues, and sigDead channel
-	workQ := make(chan *pieceWork, totalPieces)
-	piecesQ := make(chan *downloadedPiece)
+// writeBlock writes a verified block of a piece that is being downloaded to the storage.
+func (t *Torrent) writeBlock(pw *pieceWork, begin int, data []byte) error {
+	select {
+	case <-t.stopped:
+		// the storage may be closed already
+		return ErrStopped
+	default:
+	}
 
-	// fill in the work q
-	for i, hash := range tf.PieceHashes {
-		length := tf.PieceLength
-		if i == totalPieces-1 {
-			length = tf.Length - tf.PieceLength*i
-			fmt.Printf("Piece length:%d\n", tf.PieceLength)
-			fmt.Printf("Last piece length:%d\n", length)
-		}
+	if _, err := t.storage.WriteAt(data, pw.index, begin); err != nil {
+		return t.storageFailed(pw, fmt.Errorf("store block %d of piece %d: %s", begin, pw.index, err))
+	}
+	return nil
+}
+
+// store writes a verified piece to the storage and marks it as done.
+// A nil buf means that its blocks were written already, see writeBlock.
+func (t *Torrent) store(pw *pieceWork, buf []byte) error {
+	select {
+	case <-t.stopped:
+		// the storage may be closed already
+		t.pk.putBack(pw)
+		return ErrStopped
+	default:
+	}
+
+	var err error
+	if buf != nil {
+		_, err = t.storage.WriteAt(buf, pw.index, 0)
+	}
+	if err == nil {
+		err = t.storage.MarkComplete(pw.index)
+	}
+	if err != nil {
+		return t.storageFailed(pw, fmt.Errorf("store piece %d: %s", pw.index, err))
+	}
 
-		workQ <- &pieceWork{index: i, length: length, checksum: hash}
+	t.statsMu.Lock()
+	t.downloaded += int64(pw.length)
+	t.statsMu.Unlock()
+	t.m.downloaded.Add(float64(pw.length))
+	t.m.verified.Inc()
+	t.pk.done(pw)
+	t.piecesQ <- &downloadedPiece{index: pw.index}
+	t.publish(event.Event{Type: event.PieceVerified, Piece: pw.index})
+	for _, file := range t.fileDone(pw) {
+		t.publish(event.Event{Type: event.FileCompleted, File: file})
 	}
+	return nil
+}
 
-	// start download workers
-	log.Printf("Starting a download worker for each peer (%d in total).\n", len(peers))
-	for _, p := range peers {
-		go startDownloadWorker(p, tf.InfoHash, peerID, workQ, piecesQ)
+// countFiles counts the pieces every file misses, the ones s does not have as complete.
+// Padding files are left out.
+func (t *Torrent) countFiles(s storage.Storage) {
+	completed := s.Completed()
+	remaining := make([]int, t.tf.NumFiles())
+	for _, pw := range t.pk.work {
+		if completed.HasPiece(pw.index) {
+			continue
+		}
+		for _, file := range t.files(pw) {
+			remaining[file]++
+		}
 	}
 
-	// collect download pieces in a buffer until full
-	buf := make([]byte, tf.Length)
-	numDownloaded := 0
-	for numDownloaded < totalPieces {
-		piece := <-piecesQ
-		if piece == nil {
-			return nil
+	t.filesMu.Lock()
+	defer t.filesMu.Unlock()
+
+	t.fileRemaining = remaining
+}
+
+// fileDone counts the stored piece off the files it spans, and returns the files it completed.
+func (t *Torrent) fileDone(pw *pieceWork) []int {
+	t.filesMu.Lock()
+	defer t.filesMu.Unlock()
+
+	var completed []int
+	for _, file := range t.files(pw) {
+		if file >= len(t.fileRemaining) || t.fileRemaining[file] == 0 {
+			// stored twice
+			continue
 		}
-		begin := piece.index * tf.PieceLength
-		end := begin + tf.PieceLength
-		if end > tf.Length {
-			end = tf.Length
+		if t.fileRemaining[file]--; t.fileRemaining[file] == 0 {
+			completed = append(completed, file)
 		}
-		copy(buf[begin:end], piece.data)
-		numDownloaded++
+	}
+	return completed
+}
 
-		percent := float64(numDownloaded) / float64(totalPieces) * 100
-		numWorkers := runtime.NumGoroutine() - 1 // substract the main thread
-		log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, piece.index, numWorkers)
+// files returns the files the piece spans, except for the padding ones.
+func (t *Torrent) files(pw *pieceWork) []int {
+	var ret []int
+	for _, s := range t.tf.Spans(pw.offset, pw.length) {
+		if t.tf.IsMultiFile && t.tf.Files[s.File].IsPadding() {
+			continue
+		}
+		ret = append(ret, s.File)
 	}
-	close(workQ)
+	return ret
+}
 
-	return buf
+// Run downloads every piece and returns the contents of the torrent.
+func (t *Torrent) Run() []byte {
+	mem := storage.NewMemory(t.tf)
+	if err := t.RunWith(mem); err != nil {
+		t.log.Error("download failed", logging.Err(err))
+		return nil
+	}
+	return mem.Bytes()
+}
+
+// RunWith downloads the wanted pieces that s does not have yet into s, see SetFilePriority.
+// It returns once every wanted piece is complete, or when s fails or the torrent is stopped.
+// With Seed set, the peers keep being served after it returns.
+func (t *Torrent) RunWith(s storage.Storage) error {
+	select {
+	case <-t.stopped:
+		return ErrStopped
+	default:
+	}
+
+	tf := t.tf
+	t.log = t.Logger.With(logging.InfoHash(tf.InfoHash))
+	totalPieces, lastPieceLength := len(t.pk.work), 0
+	if totalPieces > 0 {
+		// io rejects metainfo without pieces, a TorrentFile built by hand may still lack them
+		lastPieceLength = t.pk.work[totalPieces-1].length
+	}
+	t.log.Info("starting download", logging.String("name", tf.Name), logging.Int("pieces", totalPieces),
+		logging.Int("piece_length", tf.PieceLength), logging.Int("last_piece_length", lastPieceLength))
+
+	t.filesMu.Lock()
+	t.storage = s
+	t.filesMu.Unlock()
+	// before the first connection
+	t.m = newTorrentMetrics(t.Metrics, tf.InfoHash)
+	t.swarm.count(t.m.peers)
+	if err := t.applyWanted(); err != nil {
+		return err
+	}
+	completed := s.Completed()
+	for _, pw := range t.pk.work {
+		if completed.HasPiece(pw.index) {
+			t.pk.done(pw)
+		}
+	}
+	t.countFiles(s)
+	if t.MaxPeers > 0 {
+		t.swarm.setMaxPeers(t.MaxPeers)
+	}
+	if t.Seed || !t.pk.finished() {
+		// start download workers
+		t.swarm.start()
+	}
+	if t.pk.finished() {
+		return nil
+	}
+
+	for _, u := range tf.URLList {
+		u := u
+		t.spawn(func() { t.startWebSeed(u) })
+	}
+	for _, u := range tf.HTTPSeeds {
+		u := u
+		t.spawn(func() { t.startHTTPSeed(u) })
+	}
+
+	// wait for every wanted piece to be stored
+	for !t.pk.finished() {
+		select {
+		case piece := <-t.piecesQ:
+			if piece.err != nil {
+				return piece.err
+			}
+		case <-t.changed:
+		case <-t.stopped:
+			return ErrStopped
+		}
+	}
+	return nil
+}
+
+// Check verifies the data s holds for the pieces it does not have as complete, and marks
+// the valid ones complete. It lets a torrent resume from, or seed, data that is on disk already.
+// The pieces that can only be verified block by block, see needsLeaves, are left to download.
+// Returns the number of valid pieces found.
+func (t *Torrent) Check(s storage.Storage) (int, error) {
+	completed := s.Completed()
+	found := 0
+	buf := make([]byte, t.tf.PieceLength)
+	for _, pw := range t.pk.work {
+		if completed.HasPiece(pw.index) {
+			continue
+		}
+		piece := buf[:pw.length]
+		if _, err := s.ReadAt(piece, pw.index, 0); err != nil {
+			return found, fmt.Errorf("read piece %d: %s", pw.index, err)
+		}
+		t.tf.ZeroPadding(pw.offset, piece)
+		if !t.verify(pw, piece) {
+			continue
+		}
+		if err := s.MarkComplete(pw.index); err != nil {
+			return found, err
+		}
+		found++
+	}
+	return found, nil
 }
@@ -0,0 +1,309 @@
+package p2p
+
+import (
+	"sync"
+	"time"
+)
+
+type pieceState uint8
+
+const (
+	pieceMissing pieceState = iota
+	pieceActive
+	pieceDone
+)
+
+// source is something pieces are downloaded from, a peer or a web seed.
+type source interface {
+	has(index int) bool
+	// canRequest reports whether the piece can be requested right now.
+	canRequest(index int) bool
+	// suggested returns the pieces the source wants us to download first.
+	suggested() []int
+}
+
+// picker hands out pieces to the download workers.
+type picker struct {
+	mu          sync.Mutex
+	changed     chan struct{} // closed and replaced when pieces may be handed out, see broadcast
+	work        []*pieceWork
+	state       []pieceState
+	priorities  []Priority
+	deadlines   map[int]time.Time // of the pieces that are needed soon, wanted whatever their priority
+	sequential  bool
+	remaining   int                     // wanted pieces that are not done
+	waiters     map[int][]chan struct{} // closed once the piece is done
+	completions int                     // pieces marked done so far, it tells when to send haves
+	stopped     bool
+}
+
+func newPicker(work []*pieceWork) *picker {
+	pk := &picker{
+		work:       work,
+		state:      make([]pieceState, len(work)),
+		priorities: make([]Priority, len(work)),
+		deadlines:  make(map[int]time.Time),
+		remaining:  len(work),
+		waiters:    make(map[int][]chan struct{}),
+		changed:    make(chan struct{}),
+	}
+	for i := range pk.priorities {
+		pk.priorities[i] = PriorityNormal
+	}
+	return pk
+}
+
+// broadcast wakes up the workers waiting for a piece. Must be called with pk.mu held.
+func (pk *picker) broadcast() {
+	close(pk.changed)
+	pk.changed = make(chan struct{})
+}
+
+// setPriorities replaces the priorities of the pieces. Pieces with PrioritySkip are not handed out.
+func (pk *picker) setPriorities(priorities []Priority) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	pk.priorities = priorities
+	pk.recount()
+}
+
+// setDeadline asks for the piece to be downloaded before the pieces without a deadline
+// and the ones with a later deadline. A zero deadline clears it.
+func (pk *picker) setDeadline(index int, deadline time.Time) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	if index < 0 || index >= len(pk.state) {
+		return
+	}
+	if deadline.IsZero() {
+		delete(pk.deadlines, index)
+	} else {
+		pk.deadlines[index] = deadline
+	}
+	pk.recount()
+}
+
+// setSequential sets whether pieces are handed out in order, whatever their priority.
+func (pk *picker) setSequential(sequential bool) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	pk.sequential = sequential
+	pk.broadcast()
+}
+
+// wanted reports whether the piece must be downloaded. Must be called with pk.mu held.
+func (pk *picker) wanted(index int) bool {
+	if pk.priorities[index] != PrioritySkip {
+		return true
+	}
+	_, ok := pk.deadlines[index]
+	return ok
+}
+
+// recount counts the wanted pieces that are not done and wakes the workers up.
+// Must be called with pk.mu held.
+func (pk *picker) recount() {
+	pk.remaining = 0
+	for i := range pk.state {
+		if pk.wanted(i) && pk.state[i] != pieceDone {
+			pk.remaining++
+		}
+	}
+	pk.broadcast()
+}
+
+// finished reports whether every wanted piece is done.
+func (pk *picker) finished() bool {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	return pk.remaining == 0
+}
+
+// progress returns the number of wanted pieces that are done, and of the wanted pieces.
+func (pk *picker) progress() (int, int) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	wanted := 0
+	for i := range pk.state {
+		if pk.wanted(i) {
+			wanted++
+		}
+	}
+	return wanted - pk.remaining, wanted
+}
+
+// missing returns the wanted pieces that are not done, in order.
+func (pk *picker) missing() []int {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	var ret []int
+	for i := range pk.state {
+		if pk.wanted(i) && pk.state[i] != pieceDone {
+			ret = append(ret, i)
+		}
+	}
+	return ret
+}
+
+// next blocks until there is a missing piece that src can serve and marks it as active.
+// Returns `nil` once every wanted piece is done, or once the picker is stopped.
+func (pk *picker) next(src source) *pieceWork {
+	for {
+		pw, changed := pk.tryNext(src)
+		if changed == nil {
+			return pw
+		}
+		<-changed
+	}
+}
+
+// tryNext marks a missing piece that src can serve as active and returns it. If there is none,
+// it returns a channel that is closed once there may be one, for src to try again.
+// Both are nil once every wanted piece is done, or once the picker is stopped.
+func (pk *picker) tryNext(src source) (*pieceWork, <-chan struct{}) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	if pk.remaining == 0 || pk.stopped {
+		return nil, nil
+	}
+	if index := pk.pick(src); index >= 0 {
+		pk.state[index] = pieceActive
+		return pk.work[index], nil
+	}
+	return nil, pk.changed
+}
+
+// pick selects a missing wanted piece that src has, or returns -1.
+// Pieces with the earliest deadline come first, then suggested pieces, then the ones
+// with the highest priority; in sequential mode the first missing piece comes after the
+// deadlines. While choked only allowed fast pieces qualify, the others wait for an unchoke
+// rather than being held by a peer that cannot send them.
+func (pk *picker) pick(src source) int {
+	wanted := func(index int) bool {
+		return index >= 0 && index < len(pk.state) &&
+			pk.state[index] == pieceMissing && pk.wanted(index) &&
+			src.has(index) && src.canRequest(index)
+	}
+
+	if index := pk.earliest(wanted); index >= 0 {
+		return index
+	}
+	if pk.sequential {
+		for index := range pk.state {
+			if wanted(index) {
+				return index
+			}
+		}
+	} else {
+		for _, index := range src.suggested() {
+			if wanted(index) {
+				return index
+			}
+		}
+		return pk.best(wanted)
+	}
+	return -1
+}
+
+// earliest returns the piece with the earliest deadline that ok accepts, or -1.
+func (pk *picker) earliest(ok func(int) bool) int {
+	earliest := -1
+	for index, deadline := range pk.deadlines {
+		if ok(index) && (earliest < 0 || deadline.Before(pk.deadlines[earliest]) ||
+			deadline.Equal(pk.deadlines[earliest]) && index < earliest) {
+			earliest = index
+		}
+	}
+	return earliest
+}
+
+// best returns the first of the pieces with the highest priority that ok accepts, or -1.
+func (pk *picker) best(ok func(int) bool) int {
+	best := -1
+	for index := range pk.state {
+		if (best < 0 || pk.priorities[index] > pk.priorities[best]) && ok(index) {
+			best = index
+			if pk.priorities[best] == PriorityHigh {
+				break
+			}
+		}
+	}
+	return best
+}
+
+// stop stops handing out pieces and wakes the workers up.
+func (pk *picker) stop() {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	pk.stopped = true
+	pk.broadcast()
+}
+
+// putBack returns an active piece to the missing set.
+func (pk *picker) putBack(pw *pieceWork) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	pk.state[pw.index] = pieceMissing
+	pk.broadcast()
+}
+
+// done marks an active piece as downloaded and verified.
+func (pk *picker) done(pw *pieceWork) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	if pk.state[pw.index] != pieceDone {
+		pk.state[pw.index] = pieceDone
+		pk.completions++
+		if pk.wanted(pw.index) {
+			pk.remaining--
+		}
+	}
+	delete(pk.deadlines, pw.index)
+	for _, ch := range pk.waiters[pw.index] {
+		close(ch)
+	}
+	delete(pk.waiters, pw.index)
+	if pk.remaining == 0 {
+		pk.broadcast()
+	}
+}
+
+// wait returns a channel that is closed once the piece with the given index is done.
+func (pk *picker) wait(index int) <-chan struct{} {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	ch := make(chan struct{})
+	if pk.state[index] == pieceDone {
+		close(ch)
+	} else {
+		pk.waiters[index] = append(pk.waiters[index], ch)
+	}
+	return ch
+}
+
+// numCompletions returns how many pieces were marked done so far.
+func (pk *picker) numCompletions() int {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	return pk.completions
+}
+
+// isDone reports whether the piece with the given index was downloaded and verified.
+func (pk *picker) isDone(index int) bool {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	return index >= 0 && index < len(pk.state) && pk.state[index] == pieceDone
+}
@@ -0,0 +1,105 @@
+package p2p
+
+import (
+	"fmt"
+
+	"github.com/VIVelev/bittorrent/storage"
+)
+
+// Priority tells how much a file, or a piece, is wanted.
+type Priority int8
+
+const (
+	// PrioritySkip files are not downloaded, only the pieces they share with wanted files are.
+	PrioritySkip Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	}
+	return fmt.Sprintf("Priority(%d)", int8(p))
+}
+
+// SetFilePriority sets the priority of the file with the given index, padding files included.
+// It is safe to call while the download runs.
+func (t *Torrent) SetFilePriority(file int, p Priority) error {
+	if p < PrioritySkip || p > PriorityHigh {
+		return fmt.Errorf("invalid priority %d", p)
+	}
+
+	t.filesMu.Lock()
+	defer t.filesMu.Unlock()
+	if file < 0 || file >= len(t.filePriorities) {
+		return fmt.Errorf("file %d does not exist", file)
+	}
+	t.filePriorities[file] = p
+	if sel, ok := t.storage.(storage.Selector); ok {
+		if err := sel.SetWanted(file, p != PrioritySkip); err != nil {
+			return err
+		}
+	}
+	t.pk.setPriorities(t.piecePriorities())
+
+	// Run may be waiting for a piece that is not wanted anymore
+	select {
+	case t.changed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// FilePriority returns the priority of the file with the given index.
+func (t *Torrent) FilePriority(file int) Priority {
+	t.filesMu.Lock()
+	defer t.filesMu.Unlock()
+	if file < 0 || file >= len(t.filePriorities) {
+		return PrioritySkip
+	}
+	return t.filePriorities[file]
+}
+
+// piecePriorities derives the priority of every piece from the files it spans:
+// a piece is as important as the most important of them. Padding does not count.
+func (t *Torrent) piecePriorities() []Priority {
+	tf := t.tf
+	prios := make([]Priority, len(t.pk.work))
+	for i, pw := range t.pk.work {
+		for _, s := range tf.Spans(pw.offset, pw.length) {
+			if tf.IsMultiFile && tf.Files[s.File].IsPadding() {
+				continue
+			}
+			if p := t.filePriorities[s.File]; p > prios[i] {
+				prios[i] = p
+			}
+		}
+	}
+	return prios
+}
+
+// applyWanted tells the storage which files are wanted, if it can leave some out.
+func (t *Torrent) applyWanted() error {
+	t.filesMu.Lock()
+	defer t.filesMu.Unlock()
+
+	sel, ok := t.storage.(storage.Selector)
+	if !ok {
+		return nil
+	}
+	for file, p := range t.filePriorities {
+		if err := sel.SetWanted(file, p != PrioritySkip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package p2p
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VIVelev/bittorrent/bitfield"
+	"github.com/VIVelev/bittorrent/internal/testtorrent"
+	"github.com/VIVelev/bittorrent/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSource has every piece. When it chokes only the allowed pieces can be requested.
+type fakeSource struct {
+	suggestions []int
+	choking     bool
+	allowed     map[int]bool
+}
+
+func (fs *fakeSource) has(int) bool              { return true }
+func (fs *fakeSource) canRequest(index int) bool { return !fs.choking || fs.allowed[index] }
+func (fs *fakeSource) suggested() []int          { return fs.suggestions }
+
+func TestPickPriority(t *testing.T) {
+	tests := map[string]struct {
+		priorities []Priority
+		suggested  []int
+		deadlines  map[int]time.Duration // from now
+		sequential bool
+		order      []int
+	}{
+		"in order": {
+			priorities: []Priority{PriorityNormal, PriorityNormal, PriorityNormal},
+			order:      []int{0, 1, 2},
+		},
+		"highest first": {
+			priorities: []Priority{PriorityLow, PriorityNormal, PriorityHigh, PriorityNormal},
+			order:      []int{2, 1, 3, 0},
+		},
+		"skipped": {
+			priorities: []Priority{PrioritySkip, PriorityLow, PrioritySkip},
+			order:      []int{1},
+		},
+		"suggested first": {
+			priorities: []Priority{PriorityHigh, PriorityNormal, PrioritySkip},
+			suggested:  []int{2, 1},
+			order:      []int{1, 0},
+		},
+		"deadlines first": {
+			priorities: []Priority{PriorityHigh, PriorityNormal, PrioritySkip, PriorityLow},
+			suggested:  []int{0},
+			deadlines:  map[int]time.Duration{3: time.Second, 2: 0},
+			order:      []int{2, 3, 0, 1},
+		},
+		"sequential": {
+			priorities: []Priority{PriorityLow, PrioritySkip, PriorityNormal, PriorityHigh},
+			suggested:  []int{3},
+			sequential: true,
+			order:      []int{0, 2, 3},
+		},
+		"sequential with deadlines": {
+			priorities: []Priority{PriorityLow, PriorityLow, PriorityLow},
+			deadlines:  map[int]time.Duration{2: time.Second},
+			sequential: true,
+			order:      []int{2, 0, 1},
+		},
+	}
+
+	for name, test := range tests {
+		work := make([]*pieceWork, len(test.priorities))
+		for i := range work {
+			work[i] = &pieceWork{index: i}
+		}
+		pk := newPicker(work)
+		pk.setPriorities(test.priorities)
+		pk.setSequential(test.sequential)
+		now := time.Now()
+		for index, d := range test.deadlines {
+			pk.setDeadline(index, now.Add(d))
+		}
+		src := &fakeSource{suggestions: test.suggested}
+
+		var order []int
+		for pw := pk.next(src); pw != nil; pw = pk.next(src) {
+			order = append(order, pw.index)
+			pk.done(pw)
+		}
+		assert.Equal(t, test.order, order, name)
+	}
+}
+
+func TestPickChoked(t *testing.T) {
+	tests := map[string]struct {
+		allowed map[int]bool
+		piece   int // -1 when none
+	}{
+		"nothing allowed": {piece: -1},
+		"allowed fast":    {allowed: map[int]bool{1: true}, piece: 1},
+	}
+
+	for name, test := range tests {
+		pk := newPicker([]*pieceWork{{index: 0}, {index: 1}})
+		pw, wake := pk.tryNext(&fakeSource{choking: true, allowed: test.allowed})
+		if test.piece < 0 {
+			assert.Nil(t, pw, name)
+			assert.NotNil(t, wake, name)
+		} else {
+			require.NotNil(t, pw, name)
+			assert.Equal(t, test.piece, pw.index, name)
+		}
+		// the pieces the choking source did not take are left to the others
+		pw = pk.next(&fakeSource{})
+		require.NotNil(t, pw, name)
+		assert.Equal(t, 0, pw.index, name)
+	}
+}
+
+func TestPiecePriorities(t *testing.T) {
+	data := randomData(100)
+	tf := newTestTorrent(t, "dir", 16, []testtorrent.File{
+		{Length: 20, Path: []string{"a"}},
+		{Length: 40, Path: []string{"b"}},
+		{Length: 40, Path: []string{"c"}},
+	}, data)
+	tr := NewTorrent(tf, [20]byte{})
+	require.Nil(t, tr.SetFilePriority(0, PriorityHigh))
+	require.Nil(t, tr.SetFilePriority(1, PrioritySkip))
+	require.Nil(t, tr.SetFilePriority(2, PriorityLow))
+	assert.NotNil(t, tr.SetFilePriority(3, PriorityLow))
+	assert.NotNil(t, tr.SetFilePriority(0, PriorityHigh+1))
+
+	// pieces 16 bytes long: a a+b b b+c c c c
+	expected := []Priority{PriorityHigh, PriorityHigh, PrioritySkip, PriorityLow, PriorityLow, PriorityLow, PriorityLow}
+	assert.Equal(t, expected, tr.piecePriorities())
+	assert.Equal(t, PrioritySkip, tr.FilePriority(1))
+}
+
+func TestFilesCompleted(t *testing.T) {
+	data := randomData(100)
+	tf := newTestTorrent(t, "dir", 16, []testtorrent.File{
+		{Length: 20, Path: []string{"a"}},
+		{Length: 40, Path: []string{"b"}},
+		{Length: 40, Path: []string{"c"}},
+	}, data)
+	completed := bitfield.New(len(tf.PieceHashes))
+	// pieces 16 bytes long: a a+b b b+c c c c
+	for _, index := range []int{1, 3, 6} {
+		completed.SetPiece(index)
+	}
+	assert.Equal(t, []int64{4, 24, 8}, FilesCompleted(tf, completed))
+}
+
+func TestSelectiveDownload(t *testing.T) {
+	data := randomData(100000)
+	files := map[string][]byte{
+		"/seed/dir/a": data[:30000],
+		"/seed/dir/b": data[30000:70000],
+		"/seed/dir/c": data[70000:],
+	}
+	var mu sync.Mutex
+	ranges := make(map[string][]string) // by path
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges[r.URL.Path] = append(ranges[r.URL.Path], r.Header.Get("Range"))
+		mu.Unlock()
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(files[r.URL.Path]))
+	}))
+	defer server.Close()
+
+	tf := newTestTorrent(t, "dir", 16384, []testtorrent.File{
+		{Length: 30000, Path: []string{"a"}},
+		{Length: 40000, Path: []string{"b"}},
+		{Length: 30000, Path: []string{"c"}},
+	}, data)
+	tf.URLList = []string{server.URL + "/seed"}
+	root := t.TempDir()
+	dir := filepath.Join(root, "dir")
+	s, err := storage.NewFile(tf, root)
+	require.Nil(t, err)
+
+	tr := NewTorrent(tf, [20]byte{})
+	require.Nil(t, tr.SetFilePriority(1, PrioritySkip))
+	require.Nil(t, tr.RunWith(s))
+
+	for _, name := range []string{"a", "c"} {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		require.Nil(t, err, name)
+		assert.True(t, bytes.Equal(files["/seed/dir/"+name], content), name)
+	}
+	_, err = os.Stat(filepath.Join(dir, "b"))
+	assert.True(t, os.IsNotExist(err), "b is not created")
+	_, err = os.Stat(filepath.Join(root, ".dir.parts"))
+	assert.Nil(t, err, "the partfile holds the pieces b shares")
+	// only the pieces b shares with a and c were fetched, 16384..32767 and 65536..81919
+	mu.Lock()
+	assert.ElementsMatch(t, []string{"bytes=0-2767", "bytes=35536-39999"}, ranges["/seed/dir/b"])
+	mu.Unlock()
+
+	// b is wanted after all
+	require.Nil(t, tr.SetFilePriority(1, PriorityNormal))
+	require.Nil(t, tr.RunWith(s))
+	require.Nil(t, s.Close())
+	content, err := ioutil.ReadFile(filepath.Join(dir, "b"))
+	require.Nil(t, err)
+	assert.True(t, bytes.Equal(files["/seed/dir/b"], content))
+	_, err = os.Stat(filepath.Join(root, ".dir.parts"))
+	assert.True(t, os.IsNotExist(err), "the partfile is removed")
+}
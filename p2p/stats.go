@@ -0,0 +1,231 @@
+package p2p
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VIVelev/bittorrent/ratelimit"
+)
+
+// TorrentStats is a snapshot of a torrent, see Torrent.Stats.
+type TorrentStats struct {
+	Pieces    int // of the torrent
+	Completed int // pieces stored
+	// Left is how many bytes of the wanted pieces are not stored yet.
+	Left       int64
+	Downloaded int64 // bytes of the verified pieces stored
+	Uploaded   int64 // bytes served to peers
+	// DownloadRate and UploadRate are in bytes per second over ratelimit.DefaultWindow,
+	// of the blocks received from peers and web seeds and of the blocks served.
+	DownloadRate float64
+	UploadRate   float64
+	// ETA is how long storing the wanted pieces takes at DownloadRate, -1 when it is 0.
+	ETA time.Duration
+	// Availability is the number of distributed copies among the connected peers: how many of
+	// them have the rarest piece, plus the fraction of the pieces more of them have.
+	Availability float64
+	// Wasted is how many bytes were received and thrown away: the pieces and the blocks that
+	// failed verification, and the blocks received twice.
+	Wasted int64
+	// HashFailures is how many pieces failed verification.
+	HashFailures int
+	Peers        int // connected to
+}
+
+// PeerStats is a snapshot of a connection to a peer, see Torrent.PeerStats.
+type PeerStats struct {
+	PeerInfo
+	PeerID [20]byte
+	// Client is the software of the peer, from its extension handshake or its peer ID,
+	// empty when unknown.
+	Client    string
+	Connected time.Time
+	// Choked is set while the peer chokes us and Interested while we are interested in its
+	// pieces, PeerInterested while it is interested in ours. We never choke peers.
+	Choked         bool
+	Interested     bool
+	PeerInterested bool
+	// Pending is how many blocks were requested from the peer and not received yet.
+	Pending    int
+	Downloaded int64 // bytes of the blocks received
+	Uploaded   int64 // bytes of the blocks served
+	// DownloadRate and UploadRate are in bytes per second over ratelimit.DefaultWindow.
+	DownloadRate float64
+	UploadRate   float64
+	// Progress is the fraction of the pieces of the torrent the peer has.
+	Progress float64
+}
+
+// connStats are updated by a connection and read by Torrent.PeerStats while it runs.
+type connStats struct {
+	mu             sync.Mutex
+	client         string
+	choked         bool
+	interested     bool
+	peerInterested bool
+	pending        int
+	connected      time.Time
+	down, up       *ratelimit.Meter
+}
+
+func newConnStats(peerID [20]byte) *connStats {
+	return &connStats{
+		client:    clientName(peerID),
+		choked:    true,
+		connected: time.Now(),
+		down:      ratelimit.NewMeter(ratelimit.DefaultWindow),
+		up:        ratelimit.NewMeter(ratelimit.DefaultWindow),
+	}
+}
+
+// update changes the counters with f, which is called with s.mu held.
+func (s *connStats) update(f func(s *connStats)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f(s)
+}
+
+// clientName returns the client and version encoded in an Azureus-style peer ID, e.g. "qB4250"
+// for "-qB4250-...", or "" for the other styles.
+func clientName(peerID [20]byte) string {
+	if peerID[0] != '-' || peerID[7] != '-' {
+		return ""
+	}
+	name := string(peerID[1:7])
+	for _, r := range name {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '.') {
+			return ""
+		}
+	}
+	return strings.TrimRight(name, ".")
+}
+
+// received counts the bytes of a block from a peer or a web seed, pc being nil for the latter.
+func (t *Torrent) received(pc *peerConn, n int) {
+	t.down.Add(n)
+	if pc != nil {
+		pc.stats.down.Add(n)
+	}
+}
+
+// waste counts the bytes received and thrown away, and the piece that failed verification if any.
+func (t *Torrent) waste(n int, failedPiece bool) {
+	t.statsMu.Lock()
+	defer t.statsMu.Unlock()
+
+	t.wasted += int64(n)
+	if failedPiece {
+		t.hashFailures++
+	}
+}
+
+// Stats returns a snapshot of the torrent. It is safe to call while the torrent runs.
+func (t *Torrent) Stats() TorrentStats {
+	st := TorrentStats{
+		Pieces:       len(t.pk.work),
+		DownloadRate: t.down.Rate(),
+		UploadRate:   t.up.Rate(),
+		ETA:          -1,
+		Peers:        t.swarm.numConnected(),
+	}
+	for _, index := range t.pk.missing() {
+		st.Left += int64(t.pk.work[index].length)
+	}
+	completed := t.Completed()
+	for index := range t.pk.work {
+		if completed.HasPiece(index) {
+			st.Completed++
+		}
+	}
+	switch {
+	case st.Left == 0:
+		st.ETA = 0
+	case st.DownloadRate > 0:
+		st.ETA = time.Duration(float64(st.Left) / st.DownloadRate * float64(time.Second))
+	}
+
+	t.statsMu.Lock()
+	st.Downloaded, st.Uploaded = t.downloaded, t.uploaded
+	st.Wasted, st.HashFailures = t.wasted, t.hashFailures
+	t.statsMu.Unlock()
+
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+	st.Availability = t.availability()
+	return st
+}
+
+// availability returns the number of distributed copies, see TorrentStats.Availability.
+// Must be called with t.connsMu held.
+func (t *Torrent) availability() float64 {
+	if len(t.conns) == 0 || len(t.pk.work) == 0 {
+		return 0
+	}
+	counts := make([]int, len(t.pk.work))
+	for pc := range t.conns {
+		for index := range counts {
+			if pc.Bitfield.HasPiece(index) {
+				counts[index]++
+			}
+		}
+	}
+	min := counts[0]
+	for _, n := range counts {
+		if n < min {
+			min = n
+		}
+	}
+	more := 0
+	for _, n := range counts {
+		if n > min {
+			more++
+		}
+	}
+	return float64(min) + float64(more)/float64(len(counts))
+}
+
+// PeerStats returns a snapshot of the connections to peers that completed their handshake.
+// It is safe to call while the torrent runs.
+func (t *Torrent) PeerStats() []PeerStats {
+	infos := make(map[string]PeerInfo)
+	for _, info := range t.swarm.peers() {
+		infos[info.Peer.String()] = info
+	}
+
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+
+	ret := make([]PeerStats, 0, len(t.conns))
+	for pc := range t.conns {
+		info, ok := infos[pc.peer.String()]
+		if !ok {
+			info = PeerInfo{Peer: pc.peer}
+		}
+		st := PeerStats{
+			PeerInfo:     info,
+			PeerID:       pc.PeerID,
+			Downloaded:   pc.stats.down.Total(),
+			Uploaded:     pc.stats.up.Total(),
+			DownloadRate: pc.stats.down.Rate(),
+			UploadRate:   pc.stats.up.Rate(),
+		}
+		if n := len(t.pk.work); n > 0 {
+			have := 0
+			for index := 0; index < n; index++ {
+				if pc.Bitfield.HasPiece(index) {
+					have++
+				}
+			}
+			st.Progress = float64(have) / float64(n)
+		}
+		pc.stats.update(func(s *connStats) {
+			st.Client, st.Connected = s.client, s.connected
+			st.Choked, st.Interested, st.PeerInterested = s.choked, s.interested, s.peerInterested
+			st.Pending = s.pending
+		})
+		ret = append(ret, st)
+	}
+	return ret
+}
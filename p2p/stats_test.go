@@ -0,0 +1,80 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/VIVelev/bittorrent/extension"
+	"github.com/VIVelev/bittorrent/peer"
+	"github.com/VIVelev/bittorrent/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	tf, data := partialTorrent(t)
+	seeder, partial := startPartialSeeder(t, tf, data)
+
+	leecher := NewTorrent(tf, [20]byte{1})
+	leecher.Dialer = testDialer
+	leecher.AddPeers([]peer.Peer{partial}, SourceTracker)
+	go leecher.RunWith(storage.NewMemory(tf))
+	defer leecher.Stop()
+	// the seeder does not have the last piece
+	require.Eventually(t, func() bool { return leecher.Stats().Completed == 3 }, 5*time.Second, 10*time.Millisecond)
+
+	st := leecher.Stats()
+	assert.Equal(t, 4, st.Pieces)
+	assert.Equal(t, int64(16384), st.Left)
+	assert.Equal(t, int64(3*16384), st.Downloaded)
+	assert.Greater(t, st.DownloadRate, 0.0)
+	assert.Greater(t, int64(st.ETA), int64(0))
+	assert.Equal(t, 0.75, st.Availability)
+	assert.Equal(t, 0, st.HashFailures)
+	assert.Equal(t, int64(0), st.Wasted)
+	assert.Equal(t, 1, st.Peers)
+
+	peers := leecher.PeerStats()
+	require.Len(t, peers, 1)
+	p := peers[0]
+	assert.Equal(t, partial, p.Peer)
+	assert.Equal(t, SourceTracker, p.Source)
+	assert.Equal(t, [20]byte{2}, p.PeerID)
+	assert.Equal(t, 0.75, p.Progress)
+	assert.Equal(t, int64(3*16384), p.Downloaded)
+	assert.Greater(t, p.DownloadRate, 0.0)
+	assert.False(t, p.Connected.IsZero())
+	assert.True(t, p.Interested)
+	assert.False(t, p.PeerInterested)
+	assert.Equal(t, 0, p.Pending, "waiting for a piece the peer does not have")
+	// the extension handshake may still be on its way
+	assert.Contains(t, []string{"", extension.ClientName}, p.Client)
+
+	require.Eventually(t, func() bool {
+		peers := seeder.PeerStats()
+		return len(peers) == 1 && peers[0].Uploaded == 3*16384 && peers[0].Client == extension.ClientName
+	}, time.Second, 10*time.Millisecond)
+	p = seeder.PeerStats()[0]
+	assert.True(t, p.PeerInterested)
+	assert.False(t, p.Choked)
+	assert.Equal(t, 0.0, p.Progress, "the leecher does not announce the pieces the seeder has")
+	assert.Greater(t, seeder.Stats().UploadRate, 0.0)
+}
+
+func TestClientName(t *testing.T) {
+	tests := map[string]struct {
+		peerID string
+		name   string
+	}{
+		"azureus":      {"-qB4250-0123456789ab", "qB4250"},
+		"padded":       {"-BT7...-0123456789ab", "BT7"},
+		"shadow":       {"M7-2-2--0123456789ab", ""},
+		"invalid":      {"-qB 250-0123456789ab", ""},
+		"unterminated": {"-qB42500123456789abc", ""},
+	}
+	for name, test := range tests {
+		var id [20]byte
+		copy(id[:], test.peerID)
+		assert.Equal(t, test.name, clientName(id), name)
+	}
+}
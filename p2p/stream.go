@@ -0,0 +1,191 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultReadahead is how many bytes ahead of its position a Reader asks for.
+	DefaultReadahead int = 4 << 20 // 4MiB
+	// readaheadStep separates the deadlines of consecutive pieces of the readahead window,
+	// only their order matters to the picker.
+	readaheadStep time.Duration = 100 * time.Millisecond
+)
+
+// ErrReaderClosed is returned by the reads of a closed Reader.
+var ErrReaderClosed = errors.New("reader closed")
+
+// SetSequential sets whether the pieces are downloaded in order, so the torrent can be
+// consumed from the start before it is complete. Pieces with a deadline still come first.
+func (t *Torrent) SetSequential(sequential bool) {
+	t.pk.setSequential(sequential)
+}
+
+// SetPieceDeadline asks for the piece with the given index to be downloaded by deadline,
+// before the pieces with later deadlines and the ones without. The piece is wanted even
+// if its files are skipped. A zero deadline clears it.
+func (t *Torrent) SetPieceDeadline(index int, deadline time.Time) {
+	t.pk.setDeadline(index, deadline)
+
+	// Run may be waiting for a piece that is not wanted anymore
+	select {
+	case t.changed <- struct{}{}:
+	default:
+	}
+}
+
+// pieceAt returns the index of the piece holding the byte at offset of the torrent, or -1.
+func (t *Torrent) pieceAt(offset int) int {
+	work := t.pk.work
+	i := sort.Search(len(work), func(i int) bool {
+		return work[i].offset+work[i].length > offset
+	})
+	if i == len(work) || work[i].offset > offset {
+		return -1
+	}
+	return i
+}
+
+// Reader reads a file of a torrent while it is being downloaded. Reads block until the
+// pieces they need are complete and ask for them, and for the ones of the readahead window
+// after them, to be downloaded first. The download must be running.
+type Reader struct {
+	// Readahead is how many bytes after the position are asked for, DefaultReadahead if zero.
+	Readahead int
+
+	t      *Torrent
+	offset int // of the file within the torrent
+	length int
+	pos    int
+
+	mu        sync.Mutex
+	deadlines map[int]bool // pieces we set a deadline for
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewReader returns a reader of the file with the given index.
+func (t *Torrent) NewReader(file int) (*Reader, error) {
+	tf := t.tf
+	if file < 0 || file >= tf.NumFiles() {
+		return nil, fmt.Errorf("file %d does not exist", file)
+	}
+	r := &Reader{t: t, length: tf.Length, deadlines: make(map[int]bool), closed: make(chan struct{})}
+	if tf.IsMultiFile {
+		for _, f := range tf.Files[:file] {
+			r.offset += f.Length
+		}
+		r.length = tf.Files[file].Length
+	}
+	return r, nil
+}
+
+// Read reads from the file at the position, waiting for the piece holding it.
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.pos >= r.length {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	offset := r.offset + r.pos
+	index := r.t.pieceAt(offset)
+	if index < 0 {
+		return 0, fmt.Errorf("no piece holds offset %d", offset)
+	}
+	r.prioritize(offset)
+
+	select {
+	case <-r.t.pk.wait(index):
+	case <-r.closed:
+		return 0, ErrReaderClosed
+	case <-r.t.stopped:
+		return 0, ErrStopped
+	}
+
+	pw := r.t.pk.work[index]
+	n := len(p)
+	if end := pw.offset + pw.length - offset; n > end {
+		n = end
+	}
+	if rest := r.length - r.pos; n > rest {
+		n = rest
+	}
+	n, err := r.t.storage.ReadAt(p[:n], index, offset-pw.offset)
+	r.pos += n
+	return n, err
+}
+
+// prioritize sets deadlines for the pieces from offset to the end of the readahead window,
+// and clears the ones it set before for the pieces out of it.
+func (r *Reader) prioritize(offset int) {
+	readahead := r.Readahead
+	if readahead <= 0 {
+		readahead = DefaultReadahead
+	}
+	end := r.offset + r.length
+	if offset+readahead < end {
+		end = offset + readahead
+	}
+
+	window := make(map[int]bool)
+	now := time.Now()
+	for index, k := r.t.pieceAt(offset), 0; index >= 0 && index < len(r.t.pk.work); index, k = index+1, k+1 {
+		if r.t.pk.work[index].offset >= end && k > 0 {
+			break
+		}
+		window[index] = true
+		if !r.t.pk.isDone(index) {
+			r.t.SetPieceDeadline(index, now.Add(time.Duration(k)*readaheadStep))
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for index := range r.deadlines {
+		if !window[index] {
+			r.t.SetPieceDeadline(index, time.Time{})
+		}
+	}
+	r.deadlines = window
+}
+
+// Seek sets the position of the next Read.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	pos := int64(r.pos)
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos += offset
+	case io.SeekEnd:
+		pos = int64(r.length) + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = int(pos)
+	return pos, nil
+}
+
+// Close unblocks the pending reads and clears the deadlines the reader set.
+func (r *Reader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		for index := range r.deadlines {
+			r.t.SetPieceDeadline(index, time.Time{})
+		}
+		r.deadlines = nil
+	})
+	return nil
+}
@@ -0,0 +1,93 @@
+package p2p
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/VIVelev/bittorrent/internal/testtorrent"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReader(t *testing.T) {
+	data := randomData(100000)
+	files := map[string][]byte{
+		"/seed/dir/a": data[:30000],
+		"/seed/dir/b": data[30000:70000],
+		"/seed/dir/c": data[70000:],
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(files[r.URL.Path]))
+	}))
+	defer server.Close()
+
+	tf := newTestTorrent(t, "dir", 16384, []testtorrent.File{
+		{Length: 30000, Path: []string{"a"}},
+		{Length: 40000, Path: []string{"b"}},
+		{Length: 30000, Path: []string{"c"}},
+	}, data)
+	tf.URLList = []string{server.URL + "/seed"}
+	tr := NewTorrent(tf, [20]byte{})
+	tr.SetSequential(true)
+
+	r, err := tr.NewReader(1)
+	require.Nil(t, err)
+	defer r.Close()
+	r.Readahead = 16384
+	done := make(chan []byte)
+	go func() { done <- tr.Run() }()
+
+	// read the end of b first, then all of it
+	pos, err := r.Seek(-10000, io.SeekEnd)
+	require.Nil(t, err)
+	assert.Equal(t, int64(30000), pos)
+	end, err := ioutil.ReadAll(r)
+	require.Nil(t, err)
+	assert.True(t, bytes.Equal(data[60000:70000], end))
+
+	_, err = r.Seek(0, io.SeekStart)
+	require.Nil(t, err)
+	all, err := ioutil.ReadAll(r)
+	require.Nil(t, err)
+	assert.True(t, bytes.Equal(files["/seed/dir/b"], all))
+
+	select {
+	case got := <-done:
+		assert.True(t, bytes.Equal(data, got))
+	case <-time.After(10 * time.Second):
+		t.Fatal("download did not finish")
+	}
+	_, err = tr.NewReader(3)
+	assert.NotNil(t, err)
+}
+
+func TestReaderClose(t *testing.T) {
+	data := randomData(100)
+	tf := newTestTorrent(t, "file", 32, []testtorrent.File{{Length: len(data)}}, data)
+	tr := NewTorrent(tf, [20]byte{})
+	tr.SetFilePriority(0, PrioritySkip)
+
+	// nothing downloads, the read waits until the reader is closed
+	r, err := tr.NewReader(0)
+	require.Nil(t, err)
+	_, err = r.Seek(40, io.SeekStart)
+	require.Nil(t, err)
+	res := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 10))
+		res <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	_, wanted := tr.pk.progress()
+	assert.Equal(t, 3, wanted, "the readahead window is wanted")
+
+	require.Nil(t, r.Close())
+	assert.Equal(t, ErrReaderClosed, <-res)
+	_, wanted = tr.pk.progress()
+	assert.Equal(t, 0, wanted, "the deadlines are cleared")
+}
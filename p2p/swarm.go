@@ -0,0 +1,353 @@
+package p2p
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/VIVelev/bittorrent/metrics"
+	"github.com/VIVelev/bittorrent/peer"
+	"github.com/VIVelev/bittorrent/pex"
+)
+
+const (
+	// MaxPeers is the max number of peers a torrent is connected to at once.
+	MaxPeers int = 50
+	// MaxKnownPeers is the max number of peers a torrent waits to connect to or is connected to
+	// for peers learned over PEX to be added, it bounds PEX flooding.
+	MaxKnownPeers int = 1000
+
+	// minRedialInterval is how long a peer we disconnected from waits to be dialed again,
+	// it doubles with every failed dial in a row up to maxRedialInterval.
+	minRedialInterval time.Duration = 30 * time.Second
+	maxRedialInterval time.Duration = 30 * time.Minute
+)
+
+// Source tells where a peer was learned from.
+type Source int
+
+const (
+	SourceTracker Source = iota
+	SourcePEX
+	// SourceLSD peers are on the local network, they are connected to first.
+	SourceLSD
+	// SourceIncoming peers connected to us.
+	SourceIncoming
+	SourceDHT
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceTracker:
+		return "tracker"
+	case SourcePEX:
+		return "pex"
+	case SourceLSD:
+		return "lsd"
+	case SourceIncoming:
+		return "incoming"
+	case SourceDHT:
+		return "dht"
+	default:
+		return fmt.Sprintf("Source#%d", int(s))
+	}
+}
+
+// redial tells when a peer we disconnected from can be added again.
+type redial struct {
+	failures int // dials in a row that ended before the handshake
+	at       time.Time
+}
+
+type candidate struct {
+	peer   peer.Peer
+	source Source
+	flags  pex.Flags
+}
+
+// swarm keeps track of the peers known for a torrent and of the connections to them.
+type swarm struct {
+	mu          sync.Mutex
+	known       map[string]bool      // pending or active, forgotten once disconnected
+	added       int                  // peers ever added, see numAdded
+	banned      map[string]bool      // by IP, see ban
+	redials     map[string]redial    // of the peers we disconnected from, see drop
+	pending     []candidate          // waiting for a free connection slot
+	active      map[string]candidate // being dialed or connected
+	established map[string]candidate // connected, the outbound ones are advertised over PEX
+	maxPeers    int                  // connected to at once
+	running     bool
+	stopped     bool
+	connect     func(candidate)
+	wg          sync.WaitGroup    // of the connections, see spawn
+	connected   *metrics.GaugeVec // established connections by source, see count
+	now         func() time.Time
+}
+
+func newSwarm(connect func(candidate)) *swarm {
+	return &swarm{
+		known:       make(map[string]bool),
+		banned:      make(map[string]bool),
+		redials:     make(map[string]redial),
+		active:      make(map[string]candidate),
+		established: make(map[string]candidate),
+		maxPeers:    MaxPeers,
+		connect:     connect,
+		now:         time.Now,
+	}
+}
+
+// add queues the peers that are not pending or connected already for connection,
+// nor waiting to be dialed again.
+func (s *swarm) add(peers []peer.Peer, src Source, flags []pex.Flags) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return
+	}
+	var local []candidate
+	now := s.now()
+	for i, p := range peers {
+		key := p.String()
+		if s.known[key] || src == SourcePEX && len(s.known) >= MaxKnownPeers || s.banned[p.IP.String()] {
+			continue
+		}
+		if r, ok := s.redials[key]; ok && now.Before(r.at) {
+			continue
+		}
+		s.known[key] = true
+		s.added++
+
+		c := candidate{peer: p, source: src}
+		if i < len(flags) {
+			c.flags = flags[i]
+		}
+		if src == SourceLSD {
+			local = append(local, c)
+		} else {
+			s.pending = append(s.pending, c)
+		}
+	}
+	// local peers jump the queue
+	s.pending = append(local, s.pending...)
+	s.fill()
+}
+
+// setMaxPeers changes how many peers are connected to at once, the connections over the limit stay.
+func (s *swarm) setMaxPeers(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maxPeers = n
+	s.fill()
+}
+
+// start begins connecting to peers.
+func (s *swarm) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.running = true
+	s.fill()
+}
+
+// stop stops connecting to peers for good.
+func (s *swarm) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopped = true
+	s.pending = nil
+}
+
+// count keeps the number of established connections by source in peers.
+func (s *swarm) count(peers *metrics.GaugeVec) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.connected = peers
+}
+
+// wait blocks until the connections end, once the swarm is stopped.
+func (s *swarm) wait() {
+	s.wg.Wait()
+}
+
+// accept takes an inbound connection from c if there is a free slot and we are not
+// connected to it already, and runs it. Its address is not the one the peer listens at,
+// so it is not advertised over PEX.
+func (s *swarm) accept(c candidate, run func()) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := c.peer.String()
+	if !s.running || s.stopped || len(s.active) >= s.maxPeers || s.banned[c.peer.IP.String()] {
+		return false
+	}
+	if _, ok := s.active[key]; ok {
+		return false
+	}
+	s.known[key] = true
+	s.active[key] = c
+	s.established[key] = c
+	s.connected.With(c.source.String()).Inc()
+	s.spawn(c, run)
+	return true
+}
+
+// fill connects to pending peers while there are free slots. Must be called with s.mu held.
+func (s *swarm) fill() {
+	for s.running && !s.stopped && len(s.active) < s.maxPeers && len(s.pending) > 0 {
+		c := s.pending[0]
+		s.pending = s.pending[1:]
+		key := c.peer.String()
+		if _, ok := s.active[key]; ok {
+			// it connected to us while it was pending
+			continue
+		}
+		if s.banned[c.peer.IP.String()] {
+			delete(s.known, key)
+			continue
+		}
+		s.active[key] = c
+		s.spawn(c, func() { s.connect(c) })
+	}
+}
+
+// spawn runs the connection to c in a goroutine, then frees its slot. Must be called with s.mu held.
+func (s *swarm) spawn(c candidate, run func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.drop(c)
+		run()
+	}()
+}
+
+// ban keeps the swarm from connecting to the IP of p again, and from accepting its connections.
+// The current connections to it are left to end.
+func (s *swarm) ban(p peer.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.banned[p.IP.String()] = true
+}
+
+// establish records a completed handshake with flags describing the connection.
+func (s *swarm) establish(c candidate, flags pex.Flags) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c.flags |= flags
+	if _, ok := s.established[c.peer.String()]; !ok {
+		s.connected.With(c.source.String()).Inc()
+	}
+	s.established[c.peer.String()] = c
+}
+
+// drop frees the slot of a peer we disconnected from, and forgets it so that it can be added
+// again once its redial interval passed. Incoming peers are not dialed, they can be added at once.
+func (s *swarm) drop(c candidate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := c.peer.String()
+	ec, ok := s.established[key]
+	if ok {
+		s.connected.With(ec.source.String()).Dec()
+	}
+	if c.source != SourceIncoming {
+		r := s.redials[key]
+		if ok {
+			r.failures = 0
+		} else {
+			r.failures++
+		}
+		r.at = s.now().Add(redialInterval(r.failures))
+		s.redials[key] = r
+		s.pruneRedials()
+	}
+	delete(s.known, key)
+	delete(s.active, key)
+	delete(s.established, key)
+	s.fill()
+}
+
+// redialInterval returns how long a peer waits to be dialed again after failures dials in a row
+// that ended before the handshake, minRedialInterval after a connection that was established.
+func redialInterval(failures int) time.Duration {
+	d := minRedialInterval
+	for i := 1; i < failures && d < maxRedialInterval; i++ {
+		d *= 2
+	}
+	if d > maxRedialInterval {
+		d = maxRedialInterval
+	}
+	return d
+}
+
+// pruneRedials forgets the peers that can be dialed again once there are more than
+// MaxKnownPeers of them, their failures start over. Must be called with s.mu held.
+func (s *swarm) pruneRedials() {
+	if len(s.redials) <= MaxKnownPeers {
+		return
+	}
+	now := s.now()
+	for key, r := range s.redials {
+		if !now.Before(r.at) {
+			delete(s.redials, key)
+		}
+	}
+}
+
+// numAdded returns the number of peers ever added, a peer counting again when it is added
+// after its connection ended.
+func (s *swarm) numAdded() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.added
+}
+
+// numConnected returns the number of established connections.
+func (s *swarm) numConnected() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.established)
+}
+
+// PeerInfo describes a connection of a torrent to a peer.
+type PeerInfo struct {
+	Peer   peer.Peer
+	Source Source
+	// Flags describe the connection, e.g. whether it is encrypted or over uTP.
+	Flags pex.Flags
+}
+
+// peers lists the peers we are connected to.
+func (s *swarm) peers() []PeerInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ret := make([]PeerInfo, 0, len(s.established))
+	for _, c := range s.established {
+		ret = append(ret, PeerInfo{Peer: c.peer, Source: c.source, Flags: c.flags})
+	}
+	return ret
+}
+
+// entries lists the peers we are connected to, except for the one at addr.
+func (s *swarm) entries(except string) []pex.Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ret := make([]pex.Entry, 0, len(s.established))
+	for key, c := range s.established {
+		if key != except && c.source != SourceIncoming {
+			ret = append(ret, pex.Entry{Peer: c.peer, Flags: c.flags})
+		}
+	}
+	return ret
+}
@@ -0,0 +1,177 @@
+package p2p
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VIVelev/bittorrent/peer"
+	"github.com/VIVelev/bittorrent/pex"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSwarm(t *testing.T) {
+	var mu sync.Mutex
+	dialed := make(map[string]Source)
+	release := make(chan struct{})
+	var s *swarm
+	s = newSwarm(func(c candidate) {
+		mu.Lock()
+		dialed[c.peer.String()] = c.source
+		mu.Unlock()
+		s.establish(c, pex.FlagReachable)
+		<-release
+	})
+
+	peers := make([]peer.Peer, MaxPeers+1)
+	for i := range peers {
+		peers[i] = peer.Peer{IP: net.IP{10, 0, 0, byte(i)}, Port: 6881}
+	}
+	s.add(peers[:1], SourceTracker, nil)
+	s.add(peers, SourcePEX, nil) // the first one is known already
+
+	mu.Lock()
+	assert.Empty(t, dialed, "nothing is dialed before the swarm starts")
+	mu.Unlock()
+
+	s.start()
+	assert.Eventually(t, func() bool { return s.numConnected() == MaxPeers }, time.Second, time.Millisecond)
+	assert.Len(t, s.pending, 1)
+	assert.Len(t, s.entries(peers[0].String()), MaxPeers-1)
+
+	close(release)
+	assert.Eventually(t, func() bool { return s.numConnected() == 0 }, time.Second, time.Millisecond)
+	s.stop()
+	s.wait()
+	mu.Lock()
+	assert.Len(t, dialed, MaxPeers+1)
+	assert.Equal(t, SourceTracker, dialed[peers[0].String()])
+	assert.Equal(t, SourcePEX, dialed[peers[MaxPeers].String()])
+	mu.Unlock()
+}
+
+func TestSwarmKnownLimit(t *testing.T) {
+	s := newSwarm(func(candidate) {})
+	for i := 0; i < MaxKnownPeers+10; i++ {
+		s.add([]peer.Peer{{IP: net.IP{10, 0, byte(i >> 8), byte(i)}, Port: 6881}}, SourcePEX, nil)
+	}
+	assert.Len(t, s.known, MaxKnownPeers)
+
+	// only PEX is limited
+	s.add([]peer.Peer{{IP: net.IP{10, 1, 0, 0}, Port: 6881}}, SourceTracker, nil)
+	assert.Len(t, s.known, MaxKnownPeers+1)
+}
+
+func TestSwarmRedial(t *testing.T) {
+	var mu sync.Mutex
+	dials, handshake := 0, false
+	now := time.Now()
+	var s *swarm
+	s = newSwarm(func(c candidate) {
+		mu.Lock()
+		dials++
+		established := handshake
+		mu.Unlock()
+		if established {
+			s.establish(c, 0)
+		}
+	})
+	s.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	s.start()
+	p := peer.Peer{IP: net.IP{10, 0, 0, 1}, Port: 6881}
+
+	steps := []struct {
+		after     time.Duration // since the last step
+		handshake bool
+		dialed    bool
+	}{
+		{dialed: true},
+		{dialed: false}, // right after the failure
+		{after: minRedialInterval, dialed: true},
+		{after: minRedialInterval, dialed: false}, // twice as long after the second failure
+		{after: minRedialInterval, handshake: true, dialed: true},
+		{after: minRedialInterval, dialed: true}, // the connection was established, the failures start over
+	}
+	for i, step := range steps {
+		mu.Lock()
+		now = now.Add(step.after)
+		handshake = step.handshake
+		before := dials
+		mu.Unlock()
+
+		s.add([]peer.Peer{p}, SourceTracker, nil)
+		if step.dialed {
+			assert.Eventually(t, func() bool {
+				mu.Lock()
+				defer mu.Unlock()
+				return dials == before+1
+			}, time.Second, time.Millisecond, "step %d", i)
+		}
+		assert.Eventually(t, func() bool {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return len(s.active) == 0 && len(s.pending) == 0
+		}, time.Second, time.Millisecond, "step %d", i)
+		mu.Lock()
+		assert.Equal(t, step.dialed, dials == before+1, "step %d", i)
+		mu.Unlock()
+	}
+	s.stop()
+	s.wait()
+	assert.Empty(t, s.known)
+}
+
+func TestRedialInterval(t *testing.T) {
+	assert.Equal(t, minRedialInterval, redialInterval(0))
+	assert.Equal(t, minRedialInterval, redialInterval(1))
+	assert.Equal(t, 4*minRedialInterval, redialInterval(3))
+	assert.Equal(t, maxRedialInterval, redialInterval(100))
+}
+
+func TestSwarmPrefersLocalPeers(t *testing.T) {
+	s := newSwarm(func(candidate) {})
+	s.add([]peer.Peer{{IP: net.IP{1, 1, 1, 1}, Port: 6881}}, SourceTracker, nil)
+	s.add([]peer.Peer{{IP: net.IP{192, 168, 0, 2}, Port: 6881}}, SourceLSD, nil)
+
+	assert.Equal(t, SourceLSD, s.pending[0].source)
+	assert.Equal(t, SourceTracker, s.pending[1].source)
+}
+
+func TestSwarmAccept(t *testing.T) {
+	s := newSwarm(func(candidate) {})
+	in := candidate{peer: peer.Peer{IP: net.IP{10, 0, 0, 1}, Port: 51413}, source: SourceIncoming}
+	disconnect := make(chan struct{})
+	run := func() { <-disconnect }
+	assert.False(t, s.accept(in, run), "the swarm is not running")
+
+	s.start()
+	assert.True(t, s.accept(in, run))
+	assert.False(t, s.accept(in, run), "connected already")
+	assert.Equal(t, 1, s.numConnected())
+	assert.Empty(t, s.entries(""), "incoming peers are not advertised")
+	assert.Equal(t, []PeerInfo{{Peer: in.peer, Source: SourceIncoming}}, s.peers())
+
+	s.setMaxPeers(1)
+	other := candidate{peer: peer.Peer{IP: net.IP{10, 0, 0, 2}, Port: 51413}, source: SourceIncoming}
+	assert.False(t, s.accept(other, run), "no free slot")
+
+	s.ban(other.peer)
+	s.setMaxPeers(2)
+	assert.False(t, s.accept(other, run), "banned")
+	s.add([]peer.Peer{{IP: other.peer.IP, Port: 6881}}, SourceTracker, nil)
+	assert.Empty(t, s.pending, "banned")
+
+	close(disconnect)
+	s.stop()
+	s.wait()
+	assert.Equal(t, 0, s.numConnected(), "the slot is freed once the connection ends")
+	assert.False(t, s.accept(in, run), "the swarm is stopped")
+	s.add([]peer.Peer{{IP: net.IP{10, 0, 0, 2}, Port: 6881}}, SourceTracker, nil)
+	assert.Empty(t, s.active)
+	assert.Empty(t, s.pending)
+}
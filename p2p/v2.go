@@ -0,0 +1,385 @@
+package p2p
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/VIVelev/bittorrent/io"
+	"github.com/VIVelev/bittorrent/logging"
+	"github.com/VIVelev/bittorrent/merkle"
+	"github.com/VIVelev/bittorrent/message"
+)
+
+const (
+	// MaxHashes is the largest number of base layer hashes we serve in one hashes message.
+	MaxHashes int = 512
+	// maxBadBlocks is how many blocks that fail verification a peer may send for a piece.
+	maxBadBlocks int = 8
+)
+
+// v2Work lays out the pieces of a torrent without v1 metadata. Every file starts with a new piece.
+func v2Work(tf *io.TorrentFile) []*pieceWork {
+	var work []*pieceWork
+	offset := 0
+	for file, f := range tf.FileTree {
+		for p := 0; p < tf.NumPiecesV2(file); p++ {
+			length := f.Length - p*tf.PieceLength
+			if length > tf.PieceLength {
+				length = tf.PieceLength
+			}
+			work = append(work, &pieceWork{
+				index:     len(work),
+				offset:    offset + p*tf.PieceLength,
+				length:    length,
+				file:      file,
+				filePiece: p,
+			})
+		}
+		offset += f.Length
+	}
+	return work
+}
+
+// locateV2 finds the file of the file tree a v1 piece of a hybrid torrent belongs to.
+// Only pieces that lie within one file and start at a piece boundary of it have v2 hashes.
+func locateV2(tf *io.TorrentFile, pw *pieceWork) {
+	pw.file = -1
+	if !tf.IsV2() {
+		return
+	}
+
+	spans := tf.Spans(pw.offset, pw.length)
+	if len(spans) != 1 || spans[0].Offset%tf.PieceLength != 0 {
+		return
+	}
+	if i := fileTreeIndex(tf, spans[0].File); i >= 0 {
+		pw.file, pw.filePiece = i, spans[0].Offset/tf.PieceLength
+	}
+}
+
+// fileTreeIndex returns the index in the file tree of a file of a hybrid torrent, or -1.
+func fileTreeIndex(tf *io.TorrentFile, file int) int {
+	if !tf.IsMultiFile {
+		if len(tf.FileTree) == 1 {
+			return 0
+		}
+		return -1
+	}
+	path := tf.Files[file].Path
+	for i, f := range tf.FileTree {
+		if equalPaths(f.Path, path) {
+			return i
+		}
+	}
+	return -1
+}
+
+func equalPaths(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// needsLeaves reports whether the piece can only be verified block by block, against the
+// leaf hashes a v2 peer sends, as the piece layer of its file is missing.
+func (t *Torrent) needsLeaves(pw *pieceWork) bool {
+	return !t.tf.IsV1() && pw.file >= 0 && !t.tf.HasPieceLayer(pw.file)
+}
+
+// verify checks a downloaded piece against the v1 or v2 hashes of the torrent.
+func (t *Torrent) verify(pw *pieceWork, buf []byte) bool {
+	if t.tf.IsV1() {
+		return checkIntegrity(pw, buf)
+	}
+	return t.tf.VerifyPieceV2(pw.file, pw.filePiece, buf)
+}
+
+// blockHashes returns the request for the leaf hashes of the piece, and the offset of
+// the piece's first leaf among the requested ones. When the file has a single block
+// its root is its only leaf, which is returned instead.
+func (t *Torrent) blockHashes(pw *pieceWork) (hr message.HashRequest, first int, leaves []merkle.Hash) {
+	f := t.tf.FileTree[pw.file]
+	height := merkle.FileHeight(f.Length)
+	if height == 0 {
+		return hr, 0, []merkle.Hash{f.PiecesRoot}
+	}
+
+	perPiece := t.tf.PieceLength / merkle.BlockSize
+	length := perPiece
+	if f.Length <= t.tf.PieceLength {
+		length = 1 << height
+	}
+	if length < 2 {
+		length = 2
+	}
+	begin := pw.filePiece * perPiece
+	index := begin - begin%length
+
+	hr = message.HashRequest{
+		PiecesRoot:  f.PiecesRoot,
+		BaseLayer:   0,
+		Index:       index,
+		Length:      length,
+		ProofLayers: height,
+	}
+	return hr, begin - index, nil
+}
+
+// requestHashes asks the peer for the hashes of the blocks of the piece, if it can tell.
+func (state *pieceProgress) requestHashes(pc *peerConn) error {
+	pw := state.pw
+	if pw.file < 0 || !pc.V2 {
+		return nil
+	}
+
+	hr, first, leaves := pc.t.blockHashes(pw)
+	if leaves != nil {
+		// nothing was received yet
+		_, err := state.setLeaves(pc.t, leaves)
+		return err
+	}
+	if err := pc.WriteHashRequest(hr); err != nil {
+		return fmt.Errorf("write hash request: %s", err)
+	}
+	state.hashReq = &hr
+	state.firstLeaf = first
+	return nil
+}
+
+// readHashes handles the response to our hash request.
+func (state *pieceProgress) readHashes(pc *peerConn, msg *message.Message) error {
+	if msg.ID == message.MsgHashReject {
+		hr, err := message.ParseHashReject(msg)
+		if err != nil {
+			return err
+		}
+		if state.hashReq != nil && hr == *state.hashReq {
+			if pc.t.needsLeaves(state.pw) {
+				return fmt.Errorf("hashes of piece %d rejected", state.pw.index)
+			}
+			// verify the whole piece instead
+			state.hashReq = nil
+		}
+		return nil
+	}
+
+	hr, hashes, err := message.ParseHashes(msg)
+	if err != nil {
+		return err
+	}
+	if state.hashReq == nil || hr != *state.hashReq {
+		// not ours, or late
+		return nil
+	}
+	proof := make([]merkle.Hash, len(hashes))
+	for i, h := range hashes {
+		proof[i] = h
+	}
+	f := pc.t.tf.FileTree[state.pw.file]
+	if !merkle.Verify(f.PiecesRoot, merkle.FileHeight(f.Length), hr.BaseLayer, hr.Index, hr.Length, proof) {
+		return errors.New("hashes do not match the pieces root")
+	}
+
+	n := len(state.blocks)
+	state.hashReq = nil
+	wasted, err := state.setLeaves(pc.t, proof[state.firstLeaf:state.firstLeaf+n])
+	pc.t.waste(wasted, false)
+	return err
+}
+
+// setLeaves records the hashes of the blocks, checks the blocks received so far and stores
+// those that pass. Returns the bytes of those that failed the check.
+func (state *pieceProgress) setLeaves(t *Torrent, leaves []merkle.Hash) (int, error) {
+	wasted := 0
+	state.leaves = leaves
+	for i, data := range state.data {
+		if data == nil {
+			continue
+		}
+		if !state.verifyBlock(i, data) {
+			begin, size := state.blockBounds(i)
+			state.log.Warn("block failed integrity check", logging.Piece(state.pw.index), logging.Int("begin", begin))
+			state.data[i] = nil
+			state.blocks[i] = blockMissing
+			state.downloaded -= size
+			state.badBlocks++
+			wasted += size
+			continue
+		}
+		if err := state.keep(t, i, data); err != nil {
+			return wasted, err
+		}
+	}
+	return wasted, nil
+}
+
+// verifyBlock checks the data of block i against its leaf hash, if it is known.
+func (state *pieceProgress) verifyBlock(i int, data []byte) bool {
+	if state.leaves == nil {
+		return true
+	}
+	return sha256.Sum256(data) == state.leaves[i]
+}
+
+// verified reports whether every block of the piece was checked against its leaf hash.
+func (state *pieceProgress) verified() bool {
+	return state.leaves != nil
+}
+
+// tree returns the merkle tree above the piece layer of the file with the given root, or nil.
+func (t *Torrent) tree(root merkle.Hash) *merkle.Tree {
+	t.treesMu.Lock()
+	defer t.treesMu.Unlock()
+
+	if tree, ok := t.trees[root]; ok {
+		return tree
+	}
+	layer, ok := t.tf.PieceLayers[root]
+	if !ok {
+		return nil
+	}
+	perPiece := t.tf.PieceLength / merkle.BlockSize
+	tree := merkle.NewTree(layer, merkle.FileHeight(t.tf.PieceLength), merkle.Width(len(layer)), merkle.Pad(perPiece))
+	if t.trees == nil {
+		t.trees = make(map[merkle.Hash]*merkle.Tree)
+	}
+	t.trees[root] = tree
+	return tree
+}
+
+// fullTree returns the merkle tree of the file with the given root down to the leaves,
+// or nil until every piece of the file is stored. It is built from the storage once.
+func (t *Torrent) fullTree(root merkle.Hash) *merkle.Tree {
+	t.treesMu.Lock()
+	tree, ok := t.fullTrees[root]
+	t.treesMu.Unlock()
+	if ok {
+		return tree
+	}
+
+	file := -1
+	for i, f := range t.tf.FileTree {
+		if f.PiecesRoot == root && f.Length > 0 {
+			file = i
+			break
+		}
+	}
+	if file < 0 {
+		return nil
+	}
+	leaves, err := t.fileLeaves(file)
+	if err != nil {
+		t.log.Error("could not hash file", logging.Int("file", file), logging.Err(err))
+		return nil
+	}
+	if leaves == nil {
+		return nil
+	}
+	width := merkle.Width(len(leaves))
+	if merkle.Root(leaves, width, merkle.Hash{}) != root {
+		t.log.Warn("file does not match its pieces root", logging.Int("file", file))
+		return nil
+	}
+
+	tree = merkle.NewTree(leaves, 0, width, merkle.Hash{})
+	t.treesMu.Lock()
+	defer t.treesMu.Unlock()
+	if t.fullTrees == nil {
+		t.fullTrees = make(map[merkle.Hash]*merkle.Tree)
+	}
+	t.fullTrees[root] = tree
+	return tree
+}
+
+// fileLeaves hashes the blocks of the file of the file tree with the given index,
+// reading them from the storage. It returns nil while a piece of the file is not stored.
+func (t *Torrent) fileLeaves(file int) ([]merkle.Hash, error) {
+	t.filesMu.Lock()
+	s := t.storage
+	t.filesMu.Unlock()
+	offset := fileOffset(t.tf, file)
+	if s == nil || offset < 0 {
+		return nil, nil
+	}
+
+	end := offset + t.tf.FileTree[file].Length
+	var leaves []merkle.Hash
+	buf := make([]byte, t.tf.PieceLength)
+	for _, pw := range t.pk.work {
+		if pw.offset+pw.length <= offset || pw.offset >= end {
+			continue
+		}
+		if !t.pk.isDone(pw.index) {
+			return nil, nil
+		}
+		// files start at a piece boundary, so do the blocks of the file within the piece
+		begin, stop := pw.offset, pw.offset+pw.length
+		if begin < offset {
+			begin = offset
+		}
+		if stop > end {
+			stop = end
+		}
+		data := buf[:stop-begin]
+		if _, err := s.ReadAt(data, pw.index, begin-pw.offset); err != nil {
+			return nil, err
+		}
+		leaves = append(leaves, merkle.Blocks(data)...)
+	}
+	return leaves, nil
+}
+
+// fileOffset returns the offset of the file of the file tree with the given index among
+// the contents of the torrent, or -1 when a hybrid torrent does not list it.
+func fileOffset(tf *io.TorrentFile, file int) int {
+	offset := 0
+	if !tf.IsV1() {
+		for _, f := range tf.FileTree[:file] {
+			offset += f.Length
+		}
+		return offset
+	}
+	if !tf.IsMultiFile {
+		return 0
+	}
+	for i, f := range tf.Files {
+		if fileTreeIndex(tf, i) == file {
+			return offset
+		}
+		offset += f.Length
+	}
+	return -1
+}
+
+// handleHashRequest serves the hashes the metadata holds from the piece layers up,
+// and the others once the file is complete.
+func (pc *peerConn) handleHashRequest(msg *message.Message) error {
+	hr, err := message.ParseHashRequest(msg)
+	if err != nil {
+		return err
+	}
+
+	tree := pc.t.tree(hr.PiecesRoot)
+	if tree == nil || hr.BaseLayer < merkle.FileHeight(pc.t.tf.PieceLength) {
+		tree = pc.t.fullTree(hr.PiecesRoot)
+	}
+	if tree == nil || hr.Length > MaxHashes {
+		return pc.WriteHashReject(hr)
+	}
+	proof, err := tree.Proof(hr.BaseLayer, hr.Index, hr.Length, hr.ProofLayers)
+	if err != nil {
+		return pc.WriteHashReject(hr)
+	}
+	hashes := make([][32]byte, len(proof))
+	for i, h := range proof {
+		hashes[i] = h
+	}
+	return pc.WriteHashes(hr, hashes)
+}
@@ -0,0 +1,356 @@
+package p2p
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VIVelev/bittorrent/client"
+	"github.com/VIVelev/bittorrent/handshake"
+	"github.com/VIVelev/bittorrent/io"
+	"github.com/VIVelev/bittorrent/merkle"
+	"github.com/VIVelev/bittorrent/message"
+	"github.com/VIVelev/bittorrent/mse"
+	"github.com/VIVelev/bittorrent/peer"
+	"github.com/VIVelev/bittorrent/storage"
+	"github.com/jackpal/bencode-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newV2TestTorrent builds the metadata of a v2 torrent without v1 metadata holding the files.
+func newV2TestTorrent(t *testing.T, pieceLength int, names []string, files [][]byte) *io.TorrentFile {
+	tree := make(map[string]interface{})
+	layers := make(map[string]interface{})
+	for i, data := range files {
+		root := merkle.DataRoot(data)
+		tree[names[i]] = map[string]interface{}{"": map[string]interface{}{"length": len(data), "pieces root": string(root[:])}}
+		if len(data) <= pieceLength {
+			continue
+		}
+		var layer []byte
+		for begin := 0; begin < len(data); begin += pieceLength {
+			end := begin + pieceLength
+			if end > len(data) {
+				end = len(data)
+			}
+			h := merkle.PieceRoot(data[begin:end], pieceLength)
+			layer = append(layer, h[:]...)
+		}
+		layers[string(root[:])] = string(layer)
+	}
+
+	buf := new(bytes.Buffer)
+	require.Nil(t, bencode.Marshal(buf, map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         "v2",
+			"piece length": pieceLength,
+			"meta version": 2,
+			"file tree":    tree,
+		},
+		"piece layers": layers,
+	}))
+	tf, err := io.Parse(buf.Bytes())
+	require.Nil(t, err)
+	return tf
+}
+
+// v2Seeder serves every piece of a v2 torrent to one peer at a time and answers hash requests.
+// It corrupts the first response for the block at corruptBegin of piece corruptIndex.
+type v2Seeder struct {
+	tf           *io.TorrentFile
+	files        [][]byte
+	corruptIndex int
+	corruptBegin int
+
+	mu       sync.Mutex
+	requests map[[2]int]int // by piece and begin
+	hashReqs int
+}
+
+func (s *v2Seeder) serve(t *testing.T, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(t, conn)
+	}
+}
+
+func (s *v2Seeder) serveConn(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	if _, err := handshake.Unmarshal(conn); err != nil {
+		return
+	}
+	hs := &handshake.Handshake{InfoHash: s.tf.InfoHash, PeerID: [20]byte{9}}
+	hs.Enable(handshake.ExtFast)
+	hs.Enable(handshake.ExtV2)
+	res := handshake.Marshal(hs)
+	conn.Write(res[:])
+	conn.Write(message.Marshal(message.HaveAll()))
+	conn.Write(message.Marshal(&message.Message{ID: message.MsgUnchoke}))
+
+	work := v2Work(s.tf)
+	for {
+		msg, err := message.Unmarshal(conn)
+		if err != nil {
+			return
+		}
+		if msg == nil {
+			continue
+		}
+		switch msg.ID {
+		case message.MsgRequest:
+			index, begin, length, err := message.ParseRequest(msg)
+			require.Nil(t, err)
+			pw := work[index]
+			data := s.files[pw.file][pw.filePiece*s.tf.PieceLength+begin:][:length]
+
+			s.mu.Lock()
+			s.requests[[2]int{index, begin}]++
+			first := s.requests[[2]int{index, begin}] == 1
+			s.mu.Unlock()
+			if first && index == s.corruptIndex && begin == s.corruptBegin {
+				data = make([]byte, length)
+			}
+			conn.Write(message.Marshal(message.Piece(index, begin, data)))
+		case message.MsgHashRequest:
+			hr, err := message.ParseHashRequest(msg)
+			require.Nil(t, err)
+			s.mu.Lock()
+			s.hashReqs++
+			s.mu.Unlock()
+
+			var proof []merkle.Hash
+			for _, data := range s.files {
+				if merkle.DataRoot(data) == hr.PiecesRoot {
+					leaves := merkle.Blocks(data)
+					tree := merkle.NewTree(leaves, 0, merkle.Width(len(leaves)), merkle.Hash{})
+					proof, err = tree.Proof(hr.BaseLayer, hr.Index, hr.Length, hr.ProofLayers)
+					require.Nil(t, err)
+				}
+			}
+			hashes := make([][32]byte, len(proof))
+			for i, h := range proof {
+				hashes[i] = h
+			}
+			conn.Write(message.Marshal(message.Hashes(hr, hashes)))
+		}
+	}
+}
+
+func TestV2Download(t *testing.T) {
+	pieceLength := 2 * merkle.BlockSize
+	files := [][]byte{
+		randomData(5*merkle.BlockSize + 100),
+		randomData(100), // a single block
+		randomData(merkle.BlockSize + 1),
+	}
+	tf := newV2TestTorrent(t, pieceLength, []string{"a", "b", "c"}, files)
+	require.False(t, tf.IsV1())
+
+	// the second block of the second piece of a is corrupted once
+	seeder := &v2Seeder{tf: tf, files: files, corruptIndex: 1, corruptBegin: merkle.BlockSize, requests: make(map[[2]int]int)}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	go seeder.serve(t, ln)
+
+	tr := NewTorrent(tf, [20]byte{1})
+	tr.Dialer = &client.Dialer{Encryption: mse.PolicyDisable, Timeout: time.Second, DisableUTP: true}
+	addr := ln.Addr().(*net.TCPAddr)
+	tr.AddPeers([]peer.Peer{{IP: addr.IP, Port: uint16(addr.Port)}}, SourceTracker)
+
+	done := make(chan []byte)
+	go func() { done <- tr.Run() }()
+	var data []byte
+	select {
+	case data = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("download did not finish")
+	}
+
+	var expected []byte
+	for _, f := range files {
+		expected = append(expected, f...)
+	}
+	assert.True(t, bytes.Equal(expected, data))
+
+	seeder.mu.Lock()
+	defer seeder.mu.Unlock()
+	// only the corrupted block was downloaded twice
+	for key, n := range seeder.requests {
+		if key == [2]int{1, merkle.BlockSize} {
+			assert.Equal(t, 2, n)
+		} else {
+			assert.Equal(t, 1, n, "block %v", key)
+		}
+	}
+	// b has a single block, its root is its hash
+	assert.Equal(t, 4, seeder.hashReqs)
+	st := tr.Stats()
+	assert.Equal(t, int64(merkle.BlockSize), st.Wasted, "the corrupted block")
+	assert.Equal(t, 0, st.HashFailures)
+}
+
+func TestV2DownloadWithoutPieceLayers(t *testing.T) {
+	pieceLength := 2 * merkle.BlockSize
+	files := [][]byte{randomData(5*merkle.BlockSize + 100), randomData(100)}
+	full := newV2TestTorrent(t, pieceLength, []string{"a", "b"}, files)
+	// as fetched for a magnet link
+	tf, err := io.ParseInfo(full.InfoBytes)
+	require.Nil(t, err)
+	require.False(t, tf.HasPieceLayer(0))
+
+	seeder := &v2Seeder{tf: full, files: files, corruptIndex: -1, requests: make(map[[2]int]int)}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	go seeder.serve(t, ln)
+
+	tr := NewTorrent(tf, [20]byte{1})
+	tr.Dialer = &client.Dialer{Encryption: mse.PolicyDisable, Timeout: time.Second, DisableUTP: true}
+	addr := ln.Addr().(*net.TCPAddr)
+	tr.AddPeers([]peer.Peer{{IP: addr.IP, Port: uint16(addr.Port)}}, SourceTracker)
+
+	done := make(chan []byte)
+	go func() { done <- tr.Run() }()
+	select {
+	case data := <-done:
+		assert.True(t, bytes.Equal(append(append([]byte(nil), files[0]...), files[1]...), data))
+	case <-time.After(10 * time.Second):
+		t.Fatal("download did not finish")
+	}
+}
+
+func TestHandleHashRequest(t *testing.T) {
+	pieceLength := merkle.BlockSize
+	data := randomData(5 * merkle.BlockSize)
+	tf := newV2TestTorrent(t, pieceLength, []string{"a"}, [][]byte{data})
+	root := tf.FileTree[0].PiecesRoot
+
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+	pc := newPeerConn(&client.Client{Conn: ours}, NewTorrent(tf, [20]byte{}), peer.Peer{})
+	leaves := merkle.Blocks(data)
+	full := merkle.NewTree(leaves, 0, merkle.Width(len(leaves)), merkle.Hash{})
+
+	tests := map[string]struct {
+		hr     message.HashRequest
+		reject bool
+	}{
+		"piece layer": {
+			hr: message.HashRequest{PiecesRoot: root, BaseLayer: 0, Index: 2, Length: 2, ProofLayers: 3},
+		},
+		"unknown root": {
+			hr:     message.HashRequest{PiecesRoot: merkle.Hash{1}, BaseLayer: 0, Index: 0, Length: 2, ProofLayers: 3},
+			reject: true,
+		},
+		"out of range": {
+			hr:     message.HashRequest{PiecesRoot: root, BaseLayer: 0, Index: 8, Length: 2, ProofLayers: 3},
+			reject: true,
+		},
+	}
+
+	for name, test := range tests {
+		go func(hr message.HashRequest) {
+			assert.Nil(t, pc.handleHashRequest(message.RequestHashes(hr)))
+		}(test.hr)
+		msg, err := message.Unmarshal(theirs)
+		require.Nil(t, err, name)
+		if test.reject {
+			assert.Equal(t, message.MsgHashReject, msg.ID, name)
+			continue
+		}
+		hr, hashes, err := message.ParseHashes(msg)
+		require.Nil(t, err, name)
+		assert.Equal(t, test.hr, hr, name)
+		want, err := full.Proof(test.hr.BaseLayer, test.hr.Index, test.hr.Length, test.hr.ProofLayers)
+		require.Nil(t, err, name)
+		require.Len(t, hashes, len(want), name)
+		for i := range want {
+			assert.Equal(t, [32]byte(want[i]), hashes[i], name)
+		}
+	}
+}
+
+func TestHandleLeafHashRequest(t *testing.T) {
+	pieceLength := 2 * merkle.BlockSize
+	data := randomData(5 * merkle.BlockSize)
+	tf := newV2TestTorrent(t, pieceLength, []string{"a"}, [][]byte{data})
+	root := tf.FileTree[0].PiecesRoot
+	tr := NewTorrent(tf, [20]byte{})
+	tr.storage = storage.NewMemory(tf)
+
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+	pc := newPeerConn(&client.Client{Conn: ours}, tr, peer.Peer{})
+	leaves := merkle.Blocks(data)
+	full := merkle.NewTree(leaves, 0, merkle.Width(len(leaves)), merkle.Hash{})
+
+	request := func(hr message.HashRequest) *message.Message {
+		go func() {
+			assert.Nil(t, pc.handleHashRequest(message.RequestHashes(hr)))
+		}()
+		msg, err := message.Unmarshal(theirs)
+		require.Nil(t, err)
+		return msg
+	}
+	leaf := message.HashRequest{PiecesRoot: root, BaseLayer: 0, Index: 2, Length: 2, ProofLayers: 2}
+	pieces := message.HashRequest{PiecesRoot: root, BaseLayer: 1, Index: 0, Length: 2, ProofLayers: 1}
+
+	// the leaves are known once the file is complete
+	assert.Equal(t, message.MsgHashReject, request(leaf).ID)
+	assert.Equal(t, message.MsgHashes, request(pieces).ID)
+	copy(tr.storage.(*storage.Memory).Bytes(), data)
+	for _, pw := range tr.pk.work {
+		require.Nil(t, tr.storage.MarkComplete(pw.index))
+		tr.pk.done(pw)
+	}
+
+	for _, hr := range []message.HashRequest{leaf, pieces} {
+		msg := request(hr)
+		require.Equal(t, message.MsgHashes, msg.ID)
+		_, hashes, err := message.ParseHashes(msg)
+		require.Nil(t, err)
+		want, err := full.Proof(hr.BaseLayer, hr.Index, hr.Length, hr.ProofLayers)
+		require.Nil(t, err)
+		require.Len(t, hashes, len(want))
+		for i := range want {
+			assert.Equal(t, [32]byte(want[i]), hashes[i])
+		}
+	}
+}
+
+func TestV2Seed(t *testing.T) {
+	pieceLength := 2 * merkle.BlockSize
+	data := randomData(5*merkle.BlockSize + 100)
+	tf := newV2TestTorrent(t, pieceLength, []string{"a"}, [][]byte{data})
+	s := storage.NewMemory(tf)
+	copy(s.Bytes(), data)
+	for i := range v2Work(tf) {
+		require.Nil(t, s.MarkComplete(i))
+	}
+	seeder, p := startSeeder(t, tf, s)
+	defer seeder.Stop()
+
+	leecher := NewTorrent(tf, [20]byte{1})
+	leecher.Dialer = &client.Dialer{Encryption: mse.PolicyDisable, Timeout: time.Second, DisableUTP: true, V2: true}
+	leecher.AddPeers([]peer.Peer{p}, SourceTracker)
+	done := make(chan []byte)
+	go func() { done <- leecher.Run() }()
+	select {
+	case got := <-done:
+		assert.True(t, bytes.Equal(data, got))
+	case <-time.After(10 * time.Second):
+		t.Fatal("download did not finish")
+	}
+
+	// the leecher asked for the leaves of the pieces, and the seeder served them
+	seeder.treesMu.Lock()
+	defer seeder.treesMu.Unlock()
+	assert.NotNil(t, seeder.fullTrees[tf.FileTree[0].PiecesRoot])
+}
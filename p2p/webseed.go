@@ -0,0 +1,224 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VIVelev/bittorrent/event"
+	"github.com/VIVelev/bittorrent/logging"
+)
+
+const (
+	// MinWebSeedBackoff is how long a failing web or HTTP seed is left alone at first.
+	MinWebSeedBackoff time.Duration = 5 * time.Second
+	// MaxWebSeedBackoff caps the backoff of a failing web or HTTP seed.
+	MaxWebSeedBackoff time.Duration = 10 * time.Minute
+)
+
+// retryError is returned when the server asks us to come back later.
+type retryError struct {
+	status string
+	after  time.Duration
+}
+
+func (e *retryError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", e.status, e.after)
+}
+
+// httpSource is the state shared by the downloaders that fetch pieces over HTTP.
+type httpSource struct {
+	t       *Torrent
+	url     string
+	backoff time.Duration
+}
+
+// a web or HTTP seed has every piece and never chokes, it cannot send the hashes of blocks
+func (hs *httpSource) has(int) bool     { return true }
+func (hs *httpSource) suggested() []int { return nil }
+
+func (hs *httpSource) canRequest(index int) bool { return !hs.t.needsLeaves(hs.t.pk.work[index]) }
+
+// webSeed downloads pieces from an HTTP or FTP server, BEP 19.
+// reference: https://www.bittorrent.org/beps/bep_0019.html
+type webSeed struct {
+	httpSource
+}
+
+// fileURL returns the URL of the file with the given index.
+func (ws *webSeed) fileURL(file int) string {
+	tf := ws.t.tf
+	if !tf.IsMultiFile {
+		// a URL ending with a slash names the directory holding the file
+		if strings.HasSuffix(ws.url, "/") {
+			return ws.url + url.PathEscape(tf.Name)
+		}
+		return ws.url
+	}
+
+	base := ws.url
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	parts := []string{url.PathEscape(tf.Name)}
+	for _, p := range tf.Files[file].Path {
+		parts = append(parts, url.PathEscape(p))
+	}
+	return base + strings.Join(parts, "/")
+}
+
+// get reads len(buf) bytes of the file at u starting at offset.
+func (ws *webSeed) get(u string, offset int, buf []byte) error {
+	if isFTP(u) {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return err
+		}
+		return ftpGet(ws.t.ctx, parsed, offset, buf)
+	}
+
+	req, err := http.NewRequestWithContext(ws.t.ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+len(buf)-1))
+
+	resp, err := ws.t.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the server ignored the range
+		if _, err := io.CopyN(io.Discard, resp.Body, int64(offset)); err != nil {
+			return fmt.Errorf("skip to offset: %s", err)
+		}
+	case http.StatusServiceUnavailable, http.StatusTooManyRequests:
+		return &retryError{status: resp.Status, after: retryAfter(resp.Header.Get("Retry-After"))}
+	default:
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		return fmt.Errorf("read body: %s", err)
+	}
+	return nil
+}
+
+// retryAfter parses the value of a Retry-After header, in seconds or an HTTP date.
+// Returns MinWebSeedBackoff if it is missing or malformed.
+func retryAfter(value string) time.Duration {
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if d := time.Until(date); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return MinWebSeedBackoff
+}
+
+// downloadPiece fetches every file range the piece spans.
+func (ws *webSeed) downloadPiece(pw *pieceWork) ([]byte, error) {
+	buf := make([]byte, pw.length)
+	n := 0
+	tf := ws.t.tf
+	for _, s := range tf.Spans(pw.offset, pw.length) {
+		if tf.IsMultiFile && tf.Files[s.File].IsPadding() {
+			// padding files are not on the server, they are zeros
+			n += s.Length
+			continue
+		}
+		if err := ws.get(ws.fileURL(s.File), s.Offset, buf[n:n+s.Length]); err != nil {
+			return nil, err
+		}
+		n += s.Length
+	}
+	return buf, nil
+}
+
+// fail puts the piece back and waits before the server is used again.
+func (hs *httpSource) fail(pw *pieceWork, err error) {
+	hs.t.pk.putBack(pw)
+
+	var re *retryError
+	if errors.As(err, &re) {
+		hs.backoff = re.after
+	} else if hs.backoff < MinWebSeedBackoff {
+		hs.backoff = MinWebSeedBackoff
+	} else {
+		hs.backoff *= 2
+	}
+	if hs.backoff > MaxWebSeedBackoff {
+		hs.backoff = MaxWebSeedBackoff
+	}
+	hs.t.log.Warn("seed failed, retrying", logging.String("url", hs.url), logging.Err(err),
+		logging.Duration("backoff", hs.backoff))
+	timer := time.NewTimer(hs.backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-hs.t.stopped:
+	}
+}
+
+// run downloads pieces with download until every piece is done.
+func (hs *httpSource) run(download func(*pieceWork) ([]byte, error)) {
+	t := hs.t
+	for {
+		pw := t.pk.next(hs)
+		if pw == nil {
+			return
+		}
+
+		buf, err := download(pw)
+		if err != nil {
+			hs.fail(pw, err)
+			continue
+		}
+		t.received(nil, len(buf))
+		t.tf.ZeroPadding(pw.offset, buf)
+		if !t.verify(pw, buf) {
+			err := fmt.Errorf("piece %d failed integrity check", pw.index)
+			t.waste(len(buf), true)
+			t.m.failed.Inc()
+			t.publish(event.Event{Type: event.PieceFailed, Piece: pw.index, Err: err})
+			hs.fail(pw, err)
+			continue
+		}
+
+		hs.backoff = 0
+		if err := t.store(pw, buf); err != nil {
+			return
+		}
+	}
+}
+
+// isHTTP reports whether u can be fetched with net/http.
+func isHTTP(u string) bool {
+	return strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://")
+}
+
+// isFTP reports whether u is fetched with ftpGet.
+func isFTP(u string) bool {
+	return strings.HasPrefix(u, "ftp://")
+}
+
+func (t *Torrent) startWebSeed(u string) {
+	if !isHTTP(u) && !isFTP(u) {
+		t.log.Warn("skipping web seed, only HTTP and FTP are supported", logging.String("url", u))
+		return
+	}
+	ws := &webSeed{httpSource{t: t, url: u}}
+	ws.run(ws.downloadPiece)
+}
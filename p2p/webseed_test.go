@@ -0,0 +1,130 @@
+package p2p
+
+import (
+	"bytes"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/VIVelev/bittorrent/internal/testtorrent"
+	"github.com/VIVelev/bittorrent/io"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestTorrent builds the metadata of a torrent with the given files.
+// A single file without a path makes a single-file torrent.
+func newTestTorrent(t *testing.T, name string, pieceLength int, files []testtorrent.File, data []byte) *io.TorrentFile {
+	tt := testtorrent.Torrent{Name: name, PieceLength: pieceLength, Files: files}
+	if len(files) == 1 && files[0].Path == nil {
+		require.Equal(t, files[0].Length, len(data))
+		tt.Files = nil
+	}
+	return tt.Parse(t, data)
+}
+
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+func TestFileURL(t *testing.T) {
+	single := newTestTorrent(t, "my file.iso", 16, []testtorrent.File{{Length: 10}}, make([]byte, 10))
+	multi := newTestTorrent(t, "dir", 16, []testtorrent.File{
+		{Length: 5, Path: []string{"a b", "c"}},
+		{Length: 5, Path: []string{"d"}},
+	}, make([]byte, 10))
+
+	tests := map[string]struct {
+		ws     *webSeed
+		file   int
+		output string
+	}{
+		"single file": {
+			ws:     &webSeed{httpSource{t: &Torrent{tf: single}, url: "http://example.com/mirror/file.iso"}},
+			output: "http://example.com/mirror/file.iso",
+		},
+		"single file in a directory": {
+			ws:     &webSeed{httpSource{t: &Torrent{tf: single}, url: "http://example.com/mirror/"}},
+			output: "http://example.com/mirror/my%20file.iso",
+		},
+		"multi file": {
+			ws:     &webSeed{httpSource{t: &Torrent{tf: multi}, url: "http://example.com/mirror"}},
+			output: "http://example.com/mirror/dir/a%20b/c",
+		},
+		"multi file with slash": {
+			ws:     &webSeed{httpSource{t: &Torrent{tf: multi}, url: "http://example.com/mirror/"}},
+			file:   1,
+			output: "http://example.com/mirror/dir/d",
+		},
+	}
+
+	for name, test := range tests {
+		assert.Equal(t, test.output, test.ws.fileURL(test.file), name)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	assert.Equal(t, 3*time.Second, retryAfter("3"))
+	assert.Equal(t, MinWebSeedBackoff, retryAfter(""))
+	assert.Equal(t, time.Duration(0), retryAfter(time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)))
+}
+
+func TestWebSeedDownload(t *testing.T) {
+	data := randomData(100000)
+	files := map[string][]byte{
+		"/seed/dir/a":      data[:30000],
+		"/seed/dir/b/c":    data[30000:30001],
+		"/seed/dir/b/last": data[30001:],
+		"/seed/single.bin": data,
+	}
+
+	var requests, failures int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first request is turned away
+		if atomic.AddInt32(&requests, 1) == 1 {
+			atomic.AddInt32(&failures, 1)
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(content))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	tests := map[string]struct {
+		tf  *io.TorrentFile
+		url string
+	}{
+		"single file": {
+			tf:  newTestTorrent(t, "single.bin", 16384, []testtorrent.File{{Length: len(data)}}, data),
+			url: server.URL + "/seed/",
+		},
+		"multi file": {
+			tf: newTestTorrent(t, "dir", 16384, []testtorrent.File{
+				{Length: 30000, Path: []string{"a"}},
+				{Length: 1, Path: []string{"b", "c"}},
+				{Length: len(data) - 30001, Path: []string{"b", "last"}},
+			}, data),
+			url: server.URL + "/seed",
+		},
+	}
+
+	for name, test := range tests {
+		atomic.StoreInt32(&requests, 0)
+		test.tf.URLList = []string{test.url}
+		tr := NewTorrent(test.tf, [20]byte{})
+		assert.True(t, bytes.Equal(data, tr.Run()), name)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&failures))
+}
@@ -20,7 +20,16 @@ func (p Peer) String() string {
 
 // UnmarshalCompact parses bytes in compact representation to peers.
 func UnmarshalCompact(peersBin []byte) ([]Peer, error) {
-	const peerSize = 6 // 4 bytes for IP, 2 for Port
+	return unmarshalCompact(peersBin, net.IPv4len)
+}
+
+// UnmarshalCompact6 parses bytes in IPv6 compact representation (BEP 7) to peers.
+func UnmarshalCompact6(peersBin []byte) ([]Peer, error) {
+	return unmarshalCompact(peersBin, net.IPv6len)
+}
+
+func unmarshalCompact(peersBin []byte, ipLen int) ([]Peer, error) {
+	peerSize := ipLen + 2 // bytes for IP, 2 for Port
 	if len(peersBin)%peerSize != 0 {
 		return nil, fmt.Errorf("peers bin must be a multiple of %d", peerSize)
 	}
@@ -28,8 +37,32 @@ func UnmarshalCompact(peersBin []byte) ([]Peer, error) {
 	peers := make([]Peer, len(peersBin)/peerSize)
 	for i := range peers {
 		offset := i * peerSize
-		peers[i].IP = net.IP(peersBin[offset : offset+4])
-		peers[i].Port = binary.BigEndian.Uint16([]byte(peersBin[offset+4 : offset+6]))
+		peers[i].IP = net.IP(peersBin[offset : offset+ipLen])
+		peers[i].Port = binary.BigEndian.Uint16([]byte(peersBin[offset+ipLen : offset+peerSize]))
 	}
 	return peers, nil
 }
+
+// MarshalCompact serializes the IPv4 peers to compact representation, others are skipped.
+func MarshalCompact(peers []Peer) []byte {
+	ret := make([]byte, 0, len(peers)*6)
+	for _, p := range peers {
+		if ip := p.IP.To4(); ip != nil {
+			ret = append(ret, ip...)
+			ret = append(ret, byte(p.Port>>8), byte(p.Port))
+		}
+	}
+	return ret
+}
+
+// MarshalCompact6 serializes the IPv6 peers to compact representation, others are skipped.
+func MarshalCompact6(peers []Peer) []byte {
+	ret := make([]byte, 0, len(peers)*18)
+	for _, p := range peers {
+		if p.IP.To4() == nil && len(p.IP) == net.IPv6len {
+			ret = append(ret, p.IP...)
+			ret = append(ret, byte(p.Port>>8), byte(p.Port))
+		}
+	}
+	return ret
+}
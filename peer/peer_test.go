@@ -53,3 +53,28 @@ func TestString(t *testing.T) {
 		assert.Equal(t, test.output, s)
 	}
 }
+
+func TestCompact6(t *testing.T) {
+	peers := []Peer{
+		{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+		{IP: net.IP{127, 0, 0, 1}, Port: 80}, // skipped
+	}
+
+	bin := MarshalCompact6(peers)
+	assert.Len(t, bin, 18)
+	parsed, err := UnmarshalCompact6(bin)
+	assert.Nil(t, err)
+	assert.Equal(t, peers[:1], parsed)
+
+	_, err = UnmarshalCompact6(bin[:17])
+	assert.NotNil(t, err)
+}
+
+func TestMarshalCompact(t *testing.T) {
+	peers := []Peer{
+		{IP: net.IP{127, 0, 0, 1}, Port: 80},
+		{IP: net.ParseIP("2001:db8::1"), Port: 6881}, // skipped
+		{IP: net.ParseIP("1.1.1.1"), Port: 443},
+	}
+	assert.Equal(t, []byte{127, 0, 0, 1, 0x00, 0x50, 1, 1, 1, 1, 0x01, 0xbb}, MarshalCompact(peers))
+}
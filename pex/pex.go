@@ -0,0 +1,200 @@
+// Package pex implements Peer Exchange, BEP 11.
+// reference: https://www.bittorrent.org/beps/bep_0011.html
+package pex
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/VIVelev/bittorrent/peer"
+	"github.com/jackpal/bencode-go"
+)
+
+// Flags describe a peer in the added.f and added6.f lists.
+type Flags byte
+
+const (
+	FlagEncryption Flags = 0x01 // prefers encryption
+	FlagSeed       Flags = 0x02 // is a seed or partial seed
+	FlagUTP        Flags = 0x04 // supports uTP
+	FlagHolepunch  Flags = 0x08 // supports ut_holepunch
+	FlagReachable  Flags = 0x10 // accepts incoming connections
+)
+
+const (
+	// MaxPeers is the most added and the most dropped peers taken from or put in a message.
+	MaxPeers int = 50
+	// Interval is the minimum time between two messages sent on a connection.
+	Interval time.Duration = time.Minute
+	// MinRecvInterval is the minimum time between two messages accepted from a connection,
+	// a little lower than Interval to tolerate timer skew.
+	MinRecvInterval time.Duration = 45 * time.Second
+)
+
+type bencodeMessage struct {
+	Added    string `bencode:"added"`
+	AddedF   string `bencode:"added.f"`
+	Added6   string `bencode:"added6,omitempty"`
+	Added6F  string `bencode:"added6.f,omitempty"`
+	Dropped  string `bencode:"dropped"`
+	Dropped6 string `bencode:"dropped6,omitempty"`
+}
+
+// Entry is a peer and its flags.
+type Entry struct {
+	Peer  peer.Peer
+	Flags Flags
+}
+
+// Message is the payload of a ut_pex message.
+type Message struct {
+	Added   []Entry
+	Dropped []peer.Peer
+}
+
+// Marshal serializes the message.
+func (m *Message) Marshal() ([]byte, error) {
+	var added, added6, dropped, dropped6 []peer.Peer
+	var flags, flags6 []byte
+	for _, e := range m.Added {
+		if e.Peer.IP.To4() != nil {
+			added = append(added, e.Peer)
+			flags = append(flags, byte(e.Flags))
+		} else {
+			added6 = append(added6, e.Peer)
+			flags6 = append(flags6, byte(e.Flags))
+		}
+	}
+	for _, p := range m.Dropped {
+		if p.IP.To4() != nil {
+			dropped = append(dropped, p)
+		} else {
+			dropped6 = append(dropped6, p)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	err := bencode.Marshal(buf, bencodeMessage{
+		Added:    string(peer.MarshalCompact(added)),
+		AddedF:   string(flags),
+		Added6:   string(peer.MarshalCompact6(added6)),
+		Added6F:  string(flags6),
+		Dropped:  string(peer.MarshalCompact(dropped)),
+		Dropped6: string(peer.MarshalCompact6(dropped6)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal parses a ut_pex payload. At most MaxPeers added and MaxPeers dropped
+// peers are kept, and peers that cannot be connected to are discarded.
+func Unmarshal(payload []byte) (*Message, error) {
+	bm := bencodeMessage{}
+	if err := bencode.Unmarshal(bytes.NewReader(payload), &bm); err != nil {
+		return nil, err
+	}
+
+	added, err := peer.UnmarshalCompact([]byte(bm.Added))
+	if err != nil {
+		return nil, fmt.Errorf("added: %s", err)
+	}
+	added6, err := peer.UnmarshalCompact6([]byte(bm.Added6))
+	if err != nil {
+		return nil, fmt.Errorf("added6: %s", err)
+	}
+	dropped, err := peer.UnmarshalCompact([]byte(bm.Dropped))
+	if err != nil {
+		return nil, fmt.Errorf("dropped: %s", err)
+	}
+	dropped6, err := peer.UnmarshalCompact6([]byte(bm.Dropped6))
+	if err != nil {
+		return nil, fmt.Errorf("dropped6: %s", err)
+	}
+
+	m := new(Message)
+	addEntries := func(peers []peer.Peer, flags string) {
+		for i, p := range peers {
+			if len(m.Added) == MaxPeers {
+				return
+			}
+			if !valid(p) {
+				continue
+			}
+			e := Entry{Peer: p}
+			if i < len(flags) {
+				e.Flags = Flags(flags[i])
+			}
+			m.Added = append(m.Added, e)
+		}
+	}
+	addEntries(added, bm.AddedF)
+	addEntries(added6, bm.Added6F)
+
+	for _, p := range append(dropped, dropped6...) {
+		if len(m.Dropped) == MaxPeers {
+			break
+		}
+		m.Dropped = append(m.Dropped, p)
+	}
+	return m, nil
+}
+
+// valid checks if p is worth connecting to.
+func valid(p peer.Peer) bool {
+	return p.Port != 0 && !p.IP.IsUnspecified() && !p.IP.IsMulticast() && !p.IP.Equal(net.IPv4bcast)
+}
+
+// State keeps track of the PEX messages exchanged over one connection.
+type State struct {
+	lastSent time.Time
+	lastRecv time.Time
+	sent     map[string]Entry
+}
+
+// Next computes the message that brings the peer up to date with the peers we are connected to.
+// Returns `nil` when less than Interval has passed since the last message or nothing changed.
+func (s *State) Next(now time.Time, connected []Entry) *Message {
+	if !s.lastSent.IsZero() && now.Sub(s.lastSent) < Interval {
+		return nil
+	}
+	if s.sent == nil {
+		s.sent = make(map[string]Entry)
+	}
+
+	m := new(Message)
+	current := make(map[string]bool, len(connected))
+	for _, e := range connected {
+		key := e.Peer.String()
+		current[key] = true
+		if _, ok := s.sent[key]; !ok && len(m.Added) < MaxPeers {
+			m.Added = append(m.Added, e)
+			s.sent[key] = e
+		}
+	}
+	for key, e := range s.sent {
+		if !current[key] && len(m.Dropped) < MaxPeers {
+			m.Dropped = append(m.Dropped, e.Peer)
+			delete(s.sent, key)
+		}
+	}
+
+	if len(m.Added) == 0 && len(m.Dropped) == 0 {
+		return nil
+	}
+	s.lastSent = now
+	return m
+}
+
+// Accept reports whether a message received now should be processed.
+// Peers that send messages more often than allowed are ignored.
+func (s *State) Accept(now time.Time) bool {
+	if !s.lastRecv.IsZero() && now.Sub(s.lastRecv) < MinRecvInterval {
+		return false
+	}
+	s.lastRecv = now
+	return true
+}
@@ -0,0 +1,85 @@
+package pex
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/VIVelev/bittorrent/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshal(t *testing.T) {
+	m := &Message{
+		Added: []Entry{
+			{Peer: peer.Peer{IP: net.IP{127, 0, 0, 1}, Port: 80}, Flags: FlagSeed},
+			{Peer: peer.Peer{IP: net.ParseIP("2001:db8::1"), Port: 0x1ae1}, Flags: FlagUTP},
+		},
+		Dropped: []peer.Peer{{IP: net.IP{1, 1, 1, 1}, Port: 443}},
+	}
+
+	b, err := m.Marshal()
+	require.Nil(t, err)
+	expected := "d" +
+		"5:added" + "6:" + string([]byte{127, 0, 0, 1, 0x00, 0x50}) +
+		"7:added.f" + "1:" + string([]byte{0x02}) +
+		"6:added6" + "18:" + string(net.ParseIP("2001:db8::1")) + string([]byte{0x1a, 0xe1}) +
+		"8:added6.f" + "1:" + string([]byte{0x04}) +
+		"7:dropped" + "6:" + string([]byte{1, 1, 1, 1, 0x01, 0xbb}) +
+		"e"
+	assert.Equal(t, expected, string(b))
+
+	parsed, err := Unmarshal(b)
+	require.Nil(t, err)
+	assert.Equal(t, m, parsed)
+}
+
+func TestUnmarshalLimits(t *testing.T) {
+	var added []Entry
+	for i := 0; i < 2*MaxPeers; i++ {
+		added = append(added, Entry{Peer: peer.Peer{IP: net.IP{10, 0, byte(i / 256), byte(i)}, Port: 6881}})
+	}
+	// garbage that must be discarded
+	added = append([]Entry{
+		{Peer: peer.Peer{IP: net.IP{0, 0, 0, 0}, Port: 6881}},
+		{Peer: peer.Peer{IP: net.IP{10, 0, 0, 1}, Port: 0}},
+		{Peer: peer.Peer{IP: net.IP{224, 0, 0, 1}, Port: 6881}},
+	}, added...)
+
+	b, err := (&Message{Added: added}).Marshal()
+	require.Nil(t, err)
+	m, err := Unmarshal(b)
+	require.Nil(t, err)
+	assert.Len(t, m.Added, MaxPeers)
+	assert.Equal(t, added[3:3+MaxPeers], m.Added)
+
+	_, err = Unmarshal([]byte("d5:added5:12345e"))
+	assert.NotNil(t, err)
+}
+
+func TestState(t *testing.T) {
+	a := Entry{Peer: peer.Peer{IP: net.IP{10, 0, 0, 1}, Port: 1}}
+	b := Entry{Peer: peer.Peer{IP: net.IP{10, 0, 0, 2}, Port: 2}}
+	now := time.Now()
+	s := new(State)
+
+	m := s.Next(now, []Entry{a, b})
+	require.NotNil(t, m)
+	assert.Equal(t, []Entry{a, b}, m.Added)
+
+	// rate limited
+	assert.Nil(t, s.Next(now.Add(time.Second), []Entry{a}))
+
+	m = s.Next(now.Add(Interval), []Entry{a})
+	require.NotNil(t, m)
+	assert.Empty(t, m.Added)
+	assert.Equal(t, []peer.Peer{b.Peer}, m.Dropped)
+
+	// nothing changed
+	assert.Nil(t, s.Next(now.Add(2*Interval), []Entry{a}))
+
+	assert.True(t, s.Accept(now))
+	assert.False(t, s.Accept(now.Add(time.Second)))
+	assert.True(t, s.Accept(now.Add(MinRecvInterval)))
+}
@@ -0,0 +1,102 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultWindow is the window of the rates of the meters of the library.
+const DefaultWindow = 10 * time.Second
+
+// Meter measures a transfer rate over a rolling window, in one second buckets.
+// It is safe for concurrent use, a nil meter measures nothing.
+type Meter struct {
+	mu      sync.Mutex
+	start   time.Time
+	buckets []int64 // bytes by second since start, a ring
+	last    int64   // second of the newest bucket
+	total   int64
+}
+
+// NewMeter returns a meter of the rate over window, of at least two seconds.
+func NewMeter(window time.Duration) *Meter {
+	n := int(window / time.Second)
+	if n < 2 {
+		n = 2
+	}
+	return &Meter{start: time.Now(), buckets: make([]int64, n)}
+}
+
+// Add records that n bytes were transferred now.
+func (m *Meter) Add(n int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.add(time.Now(), int64(n))
+}
+
+func (m *Meter) add(now time.Time, n int64) {
+	sec := m.advance(now)
+	m.buckets[sec%int64(len(m.buckets))] += n
+	m.total += n
+}
+
+// advance clears the buckets of the seconds that passed since the newest one,
+// and returns the current second.
+func (m *Meter) advance(now time.Time) int64 {
+	sec := int64(now.Sub(m.start) / time.Second)
+	if sec < m.last {
+		// the clock of now is not monotonic, count it in the newest bucket
+		return m.last
+	}
+	for s := m.last + 1; s <= sec && s <= m.last+int64(len(m.buckets)); s++ {
+		m.buckets[s%int64(len(m.buckets))] = 0
+	}
+	m.last = sec
+	return sec
+}
+
+// Rate returns the bytes per second transferred over the window, or since the meter was
+// created if more recently.
+func (m *Meter) Rate() float64 {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.rate(time.Now())
+}
+
+func (m *Meter) rate(now time.Time) float64 {
+	sec := m.advance(now)
+	var sum int64
+	for _, n := range m.buckets {
+		sum += n
+	}
+	// the buckets span the past seconds and the current one so far
+	elapsed := now.Sub(m.start).Seconds()
+	span := float64(len(m.buckets)-1) + elapsed - float64(sec)
+	if elapsed < span {
+		span = elapsed
+	}
+	if span < 1 {
+		// a burst right after the start is not a rate yet
+		span = 1
+	}
+	return float64(sum) / span
+}
+
+// Total returns the bytes transferred since the meter was created.
+func (m *Meter) Total() int64 {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.total
+}
@@ -0,0 +1,104 @@
+// Package ratelimit limits the transfer rates of connections with token buckets, and measures them.
+package ratelimit
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket shared by the connections it limits. Tokens are bytes,
+// they fill the bucket at the rate up to one second worth of them.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int // bytes per second, 0 is unlimited
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter of rate bytes per second, unlimited if rate is 0.
+func NewLimiter(rate int) *Limiter {
+	l := &Limiter{}
+	l.SetRate(rate)
+	return l
+}
+
+// SetRate changes the rate of the limiter, 0 is unlimited.
+func (l *Limiter) SetRate(rate int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if rate < 0 {
+		rate = 0
+	}
+	l.rate = rate
+	l.tokens = float64(rate)
+	l.last = time.Now()
+}
+
+// Rate returns the rate of the limiter in bytes per second, 0 is unlimited.
+func (l *Limiter) Rate() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.rate
+}
+
+// reserve takes n tokens from the bucket and returns how long to wait for them.
+func (l *Limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate == 0 {
+		return 0
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+
+	// the bucket goes in debt, later callers wait for it to be paid off
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// WaitN blocks until n bytes may pass. A nil limiter never blocks.
+func (l *Limiter) WaitN(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	if d := l.reserve(n); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// Conn is a connection whose reads and writes are limited.
+type Conn struct {
+	net.Conn
+	down *Limiter
+	up   *Limiter
+}
+
+// NewConn limits the reads of conn with down and its writes with up, either may be nil.
+func NewConn(conn net.Conn, down, up *Limiter) *Conn {
+	return &Conn{Conn: conn, down: down, up: up}
+}
+
+// Read reads from the connection, then waits for the bytes it read to pass,
+// so a fast peer is slowed down by the flow control of the transport.
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.down.WaitN(n)
+	return n, err
+}
+
+// Write waits for the bytes to pass, then writes them to the connection.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.up.WaitN(len(b))
+	return c.Conn.Write(b)
+}
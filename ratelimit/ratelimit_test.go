@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter(t *testing.T) {
+	tests := map[string]struct {
+		rate     int
+		n        []int
+		min, max time.Duration
+	}{
+		"unlimited":  {rate: 0, n: []int{1 << 20, 1 << 20}, max: 50 * time.Millisecond},
+		"burst":      {rate: 1000, n: []int{1000}, max: 50 * time.Millisecond},
+		"over burst": {rate: 1000, n: []int{1000, 300}, min: 250 * time.Millisecond, max: 450 * time.Millisecond},
+		"large":      {rate: 1000, n: []int{1300}, min: 250 * time.Millisecond, max: 450 * time.Millisecond},
+	}
+
+	for name, test := range tests {
+		l := NewLimiter(test.rate)
+		start := time.Now()
+		for _, n := range test.n {
+			l.WaitN(n)
+		}
+		elapsed := time.Since(start)
+		assert.GreaterOrEqual(t, int64(elapsed), int64(test.min), name)
+		assert.LessOrEqual(t, int64(elapsed), int64(test.max), name)
+	}
+}
+
+func TestSetRate(t *testing.T) {
+	l := NewLimiter(10)
+	assert.Equal(t, 10, l.Rate())
+	l.SetRate(0)
+	assert.Equal(t, 0, l.Rate())
+
+	start := time.Now()
+	l.WaitN(1 << 20)
+	assert.Less(t, int64(time.Since(start)), int64(50*time.Millisecond))
+}
+
+func TestConn(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+	conn := NewConn(ours, NewLimiter(1000), nil)
+	defer conn.Close()
+
+	go func() {
+		theirs.Write(make([]byte, 1300))
+	}()
+	start := time.Now()
+	buf := make([]byte, 1300)
+	for read := 0; read < len(buf); {
+		n, err := conn.Read(buf[read:])
+		require.Nil(t, err)
+		read += n
+	}
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(250*time.Millisecond))
+
+	// writes are not limited
+	go func() {
+		theirs.Read(make([]byte, 1<<16))
+	}()
+	start = time.Now()
+	_, err := conn.Write(make([]byte, 1<<16))
+	require.Nil(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(50*time.Millisecond))
+}
+
+func TestMeter(t *testing.T) {
+	m := NewMeter(4 * time.Second)
+	at := func(secs float64) time.Time {
+		return m.start.Add(time.Duration(secs * float64(time.Second)))
+	}
+
+	m.add(at(0.5), 1000)
+	assert.Equal(t, 1000.0, m.rate(at(0.5)), "burst at the start")
+	m.add(at(2.5), 3000)
+	assert.Equal(t, 1600.0, m.rate(at(2.5)), "since the start")
+	assert.InDelta(t, 3000/3.5, m.rate(at(5.5)), 1e-9, "over the window")
+	m.add(at(4.2), 10) // out of order, counted in the newest bucket
+	assert.Equal(t, 0.0, m.rate(at(20)), "idle")
+	assert.Equal(t, int64(4010), m.Total())
+
+	var none *Meter
+	none.Add(1)
+	assert.Equal(t, 0.0, none.Rate())
+	assert.Equal(t, int64(0), none.Total())
+}
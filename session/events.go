@@ -0,0 +1,55 @@
+package session
+
+import (
+	"sync"
+
+	"github.com/VIVelev/bittorrent/event"
+)
+
+// notifier publishes events in order from its own goroutine, so that they can be queued
+// with the locks of the session held while the subscribers call back into it.
+type notifier struct {
+	bus   *event.Bus
+	mu    sync.Mutex
+	queue []event.Event
+	wake  chan struct{}
+}
+
+func newNotifier(bus *event.Bus) *notifier {
+	return &notifier{bus: bus, wake: make(chan struct{}, 1)}
+}
+
+// notify queues e for publishing.
+func (n *notifier) notify(e event.Event) {
+	n.mu.Lock()
+	n.queue = append(n.queue, e)
+	n.mu.Unlock()
+
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run publishes the queued events until done is closed.
+func (n *notifier) run(done chan struct{}) {
+	for {
+		select {
+		case <-n.wake:
+		case <-done:
+			return
+		}
+		for {
+			n.mu.Lock()
+			queue := n.queue
+			n.queue = nil
+			n.mu.Unlock()
+			if len(queue) == 0 {
+				break
+			}
+			for _, e := range queue {
+				n.bus.Publish(e)
+			}
+		}
+	}
+}
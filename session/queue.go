@@ -0,0 +1,181 @@
+package session
+
+import "time"
+
+// manageInterval is how often the seeding goals of the torrents are checked.
+const manageInterval time.Duration = time.Second
+
+// GoalAction is what happens to a torrent that reached its seeding goals.
+type GoalAction int
+
+const (
+	// GoalPause pauses the torrent. Once resumed, it seeds until its goals are set again.
+	GoalPause GoalAction = iota
+	// GoalRemove removes the torrent from the session, its files are kept.
+	GoalRemove
+)
+
+// SeedGoals end the seeding of a torrent once any of the goals that are set is reached.
+// The zero value seeds forever.
+type SeedGoals struct {
+	// Ratio of the uploaded bytes to the size of the torrent, or to the downloaded bytes if more.
+	Ratio float64
+	// Time spent seeding.
+	Time time.Duration
+	// Idle is the time spent seeding without uploading to any peer.
+	Idle time.Duration
+	// Action is taken once a goal is reached.
+	Action GoalAction
+}
+
+// reached reports whether the goals are reached by a torrent that seeded for seeding,
+// and did not upload for idle.
+func (g SeedGoals) reached(ratio float64, seeding, idle time.Duration) bool {
+	return g.Ratio > 0 && ratio >= g.Ratio ||
+		g.Time > 0 && seeding >= g.Time ||
+		g.Idle > 0 && idle >= g.Idle
+}
+
+// schedule starts the torrents in queue order while the session has room for them, see
+// Config.MaxActiveDownloads and Config.MaxActiveSeeds, and queues the others.
+func (s *Session) schedule() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	downloads, seeds := 0, 0
+	for _, t := range s.queue {
+		t.mu.Lock()
+		if t.wanted && t.state != StateError {
+			var active bool
+			if t.finished {
+				active = s.cfg.MaxActiveSeeds <= 0 || seeds < s.cfg.MaxActiveSeeds
+				if active {
+					seeds++
+				}
+			} else {
+				active = s.cfg.MaxActiveDownloads <= 0 || downloads < s.cfg.MaxActiveDownloads
+				if active {
+					downloads++
+				}
+			}
+			if active {
+				t.start()
+			} else {
+				t.halt(StateQueued)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+// manage acts on the torrents that reached their seeding goals until the session is closed.
+func (s *Session) manage() {
+	ticker := time.NewTicker(manageInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+		for _, t := range s.Torrents() {
+			goals, ok := t.goalReached()
+			if !ok {
+				continue
+			}
+			switch goals.Action {
+			case GoalRemove:
+				s.Remove(t.infoHash, false)
+			default:
+				t.mu.Lock()
+				t.goalsMet = true
+				t.mu.Unlock()
+				t.Pause()
+			}
+		}
+	}
+}
+
+// QueuePosition returns the position of the torrent in the queue of its session, 0 being the
+// first to start. It is -1 once the torrent is removed.
+func (t *Torrent) QueuePosition() int {
+	s := t.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, qt := range s.queue {
+		if qt == t {
+			return i
+		}
+	}
+	return -1
+}
+
+// SetQueuePosition moves the torrent to pos in the queue of its session, to the front when
+// pos is negative and to the back when past the end. The torrents before it start first.
+func (t *Torrent) SetQueuePosition(pos int) {
+	s := t.s
+	s.mu.Lock()
+	cur := -1
+	for i, qt := range s.queue {
+		if qt == t {
+			cur = i
+			break
+		}
+	}
+	if cur < 0 {
+		s.mu.Unlock()
+		return
+	}
+	s.queue = append(s.queue[:cur], s.queue[cur+1:]...)
+	if pos < 0 {
+		pos = 0
+	}
+	if pos > len(s.queue) {
+		pos = len(s.queue)
+	}
+	s.queue = append(s.queue, nil)
+	copy(s.queue[pos+1:], s.queue[pos:])
+	s.queue[pos] = t
+	s.mu.Unlock()
+
+	s.schedule()
+}
+
+// SeedGoals returns the seeding goals of the torrent, those of the session unless set.
+func (t *Torrent) SeedGoals() SeedGoals {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.goals
+}
+
+// SetSeedGoals changes the seeding goals of the torrent. They are checked again if the torrent
+// was paused for reaching the previous ones.
+func (t *Torrent) SetSeedGoals(goals SeedGoals) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.goals = goals
+	t.goalsMet = false
+}
+
+// goalReached returns the goals of the torrent if it seeds and reached them, unless it was
+// resumed after pausing for them.
+func (t *Torrent) goalReached() (SeedGoals, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.state != StateSeeding || t.run == nil || t.goalsMet {
+		return t.goals, false
+	}
+	now := time.Now()
+	lastActive := t.seedingSince
+	if last := t.run.LastUpload(); last.After(lastActive) {
+		lastActive = last
+	}
+	return t.goals, t.goals.reached(t.ratio(), t.seedingTime(now), now.Sub(lastActive))
+}
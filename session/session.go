@@ -0,0 +1,483 @@
+// Package session runs many torrents in one process. The torrents of a session share
+// its peer ID, its listener, its rate limiters and its disk.
+package session
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/VIVelev/bittorrent/bitfield"
+	"github.com/VIVelev/bittorrent/client"
+	"github.com/VIVelev/bittorrent/discovery"
+	"github.com/VIVelev/bittorrent/event"
+	"github.com/VIVelev/bittorrent/io"
+	"github.com/VIVelev/bittorrent/logging"
+	"github.com/VIVelev/bittorrent/lsd"
+	"github.com/VIVelev/bittorrent/metrics"
+	"github.com/VIVelev/bittorrent/mse"
+	"github.com/VIVelev/bittorrent/p2p"
+	"github.com/VIVelev/bittorrent/peer"
+	"github.com/VIVelev/bittorrent/ratelimit"
+	"github.com/VIVelev/bittorrent/storage"
+	"github.com/VIVelev/bittorrent/utp"
+)
+
+// DefaultDiskWorkers is how many reads and writes a session runs at once by default.
+const DefaultDiskWorkers int = 8
+
+var (
+	// ErrClosed is returned when torrents are added to a closed session.
+	ErrClosed = errors.New("session closed")
+	// ErrExists is returned when a torrent is added to a session that has it already.
+	ErrExists = errors.New("torrent exists already")
+)
+
+// Discovery finds the peers of torrents beyond their trackers, e.g. a DHT.
+// lsd.Service is one.
+type Discovery interface {
+	// Add starts looking for the peers of the torrent, found is called for every one of them.
+	Add(infoHash [20]byte, found func(peer.Peer))
+	// Remove stops looking for the peers of the torrent.
+	Remove(infoHash [20]byte)
+}
+
+// Config holds the settings of a session. The zero value is valid.
+type Config struct {
+	// PeerID introduces us to peers and trackers, a random one is used when zero.
+	PeerID [20]byte
+	// ListenAddr is the TCP and UDP address peers connect to, ":6881" when empty.
+	// Port 0 picks a free port.
+	ListenAddr string
+	// DataDir is where torrents are stored by default, the working directory when empty.
+	DataDir string
+	// Encryption is the Message Stream Encryption policy of every connection.
+	Encryption mse.Policy
+	// DisableUTP connects to peers over TCP only, and accepts TCP connections only.
+	DisableUTP bool
+	// DisableLSD turns Local Service Discovery off.
+	DisableLSD bool
+	// DHT looks up the peers of the torrents, none when nil. This module does not implement
+	// the DHT (BEP 5), a DHT node of another package plugs in through Discovery.
+	DHT Discovery
+	// DownloadRate and UploadRate limit the transfers of every torrent together,
+	// in bytes per second. Zero is unlimited.
+	DownloadRate int
+	UploadRate   int
+	// MaxPeers is how many peers a torrent is connected to at once, p2p.MaxPeers when zero.
+	MaxPeers int
+	// DiskWorkers is how many reads and writes run at once, DefaultDiskWorkers when zero.
+	DiskWorkers int
+	// Storage opens the storage of a torrent under dir, storage.NewFile when nil.
+	Storage func(tf *io.TorrentFile, dir string) (storage.Storage, error)
+	// MaxActiveDownloads and MaxActiveSeeds limit how many torrents download and seed at once,
+	// the others wait in the queue of the session. Zero is unlimited.
+	MaxActiveDownloads int
+	MaxActiveSeeds     int
+	// SeedGoals are the seeding goals of the torrents as they are added, see Torrent.SetSeedGoals.
+	SeedGoals SeedGoals
+	// Metrics receives the metrics of the torrents, their peers, trackers and storage, none when nil.
+	// The torrents are counted by state while the session is open.
+	Metrics *metrics.Registry
+	// Logger receives the records of the session and of its torrents, none when nil.
+	Logger *logging.Logger
+}
+
+// Session manages torrents that are added and removed at runtime.
+type Session struct {
+	cfg      Config
+	peerID   [20]byte
+	port     uint16
+	ln       net.Listener
+	utp      *utp.Socket
+	lsd      *lsd.Service
+	dialer   *client.Dialer
+	down     *ratelimit.Limiter
+	up       *ratelimit.Limiter
+	pool     *storage.Pool
+	events   *event.Bus
+	notes    *notifier // of the state changes
+	trackers *discovery.Announcer
+	announce sync.WaitGroup // of the announce loops of the torrents, see Close
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*Torrent
+	queue    []*Torrent // in the order they start in
+	closed   bool
+	done     chan struct{} // closed by Close
+}
+
+// New starts a session: it listens for peers and joins Local Service Discovery.
+func New(cfg Config) (*Session, error) {
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = ":" + strconv.Itoa(int(peer.DownloadPort))
+	}
+	if cfg.DiskWorkers == 0 {
+		cfg.DiskWorkers = DefaultDiskWorkers
+	}
+	if cfg.Storage == nil {
+		cfg.Storage = func(tf *io.TorrentFile, dir string) (storage.Storage, error) {
+			return storage.NewFile(tf, dir)
+		}
+	}
+
+	s := &Session{
+		cfg:      cfg,
+		peerID:   cfg.PeerID,
+		down:     ratelimit.NewLimiter(cfg.DownloadRate),
+		up:       ratelimit.NewLimiter(cfg.UploadRate),
+		pool:     storage.NewPool(cfg.DiskWorkers),
+		events:   event.NewBus(),
+		torrents: make(map[[20]byte]*Torrent),
+		done:     make(chan struct{}),
+	}
+	s.notes = newNotifier(s.events)
+	s.trackers = &discovery.Announcer{Events: s.events, Metrics: cfg.Metrics, Logger: cfg.Logger}
+	if s.peerID == ([20]byte{}) {
+		s.peerID = peer.RandID()
+	}
+
+	ln, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("listen: %s", err)
+	}
+	s.ln = ln
+	addr := ln.Addr().(*net.TCPAddr)
+	s.port = uint16(addr.Port)
+	if !cfg.DisableUTP {
+		// uTP goes over the same port as TCP
+		host, _, _ := net.SplitHostPort(cfg.ListenAddr)
+		s.utp, err = utp.Listen("udp", net.JoinHostPort(host, strconv.Itoa(addr.Port)))
+		if err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("listen: %s", err)
+		}
+	}
+	s.dialer = &client.Dialer{
+		Encryption: cfg.Encryption,
+		Timeout:    client.DefaultDialer.Timeout,
+		DisableUTP: cfg.DisableUTP,
+		UTP:        s.utp,
+		WrapConn:   s.limit,
+		Events:     s.events,
+		Metrics:    cfg.Metrics,
+		Logger:     cfg.Logger,
+	}
+
+	if !cfg.DisableLSD {
+		if s.lsd, err = lsd.New(s.port, cfg.Logger); err != nil {
+			cfg.Logger.Warn("local service discovery is unavailable", logging.Err(err))
+		}
+	}
+
+	go s.acceptLoop(ln)
+	if s.utp != nil {
+		go s.acceptLoop(s.utp)
+	}
+	go s.manage()
+	go s.notes.run(s.done)
+	cfg.Metrics.GaugeFunc("bittorrent_torrents", "Torrents of the session by state.", []string{"state"}, s.countStates)
+	return s, nil
+}
+
+// Events returns the bus the session publishes what happens to its torrents on:
+// their state changes, and the events of their peers, pieces, files and trackers.
+func (s *Session) Events() *event.Bus {
+	return s.events
+}
+
+// countStates reports how many torrents are in every state, see Config.Metrics.
+func (s *Session) countStates(observe func(float64, ...string)) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	torrents := append([]*Torrent(nil), s.queue...)
+	s.mu.Unlock()
+
+	counts := make(map[State]int)
+	for _, t := range torrents {
+		counts[t.State()]++
+	}
+	for state := StatePaused; state <= StateQueued; state++ {
+		observe(float64(counts[state]), state.String())
+	}
+}
+
+// PeerID returns the peer ID of the session.
+func (s *Session) PeerID() [20]byte {
+	return s.peerID
+}
+
+// Port returns the port peers connect to.
+func (s *Session) Port() uint16 {
+	return s.port
+}
+
+// DataDir returns where torrents are stored by default.
+func (s *Session) DataDir() string {
+	return s.dir(AddOptions{})
+}
+
+// SetRateLimits changes the download and upload rates of the session, in bytes per second.
+// Zero is unlimited.
+func (s *Session) SetRateLimits(download, upload int) {
+	s.down.SetRate(download)
+	s.up.SetRate(upload)
+}
+
+// limit applies the rate limits of the session to a connection.
+func (s *Session) limit(conn net.Conn) net.Conn {
+	return ratelimit.NewConn(conn, s.down, s.up)
+}
+
+// AddOptions tune a torrent as it is added. The zero value is valid.
+type AddOptions struct {
+	// Dir is where the torrent is stored, the DataDir of the session when empty.
+	Dir string
+	// Paused adds the torrent without starting it, see Torrent.Resume. Otherwise it is queued
+	// at the back, and starts once the session has room for it.
+	Paused bool
+	// Trackers replace the trackers of the torrent when set.
+	Trackers []string
+}
+
+// AddFile adds the torrent of the .torrent file at path.
+func (s *Session) AddFile(path string, opts AddOptions) (*Torrent, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.AddBytes(data, opts)
+}
+
+// AddBytes adds the torrent of the contents of a .torrent file.
+func (s *Session) AddBytes(data []byte, opts AddOptions) (*Torrent, error) {
+	tf, err := io.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse: %s", err)
+	}
+	t := s.newTorrent(tf.InfoHash, tf.Name, opts)
+	t.tf = tf
+	t.trackers = tf.Trackers()
+	if len(opts.Trackers) > 0 {
+		t.trackers = opts.Trackers
+	}
+	return s.add(t, opts)
+}
+
+// AddMagnet adds the torrent of a magnet link. Its metadata is fetched from its peers first.
+func (s *Session) AddMagnet(link string, opts AddOptions) (*Torrent, error) {
+	m, err := io.ParseMagnet(link)
+	if err != nil {
+		return nil, fmt.Errorf("magnet: %s", err)
+	}
+	t := s.newTorrent(m.InfoHash, m.Name, opts)
+	t.trackers = m.Trackers
+	if len(opts.Trackers) > 0 {
+		t.trackers = opts.Trackers
+	}
+	t.webSeeds = m.WebSeeds
+	return s.add(t, opts)
+}
+
+func (s *Session) add(t *Torrent, opts AddOptions) (*Torrent, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if _, ok := s.torrents[t.infoHash]; ok {
+		s.mu.Unlock()
+		return nil, ErrExists
+	}
+	s.torrents[t.infoHash] = t
+	s.queue = append(s.queue, t)
+	t.wanted = !opts.Paused
+	t.goals = s.cfg.SeedGoals
+	s.mu.Unlock()
+
+	if s.lsd != nil {
+		s.lsd.Add(t.infoHash, func(p peer.Peer) {
+			t.addPeers([]peer.Peer{p}, p2p.SourceLSD)
+		})
+	}
+	if s.cfg.DHT != nil {
+		s.cfg.DHT.Add(t.infoHash, func(p peer.Peer) {
+			t.addPeers([]peer.Peer{p}, p2p.SourceDHT)
+		})
+	}
+	s.schedule()
+	return t, nil
+}
+
+// Get returns the torrent with the given info hash.
+func (s *Session) Get(infoHash [20]byte) (*Torrent, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.torrents[infoHash]
+	return t, ok
+}
+
+// Torrents returns every torrent of the session, in queue order.
+func (s *Session) Torrents() []*Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*Torrent(nil), s.queue...)
+}
+
+// Remove stops the torrent with the given info hash and forgets it. With deleteData, its
+// files are deleted too; only the files of the default storage are known to the session.
+func (s *Session) Remove(infoHash [20]byte, deleteData bool) error {
+	s.mu.Lock()
+	t, ok := s.torrents[infoHash]
+	delete(s.torrents, infoHash)
+	for i, qt := range s.queue {
+		if qt == t {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			break
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("torrent %x does not exist", infoHash)
+	}
+
+	if s.lsd != nil {
+		s.lsd.Remove(infoHash)
+	}
+	if s.cfg.DHT != nil {
+		s.cfg.DHT.Remove(infoHash)
+	}
+	tf, err := t.close()
+	p2p.DeleteMetrics(s.cfg.Metrics, infoHash)
+	s.schedule()
+	if err != nil || !deleteData || tf == nil {
+		return err
+	}
+	return storage.RemoveFiles(tf, t.dir)
+}
+
+// Close stops every torrent and closes their storage, then stops listening. It waits for the
+// trackers to be told that the torrents stopped, within a few seconds.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	torrents := s.torrents
+	s.torrents = make(map[[20]byte]*Torrent)
+	s.queue = nil
+	s.mu.Unlock()
+
+	var firstErr error
+	for _, t := range torrents {
+		if _, err := t.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.announce.Wait()
+	s.ln.Close()
+	if s.utp != nil {
+		s.utp.Close()
+	}
+	if s.lsd != nil {
+		s.lsd.Close()
+	}
+	return firstErr
+}
+
+// acceptLoop hands the connections of peers over to the torrents they ask for.
+func (s *Session) acceptLoop(ln interface{ Accept() (net.Conn, error) }) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Session) handleConn(conn net.Conn) {
+	p, err := remotePeer(conn.RemoteAddr())
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	s.mu.Lock()
+	infoHashes := make([][20]byte, 0, len(s.torrents))
+	for ih := range s.torrents {
+		infoHashes = append(infoHashes, ih)
+	}
+	s.mu.Unlock()
+
+	c, infoHash, err := client.AcceptHave(s.limit(conn), s.cfg.Encryption, s.peerID, infoHashes, s.lookup)
+	if err != nil {
+		s.cfg.Logger.Debug("could not accept connection", logging.Peer(p), logging.Err(err))
+		return
+	}
+	t, ok := s.Get(infoHash)
+	if !ok {
+		c.Conn.Close()
+		return
+	}
+	t.addConn(c, p)
+}
+
+// lookup reports the pieces we have of the running torrent with the given info hash,
+// and whether it is a v2 torrent.
+func (s *Session) lookup(infoHash [20]byte) (int, bitfield.Bitfield, bool, bool) {
+	t, ok := s.Get(infoHash)
+	if !ok {
+		return 0, nil, false, false
+	}
+	run := t.running()
+	if run == nil {
+		return 0, nil, false, false
+	}
+	return run.NumPieces(), run.Completed(), run.TorrentFile().IsV2(), true
+}
+
+// remotePeer returns the address of the peer at the other end of a TCP or uTP connection.
+func remotePeer(addr net.Addr) (peer.Peer, error) {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}, nil
+	case *net.UDPAddr:
+		return peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}, nil
+	default:
+		return peer.Peer{}, fmt.Errorf("unsupported address %s", addr)
+	}
+}
+
+// dir returns where a torrent added with opts is stored.
+func (s *Session) dir(opts AddOptions) string {
+	if opts.Dir != "" {
+		return opts.Dir
+	}
+	if s.cfg.DataDir != "" {
+		return s.cfg.DataDir
+	}
+	return "."
+}
+
+// openStorage opens the storage of tf under dir, going through the disk pool of the session.
+func (s *Session) openStorage(tf *io.TorrentFile, dir string) (storage.Storage, error) {
+	st, err := s.cfg.Storage(tf, filepath.Clean(dir))
+	if err != nil {
+		return nil, err
+	}
+	// the latency of the disk leaves the wait for the pool out
+	return s.pool.Wrap(storage.WithMetrics(st, s.cfg.Metrics)), nil
+}
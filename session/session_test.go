@@ -0,0 +1,540 @@
+package session
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VIVelev/bittorrent/event"
+	"github.com/VIVelev/bittorrent/internal/testtorrent"
+	"github.com/VIVelev/bittorrent/logging"
+	"github.com/VIVelev/bittorrent/metrics"
+	"github.com/VIVelev/bittorrent/p2p"
+	"github.com/VIVelev/bittorrent/peer"
+	"github.com/jackpal/bencode-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const pieceLength int = 16384
+
+// testTorrent is a multi-file torrent with the files a and b/c.
+type testTorrent struct {
+	data    []byte
+	torrent []byte // the .torrent file
+	files   map[string][]byte
+}
+
+func newTestTorrent(t *testing.T, name string) *testTorrent {
+	data := make([]byte, 80000)
+	rand.New(rand.NewSource(int64(len(name)))).Read(data)
+
+	torrent := testtorrent.Torrent{Name: name, PieceLength: pieceLength, Files: []testtorrent.File{
+		{Length: 30000, Path: []string{"a"}},
+		{Length: 50000, Path: []string{"b", "c"}},
+	}}.Bytes(t, data)
+	return &testTorrent{
+		data:    data,
+		torrent: torrent,
+		files: map[string][]byte{
+			filepath.Join(name, "a"):      data[:30000],
+			filepath.Join(name, "b", "c"): data[30000:],
+		},
+	}
+}
+
+// write lays the files of the torrent out under root.
+func (tt *testTorrent) write(t *testing.T, root string) {
+	for path, content := range tt.files {
+		path = filepath.Join(root, path)
+		require.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.Nil(t, ioutil.WriteFile(path, content, 0644))
+	}
+}
+
+// check asserts that the files of the torrent are under root.
+func (tt *testTorrent) check(t *testing.T, root string, msg string) {
+	for path, content := range tt.files {
+		got, err := ioutil.ReadFile(filepath.Join(root, path))
+		require.Nil(t, err, msg)
+		assert.True(t, bytes.Equal(content, got), msg)
+	}
+}
+
+func newTestSession(t *testing.T) *Session {
+	return newTestSessionWith(t, Config{})
+}
+
+func newTestSessionWith(t *testing.T, cfg Config) *Session {
+	cfg.ListenAddr, cfg.DataDir, cfg.DisableLSD = "127.0.0.1:0", t.TempDir(), true
+	s, err := New(cfg)
+	require.Nil(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func (s *Session) peer() peer.Peer {
+	return peer.Peer{IP: net.IPv4(127, 0, 0, 1), Port: s.Port()}
+}
+
+func waitState(t *testing.T, tr *Torrent, state State, msg string) {
+	require.Eventually(t, func() bool { return tr.State() == state }, 10*time.Second, 10*time.Millisecond,
+		"%s: state %s, error %v", msg, tr.State(), tr.Err())
+}
+
+func TestSession(t *testing.T) {
+	tt := newTestTorrent(t, "dir")
+
+	// the seeder has the files on disk already
+	seeder := newTestSession(t)
+	tt.write(t, seeder.cfg.DataDir)
+	st, err := seeder.AddBytes(tt.torrent, AddOptions{})
+	require.Nil(t, err)
+	waitState(t, st, StateSeeding, "seeder")
+	_, err = seeder.AddBytes(tt.torrent, AddOptions{})
+	assert.NotNil(t, err, "added twice")
+
+	tests := map[string]func(s *Session) (*Torrent, error){
+		"torrent file": func(s *Session) (*Torrent, error) {
+			return s.AddBytes(tt.torrent, AddOptions{})
+		},
+		"magnet": func(s *Session) (*Torrent, error) {
+			return s.AddMagnet(fmt.Sprintf("magnet:?xt=urn:btih:%x&dn=dir", st.InfoHash()), AddOptions{})
+		},
+	}
+
+	for name, add := range tests {
+		leecher := newTestSession(t)
+		lt, err := add(leecher)
+		require.Nil(t, err, name)
+		lt.AddPeers([]peer.Peer{seeder.peer()})
+		waitState(t, lt, StateSeeding, name)
+		assert.Equal(t, "dir", lt.Name(), name)
+		assert.Equal(t, int64(len(tt.data)), lt.Downloaded(), name)
+		require.Nil(t, leecher.Close(), name)
+		tt.check(t, leecher.cfg.DataDir, name)
+	}
+	assert.Eventually(t, func() bool { return st.Uploaded() >= int64(len(tests)*len(tt.data)) },
+		time.Second, 10*time.Millisecond, "uploaded %d", st.Uploaded())
+}
+
+func TestEvents(t *testing.T) {
+	tt := newTestTorrent(t, "dir")
+	// a uTP connection closed by both sides at once lingers, the sessions close as it seeds
+	seeder := newTestSessionWith(t, Config{DisableUTP: true})
+	tt.write(t, seeder.cfg.DataDir)
+	st, err := seeder.AddBytes(tt.torrent, AddOptions{})
+	require.Nil(t, err)
+	waitState(t, st, StateSeeding, "seeder")
+
+	leecher := newTestSessionWith(t, Config{DisableUTP: true})
+	sub := leecher.Events().Subscribe(100, event.Block)
+	lt, err := leecher.AddBytes(tt.torrent, AddOptions{})
+	require.Nil(t, err)
+	lt.AddPeers([]peer.Peer{seeder.peer()})
+
+	var states []string
+	counts := make(map[event.Type]int)
+	timeout := time.After(10 * time.Second)
+	for len(states) == 0 || states[len(states)-1] != "seeding" {
+		select {
+		case e := <-sub.Events():
+			assert.Equal(t, st.InfoHash(), e.InfoHash, e.Type)
+			counts[e.Type]++
+			if e.Type == event.StateChanged {
+				states = append(states, e.State)
+			}
+		case <-timeout:
+			t.Fatalf("not seeding, states %v", states)
+		}
+	}
+	sub.Close()
+	assert.Equal(t, []string{"downloading", "checking", "downloading", "seeding"}, states)
+	assert.Equal(t, (len(tt.data)+pieceLength-1)/pieceLength, counts[event.PieceVerified])
+	assert.Equal(t, 2, counts[event.FileCompleted])
+	assert.Equal(t, 1, counts[event.PeerConnected])
+}
+
+func TestMetrics(t *testing.T) {
+	tt := newTestTorrent(t, "dir")
+	seeder := newTestSessionWith(t, Config{DisableUTP: true})
+	tt.write(t, seeder.cfg.DataDir)
+	st, err := seeder.AddBytes(tt.torrent, AddOptions{})
+	require.Nil(t, err)
+	waitState(t, st, StateSeeding, "seeder")
+
+	reg := metrics.NewRegistry()
+	leecher := newTestSessionWith(t, Config{DisableUTP: true, Metrics: reg})
+	lt, err := leecher.AddBytes(tt.torrent, AddOptions{})
+	require.Nil(t, err)
+	lt.AddPeers([]peer.Peer{seeder.peer()})
+	waitState(t, lt, StateSeeding, "leecher")
+
+	ih := lt.InfoHash()
+	var buf bytes.Buffer
+	_, err = reg.WriteTo(&buf)
+	require.Nil(t, err)
+	for _, line := range []string{
+		`bittorrent_torrents{state="seeding"} 1`,
+		`bittorrent_torrents{state="downloading"} 0`,
+		fmt.Sprintf(`bittorrent_downloaded_bytes_total{info_hash="%x"} %d`, ih, len(tt.data)),
+		fmt.Sprintf(`bittorrent_pieces_verified_total %d`, (len(tt.data)+pieceLength-1)/pieceLength),
+		`bittorrent_peer_dials_total{result="connected"} 1`,
+		`# TYPE bittorrent_peers_connected gauge`,
+		`# TYPE bittorrent_storage_duration_seconds histogram`,
+	} {
+		assert.Contains(t, buf.String(), line+"\n")
+	}
+
+	require.Nil(t, leecher.Remove(ih, false))
+	buf.Reset()
+	_, err = reg.WriteTo(&buf)
+	require.Nil(t, err)
+	assert.NotContains(t, buf.String(), fmt.Sprintf(`info_hash="%x"`, ih), "removed")
+
+	leecher.Close()
+	buf.Reset()
+	_, err = reg.WriteTo(&buf)
+	require.Nil(t, err)
+	assert.NotContains(t, buf.String(), "bittorrent_torrents", "closed")
+}
+
+// lockedBuffer is a buffer that is written to while it is read.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLogger(t *testing.T) {
+	tt := newTestTorrent(t, "dir")
+	seeder := newTestSessionWith(t, Config{DisableUTP: true})
+	tt.write(t, seeder.cfg.DataDir)
+	st, err := seeder.AddBytes(tt.torrent, AddOptions{})
+	require.Nil(t, err)
+	waitState(t, st, StateSeeding, "seeder")
+
+	var buf lockedBuffer
+	logger := logging.New(logging.NewJSONHandler(&buf, logging.Debug))
+	leecher := newTestSessionWith(t, Config{DisableUTP: true, Logger: logger})
+	lt, err := leecher.AddBytes(tt.torrent, AddOptions{})
+	require.Nil(t, err)
+	lt.AddPeers([]peer.Peer{seeder.peer()})
+	waitState(t, lt, StateSeeding, "leecher")
+
+	ih := fmt.Sprintf("%x", lt.InfoHash())
+	var states []string
+	connected := false
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var r map[string]interface{}
+		require.Nil(t, json.Unmarshal([]byte(line), &r), line)
+		switch r["msg"] {
+		case "state changed":
+			assert.Equal(t, ih, r["infohash"])
+			states = append(states, r["state"].(string))
+		case "completed handshake":
+			assert.Equal(t, ih, r["infohash"])
+			assert.Equal(t, seeder.peer().String(), r["peer"])
+			connected = true
+		}
+	}
+	assert.Contains(t, states, StateDownloading.String())
+	assert.Equal(t, StateSeeding.String(), states[len(states)-1])
+	assert.True(t, connected, "connected")
+}
+
+func TestPauseResume(t *testing.T) {
+	tt := newTestTorrent(t, "dir")
+	seeder := newTestSession(t)
+	tt.write(t, seeder.cfg.DataDir)
+	st, err := seeder.AddBytes(tt.torrent, AddOptions{})
+	require.Nil(t, err)
+	waitState(t, st, StateSeeding, "seeder")
+
+	leecher := newTestSession(t)
+	lt, err := leecher.AddBytes(tt.torrent, AddOptions{Paused: true})
+	require.Nil(t, err)
+	lt.AddPeers([]peer.Peer{seeder.peer()})
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, StatePaused, lt.State())
+
+	lt.Resume()
+	waitState(t, lt, StateSeeding, "leecher")
+	lt.Pause()
+	assert.Equal(t, StatePaused, lt.State())
+
+	// the pieces are kept while paused
+	lt.Resume()
+	waitState(t, lt, StateSeeding, "resumed")
+
+	got, ok := leecher.Get(lt.InfoHash())
+	require.True(t, ok)
+	assert.Equal(t, lt, got)
+	assert.Len(t, leecher.Torrents(), 1)
+
+	require.Nil(t, leecher.Remove(lt.InfoHash(), true))
+	_, ok = leecher.Get(lt.InfoHash())
+	assert.False(t, ok)
+	_, err = os.Stat(filepath.Join(leecher.cfg.DataDir, "dir"))
+	assert.True(t, os.IsNotExist(err))
+	assert.NotNil(t, leecher.Remove(lt.InfoHash(), true), "removed twice")
+
+	require.Nil(t, leecher.Close())
+	_, err = leecher.AddBytes(tt.torrent, AddOptions{})
+	assert.Equal(t, ErrClosed, err)
+}
+
+func TestQueue(t *testing.T) {
+	ta, tb := newTestTorrent(t, "a"), newTestTorrent(t, "b")
+	seeder := newTestSession(t)
+	ta.write(t, seeder.cfg.DataDir)
+	tb.write(t, seeder.cfg.DataDir)
+	for _, tt := range []*testTorrent{ta, tb} {
+		st, err := seeder.AddBytes(tt.torrent, AddOptions{})
+		require.Nil(t, err)
+		waitState(t, st, StateSeeding, "seeder")
+	}
+
+	leecher := newTestSessionWith(t, Config{MaxActiveDownloads: 1, MaxActiveSeeds: 1})
+	la, err := leecher.AddBytes(ta.torrent, AddOptions{})
+	require.Nil(t, err)
+	lb, err := leecher.AddBytes(tb.torrent, AddOptions{})
+	require.Nil(t, err)
+	assert.NotEqual(t, StateQueued, la.State())
+	assert.Equal(t, StateQueued, lb.State())
+	assert.Equal(t, []*Torrent{la, lb}, leecher.Torrents())
+
+	// b goes first, a waits for it
+	lb.SetQueuePosition(0)
+	assert.Equal(t, 0, lb.QueuePosition())
+	assert.Equal(t, 1, la.QueuePosition())
+	assert.Equal(t, StateQueued, la.State())
+	assert.NotEqual(t, StateQueued, lb.State())
+
+	// a downloads once b is done, then waits for b to stop seeding
+	la.AddPeers([]peer.Peer{seeder.peer()})
+	lb.AddPeers([]peer.Peer{seeder.peer()})
+	waitState(t, lb, StateSeeding, "b")
+	require.Eventually(t, func() bool { return la.Downloaded() == int64(len(ta.data)) }, 10*time.Second, 10*time.Millisecond)
+	waitState(t, la, StateQueued, "a")
+
+	lb.Pause()
+	waitState(t, la, StateSeeding, "a")
+	require.Nil(t, leecher.Remove(la.InfoHash(), false))
+	assert.Equal(t, -1, la.QueuePosition())
+	lb.Resume()
+	waitState(t, lb, StateSeeding, "b resumed")
+	ta.check(t, leecher.cfg.DataDir, "a")
+	tb.check(t, leecher.cfg.DataDir, "b")
+}
+
+func TestSeedGoals(t *testing.T) {
+	tt := newTestTorrent(t, "dir")
+	tests := map[string]struct {
+		goals   SeedGoals
+		leecher bool // downloads from the seeder
+		removed bool
+	}{
+		"ratio":   {goals: SeedGoals{Ratio: 1}, leecher: true},
+		"time":    {goals: SeedGoals{Time: 100 * time.Millisecond, Action: GoalRemove}, removed: true},
+		"idle":    {goals: SeedGoals{Idle: 100 * time.Millisecond}},
+		"forever": {goals: SeedGoals{}},
+	}
+
+	for name, test := range tests {
+		seeder := newTestSessionWith(t, Config{SeedGoals: test.goals})
+		tt.write(t, seeder.cfg.DataDir)
+		st, err := seeder.AddBytes(tt.torrent, AddOptions{})
+		require.Nil(t, err, name)
+		assert.Equal(t, test.goals, st.SeedGoals(), name)
+		waitState(t, st, StateSeeding, name)
+
+		if test.leecher {
+			leecher := newTestSession(t)
+			lt, err := leecher.AddBytes(tt.torrent, AddOptions{})
+			require.Nil(t, err, name)
+			lt.AddPeers([]peer.Peer{seeder.peer()})
+			waitState(t, lt, StateSeeding, name)
+		}
+
+		if test.goals == (SeedGoals{}) {
+			time.Sleep(2 * manageInterval)
+			assert.Equal(t, StateSeeding, st.State(), name)
+			continue
+		}
+		if test.removed {
+			require.Eventually(t, func() bool { return len(seeder.Torrents()) == 0 }, 5*time.Second, 10*time.Millisecond, name)
+			assert.Equal(t, StatePaused, st.State(), name)
+			tt.check(t, seeder.cfg.DataDir, name)
+			continue
+		}
+		waitState(t, st, StatePaused, name)
+		assert.GreaterOrEqual(t, st.Ratio(), test.goals.Ratio, name)
+		assert.GreaterOrEqual(t, st.SeedingTime(), test.goals.Idle, name)
+
+		// a torrent resumed by hand seeds on
+		st.Resume()
+		waitState(t, st, StateSeeding, name)
+		time.Sleep(2 * manageInterval)
+		assert.Equal(t, StateSeeding, st.State(), name)
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	tt := newTestTorrent(t, "dir")
+	seeder := newTestSession(t)
+	tt.write(t, seeder.cfg.DataDir)
+	st, err := seeder.AddBytes(tt.torrent, AddOptions{})
+	require.Nil(t, err)
+	waitState(t, st, StateSeeding, "seeder")
+
+	var mu sync.Mutex
+	var events []string
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		events = append(events, r.URL.Query().Get("event"))
+		mu.Unlock()
+		peers := make([]byte, 6)
+		copy(peers, net.IPv4(127, 0, 0, 1).To4())
+		binary.BigEndian.PutUint16(peers[4:], seeder.Port())
+		bencode.Marshal(w, map[string]interface{}{"interval": 900, "peers": string(peers)})
+	}))
+	defer tracker.Close()
+	// a tracker that never answers
+	block := make(chan struct{})
+	silent := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { <-block }))
+	defer silent.Close()
+	defer close(block)
+
+	leecher := newTestSession(t)
+	lt, err := leecher.AddBytes(tt.torrent, AddOptions{Trackers: []string{tracker.URL + "/announce", silent.URL + "/announce"}})
+	require.Nil(t, err)
+	waitState(t, lt, StateSeeding, "leecher")
+	tt.check(t, leecher.cfg.DataDir, "leecher")
+
+	expect := func(expected []string, msg string) {
+		require.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return assert.ObjectsAreEqual(expected, events)
+		}, 5*time.Second, 10*time.Millisecond, msg)
+	}
+	expect([]string{"started", "completed"}, "download")
+	lt.Pause()
+	expect([]string{"started", "completed", "stopped"}, "paused")
+	// the data was complete when it started
+	lt.Resume()
+	expect([]string{"started", "completed", "stopped", "started"}, "resumed")
+
+	start := time.Now()
+	require.Nil(t, leecher.Close())
+	assert.Less(t, int64(time.Since(start)), int64(2*time.Second), "the silent tracker is abandoned")
+	expect([]string{"started", "completed", "stopped", "started", "stopped"}, "closed")
+}
+
+func TestRetryInterval(t *testing.T) {
+	tests := map[string]struct {
+		failures int
+		expected time.Duration
+	}{
+		"first failure":  {failures: 0, expected: MinAnnounceInterval},
+		"second failure": {failures: 1, expected: 2 * MinAnnounceInterval},
+		"third failure":  {failures: 2, expected: 4 * MinAnnounceInterval},
+		"capped":         {failures: 10, expected: AnnounceInterval},
+		"many":           {failures: 1000, expected: AnnounceInterval},
+	}
+
+	for name, test := range tests {
+		assert.Equal(t, test.expected, retryInterval(test.failures), name)
+	}
+}
+
+func TestRememberPeers(t *testing.T) {
+	tr := &Torrent{}
+	peers := make([]peer.Peer, p2p.MaxKnownPeers+1)
+	for i := range peers {
+		peers[i] = peer.Peer{IP: net.IP{10, 0, byte(i >> 8), byte(i)}, Port: 6881}
+	}
+	tr.remember(peers[:2], p2p.SourceTracker)
+	tr.remember(peers[:1], p2p.SourceDHT)
+	assert.Equal(t, []knownPeer{{peers[1], p2p.SourceTracker}, {peers[0], p2p.SourceDHT}}, tr.peers, "added again")
+
+	tr.remember(peers[2:], p2p.SourceTracker)
+	assert.Len(t, tr.peers, p2p.MaxKnownPeers)
+	assert.Equal(t, peers[0], tr.peers[0].peer, "the oldest one is forgotten")
+}
+
+func TestStatus(t *testing.T) {
+	tt := newTestTorrent(t, "dir")
+	seeder := newTestSession(t)
+	tt.write(t, seeder.cfg.DataDir)
+	st, err := seeder.AddBytes(tt.torrent, AddOptions{})
+	require.Nil(t, err)
+	waitState(t, st, StateSeeding, "seeder")
+
+	leecher := newTestSession(t)
+	lt, err := leecher.AddBytes(tt.torrent, AddOptions{Paused: true})
+	require.Nil(t, err)
+	assert.Equal(t, int64(len(tt.data)), lt.Size())
+	assert.Equal(t, int64(0), lt.BytesCompleted())
+	assert.NotNil(t, lt.SetFilePriority(2, p2p.PriorityHigh), "no such file")
+	require.Nil(t, lt.SetFilePriority(1, p2p.PrioritySkip))
+
+	// only the pieces of a are downloaded, the second one holds the start of b/c
+	lt.AddPeers([]peer.Peer{seeder.peer()})
+	lt.Resume()
+	waitState(t, lt, StateSeeding, "a")
+	expected := []FileStatus{
+		{Path: "dir/a", Length: 30000, Completed: 30000, Priority: p2p.PriorityNormal},
+		{Path: "dir/b/c", Length: 50000, Completed: 2*int64(pieceLength) - 30000, Priority: p2p.PrioritySkip},
+	}
+	assert.Equal(t, expected, lt.Files())
+	assert.Equal(t, 2*int64(pieceLength), lt.BytesCompleted())
+	assert.Empty(t, lt.Trackers())
+	stats := lt.Stats()
+	assert.Equal(t, int64(0), stats.Left)
+	assert.Equal(t, time.Duration(0), stats.ETA)
+	assert.Equal(t, 2*int64(pieceLength), stats.Downloaded)
+
+	// a seed downloads the files it wants again
+	require.Nil(t, lt.SetFilePriority(1, p2p.PriorityHigh))
+	waitState(t, lt, StateSeeding, "b/c")
+	assert.Equal(t, int64(len(tt.data)), lt.BytesCompleted())
+	assert.Equal(t, int64(len(tt.data)), lt.Stats().Downloaded, "over both runs")
+	require.Nil(t, leecher.Close())
+	tt.check(t, leecher.cfg.DataDir, "b/c")
+
+	settings := Settings{DownloadRate: 100, UploadRate: 200, MaxActiveDownloads: 1, SeedGoals: SeedGoals{Ratio: 2}}
+	seeder.SetSettings(settings)
+	assert.Equal(t, settings, seeder.Settings())
+	// paused torrents do not announce
+	other := newTestSession(t)
+	ot, err := other.AddBytes(tt.torrent, AddOptions{Paused: true, Trackers: []string{"udp://tracker:80"}})
+	require.Nil(t, err)
+	assert.Equal(t, []TrackerStatus{{URL: "udp://tracker:80"}}, ot.Trackers())
+	assert.Equal(t, p2p.TorrentStats{ETA: -1}, ot.Stats())
+	assert.Nil(t, ot.PeerStats())
+}
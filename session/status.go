@@ -0,0 +1,261 @@
+package session
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/VIVelev/bittorrent/bitfield"
+	"github.com/VIVelev/bittorrent/io"
+	"github.com/VIVelev/bittorrent/p2p"
+)
+
+// FileStatus describes a file of a torrent.
+type FileStatus struct {
+	// Path is relative to the directory of the torrent, slash separated.
+	Path    string
+	Length  int64
+	Padding bool // BEP 47, never written to disk
+	// Completed is how many bytes of the file are verified.
+	Completed int64
+	Priority  p2p.Priority
+}
+
+// TrackerStatus describes the last announce of a torrent to a tracker.
+type TrackerStatus struct {
+	URL          string
+	LastAnnounce time.Time // zero until the first announce is done
+	Peers        int       // returned by the last announce
+	Err          error     // of the last announce
+}
+
+// Settings are the settings of a session that can change while it runs, see Config.
+type Settings struct {
+	DownloadRate       int
+	UploadRate         int
+	MaxActiveDownloads int
+	MaxActiveSeeds     int
+	// SeedGoals are given to the torrents added from now on.
+	SeedGoals SeedGoals
+}
+
+// Settings returns the current settings of the session.
+func (s *Session) Settings() Settings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return Settings{
+		DownloadRate:       s.down.Rate(),
+		UploadRate:         s.up.Rate(),
+		MaxActiveDownloads: s.cfg.MaxActiveDownloads,
+		MaxActiveSeeds:     s.cfg.MaxActiveSeeds,
+		SeedGoals:          s.cfg.SeedGoals,
+	}
+}
+
+// SetSettings changes the settings of the session, torrents start or wait in the queue
+// according to the new limits.
+func (s *Session) SetSettings(st Settings) {
+	s.SetRateLimits(st.DownloadRate, st.UploadRate)
+	s.mu.Lock()
+	s.cfg.DownloadRate, s.cfg.UploadRate = st.DownloadRate, st.UploadRate
+	s.cfg.MaxActiveDownloads, s.cfg.MaxActiveSeeds = st.MaxActiveDownloads, st.MaxActiveSeeds
+	s.cfg.SeedGoals = st.SeedGoals
+	s.mu.Unlock()
+
+	s.schedule()
+}
+
+// Dir returns the directory the torrent is stored under.
+func (t *Torrent) Dir() string {
+	return t.dir
+}
+
+// Added returns when the torrent was added to the session.
+func (t *Torrent) Added() time.Time {
+	return t.added
+}
+
+// Magnet returns the magnet link of the torrent.
+func (t *Torrent) Magnet() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	m := &io.Magnet{InfoHash: t.infoHash, Name: t.name, Trackers: t.trackers, WebSeeds: t.webSeeds}
+	if t.tf != nil {
+		m.WebSeeds = t.tf.URLList
+	}
+	return m.String()
+}
+
+// completed returns the metadata of the torrent and the pieces it has, the latter nil
+// until its storage is open.
+func (t *Torrent) completed() (*io.TorrentFile, bitfield.Bitfield) {
+	t.mu.Lock()
+	tf, run, st := t.tf, t.run, t.storage
+	t.mu.Unlock()
+	switch {
+	case run != nil:
+		return tf, run.Completed()
+	case st != nil:
+		return tf, st.Completed()
+	default:
+		return tf, nil
+	}
+}
+
+// Size returns the size of the contents of the torrent, 0 until the metadata is fetched.
+func (t *Torrent) Size() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.tf == nil {
+		return 0
+	}
+	return int64(t.tf.Length)
+}
+
+// BytesCompleted returns how many bytes of the torrent are verified.
+func (t *Torrent) BytesCompleted() int64 {
+	tf, completed := t.completed()
+	if tf == nil || completed == nil {
+		return 0
+	}
+	var n int64
+	for _, c := range p2p.FilesCompleted(tf, completed) {
+		n += c
+	}
+	return n
+}
+
+// Files describes the files of the torrent, nil until the metadata is fetched.
+func (t *Torrent) Files() []FileStatus {
+	tf, completed := t.completed()
+	if tf == nil {
+		return nil
+	}
+	var done []int64
+	if completed != nil {
+		done = p2p.FilesCompleted(tf, completed)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ret := make([]FileStatus, tf.NumFiles())
+	for i := range ret {
+		f := &ret[i]
+		if tf.IsMultiFile {
+			f.Path = path.Join(append([]string{tf.Name}, tf.Files[i].Path...)...)
+			f.Length = int64(tf.Files[i].Length)
+			f.Padding = tf.Files[i].IsPadding()
+		} else {
+			f.Path, f.Length = tf.Name, int64(tf.Length)
+		}
+		if done != nil {
+			f.Completed = done[i]
+		}
+		f.Priority = t.filePriority(i)
+	}
+	return ret
+}
+
+// filePriority must be called with t.mu held.
+func (t *Torrent) filePriority(file int) p2p.Priority {
+	if t.priorities == nil {
+		return p2p.PriorityNormal
+	}
+	return t.priorities[file]
+}
+
+// SetFilePriority sets the priority of the file with the given index, see p2p.Torrent.SetFilePriority.
+// A seeding torrent that wants a skipped file again starts downloading it.
+func (t *Torrent) SetFilePriority(file int, p p2p.Priority) error {
+	if p < p2p.PrioritySkip || p > p2p.PriorityHigh {
+		return fmt.Errorf("invalid priority %d", p)
+	}
+
+	t.mu.Lock()
+	if t.tf == nil {
+		t.mu.Unlock()
+		return fmt.Errorf("metadata of %x is not fetched yet", t.infoHash)
+	}
+	if file < 0 || file >= t.tf.NumFiles() {
+		t.mu.Unlock()
+		return fmt.Errorf("file %d does not exist", file)
+	}
+	if t.priorities == nil {
+		t.priorities = make([]p2p.Priority, t.tf.NumFiles())
+		for i := range t.priorities {
+			t.priorities[i] = p2p.PriorityNormal
+		}
+	}
+	wanted := t.priorities[file] == p2p.PrioritySkip && p != p2p.PrioritySkip
+	t.priorities[file] = p
+	restart := wanted && t.finished
+	if restart {
+		// a finished run does not download anymore, the next one does
+		t.finished = false
+		t.halt(StatePaused)
+	} else if t.run != nil {
+		if err := t.run.SetFilePriority(file, p); err != nil {
+			t.mu.Unlock()
+			return err
+		}
+	}
+	t.mu.Unlock()
+
+	if restart {
+		t.s.schedule()
+	}
+	return nil
+}
+
+// Peers lists the peers the torrent is connected to.
+func (t *Torrent) Peers() []p2p.PeerInfo {
+	run := t.running()
+	if run == nil {
+		return nil
+	}
+	return run.Peers()
+}
+
+// PeerStats returns a snapshot of the connections of the torrent, see p2p.Torrent.PeerStats.
+func (t *Torrent) PeerStats() []p2p.PeerStats {
+	run := t.running()
+	if run == nil {
+		return nil
+	}
+	return run.PeerStats()
+}
+
+// Stats returns a snapshot of the torrent, see p2p.Torrent.Stats. Its bytes and hash failures
+// are counted over every run, the rest is of the current run, zero while it is not running.
+func (t *Torrent) Stats() p2p.TorrentStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st := p2p.TorrentStats{ETA: -1}
+	if t.run != nil {
+		st = t.run.Stats()
+	}
+	st.Downloaded += t.downloaded
+	st.Uploaded += t.uploaded
+	st.Wasted += t.wasted
+	st.HashFailures += t.hashFailures
+	return st
+}
+
+// Trackers describes the last announces of the torrent.
+func (t *Torrent) Trackers() []TrackerStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ret := make([]TrackerStatus, len(t.trackers))
+	for i, tr := range t.trackers {
+		ret[i] = TrackerStatus{URL: tr}
+		if st, ok := t.announces[tr]; ok {
+			ret[i] = st
+		}
+	}
+	return ret
+}
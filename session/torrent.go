@@ -0,0 +1,678 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/VIVelev/bittorrent/client"
+	"github.com/VIVelev/bittorrent/discovery"
+	"github.com/VIVelev/bittorrent/event"
+	"github.com/VIVelev/bittorrent/io"
+	"github.com/VIVelev/bittorrent/logging"
+	"github.com/VIVelev/bittorrent/p2p"
+	"github.com/VIVelev/bittorrent/peer"
+	"github.com/VIVelev/bittorrent/storage"
+)
+
+const (
+	// AnnounceInterval is how often the trackers of a running torrent are asked for peers,
+	// unless they tell otherwise.
+	AnnounceInterval time.Duration = 30 * time.Minute
+	// MinAnnounceInterval bounds how often a tracker can ask to be announced to. A failed
+	// announce is retried after it, then after twice as long every time it fails again,
+	// up to AnnounceInterval.
+	MinAnnounceInterval time.Duration = time.Minute
+	// stoppedTimeout bounds the announces telling the trackers that a torrent stopped.
+	stoppedTimeout time.Duration = 5 * time.Second
+)
+
+// State is the stage a torrent of a session is at.
+type State int
+
+const (
+	StatePaused State = iota
+	// StateMetadata torrents are fetching their metadata from peers, see Session.AddMagnet.
+	StateMetadata
+	// StateChecking torrents are verifying the data that is on disk already.
+	StateChecking
+	StateDownloading
+	// StateSeeding torrents have every wanted piece and upload to peers.
+	StateSeeding
+	// StateError torrents failed, see Torrent.Err. Resume retries them.
+	StateError
+	// StateQueued torrents wait for another torrent of the session to stop, see Config.MaxActiveDownloads.
+	StateQueued
+)
+
+func (s State) String() string {
+	switch s {
+	case StatePaused:
+		return "paused"
+	case StateMetadata:
+		return "metadata"
+	case StateChecking:
+		return "checking"
+	case StateDownloading:
+		return "downloading"
+	case StateSeeding:
+		return "seeding"
+	case StateError:
+		return "error"
+	case StateQueued:
+		return "queued"
+	default:
+		return fmt.Sprintf("State#%d", int(s))
+	}
+}
+
+type knownPeer struct {
+	peer   peer.Peer
+	source p2p.Source
+}
+
+// Torrent is a torrent of a session.
+type Torrent struct {
+	s        *Session
+	infoHash [20]byte
+	added    time.Time
+	dir      string
+	trackers []string
+	webSeeds []string // of the magnet link, added to the metadata once fetched
+
+	// setup is held while the storage is opened and checked
+	setup sync.Mutex
+	// announcing is held by the announce loop of a run, so that the next one starts once the
+	// trackers are told the previous one stopped
+	announcing sync.Mutex
+
+	mu      sync.Mutex
+	name    string
+	tf      *io.TorrentFile // nil until the metadata is fetched
+	storage storage.Storage // nil until the torrent first runs
+	state   State
+	err     error
+	wanted  bool          // Resume was called, and Pause was not since
+	stop    chan struct{} // closed by Pause, nil while paused
+	run     *p2p.Torrent
+	runs    sync.WaitGroup // of the runs whose goroutines may still use the storage, see close
+	fetcher *p2p.MetadataFetcher
+	peers   []knownPeer   // the latest ones added, for the runs to come
+	done    chan struct{} // closed when the current run completes the download
+
+	finished     bool  // seeded once, so the torrent counts against Config.MaxActiveSeeds
+	downloaded   int64 // by the runs before the current one
+	uploaded     int64
+	wasted       int64
+	hashFailures int
+	seeding      time.Duration // of the runs before the current one
+	seedingSince time.Time     // of the current run, zero unless it seeds
+	goals        SeedGoals
+	goalsMet     bool // paused by GoalPause, the goals are not checked anymore
+
+	priorities []p2p.Priority // of the files, nil while every file is normal
+	announces  map[string]TrackerStatus
+}
+
+func (s *Session) newTorrent(infoHash [20]byte, name string, opts AddOptions) *Torrent {
+	return &Torrent{
+		s:         s,
+		infoHash:  infoHash,
+		added:     time.Now(),
+		dir:       s.dir(opts),
+		name:      name,
+		announces: make(map[string]TrackerStatus),
+	}
+}
+
+// InfoHash returns the info hash of the torrent.
+func (t *Torrent) InfoHash() [20]byte {
+	return t.infoHash
+}
+
+// Name returns the name of the torrent, the display name of the magnet link until the metadata is fetched.
+func (t *Torrent) Name() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.name
+}
+
+// TorrentFile returns the metadata of the torrent, nil until it is fetched.
+func (t *Torrent) TorrentFile() *io.TorrentFile {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.tf
+}
+
+// State returns the stage the torrent is at.
+func (t *Torrent) State() State {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.state
+}
+
+// Err returns why the torrent failed, nil unless it is in StateError.
+func (t *Torrent) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.err
+}
+
+// Pause disconnects the torrent from its peers and stops announcing it. Its storage stays open.
+// The next torrent in the queue of the session may start instead.
+func (t *Torrent) Pause() {
+	t.mu.Lock()
+	t.wanted = false
+	t.halt(StatePaused)
+	t.mu.Unlock()
+
+	t.s.schedule()
+}
+
+// halt stops the current run, if any, and moves the torrent to state.
+// Must be called with t.mu held.
+func (t *Torrent) halt(state State) {
+	t.enter(state, nil)
+	if t.stop == nil {
+		return
+	}
+	close(t.stop)
+	t.stop = nil
+	if t.fetcher != nil {
+		t.fetcher.Stop()
+		t.fetcher = nil
+	}
+	if t.run != nil {
+		t.run.Stop()
+		st := t.run.Stats()
+		t.downloaded += st.Downloaded
+		t.uploaded += st.Uploaded
+		t.wasted += st.Wasted
+		t.hashFailures += st.HashFailures
+		t.run = nil
+	}
+	t.seeding = t.seedingTime(time.Now())
+	t.seedingSince = time.Time{}
+}
+
+// Resume starts a paused or failed torrent again. It waits in StateQueued while the
+// session runs as many torrents as it may, see Config.MaxActiveDownloads.
+func (t *Torrent) Resume() {
+	t.mu.Lock()
+	if t.state == StateError {
+		t.halt(StatePaused)
+	}
+	t.wanted = true
+	t.mu.Unlock()
+
+	t.s.schedule()
+}
+
+// start runs the torrent unless it runs already. Must be called with t.mu held.
+func (t *Torrent) start() {
+	if t.stop != nil {
+		return
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	t.stop, t.done = stop, done
+	t.enter(StateDownloading, nil)
+	t.s.announce.Add(1)
+	go t.announceLoop(stop, done)
+	go t.runUntil(stop)
+}
+
+// close pauses the torrent for good and closes its storage. It returns the metadata, if any.
+func (t *Torrent) close() (*io.TorrentFile, error) {
+	t.mu.Lock()
+	t.wanted = false
+	t.halt(StatePaused)
+	t.mu.Unlock()
+	// wait for the runs to stop using the storage, and for a check in progress
+	t.runs.Wait()
+	t.setup.Lock()
+	defer t.setup.Unlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var err error
+	if t.storage != nil {
+		err = t.storage.Close()
+		t.storage = nil
+	}
+	return t.tf, err
+}
+
+// stopped reports whether stop was closed. Must be called with t.mu held.
+func (t *Torrent) stopped(stop chan struct{}) bool {
+	return t.stop != stop
+}
+
+// setState records the state of the run that stop belongs to, unless it was paused since.
+func (t *Torrent) setState(stop chan struct{}, state State, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.stopped(stop) {
+		t.enter(state, err)
+	}
+}
+
+// enter moves the torrent to state, and tells the observers of the session when it changed.
+// Must be called with t.mu held.
+func (t *Torrent) enter(state State, err error) {
+	changed := t.state != state
+	t.state, t.err = state, err
+	if changed {
+		if err != nil {
+			t.s.cfg.Logger.Error("torrent failed", logging.InfoHash(t.infoHash), logging.String("state", state.String()), logging.Err(err))
+		} else {
+			t.s.cfg.Logger.Info("state changed", logging.InfoHash(t.infoHash), logging.String("state", state.String()))
+		}
+		t.s.notes.notify(event.Event{Type: event.StateChanged, InfoHash: t.infoHash, State: state.String(), Err: err})
+	}
+}
+
+// runUntil fetches the metadata, checks the data on disk, then downloads and seeds the torrent
+// until stop is closed.
+func (t *Torrent) runUntil(stop chan struct{}) {
+	tf, err := t.metadata(stop)
+	if err == p2p.ErrStopped {
+		return
+	}
+	if err != nil {
+		t.setState(stop, StateError, err)
+		t.s.schedule()
+		return
+	}
+	st, err := t.openStorage(tf, stop)
+	if err != nil {
+		t.setState(stop, StateError, err)
+		t.s.schedule()
+		return
+	}
+
+	run := p2p.NewTorrent(tf, t.s.peerID)
+	run.Dialer = t.s.dialer
+	run.Seed = true
+	run.MaxPeers = t.s.cfg.MaxPeers
+	run.Events = t.s.events
+	run.Metrics = t.s.cfg.Metrics
+	run.Logger = t.s.cfg.Logger
+	t.mu.Lock()
+	if t.stopped(stop) {
+		t.mu.Unlock()
+		return
+	}
+	for file, p := range t.priorities {
+		run.SetFilePriority(file, p) // valid, see Torrent.SetFilePriority
+	}
+	t.run = run
+	t.runs.Add(1)
+	t.enter(StateDownloading, nil)
+	peers := t.peers
+	t.mu.Unlock()
+	defer func() {
+		// the connections outlive RunWith while seeding
+		<-stop
+		run.Wait()
+		t.runs.Done()
+	}()
+	for _, kp := range peers {
+		run.AddPeers([]peer.Peer{kp.peer}, kp.source)
+	}
+
+	err = run.RunWith(st)
+	switch {
+	case err == p2p.ErrStopped:
+	case err != nil:
+		t.setState(stop, StateError, err)
+		t.s.schedule()
+	default:
+		t.mu.Lock()
+		if !t.stopped(stop) {
+			t.enter(StateSeeding, nil)
+			if !t.finished {
+				// the trackers are told, unless the data was complete already
+				close(t.done)
+			}
+			t.finished, t.seedingSince = true, time.Now()
+		}
+		t.mu.Unlock()
+		// it may wait for a seeding slot now, and leave its downloading slot to another torrent
+		t.s.schedule()
+	}
+}
+
+// metadata returns the metadata of the torrent, fetching it from its peers if needed.
+func (t *Torrent) metadata(stop chan struct{}) (*io.TorrentFile, error) {
+	t.mu.Lock()
+	if t.tf != nil {
+		defer t.mu.Unlock()
+		return t.tf, nil
+	}
+	if t.stopped(stop) {
+		t.mu.Unlock()
+		return nil, p2p.ErrStopped
+	}
+	f := p2p.NewMetadataFetcher(t.infoHash, t.s.peerID)
+	f.Dialer = t.s.dialer
+	f.Logger = t.s.cfg.Logger
+	t.fetcher = f
+	t.enter(StateMetadata, nil)
+	peers := t.peers
+	t.mu.Unlock()
+	for _, kp := range peers {
+		f.AddPeers([]peer.Peer{kp.peer}, kp.source)
+	}
+
+	tf, err := f.Run()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.fetcher == f {
+		t.fetcher = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tf.InfoHash != t.infoHash {
+		return nil, fmt.Errorf("metadata of torrent %x instead of %x", tf.InfoHash, t.infoHash)
+	}
+	tf.URLList = append(tf.URLList, t.webSeeds...)
+	t.tf, t.name = tf, tf.Name
+	return tf, nil
+}
+
+// openStorage opens the storage of the torrent on its first run, and checks the data it has already.
+func (t *Torrent) openStorage(tf *io.TorrentFile, stop chan struct{}) (storage.Storage, error) {
+	t.setup.Lock()
+	defer t.setup.Unlock()
+
+	t.mu.Lock()
+	st := t.storage
+	t.mu.Unlock()
+	if st != nil {
+		return st, nil
+	}
+
+	st, err := t.s.openStorage(tf, t.dir)
+	if err != nil {
+		return nil, fmt.Errorf("storage: %s", err)
+	}
+	t.setState(stop, StateChecking, nil)
+	found, err := p2p.NewTorrent(tf, t.s.peerID).Check(st)
+	if err != nil {
+		st.Close()
+		return nil, fmt.Errorf("check: %s", err)
+	}
+	if found > 0 {
+		t.s.cfg.Logger.Info("found valid pieces on disk", logging.InfoHash(t.infoHash), logging.String("name", tf.Name), logging.Int("pieces", found))
+	}
+
+	t.mu.Lock()
+	t.storage = st
+	t.mu.Unlock()
+	return st, nil
+}
+
+// addPeers remembers peers for the runs to come and hands them to the current one.
+func (t *Torrent) addPeers(peers []peer.Peer, src p2p.Source) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.remember(peers, src)
+	if t.fetcher != nil {
+		t.fetcher.AddPeers(peers, src)
+	}
+	if t.run != nil {
+		t.run.AddPeers(peers, src)
+	}
+}
+
+// remember keeps the latest peers added, up to p2p.MaxKnownPeers, the peers added again
+// moving to the back. Must be called with t.mu held.
+func (t *Torrent) remember(peers []peer.Peer, src p2p.Source) {
+	added := make(map[string]bool, len(peers))
+	var fresh []knownPeer
+	for _, p := range peers {
+		if key := p.String(); !added[key] {
+			added[key] = true
+			fresh = append(fresh, knownPeer{peer: p, source: src})
+		}
+	}
+	// a new slice, the runs iterate over the old one
+	kept := make([]knownPeer, 0, len(t.peers)+len(fresh))
+	for _, kp := range t.peers {
+		if !added[kp.peer.String()] {
+			kept = append(kept, kp)
+		}
+	}
+	kept = append(kept, fresh...)
+	if len(kept) > p2p.MaxKnownPeers {
+		kept = kept[len(kept)-p2p.MaxKnownPeers:]
+	}
+	t.peers = kept
+}
+
+// AddPeers adds peers to connect to, e.g. found out of band.
+func (t *Torrent) AddPeers(peers []peer.Peer) {
+	t.addPeers(peers, p2p.SourceTracker)
+}
+
+// running returns the download of the torrent, nil unless it runs.
+func (t *Torrent) running() *p2p.Torrent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.run
+}
+
+// addConn hands a connection from a peer over to the running download.
+func (t *Torrent) addConn(c *client.Client, p peer.Peer) {
+	run := t.running()
+	if run == nil {
+		c.Conn.Close()
+		return
+	}
+	run.AddConn(c, p)
+}
+
+// Downloaded returns how many bytes of verified pieces the torrent downloaded, over every run.
+func (t *Torrent) Downloaded() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.run != nil {
+		return t.downloaded + t.run.Downloaded()
+	}
+	return t.downloaded
+}
+
+// Uploaded returns how many bytes the torrent uploaded to peers, over every run.
+func (t *Torrent) Uploaded() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.run != nil {
+		return t.uploaded + t.run.Uploaded()
+	}
+	return t.uploaded
+}
+
+// Ratio returns the share ratio of the torrent: its uploaded bytes to its size,
+// or to its downloaded bytes if more. It is 0 until the metadata is fetched.
+func (t *Torrent) Ratio() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.ratio()
+}
+
+// ratio must be called with t.mu held.
+func (t *Torrent) ratio() float64 {
+	if t.tf == nil || t.tf.Length == 0 {
+		return 0
+	}
+	downloaded, uploaded := t.downloaded, t.uploaded
+	if t.run != nil {
+		downloaded += t.run.Downloaded()
+		uploaded += t.run.Uploaded()
+	}
+	if size := int64(t.tf.Length); downloaded < size {
+		downloaded = size
+	}
+	return float64(uploaded) / float64(downloaded)
+}
+
+// SeedingTime returns how long the torrent seeded, over every run.
+func (t *Torrent) SeedingTime() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.seedingTime(time.Now())
+}
+
+// seedingTime must be called with t.mu held.
+func (t *Torrent) seedingTime(now time.Time) time.Duration {
+	if t.seedingSince.IsZero() {
+		return t.seeding
+	}
+	return t.seeding + now.Sub(t.seedingSince)
+}
+
+// progress returns what we tell the trackers about the torrent.
+func (t *Torrent) progress() discovery.Progress {
+	return discovery.Progress{Uploaded: t.Uploaded(), Downloaded: t.Downloaded(), Left: t.left()}
+}
+
+// left returns how many bytes we miss to announce to trackers.
+func (t *Torrent) left() int64 {
+	size := t.Size()
+	if size == 0 {
+		// unknown, but not complete
+		return 1
+	}
+	return size - t.BytesCompleted()
+}
+
+// announceLoop announces the torrent to its trackers until stop is closed, and the completion
+// of the download once done is closed.
+func (t *Torrent) announceLoop(stop, done chan struct{}) {
+	defer t.s.announce.Done()
+	if len(t.trackers) == 0 {
+		return
+	}
+	t.announcing.Lock()
+	defer t.announcing.Unlock()
+	// the announces in flight are abandoned once the torrent stops
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, tr := range t.trackers {
+		wg.Add(1)
+		go func(tracker string) {
+			defer wg.Done()
+			t.announceTo(ctx, tracker, done)
+		}(tr)
+	}
+	wg.Wait()
+}
+
+// announceTo announces the torrent to tracker when it asks to until ctx is done, then tells it
+// that the torrent stopped.
+func (t *Torrent) announceTo(ctx context.Context, tracker string, done chan struct{}) {
+	ev, started := discovery.EventStarted, false
+	failures := 0
+	for {
+		interval, err := t.announce(ctx, tracker, ev)
+		switch {
+		case ctx.Err() != nil:
+		case err != nil:
+			interval = retryInterval(failures)
+			failures++
+		default:
+			ev, started = discovery.EventNone, true
+			failures = 0
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-done:
+			done = nil
+			if started {
+				ev = discovery.EventCompleted
+			}
+		case <-ctx.Done():
+		}
+		timer.Stop()
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if !started {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stoppedTimeout)
+	defer cancel()
+	t.announce(ctx, tracker, discovery.EventStopped)
+}
+
+// retryInterval returns how long to wait after an announce failed, failures being how many
+// announces failed in a row before it.
+func retryInterval(failures int) time.Duration {
+	interval := MinAnnounceInterval
+	for i := 0; i < failures && interval < AnnounceInterval; i++ {
+		interval *= 2
+	}
+	if interval > AnnounceInterval {
+		return AnnounceInterval
+	}
+	return interval
+}
+
+// announce tells tracker about the torrent with ev and adds the peers it replies with.
+// It returns how long to wait before the next announce, once it succeeded.
+func (t *Torrent) announce(ctx context.Context, tracker string, ev discovery.Event) (time.Duration, error) {
+	progress := t.progress()
+	progress.Event = ev
+	reply, err := t.s.trackers.Announce(ctx, tracker, progress, t.infoHash, t.s.peerID, t.s.port)
+	if ctx.Err() != nil {
+		// abandoned, the torrent stopped
+		return 0, ctx.Err()
+	}
+	if ev == discovery.EventStopped {
+		if err != nil {
+			t.s.cfg.Logger.Debug("could not announce the stop", logging.InfoHash(t.infoHash), logging.String("tracker", tracker), logging.Err(err))
+		}
+		return 0, err
+	}
+	t.mu.Lock()
+	t.announces[tracker] = TrackerStatus{URL: tracker, LastAnnounce: time.Now(), Peers: len(reply.Peers), Err: err}
+	t.mu.Unlock()
+	if err != nil {
+		t.s.cfg.Logger.Warn("could not announce", logging.InfoHash(t.infoHash), logging.String("tracker", tracker), logging.Err(err))
+		return 0, err
+	}
+	t.addPeers(reply.Peers, p2p.SourceTracker)
+
+	switch {
+	case reply.Interval == 0:
+		return AnnounceInterval, nil
+	case reply.Interval < MinAnnounceInterval:
+		return MinAnnounceInterval, nil
+	default:
+		return reply.Interval, nil
+	}
+}
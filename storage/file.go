@@ -0,0 +1,347 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	stdio "io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/VIVelev/bittorrent/io"
+)
+
+const dirPerm os.FileMode = 0755
+
+// File keeps the contents of a torrent in its files on disk, laid out under a root directory.
+//
+// Files that are not wanted are not created. The parts of them that share pieces with
+// wanted files go to a partfile next to the torrent instead, at their offset within the torrent.
+type File struct {
+	pieceMap
+	layout   *io.Layout
+	partPath string
+
+	// routing holds writers off while a file changes between its partfile and the disk
+	routing sync.RWMutex
+
+	mu     sync.Mutex
+	files  []*os.File // opened on demand
+	wanted []bool
+	part   *os.File
+}
+
+// NewFile returns a storage for tf that keeps its files under root, see io.Layout.
+// The symlinks of the torrent are created right away.
+func NewFile(tf *io.TorrentFile, root string) (*File, error) {
+	l, err := tf.Layout(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := createSymlinks(l); err != nil {
+		return nil, err
+	}
+
+	fs := &File{
+		pieceMap: newPieceMap(tf),
+		layout:   l,
+		partPath: partPath(l),
+		files:    make([]*os.File, len(l.Files)),
+		wanted:   make([]bool, len(l.Files)),
+	}
+	for i := range fs.wanted {
+		fs.wanted[i] = true
+	}
+	return fs, nil
+}
+
+// partPath returns the path of the partfile of the layout, a hidden file named like the torrent.
+func partPath(l *io.Layout) string {
+	name := filepath.Base(l.Dir)
+	if l.Dir == l.Root {
+		name = filepath.Base(l.Files[0].Path)
+	}
+	return filepath.Join(l.Root, "."+name+".parts")
+}
+
+// RemoveFiles deletes what NewFile keeps of tf under root, the partfile included.
+func RemoveFiles(tf *io.TorrentFile, root string) error {
+	l, err := tf.Layout(root)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(partPath(l)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if l.Dir != l.Root {
+		return os.RemoveAll(l.Dir)
+	}
+	if err := os.Remove(l.Files[0].Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// createSymlinks creates the symlinks of the layout that do not exist yet.
+func createSymlinks(l *io.Layout) error {
+	for _, f := range l.Files {
+		if f.Symlink == "" {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(f.Path), dirPerm); err != nil {
+			return err
+		}
+		if err := os.Symlink(f.Symlink, f.Path); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// open returns the file with the given index of the layout, creating it if create is set.
+// Returns nil if it does not exist.
+func (fs *File) open(i int, create bool) (*os.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.files[i] != nil {
+		return fs.files[i], nil
+	}
+	lf := fs.layout.Files[i]
+	f, err := openFile(lf.Path, create, lf.Mode())
+	if f != nil {
+		fs.files[i] = f
+	}
+	return f, err
+}
+
+// openPart returns the partfile, creating it if create is set. Returns nil if it does not exist.
+func (fs *File) openPart(create bool) (*os.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.part != nil {
+		return fs.part, nil
+	}
+	f, err := openFile(fs.partPath, create, 0644)
+	if f != nil {
+		fs.part = f
+	}
+	return f, err
+}
+
+func openFile(path string, create bool, mode os.FileMode) (*os.File, error) {
+	flag := os.O_RDWR
+	if create {
+		if err := os.MkdirAll(filepath.Dir(path), dirPerm); err != nil {
+			return nil, err
+		}
+		flag |= os.O_CREATE
+	}
+	f, err := os.OpenFile(path, flag, mode)
+	if os.IsNotExist(err) && !create {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// route returns where the data of the file with the given index goes, and the offset of its data there.
+// Files that are not wanted use the partfile, unless they exist on disk already.
+// Returns nil if create is not set and there is nothing to read yet.
+func (fs *File) route(s span, torrentOffset int, create bool) (*os.File, int, error) {
+	fs.mu.Lock()
+	wanted := fs.wanted[s.file]
+	fs.mu.Unlock()
+
+	if wanted {
+		f, err := fs.open(s.file, create)
+		return f, s.offset, err
+	}
+	f, err := fs.open(s.file, false)
+	if f != nil || err != nil {
+		return f, s.offset, err
+	}
+	f, err = fs.openPart(create)
+	return f, torrentOffset + s.buf, err
+}
+
+// skip reports whether the file holds no data on disk.
+func skip(lf io.LayoutFile) bool {
+	return lf.IsPadding() || lf.Symlink != ""
+}
+
+func (fs *File) ReadAt(p []byte, index, off int) (int, error) {
+	begin, err := fs.locate(index, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	fs.routing.RLock()
+	defer fs.routing.RUnlock()
+
+	for _, s := range spans(fs.layout.Files, begin, len(p)) {
+		buf := p[s.buf : s.buf+s.length]
+		if skip(fs.layout.Files[s.file]) {
+			// padding is zeros
+			zero(buf)
+			continue
+		}
+		f, at, err := fs.route(s, begin, false)
+		if err != nil {
+			return s.buf, err
+		}
+		if f == nil {
+			// not written yet
+			zero(buf)
+			continue
+		}
+		n, err := f.ReadAt(buf, int64(at))
+		if errors.Is(err, stdio.EOF) {
+			zero(buf[n:])
+		} else if err != nil {
+			return s.buf + n, err
+		}
+	}
+	return len(p), nil
+}
+
+func (fs *File) WriteAt(p []byte, index, off int) (int, error) {
+	begin, err := fs.locate(index, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	fs.routing.RLock()
+	defer fs.routing.RUnlock()
+
+	for _, s := range spans(fs.layout.Files, begin, len(p)) {
+		if skip(fs.layout.Files[s.file]) {
+			continue
+		}
+		f, at, err := fs.route(s, begin, true)
+		if err != nil {
+			return s.buf, err
+		}
+		if n, err := f.WriteAt(p[s.buf:s.buf+s.length], int64(at)); err != nil {
+			return s.buf + n, err
+		}
+	}
+	return len(p), nil
+}
+
+// SetWanted sets whether the file is created on disk. When a file becomes wanted,
+// the data of it that is in the partfile is moved to the file.
+func (fs *File) SetWanted(file int, wanted bool) error {
+	if file < 0 || file >= len(fs.wanted) {
+		return fmt.Errorf("file %d does not exist", file)
+	}
+	fs.routing.Lock()
+	defer fs.routing.Unlock()
+
+	fs.mu.Lock()
+	was := fs.wanted[file]
+	fs.wanted[file] = wanted
+	fs.mu.Unlock()
+
+	lf := fs.layout.Files[file]
+	if was || !wanted || skip(lf) {
+		return nil
+	}
+	if f, err := fs.open(file, false); f != nil || err != nil {
+		// the file was on disk all along
+		return err
+	}
+	part, err := fs.openPart(false)
+	if part == nil || err != nil {
+		return err
+	}
+
+	// only the first and the last piece of the file can be in the partfile,
+	// the others are downloaded once the file is wanted
+	f, err := fs.open(file, true)
+	if err != nil {
+		return err
+	}
+	for _, p := range fs.boundaryPieces(lf) {
+		ss := spans(fs.layout.Files[file:file+1], p.offset, p.length)
+		if len(ss) == 0 {
+			continue
+		}
+		buf := make([]byte, ss[0].length)
+		offset := p.offset + ss[0].buf
+		n, err := part.ReadAt(buf, int64(offset))
+		if err != nil && !errors.Is(err, stdio.EOF) {
+			return err
+		}
+		if _, err := f.WriteAt(buf[:n], int64(ss[0].offset)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// boundaryPieces returns the first and the last piece of the file.
+func (fs *File) boundaryPieces(lf io.LayoutFile) []piece {
+	var ps []piece
+	for _, p := range fs.pieces {
+		if p.offset+p.length <= lf.Offset || p.offset >= lf.Offset+lf.Length {
+			continue
+		}
+		if p.offset <= lf.Offset || p.offset+p.length >= lf.Offset+lf.Length {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+// Close closes the open files. Empty files that are wanted and were never written are created first.
+// The partfile is removed once every file is wanted.
+func (fs *File) Close() error {
+	var firstErr error
+	for i, lf := range fs.layout.Files {
+		fs.mu.Lock()
+		wanted := fs.wanted[i]
+		fs.mu.Unlock()
+		if lf.Length == 0 && wanted && !skip(lf) {
+			if _, err := fs.open(i, true); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for i, f := range fs.files {
+		if f == nil {
+			continue
+		}
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		fs.files[i] = nil
+	}
+
+	removePart := true
+	for _, wanted := range fs.wanted {
+		removePart = removePart && wanted
+	}
+	if fs.part != nil {
+		if err := fs.part.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		fs.part = nil
+	}
+	if removePart {
+		if err := os.Remove(fs.partPath); err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func zero(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+}
@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"github.com/VIVelev/bittorrent/io"
+)
+
+// Memory keeps the contents of a torrent in memory.
+type Memory struct {
+	pieceMap
+	data []byte
+}
+
+// NewMemory returns an empty in-memory storage for tf.
+func NewMemory(tf *io.TorrentFile) *Memory {
+	return &Memory{pieceMap: newPieceMap(tf), data: make([]byte, tf.Length)}
+}
+
+func (m *Memory) ReadAt(p []byte, index, off int) (int, error) {
+	begin, err := m.locate(index, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	return copy(p, m.data[begin:]), nil
+}
+
+func (m *Memory) WriteAt(p []byte, index, off int) (int, error) {
+	begin, err := m.locate(index, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	return copy(m.data[begin:], p), nil
+}
+
+// Bytes returns the contents of the torrent. It must not be used while pieces are written.
+func (m *Memory) Bytes() []byte {
+	return m.data
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/VIVelev/bittorrent/metrics"
+)
+
+// diskBuckets are the upper bounds of the histograms of disk latencies in seconds.
+var diskBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+// WithMetrics returns s with the latency and the errors of its reads and writes recorded in r,
+// s itself when r is nil. The result is a Selector, which forwards to s if it is one too.
+func WithMetrics(s Storage, r *metrics.Registry) Storage {
+	if r == nil {
+		return s
+	}
+	latency := r.Histogram("bittorrent_storage_duration_seconds", "Latency of the reads and writes of blocks on disk.",
+		diskBuckets, "op")
+	errs := r.Counter("bittorrent_storage_errors_total", "Reads, writes and completions that failed.", "op")
+	return &metered{
+		Storage: s,
+		reads:   latency.With("read"),
+		writes:  latency.With("write"),
+		errs:    errs,
+	}
+}
+
+// metered is a storage that records the latency of its operations.
+type metered struct {
+	Storage
+	reads  *metrics.Histogram
+	writes *metrics.Histogram
+	errs   *metrics.CounterVec
+}
+
+func (ms *metered) ReadAt(p []byte, index, off int) (int, error) {
+	start := time.Now()
+	n, err := ms.Storage.ReadAt(p, index, off)
+	ms.reads.ObserveDuration(time.Since(start))
+	if err != nil {
+		ms.errs.With("read").Inc()
+	}
+	return n, err
+}
+
+func (ms *metered) WriteAt(p []byte, index, off int) (int, error) {
+	start := time.Now()
+	n, err := ms.Storage.WriteAt(p, index, off)
+	ms.writes.ObserveDuration(time.Since(start))
+	if err != nil {
+		ms.errs.With("write").Inc()
+	}
+	return n, err
+}
+
+func (ms *metered) MarkComplete(index int) error {
+	err := ms.Storage.MarkComplete(index)
+	if err != nil {
+		ms.errs.With("mark_complete").Inc()
+	}
+	return err
+}
+
+// SetWanted forwards to the wrapped storage. Storages that are not selectors keep every file.
+func (ms *metered) SetWanted(file int, wanted bool) error {
+	if sel, ok := ms.Storage.(Selector); ok {
+		return sel.SetWanted(file, wanted)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/VIVelev/bittorrent/io"
+)
+
+var errClosed = errors.New("storage is closed")
+
+// Mmap keeps the contents of a torrent in its files on disk, mapped into memory.
+type Mmap struct {
+	pieceMap
+	layout *io.Layout
+
+	// mu holds Close off while the mappings are copied from or to
+	mu     sync.RWMutex
+	data   [][]byte // of the files, nil for the ones without data on disk
+	closed bool
+}
+
+// NewMmap returns a storage for tf that maps its files under root, see io.Layout.
+// Every file is created with its full length right away, whether it is wanted or not:
+// unlike File, Mmap is not a Selector.
+func NewMmap(tf *io.TorrentFile, root string) (*Mmap, error) {
+	l, err := tf.Layout(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := createSymlinks(l); err != nil {
+		return nil, err
+	}
+
+	m := &Mmap{pieceMap: newPieceMap(tf), layout: l, data: make([][]byte, len(l.Files))}
+	for i, lf := range l.Files {
+		if skip(lf) {
+			continue
+		}
+		if m.data[i], err = mmapFile(lf); err != nil {
+			m.Close()
+			return nil, fmt.Errorf("mmap %s: %s", lf.Path, err)
+		}
+	}
+	return m, nil
+}
+
+// mmapFile creates the file if needed, grows it to its length and maps it.
+func mmapFile(lf io.LayoutFile) ([]byte, error) {
+	if err := os.MkdirAll(filepath.Dir(lf.Path), dirPerm); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(lf.Path, os.O_RDWR|os.O_CREATE, lf.Mode())
+	if err != nil {
+		return nil, err
+	}
+	// the mapping outlives the descriptor
+	defer f.Close()
+
+	if lf.Length == 0 {
+		return nil, nil
+	}
+	if err := f.Truncate(int64(lf.Length)); err != nil {
+		return nil, err
+	}
+	return syscall.Mmap(int(f.Fd()), 0, lf.Length, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+func (m *Mmap) ReadAt(p []byte, index, off int) (int, error) {
+	begin, err := m.locate(index, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return 0, errClosed
+	}
+
+	for _, s := range spans(m.layout.Files, begin, len(p)) {
+		buf := p[s.buf : s.buf+s.length]
+		if skip(m.layout.Files[s.file]) {
+			// padding is zeros
+			zero(buf)
+			continue
+		}
+		copy(buf, m.data[s.file][s.offset:])
+	}
+	return len(p), nil
+}
+
+func (m *Mmap) WriteAt(p []byte, index, off int) (int, error) {
+	begin, err := m.locate(index, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return 0, errClosed
+	}
+
+	for _, s := range spans(m.layout.Files, begin, len(p)) {
+		if !skip(m.layout.Files[s.file]) {
+			copy(m.data[s.file][s.offset:], p[s.buf:s.buf+s.length])
+		}
+	}
+	return len(p), nil
+}
+
+// Close unmaps the files, which flushes them to disk eventually. The reads and writes
+// that follow fail.
+func (m *Mmap) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	var firstErr error
+	for i, data := range m.data {
+		if data == nil {
+			continue
+		}
+		if err := syscall.Munmap(data); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		m.data[i] = nil
+	}
+	return firstErr
+}
@@ -0,0 +1,20 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package storage
+
+import (
+	"errors"
+
+	"github.com/VIVelev/bittorrent/io"
+)
+
+// Mmap is not supported on this platform.
+type Mmap struct {
+	File
+}
+
+// NewMmap fails on this platform, use NewFile instead.
+func NewMmap(tf *io.TorrentFile, root string) (*Mmap, error) {
+	return nil, errors.New("mmap storage is not supported on this platform")
+}
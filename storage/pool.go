@@ -0,0 +1,50 @@
+package storage
+
+// Pool bounds the reads and writes in flight across the storages it wraps,
+// so that the torrents of a session share the disk instead of contending for it.
+type Pool struct {
+	slots chan struct{}
+}
+
+// NewPool returns a pool that lets n operations run at once.
+func NewPool(n int) *Pool {
+	if n < 1 {
+		n = 1
+	}
+	return &Pool{slots: make(chan struct{}, n)}
+}
+
+// Wrap returns s with its reads and writes going through the pool.
+// The result is a Selector, which forwards to s if it is one too.
+func (p *Pool) Wrap(s Storage) Storage {
+	return &pooled{Storage: s, pool: p}
+}
+
+func (p *Pool) acquire() { p.slots <- struct{}{} }
+func (p *Pool) release() { <-p.slots }
+
+// pooled is a storage whose operations take a slot of a pool.
+type pooled struct {
+	Storage
+	pool *Pool
+}
+
+func (ps *pooled) ReadAt(p []byte, index, off int) (int, error) {
+	ps.pool.acquire()
+	defer ps.pool.release()
+	return ps.Storage.ReadAt(p, index, off)
+}
+
+func (ps *pooled) WriteAt(p []byte, index, off int) (int, error) {
+	ps.pool.acquire()
+	defer ps.pool.release()
+	return ps.Storage.WriteAt(p, index, off)
+}
+
+// SetWanted forwards to the wrapped storage. Storages that are not selectors keep every file.
+func (ps *pooled) SetWanted(file int, wanted bool) error {
+	if sel, ok := ps.Storage.(Selector); ok {
+		return sel.SetWanted(file, wanted)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// Package storage keeps the pieces of a torrent while it is downloaded and seeded.
+package storage
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/VIVelev/bittorrent/bitfield"
+	"github.com/VIVelev/bittorrent/io"
+)
+
+// Storage holds the pieces of a torrent. Implementations must be safe for concurrent use.
+type Storage interface {
+	// ReadAt reads len(p) bytes of the piece with the given index starting at off.
+	ReadAt(p []byte, index, off int) (int, error)
+	// WriteAt writes p to the piece with the given index starting at off.
+	WriteAt(p []byte, index, off int) (int, error)
+	// MarkComplete records that the piece was written and verified.
+	MarkComplete(index int) error
+	// Completed returns a copy of the bitfield of the complete pieces.
+	Completed() bitfield.Bitfield
+	Close() error
+}
+
+// Selector is implemented by the storages that only create the files that are wanted.
+type Selector interface {
+	// SetWanted sets whether the file with the given index is wanted, padding files included.
+	// Every file is wanted at first.
+	SetWanted(file int, wanted bool) error
+}
+
+// piece locates a piece within the contents of the torrent.
+type piece struct {
+	offset int
+	length int
+}
+
+// pieces lays out the pieces of tf. Without v1 metadata every file starts with a new piece.
+func pieces(tf *io.TorrentFile) []piece {
+	var ps []piece
+	if tf.IsV1() {
+		for i := range tf.PieceHashes {
+			length := tf.PieceLength
+			if i == len(tf.PieceHashes)-1 {
+				length = tf.Length - tf.PieceLength*i
+			}
+			ps = append(ps, piece{offset: i * tf.PieceLength, length: length})
+		}
+		return ps
+	}
+
+	offset := 0
+	for file, f := range tf.FileTree {
+		for p := 0; p < tf.NumPiecesV2(file); p++ {
+			length := f.Length - p*tf.PieceLength
+			if length > tf.PieceLength {
+				length = tf.PieceLength
+			}
+			ps = append(ps, piece{offset: offset + p*tf.PieceLength, length: length})
+		}
+		offset += f.Length
+	}
+	return ps
+}
+
+// pieceMap implements the bookkeeping shared by the storages:
+// locating pieces and tracking their completion.
+type pieceMap struct {
+	pieces []piece
+
+	mu        sync.Mutex
+	completed bitfield.Bitfield
+}
+
+func newPieceMap(tf *io.TorrentFile) pieceMap {
+	ps := pieces(tf)
+	return pieceMap{pieces: ps, completed: bitfield.New(len(ps))}
+}
+
+// locate returns the offset within the torrent of n bytes at off of the piece with the given index.
+func (pm *pieceMap) locate(index, off, n int) (int, error) {
+	if index < 0 || index >= len(pm.pieces) {
+		return 0, fmt.Errorf("piece %d does not exist", index)
+	}
+	p := pm.pieces[index]
+	if off < 0 || off+n > p.length {
+		return 0, fmt.Errorf("range of %d bytes at %d is out of piece %d", n, off, index)
+	}
+	return p.offset + off, nil
+}
+
+func (pm *pieceMap) MarkComplete(index int) error {
+	if index < 0 || index >= len(pm.pieces) {
+		return fmt.Errorf("piece %d does not exist", index)
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.completed.SetPiece(index)
+	return nil
+}
+
+func (pm *pieceMap) Completed() bitfield.Bitfield {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return append(bitfield.Bitfield(nil), pm.completed...)
+}
+
+// span is the part of a file that a range of the torrent covers.
+type span struct {
+	file   int
+	offset int // within the file
+	buf    int // offset within the range
+	length int
+}
+
+// spans splits the range of length bytes at offset of the torrent by the files of the layout.
+func spans(files []io.LayoutFile, offset, length int) []span {
+	var ss []span
+	for i, f := range files {
+		begin, end := offset, offset+length
+		if begin < f.Offset {
+			begin = f.Offset
+		}
+		if end > f.Offset+f.Length {
+			end = f.Offset + f.Length
+		}
+		if begin >= end {
+			continue
+		}
+		ss = append(ss, span{file: i, offset: begin - f.Offset, buf: begin - offset, length: end - begin})
+	}
+	return ss
+}
@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VIVelev/bittorrent/internal/testtorrent"
+	"github.com/VIVelev/bittorrent/io"
+	"github.com/VIVelev/bittorrent/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const pieceLength int = 4
+
+// newTestTorrent builds a multi-file torrent of 14 bytes in 4 pieces:
+// a (5 bytes), a padding file (3 bytes), an empty file, a symlink to a and b/c (6 bytes).
+func newTestTorrent(t *testing.T, data []byte) *io.TorrentFile {
+	return testtorrent.Torrent{Name: "dir", PieceLength: pieceLength, Files: []testtorrent.File{
+		{Length: 5, Path: []string{"a"}},
+		{Length: 3, Path: []string{".pad", "3"}, Attr: "p"},
+		{Length: 0, Path: []string{"empty"}},
+		{Length: 0, Path: []string{"link"}, Attr: "l", SymlinkPath: []string{"a"}},
+		{Length: 6, Path: []string{"b", "c"}, Attr: "x"},
+	}}.Parse(t, data)
+}
+
+func testData() []byte {
+	data := make([]byte, 14)
+	rand.Read(data)
+	for i := 5; i < 8; i++ {
+		data[i] = 0
+	}
+	return data
+}
+
+func TestStorage(t *testing.T) {
+	data := testData()
+	tf := newTestTorrent(t, data)
+
+	tests := map[string]func(root string) (Storage, error){
+		"memory": func(string) (Storage, error) { return NewMemory(tf), nil },
+		"file":   func(root string) (Storage, error) { return NewFile(tf, root) },
+		"mmap":   func(root string) (Storage, error) { return NewMmap(tf, root) },
+		"pooled": func(root string) (Storage, error) {
+			s, err := NewFile(tf, root)
+			if err != nil {
+				return nil, err
+			}
+			return NewPool(1).Wrap(s), nil
+		},
+		"metered": func(root string) (Storage, error) {
+			s, err := NewFile(tf, root)
+			if err != nil {
+				return nil, err
+			}
+			return WithMetrics(s, metrics.NewRegistry()), nil
+		},
+	}
+
+	for name, open := range tests {
+		root := t.TempDir()
+		s, err := open(root)
+		require.Nil(t, err, name)
+
+		// the pieces are written in blocks, in any order
+		for _, index := range []int{3, 1, 0, 2} {
+			length := pieceLength
+			if index == 3 {
+				length = 2
+			}
+			for off := 0; off < length; off += 2 {
+				n, err := s.WriteAt(data[index*pieceLength+off:][:2], index, off)
+				require.Nil(t, err, name)
+				assert.Equal(t, 2, n, name)
+			}
+			require.Nil(t, s.MarkComplete(index), name)
+			assert.True(t, s.Completed().HasPiece(index), name)
+		}
+		assert.NotNil(t, s.MarkComplete(4), name)
+
+		// reads may cross files
+		buf := make([]byte, 3)
+		_, err = s.ReadAt(buf, 1, 1)
+		require.Nil(t, err, name)
+		assert.Equal(t, data[5:8], buf, name)
+		for index := 0; index < 4; index++ {
+			buf := make([]byte, pieceLength)
+			if index == 3 {
+				buf = buf[:2]
+			}
+			_, err := s.ReadAt(buf, index, 0)
+			require.Nil(t, err, name)
+			assert.Equal(t, data[index*pieceLength:][:len(buf)], buf, name)
+		}
+
+		_, err = s.ReadAt(make([]byte, 3), 3, 0)
+		assert.NotNil(t, err, name, "out of the piece")
+		_, err = s.WriteAt(make([]byte, 1), 4, 0)
+		assert.NotNil(t, err, name, "no such piece")
+
+		require.Nil(t, s.Close(), name)
+		if mem, ok := s.(*Memory); ok {
+			assert.Equal(t, data, mem.Bytes(), name)
+			continue
+		}
+
+		dir := filepath.Join(root, "dir")
+		content, err := ioutil.ReadFile(filepath.Join(dir, "a"))
+		require.Nil(t, err, name)
+		assert.Equal(t, data[:5], content, name)
+		content, err = ioutil.ReadFile(filepath.Join(dir, "b", "c"))
+		require.Nil(t, err, name)
+		assert.Equal(t, data[8:], content, name)
+		info, err := os.Stat(filepath.Join(dir, "b", "c"))
+		require.Nil(t, err, name)
+		assert.NotZero(t, info.Mode()&0100, name)
+		content, err = ioutil.ReadFile(filepath.Join(dir, "empty"))
+		require.Nil(t, err, name)
+		assert.Empty(t, content, name)
+		content, err = ioutil.ReadFile(filepath.Join(dir, "link"))
+		require.Nil(t, err, name)
+		assert.Equal(t, data[:5], content, name)
+		_, err = os.Stat(filepath.Join(dir, ".pad"))
+		assert.True(t, os.IsNotExist(err), name)
+	}
+}
+
+func TestMmapClose(t *testing.T) {
+	data := testData()
+	tf := newTestTorrent(t, data)
+	m, err := NewMmap(tf, t.TempDir())
+	require.Nil(t, err)
+	_, err = m.WriteAt(data[:pieceLength], 0, 0)
+	require.Nil(t, err)
+	require.Nil(t, m.Close())
+
+	// a late write is not dropped silently, nor does a late read return zeros
+	_, err = m.WriteAt(data[:pieceLength], 0, 0)
+	assert.NotNil(t, err)
+	_, err = m.ReadAt(make([]byte, pieceLength), 1, 0)
+	assert.NotNil(t, err, "padding included")
+	require.Nil(t, m.Close(), "twice is fine")
+}
+
+func TestFileReadMissing(t *testing.T) {
+	data := testData()
+	tf := newTestTorrent(t, data)
+	s, err := NewFile(tf, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close()
+
+	// nothing was written yet, then only the start of a
+	buf := []byte{1, 1, 1, 1}
+	_, err = s.ReadAt(buf, 0, 0)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 0}, buf)
+
+	_, err = s.WriteAt(data[:2], 0, 0)
+	require.Nil(t, err)
+	_, err = s.ReadAt(buf, 0, 0)
+	require.Nil(t, err)
+	assert.Equal(t, append(data[:2:2], 0, 0), buf)
+}
+
+func TestRemoveFiles(t *testing.T) {
+	data := testData()
+	tf := newTestTorrent(t, data)
+	root := t.TempDir()
+	s, err := NewFile(tf, root)
+	require.Nil(t, err)
+	require.Nil(t, s.SetWanted(0, false))
+	_, err = s.WriteAt(data[:pieceLength], 0, 0)
+	require.Nil(t, err)
+	require.Nil(t, s.Close())
+	_, err = os.Stat(filepath.Join(root, ".dir.parts"))
+	require.Nil(t, err)
+
+	require.Nil(t, RemoveFiles(tf, root))
+	entries, err := ioutil.ReadDir(root)
+	require.Nil(t, err)
+	assert.Empty(t, entries)
+	assert.Nil(t, RemoveFiles(tf, root), "nothing to remove")
+}
+
+// slowStorage tracks how many reads are in flight at once across the storages sharing its counter.
+type slowStorage struct {
+	*Memory
+	counter *inFlight
+}
+
+type inFlight struct {
+	mu  sync.Mutex
+	n   int
+	max int
+}
+
+func (s *slowStorage) ReadAt(p []byte, index, off int) (int, error) {
+	c := s.counter
+	c.mu.Lock()
+	c.n++
+	if c.n > c.max {
+		c.max = c.n
+	}
+	c.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	c.mu.Lock()
+	c.n--
+	c.mu.Unlock()
+	return s.Memory.ReadAt(p, index, off)
+}
+
+func TestPool(t *testing.T) {
+	tf := newTestTorrent(t, testData())
+	pool := NewPool(2)
+	counter := new(inFlight)
+
+	// two torrents share the pool
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		s := pool.Wrap(&slowStorage{Memory: NewMemory(tf), counter: counter})
+		for index := 0; index < 4; index++ {
+			wg.Add(1)
+			go func(index int) {
+				defer wg.Done()
+				_, err := s.ReadAt(make([]byte, 1), index, 0)
+				assert.Nil(t, err)
+			}(index)
+		}
+	}
+	wg.Wait()
+	assert.Equal(t, 2, counter.max)
+
+	// memory storages keep every file
+	sel, ok := pool.Wrap(NewMemory(tf)).(Selector)
+	require.True(t, ok)
+	assert.Nil(t, sel.SetWanted(0, false))
+}
+
+func TestWithMetrics(t *testing.T) {
+	data := testData()
+	tf := newTestTorrent(t, data)
+	mem := NewMemory(tf)
+	assert.Equal(t, mem, WithMetrics(mem, nil), "unchanged without a registry")
+
+	reg := metrics.NewRegistry()
+	s := WithMetrics(mem, reg)
+	_, err := s.WriteAt(data[:pieceLength], 0, 0)
+	require.Nil(t, err)
+	_, err = s.WriteAt(data[:1], 4, 0)
+	assert.NotNil(t, err)
+	_, err = s.ReadAt(make([]byte, pieceLength), 0, 0)
+	require.Nil(t, err)
+	assert.NotNil(t, s.MarkComplete(4))
+
+	latency := reg.Histogram("bittorrent_storage_duration_seconds", "", nil, "op")
+	errs := reg.Counter("bittorrent_storage_errors_total", "", "op")
+	assert.Equal(t, uint64(2), latency.With("write").Count())
+	assert.Equal(t, uint64(1), latency.With("read").Count())
+	assert.Equal(t, 1.0, errs.With("write").Value())
+	assert.Equal(t, 0.0, errs.With("read").Value())
+	assert.Equal(t, 1.0, errs.With("mark_complete").Value())
+	_, ok := s.(Selector)
+	assert.True(t, ok)
+}
@@ -0,0 +1,109 @@
+// Package stream serves the files of a torrent over HTTP while it is being downloaded.
+package stream
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/VIVelev/bittorrent/logging"
+	"github.com/VIVelev/bittorrent/p2p"
+)
+
+// Handler serves every file of a torrent at a stable URL: /<name> for single-file torrents
+// and /<name>/<path> for multi-file ones. GET and HEAD requests are supported, with ranges.
+// Reads wait for the pieces they need and have them downloaded first, so the download must
+// be running. / lists the URLs of the files, one per line.
+type Handler struct {
+	// Logger receives the requests that are served, none when nil.
+	Logger *logging.Logger
+
+	t     *p2p.Torrent
+	paths []string       // of the files, unescaped, empty for the ones that are not served
+	files map[string]int // by path
+}
+
+// NewHandler returns a handler serving the files of t.
+func NewHandler(t *p2p.Torrent) *Handler {
+	tf := t.TorrentFile()
+	h := &Handler{t: t, paths: make([]string, tf.NumFiles()), files: make(map[string]int)}
+	if !tf.IsMultiFile {
+		h.add(0, "/"+tf.Name)
+		return h
+	}
+	for i, f := range tf.Files {
+		if f.IsPadding() {
+			continue
+		}
+		h.add(i, "/"+tf.Name+"/"+strings.Join(f.Path, "/"))
+	}
+	return h
+}
+
+func (h *Handler) add(file int, p string) {
+	if _, ok := h.files[p]; ok {
+		// ambiguous, the first file keeps the path
+		return
+	}
+	h.paths[file] = p
+	h.files[p] = file
+}
+
+// Path returns the escaped URL path of the file with the given index, or "" if it is not served.
+func (h *Handler) Path(file int) string {
+	if file < 0 || file >= len(h.paths) || h.paths[file] == "" {
+		return ""
+	}
+	return (&url.URL{Path: h.paths[file]}).EscapedPath()
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.URL.Path == "/" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for i := range h.paths {
+			if p := h.Path(i); p != "" {
+				fmt.Fprintln(w, p)
+			}
+		}
+		return
+	}
+
+	file, ok := h.files[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	reader, err := h.t.NewReader(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// unblocks the reads once the client goes away
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+		reader.Close()
+	}()
+
+	// detected from the extension, otherwise ServeContent sniffs the first bytes
+	if ctype := mime.TypeByExtension(path.Ext(r.URL.Path)); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	h.Logger.Info("streaming", logging.String("path", r.URL.Path), logging.String("method", r.Method),
+		logging.String("range", r.Header.Get("Range")))
+	http.ServeContent(w, r, path.Base(r.URL.Path), time.Time{}, reader)
+}
@@ -0,0 +1,217 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VIVelev/bittorrent/client"
+	"github.com/VIVelev/bittorrent/handshake"
+	"github.com/VIVelev/bittorrent/internal/testtorrent"
+	"github.com/VIVelev/bittorrent/io"
+	"github.com/VIVelev/bittorrent/message"
+	"github.com/VIVelev/bittorrent/mse"
+	"github.com/VIVelev/bittorrent/p2p"
+	"github.com/VIVelev/bittorrent/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const pieceLength int = 16384
+
+func newTestTorrent(t *testing.T, files []testtorrent.File, data []byte) *io.TorrentFile {
+	return testtorrent.Torrent{Name: "media", PieceLength: pieceLength, Files: files}.Parse(t, data)
+}
+
+// seeder serves every piece of a v1 torrent, one block every delay, and records the pieces requested.
+type seeder struct {
+	tf    *io.TorrentFile
+	data  []byte
+	delay time.Duration
+
+	mu        sync.Mutex
+	requested []int // first request of every piece, in order
+}
+
+func (s *seeder) serve(t *testing.T, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(t, conn)
+	}
+}
+
+func (s *seeder) serveConn(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	if _, err := handshake.Unmarshal(conn); err != nil {
+		return
+	}
+	hs := &handshake.Handshake{InfoHash: s.tf.InfoHash, PeerID: [20]byte{9}}
+	hs.Enable(handshake.ExtFast)
+	res := handshake.Marshal(hs)
+	conn.Write(res[:])
+	conn.Write(message.Marshal(message.HaveAll()))
+	conn.Write(message.Marshal(&message.Message{ID: message.MsgUnchoke}))
+
+	for {
+		msg, err := message.Unmarshal(conn)
+		if err != nil {
+			return
+		}
+		if msg == nil || msg.ID != message.MsgRequest {
+			continue
+		}
+		index, begin, length, err := message.ParseRequest(msg)
+		require.Nil(t, err)
+		s.mu.Lock()
+		if begin == 0 {
+			s.requested = append(s.requested, index)
+		}
+		s.mu.Unlock()
+		time.Sleep(s.delay)
+		conn.Write(message.Marshal(message.Piece(index, begin, s.data[index*pieceLength+begin:][:length])))
+	}
+}
+
+func TestHandler(t *testing.T) {
+	data := make([]byte, 40*pieceLength+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	tf := newTestTorrent(t, []testtorrent.File{
+		{Length: 100, Path: []string{"notes.txt"}},
+		{Length: len(data) - 100, Path: []string{"video", "clip one.bin"}},
+	}, data)
+
+	s := &seeder{tf: tf, data: data, delay: time.Millisecond}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	go s.serve(t, ln)
+
+	tr := p2p.NewTorrent(tf, [20]byte{1})
+	tr.Dialer = &client.Dialer{Encryption: mse.PolicyDisable, Timeout: time.Second, DisableUTP: true}
+	tr.SetSequential(true)
+	addr := ln.Addr().(*net.TCPAddr)
+	tr.AddPeers([]peer.Peer{{IP: addr.IP, Port: uint16(addr.Port)}}, p2p.SourceTracker)
+	h := NewHandler(tr)
+	server := httptest.NewServer(h)
+	defer server.Close()
+	done := make(chan []byte)
+	go func() { done <- tr.Run() }()
+
+	video := server.URL + "/media/video/clip%20one.bin"
+	assert.Equal(t, "/media/video/clip%20one.bin", h.Path(1))
+
+	// the end of the video first
+	req, err := http.NewRequest(http.MethodGet, video, nil)
+	require.Nil(t, err)
+	req.Header.Set("Range", "bytes=-1000")
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, fmt.Sprintf("bytes %d-%d/%d", len(data)-1100, len(data)-101, len(data)-100), resp.Header.Get("Content-Range"))
+	assert.True(t, bytes.Equal(data[len(data)-1000:], body))
+	s.mu.Lock()
+	last := len(data) / pieceLength
+	requested := s.requested
+	if len(requested) > 5 {
+		requested = requested[:5]
+	}
+	assert.Contains(t, requested, last, "the last piece jumps the queue")
+	s.mu.Unlock()
+
+	tests := map[string]struct {
+		method   string
+		url      string
+		rng      string
+		status   int
+		ctype    string
+		expected []byte
+	}{
+		"text": {
+			method:   http.MethodGet,
+			url:      server.URL + "/media/notes.txt",
+			status:   http.StatusOK,
+			ctype:    "text/plain; charset=utf-8",
+			expected: data[:100],
+		},
+		"range": {
+			method:   http.MethodGet,
+			url:      video,
+			rng:      "bytes=20000-40000",
+			status:   http.StatusPartialContent,
+			expected: data[20100:40101],
+		},
+		"head": {
+			method:   http.MethodHead,
+			url:      video,
+			status:   http.StatusOK,
+			ctype:    "application/octet-stream",
+			expected: []byte{},
+		},
+		"whole file": {
+			method:   http.MethodGet,
+			url:      video,
+			status:   http.StatusOK,
+			expected: data[100:],
+		},
+		"listing": {
+			method:   http.MethodGet,
+			url:      server.URL + "/",
+			status:   http.StatusOK,
+			expected: []byte("/media/notes.txt\n/media/video/clip%20one.bin\n"),
+		},
+		"not found": {
+			method: http.MethodGet,
+			url:    server.URL + "/media/video",
+			status: http.StatusNotFound,
+		},
+		"post": {
+			method: http.MethodPost,
+			url:    video,
+			status: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for name, test := range tests {
+		req, err := http.NewRequest(test.method, test.url, nil)
+		require.Nil(t, err, name)
+		if test.rng != "" {
+			req.Header.Set("Range", test.rng)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err, name)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Nil(t, err, name)
+		assert.Equal(t, test.status, resp.StatusCode, name)
+		if test.ctype != "" {
+			assert.Equal(t, test.ctype, resp.Header.Get("Content-Type"), name)
+		}
+		if test.method == http.MethodHead {
+			assert.Equal(t, fmt.Sprint(len(data)-100), resp.Header.Get("Content-Length"), name)
+			assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"), name)
+		}
+		if test.expected != nil {
+			assert.True(t, bytes.Equal(test.expected, body), name)
+		}
+	}
+
+	select {
+	case got := <-done:
+		assert.True(t, bytes.Equal(data, got))
+	case <-time.After(10 * time.Second):
+		t.Fatal("download did not finish")
+	}
+}
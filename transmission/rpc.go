@@ -0,0 +1,266 @@
+// Package transmission serves a session over a subset of the Transmission RPC protocol, so that
+// the dashboards and apps that manage Transmission manage this client too.
+// reference: https://github.com/transmission/transmission/blob/main/docs/rpc-spec.md
+//
+// The methods served are session-get, session-set, torrent-get, torrent-add, torrent-start,
+// torrent-start-now, torrent-stop, torrent-remove and torrent-set. The arguments they do not
+// know are ignored, as Transmission does.
+package transmission
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/VIVelev/bittorrent/session"
+)
+
+const (
+	// Path is where Transmission clients send their requests.
+	Path = "/transmission/rpc"
+	// SessionIDHeader carries the token that every request must echo, against CSRF.
+	// A request without it is answered with 409 Conflict and the token.
+	SessionIDHeader = "X-Transmission-Session-Id"
+
+	// the protocol of Transmission 3.00
+	rpcVersion        = 17
+	rpcVersionMinimum = 1
+	version           = "3.00 (bittorrent)"
+
+	// maxBodySize bounds the requests, .torrent files included.
+	maxBodySize int64 = 16 << 20 // 16MiB
+)
+
+// Server answers the RPC requests for a session. It is an http.Handler.
+type Server struct {
+	// Username and Password protect the server with HTTP basic authentication when set.
+	// Without them, anyone who reaches the server can make it read local files and fetch URLs.
+	Username string
+	Password string
+
+	s         *session.Session
+	sessionID string
+
+	mu     sync.Mutex
+	ids    map[[20]byte]int // Transmission numbers torrents in the order they are seen
+	nextID int
+	limits limits
+	modes  map[[20]byte]seedModes
+}
+
+// New serves s.
+func New(s *session.Session) *Server {
+	var id [24]byte
+	rand.Read(id[:])
+	return &Server{
+		s:         s,
+		sessionID: hex.EncodeToString(id[:]),
+		ids:       make(map[[20]byte]int),
+		nextID:    1,
+		limits:    newLimits(s.Settings()),
+		modes:     make(map[[20]byte]seedModes),
+	}
+}
+
+type request struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments"`
+	Tag       json.RawMessage `json:"tag,omitempty"`
+}
+
+type response struct {
+	Result    string                 `json:"result"`
+	Arguments map[string]interface{} `json:"arguments"`
+	Tag       json.RawMessage        `json:"tag,omitempty"`
+}
+
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if srv.Username != "" || srv.Password != "" {
+		user, pass, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(srv.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(srv.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Transmission"`)
+			http.Error(w, "401: Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	if r.Header.Get(SessionIDHeader) != srv.sessionID {
+		w.Header().Set(SessionIDHeader, srv.sessionID)
+		http.Error(w, "409: Conflict, the request had an invalid "+SessionIDHeader+" header", http.StatusConflict)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "405: Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("400: Bad Request, %s", err), http.StatusBadRequest)
+		return
+	}
+	args, err := srv.call(req.Method, req.Arguments)
+	resp := response{Result: "success", Arguments: args, Tag: req.Tag}
+	if err != nil {
+		resp.Result = err.Error()
+	}
+	if resp.Arguments == nil {
+		resp.Arguments = map[string]interface{}{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// call runs a method with its JSON arguments.
+func (srv *Server) call(method string, raw json.RawMessage) (map[string]interface{}, error) {
+	switch method {
+	case "session-get":
+		var args struct {
+			Fields []string `json:"fields"`
+		}
+		if err := decode(raw, &args); err != nil {
+			return nil, err
+		}
+		return srv.sessionGet(args.Fields), nil
+	case "session-set":
+		var args sessionSetArgs
+		if err := decode(raw, &args); err != nil {
+			return nil, err
+		}
+		return nil, srv.sessionSet(args)
+	case "torrent-get":
+		var args struct {
+			IDs    json.RawMessage `json:"ids"`
+			Fields []string        `json:"fields"`
+		}
+		if err := decode(raw, &args); err != nil {
+			return nil, err
+		}
+		return srv.torrentGet(args.IDs, args.Fields)
+	case "torrent-add":
+		var args torrentAddArgs
+		if err := decode(raw, &args); err != nil {
+			return nil, err
+		}
+		return srv.torrentAdd(args)
+	case "torrent-start", "torrent-start-now", "torrent-stop", "torrent-remove":
+		var args struct {
+			IDs             json.RawMessage `json:"ids"`
+			DeleteLocalData bool            `json:"delete-local-data"`
+		}
+		if err := decode(raw, &args); err != nil {
+			return nil, err
+		}
+		torrents, err := srv.resolve(args.IDs)
+		if err != nil {
+			return nil, err
+		}
+		return nil, srv.torrentAction(method, torrents, args.DeleteLocalData)
+	case "torrent-set":
+		var args torrentSetArgs
+		if err := decode(raw, &args); err != nil {
+			return nil, err
+		}
+		torrents, err := srv.resolve(args.IDs)
+		if err != nil {
+			return nil, err
+		}
+		return nil, srv.torrentSet(torrents, args)
+	default:
+		return nil, errors.New("method name not recognized")
+	}
+}
+
+// decode unmarshals the arguments of a request, which may be left out.
+func decode(raw json.RawMessage, v interface{}) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("arguments: %s", err)
+	}
+	return nil
+}
+
+// id returns the number of a torrent, numbering it if it is new.
+func (srv *Server) id(t *session.Torrent) int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	ih := t.InfoHash()
+	id, ok := srv.ids[ih]
+	if !ok {
+		id = srv.nextID
+		srv.nextID++
+		srv.ids[ih] = id
+	}
+	return id
+}
+
+// forget drops the number and the seeding modes of a removed torrent.
+func (srv *Server) forget(t *session.Torrent) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	delete(srv.ids, t.InfoHash())
+	delete(srv.modes, t.InfoHash())
+}
+
+// resolve returns the torrents that ids refers to: every torrent when it is left out, null or
+// "recently-active", else a number, an info hash or a list of them. Unknown torrents are skipped.
+func (srv *Server) resolve(raw json.RawMessage) ([]*session.Torrent, error) {
+	torrents := srv.s.Torrents()
+	if len(raw) == 0 {
+		return torrents, nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, fmt.Errorf("ids: %s", err)
+	}
+	var list []interface{}
+	switch v := v.(type) {
+	case nil:
+		return torrents, nil
+	case float64:
+		list = []interface{}{v}
+	case string:
+		if v == "recently-active" {
+			return torrents, nil
+		}
+		list = []interface{}{v}
+	case []interface{}:
+		list = v
+	default:
+		return nil, fmt.Errorf("invalid ids %s", raw)
+	}
+
+	byID := make(map[int]*session.Torrent)
+	byHash := make(map[string]*session.Torrent)
+	for _, t := range torrents {
+		ih := t.InfoHash()
+		byID[srv.id(t)] = t
+		byHash[hex.EncodeToString(ih[:])] = t
+	}
+	var ret []*session.Torrent
+	for _, id := range list {
+		var t *session.Torrent
+		switch id := id.(type) {
+		case float64:
+			t = byID[int(id)]
+		case string:
+			t = byHash[id]
+		default:
+			return nil, fmt.Errorf("invalid id %v", id)
+		}
+		if t != nil {
+			ret = append(ret, t)
+		}
+	}
+	return ret, nil
+}
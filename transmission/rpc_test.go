@@ -0,0 +1,309 @@
+package transmission
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/VIVelev/bittorrent/internal/testswarm"
+	bio "github.com/VIVelev/bittorrent/io"
+	"github.com/VIVelev/bittorrent/session"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rpcClient calls a server the way Transmission clients do: it learns the session id from
+// the first response, and sends it from then on.
+type rpcClient struct {
+	t         *testing.T
+	url       string
+	sessionID string
+}
+
+func newTestServer(t *testing.T, dataDir string) (*rpcClient, *session.Session) {
+	s := testswarm.NewSession(t, dataDir)
+	ts := httptest.NewServer(New(s))
+	t.Cleanup(ts.Close)
+	return &rpcClient{t: t, url: ts.URL + Path}, s
+}
+
+// call runs method and decodes its arguments into v, returning the result.
+func (c *rpcClient) call(method string, args interface{}, v interface{}) string {
+	body, err := json.Marshal(map[string]interface{}{"method": method, "arguments": args, "tag": 7})
+	require.Nil(c.t, err)
+	for retry := 0; ; retry++ {
+		req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+		require.Nil(c.t, err)
+		req.Header.Set(SessionIDHeader, c.sessionID)
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(c.t, err)
+		if resp.StatusCode == http.StatusConflict && retry == 0 {
+			resp.Body.Close()
+			c.sessionID = resp.Header.Get(SessionIDHeader)
+			continue
+		}
+		defer resp.Body.Close()
+		require.Equal(c.t, http.StatusOK, resp.StatusCode)
+
+		var r struct {
+			Result    string          `json:"result"`
+			Arguments json.RawMessage `json:"arguments"`
+			Tag       int             `json:"tag"`
+		}
+		require.Nil(c.t, json.NewDecoder(resp.Body).Decode(&r))
+		assert.Equal(c.t, 7, r.Tag)
+		if v != nil {
+			require.Nil(c.t, json.Unmarshal(r.Arguments, v))
+		}
+		return r.Result
+	}
+}
+
+type torrent struct {
+	ID             int     `json:"id"`
+	HashString     string  `json:"hashString"`
+	Name           string  `json:"name"`
+	Status         int     `json:"status"`
+	TotalSize      int64   `json:"totalSize"`
+	LeftUntilDone  int64   `json:"leftUntilDone"`
+	PercentDone    float64 `json:"percentDone"`
+	DownloadedEver int64   `json:"downloadedEver"`
+	RateDownload   int64   `json:"rateDownload"`
+	ETA            int64   `json:"eta"`
+	Wanted         []int   `json:"wanted"`
+	Priorities     []int   `json:"priorities"`
+	SeedRatioMode  int     `json:"seedRatioMode"`
+	SeedRatioLimit float64 `json:"seedRatioLimit"`
+	MagnetLink     string  `json:"magnetLink"`
+	Trackers       []struct {
+		Announce string `json:"announce"`
+	} `json:"trackers"`
+}
+
+var fields = []string{"id", "hashString", "name", "status", "totalSize", "leftUntilDone", "percentDone",
+	"downloadedEver", "rateDownload", "eta", "wanted", "priorities", "seedRatioMode", "seedRatioLimit", "magnetLink", "trackers"}
+
+func (c *rpcClient) get(ids interface{}) []torrent {
+	var args struct {
+		Torrents []torrent `json:"torrents"`
+	}
+	require.Equal(c.t, "success", c.call("torrent-get", map[string]interface{}{"ids": ids, "fields": fields}, &args))
+	return args.Torrents
+}
+
+func (c *rpcClient) waitStatus(id, status int) torrent {
+	var tr torrent
+	require.Eventually(c.t, func() bool {
+		torrents := c.get(id)
+		if len(torrents) == 1 {
+			tr = torrents[0]
+		}
+		return tr.Status == status
+	}, 10*time.Second, 20*time.Millisecond, "waiting for status %d", status)
+	return tr
+}
+
+func TestHandshake(t *testing.T) {
+	s := testswarm.NewSession(t, t.TempDir())
+	srv := New(s)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	body := `{"method": "session-get"}`
+
+	tests := map[string]struct {
+		method    string
+		sessionID string
+		user      string
+		status    int
+	}{
+		"no session id":    {method: http.MethodPost, status: http.StatusConflict},
+		"wrong session id": {method: http.MethodPost, sessionID: "guess", status: http.StatusConflict},
+		"session id":       {method: http.MethodPost, sessionID: srv.sessionID, status: http.StatusOK},
+		"get":              {method: http.MethodGet, sessionID: srv.sessionID, status: http.StatusMethodNotAllowed},
+	}
+
+	for name, test := range tests {
+		req, err := http.NewRequest(test.method, ts.URL+Path, bytes.NewBufferString(body))
+		require.Nil(t, err, name)
+		if test.sessionID != "" {
+			req.Header.Set(SessionIDHeader, test.sessionID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err, name)
+		resp.Body.Close()
+		assert.Equal(t, test.status, resp.StatusCode, name)
+		if test.status == http.StatusConflict {
+			assert.Equal(t, srv.sessionID, resp.Header.Get(SessionIDHeader), name)
+		}
+	}
+
+	srv.Username, srv.Password = "user", "pass"
+	for name, test := range map[string]struct {
+		user, pass string
+		status     int
+	}{
+		"no credentials":    {status: http.StatusUnauthorized},
+		"wrong credentials": {user: "user", pass: "guess", status: http.StatusUnauthorized},
+		"credentials":       {user: "user", pass: "pass", status: http.StatusOK},
+	} {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+Path, bytes.NewBufferString(body))
+		require.Nil(t, err, name)
+		req.Header.Set(SessionIDHeader, srv.sessionID)
+		if test.user != "" {
+			req.SetBasicAuth(test.user, test.pass)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err, name)
+		resp.Body.Close()
+		assert.Equal(t, test.status, resp.StatusCode, name)
+		if test.status == http.StatusUnauthorized {
+			assert.Equal(t, `Basic realm="Transmission"`, resp.Header.Get("WWW-Authenticate"), name)
+		}
+	}
+}
+
+func TestRPC(t *testing.T) {
+	data := make([]byte, 3*testswarm.PieceLength+100)
+	rand.New(rand.NewSource(44)).Read(data)
+	tracker := testswarm.Start(t, data)
+	metainfo := testswarm.Torrent(t, data, tracker)
+	dataDir := t.TempDir()
+	c, s := newTestServer(t, dataDir)
+
+	// added paused, then added again
+	add := map[string]interface{}{"metainfo": base64.StdEncoding.EncodeToString(metainfo), "paused": true}
+	var added map[string]struct {
+		ID         int    `json:"id"`
+		Name       string `json:"name"`
+		HashString string `json:"hashString"`
+	}
+	require.Equal(t, "success", c.call("torrent-add", add, &added))
+	require.Contains(t, added, "torrent-added")
+	id, hash := added["torrent-added"].ID, added["torrent-added"].HashString
+	assert.Equal(t, 1, id)
+	assert.Equal(t, "file", added["torrent-added"].Name)
+	tf, err := bio.Parse(metainfo)
+	require.Nil(t, err)
+	assert.Equal(t, hex.EncodeToString(tf.InfoHash[:]), hash)
+
+	added = nil
+	require.Equal(t, "success", c.call("torrent-add", add, &added))
+	require.Contains(t, added, "torrent-duplicate")
+	assert.Equal(t, id, added["torrent-duplicate"].ID)
+
+	tr := c.waitStatus(id, statusStopped)
+	assert.Equal(t, int64(len(data)), tr.TotalSize)
+	assert.Equal(t, int64(len(data)), tr.LeftUntilDone)
+	assert.Equal(t, []int{1}, tr.Wanted)
+	assert.Equal(t, tracker, tr.Trackers[0].Announce)
+	m, err := bio.ParseMagnet(tr.MagnetLink)
+	require.Nil(t, err)
+	assert.Equal(t, tf.InfoHash, m.InfoHash)
+
+	// downloaded
+	require.Equal(t, "success", c.call("torrent-start", map[string]interface{}{"ids": []interface{}{hash}}, nil))
+	tr = c.waitStatus(id, statusSeed)
+	assert.Equal(t, 1.0, tr.PercentDone)
+	assert.Equal(t, int64(0), tr.LeftUntilDone)
+	assert.Equal(t, int64(len(data)), tr.DownloadedEver)
+	assert.Greater(t, tr.RateDownload, int64(0))
+	assert.Equal(t, int64(-1), tr.ETA, "done")
+	downloaded, err := ioutil.ReadFile(filepath.Join(dataDir, "file"))
+	require.Nil(t, err)
+	assert.Equal(t, data, downloaded)
+
+	// torrent limits, then session limits
+	set := map[string]interface{}{"ids": id, "priority-high": []int{0}, "seedRatioMode": modeSingle, "seedRatioLimit": 3}
+	require.Equal(t, "success", c.call("torrent-set", set, nil))
+	tr = c.get(id)[0]
+	assert.Equal(t, []int{1}, tr.Priorities)
+	assert.Equal(t, modeSingle, tr.SeedRatioMode)
+	assert.Equal(t, 3.0, tr.SeedRatioLimit)
+	st, ok := s.Get(tf.InfoHash)
+	require.True(t, ok)
+	assert.Equal(t, 3.0, st.SeedGoals().Ratio)
+
+	sessionSet := map[string]interface{}{
+		"speed-limit-down":         50,
+		"speed-limit-down-enabled": true,
+		"download-queue-size":      2,
+		"download-queue-enabled":   true,
+		"seedRatioLimit":           1.5,
+		"seedRatioLimited":         true,
+	}
+	require.Equal(t, "success", c.call("session-set", sessionSet, nil))
+	var sessionGet map[string]interface{}
+	require.Equal(t, "success", c.call("session-get", nil, &sessionGet))
+	for k, v := range sessionSet {
+		assert.EqualValues(t, v, sessionGet[k], k)
+	}
+	assert.EqualValues(t, s.Port(), sessionGet["peer-port"])
+	assert.Equal(t, dataDir, sessionGet["download-dir"])
+	settings := s.Settings()
+	assert.Equal(t, 50*kB, settings.DownloadRate)
+	assert.Equal(t, 0, settings.UploadRate)
+	assert.Equal(t, 2, settings.MaxActiveDownloads)
+	assert.Equal(t, 1.5, settings.SeedGoals.Ratio)
+	assert.Equal(t, 3.0, st.SeedGoals().Ratio, "the torrent keeps its own limit")
+	require.Equal(t, "success", c.call("torrent-set", map[string]interface{}{"ids": id, "seedRatioMode": modeGlobal}, nil))
+	assert.Equal(t, 1.5, st.SeedGoals().Ratio)
+
+	// stopped, then removed with its data
+	require.Equal(t, "success", c.call("torrent-stop", map[string]interface{}{"ids": []int{id}}, nil))
+	c.waitStatus(id, statusStopped)
+	assert.Equal(t, "method name not recognized", c.call("torrent-verify", nil, nil))
+	require.Equal(t, "success", c.call("torrent-remove", map[string]interface{}{"ids": id, "delete-local-data": true}, nil))
+	assert.Empty(t, c.get(nil))
+	_, err = os.Stat(filepath.Join(dataDir, "file"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestTorrentAdd(t *testing.T) {
+	metainfo := testswarm.Torrent(t, []byte("contents"), "")
+	tf, err := bio.Parse(metainfo)
+	require.Nil(t, err)
+	path := filepath.Join(t.TempDir(), "file.torrent")
+	require.Nil(t, ioutil.WriteFile(path, metainfo, 0644))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(metainfo)
+	}))
+	defer ts.Close()
+
+	tests := map[string]struct {
+		args   map[string]interface{}
+		result string
+	}{
+		"magnet": {args: map[string]interface{}{"filename": "magnet:?xt=urn:btih:" + hex.EncodeToString(tf.InfoHash[:])},
+			result: "success"},
+		"url":          {args: map[string]interface{}{"filename": ts.URL + "/file.torrent"}, result: "success"},
+		"path":         {args: map[string]interface{}{"filename": path}, result: "success"},
+		"invalid":      {args: map[string]interface{}{"metainfo": base64.StdEncoding.EncodeToString([]byte("junk"))}},
+		"no arguments": {args: map[string]interface{}{}, result: "no filename or metainfo"},
+	}
+
+	for name, test := range tests {
+		c, _ := newTestServer(t, t.TempDir())
+		test.args["paused"] = true
+		var added map[string]struct {
+			HashString string `json:"hashString"`
+		}
+		result := c.call("torrent-add", test.args, &added)
+		if test.result == "" {
+			assert.NotEqual(t, "success", result, name)
+			continue
+		}
+		require.Equal(t, test.result, result, name)
+		if result == "success" {
+			assert.Equal(t, hex.EncodeToString(tf.InfoHash[:]), added["torrent-added"].HashString, name)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package transmission
+
+import (
+	"errors"
+	"time"
+
+	"github.com/VIVelev/bittorrent/session"
+)
+
+// kB is the unit of the speed limits of Transmission, in bytes.
+const kB = 1000
+
+// the limits Transmission starts with, kept until a limit is enabled
+const (
+	defaultSpeedLimit    = 100 // kB/s
+	defaultDownloadQueue = 5
+	defaultSeedQueue     = 10
+	defaultRatio         = 2
+	defaultIdle          = 30 // minutes
+)
+
+// limits are the settings of the session as Transmission has them: a limit keeps its value
+// while it is disabled.
+type limits struct {
+	speedDown, speedUp               int // kB/s
+	speedDownEnabled, speedUpEnabled bool
+
+	downloadQueue, seedQueue               int
+	downloadQueueEnabled, seedQueueEnabled bool
+
+	ratio        float64
+	ratioEnabled bool
+	idle         int // minutes
+	idleEnabled  bool
+}
+
+func newLimits(st session.Settings) limits {
+	l := limits{
+		speedDown:     defaultSpeedLimit,
+		speedUp:       defaultSpeedLimit,
+		downloadQueue: defaultDownloadQueue,
+		seedQueue:     defaultSeedQueue,
+		ratio:         defaultRatio,
+		idle:          defaultIdle,
+	}
+	if st.DownloadRate > 0 {
+		l.speedDown, l.speedDownEnabled = st.DownloadRate/kB, true
+	}
+	if st.UploadRate > 0 {
+		l.speedUp, l.speedUpEnabled = st.UploadRate/kB, true
+	}
+	if st.MaxActiveDownloads > 0 {
+		l.downloadQueue, l.downloadQueueEnabled = st.MaxActiveDownloads, true
+	}
+	if st.MaxActiveSeeds > 0 {
+		l.seedQueue, l.seedQueueEnabled = st.MaxActiveSeeds, true
+	}
+	if st.SeedGoals.Ratio > 0 {
+		l.ratio, l.ratioEnabled = st.SeedGoals.Ratio, true
+	}
+	if st.SeedGoals.Idle > 0 {
+		l.idle, l.idleEnabled = int(st.SeedGoals.Idle/time.Minute), true
+	}
+	return l
+}
+
+// settings returns st with the limits that are enabled, the others being 0.
+func (l limits) settings(st session.Settings) session.Settings {
+	enabled := func(v int, ok bool) int {
+		if ok {
+			return v
+		}
+		return 0
+	}
+	st.DownloadRate = enabled(l.speedDown*kB, l.speedDownEnabled)
+	st.UploadRate = enabled(l.speedUp*kB, l.speedUpEnabled)
+	st.MaxActiveDownloads = enabled(l.downloadQueue, l.downloadQueueEnabled)
+	st.MaxActiveSeeds = enabled(l.seedQueue, l.seedQueueEnabled)
+	st.SeedGoals.Ratio = 0
+	if l.ratioEnabled {
+		st.SeedGoals.Ratio = l.ratio
+	}
+	st.SeedGoals.Idle = time.Duration(enabled(l.idle, l.idleEnabled)) * time.Minute
+	return st
+}
+
+// the seeding modes of a torrent
+const (
+	modeGlobal    = 0 // the limit of the session
+	modeSingle    = 1 // the limit of the torrent
+	modeUnlimited = 2
+)
+
+// seedModes are the seeding limits of a torrent, those of the session by default.
+type seedModes struct {
+	ratioMode int
+	ratio     float64
+	idleMode  int
+	idle      int // minutes
+}
+
+// goals returns the seeding goals of a torrent with modes m in a session with settings st.
+func (m seedModes) goals(st session.Settings) session.SeedGoals {
+	goals := st.SeedGoals
+	switch m.ratioMode {
+	case modeSingle:
+		goals.Ratio = m.ratio
+	case modeUnlimited:
+		goals.Ratio = 0
+	}
+	switch m.idleMode {
+	case modeSingle:
+		goals.Idle = time.Duration(m.idle) * time.Minute
+	case modeUnlimited:
+		goals.Idle = 0
+	}
+	return goals
+}
+
+// applyGoals gives the torrents their seeding goals again, after the settings of the session change.
+func (srv *Server) applyGoals() {
+	st := srv.s.Settings()
+	for _, t := range srv.s.Torrents() {
+		srv.mu.Lock()
+		m := srv.modes[t.InfoHash()]
+		srv.mu.Unlock()
+		t.SetSeedGoals(m.goals(st))
+	}
+}
+
+func (srv *Server) sessionGet(fields []string) map[string]interface{} {
+	srv.mu.Lock()
+	l := srv.limits
+	srv.mu.Unlock()
+
+	ret := map[string]interface{}{
+		"version":                    version,
+		"rpc-version":                rpcVersion,
+		"rpc-version-minimum":        rpcVersionMinimum,
+		"session-id":                 srv.sessionID,
+		"download-dir":               srv.s.DataDir(),
+		"peer-port":                  srv.s.Port(),
+		"pex-enabled":                true,
+		"start-added-torrents":       true,
+		"speed-limit-down":           l.speedDown,
+		"speed-limit-down-enabled":   l.speedDownEnabled,
+		"speed-limit-up":             l.speedUp,
+		"speed-limit-up-enabled":     l.speedUpEnabled,
+		"alt-speed-enabled":          false,
+		"download-queue-size":        l.downloadQueue,
+		"download-queue-enabled":     l.downloadQueueEnabled,
+		"seed-queue-size":            l.seedQueue,
+		"seed-queue-enabled":         l.seedQueueEnabled,
+		"seedRatioLimit":             l.ratio,
+		"seedRatioLimited":           l.ratioEnabled,
+		"idle-seeding-limit":         l.idle,
+		"idle-seeding-limit-enabled": l.idleEnabled,
+		"units": map[string]interface{}{
+			"speed-units":  []string{"kB/s", "MB/s", "GB/s", "TB/s"},
+			"speed-bytes":  kB,
+			"size-units":   []string{"kB", "MB", "GB", "TB"},
+			"size-bytes":   kB,
+			"memory-units": []string{"KiB", "MiB", "GiB", "TiB"},
+			"memory-bytes": 1024,
+		},
+	}
+	if len(fields) == 0 {
+		return ret
+	}
+	filtered := make(map[string]interface{})
+	for _, f := range fields {
+		if v, ok := ret[f]; ok {
+			filtered[f] = v
+		}
+	}
+	return filtered
+}
+
+type sessionSetArgs struct {
+	SpeedLimitDown          *int     `json:"speed-limit-down"`
+	SpeedLimitDownEnabled   *bool    `json:"speed-limit-down-enabled"`
+	SpeedLimitUp            *int     `json:"speed-limit-up"`
+	SpeedLimitUpEnabled     *bool    `json:"speed-limit-up-enabled"`
+	DownloadQueueSize       *int     `json:"download-queue-size"`
+	DownloadQueueEnabled    *bool    `json:"download-queue-enabled"`
+	SeedQueueSize           *int     `json:"seed-queue-size"`
+	SeedQueueEnabled        *bool    `json:"seed-queue-enabled"`
+	SeedRatioLimit          *float64 `json:"seedRatioLimit"`
+	SeedRatioLimited        *bool    `json:"seedRatioLimited"`
+	IdleSeedingLimit        *int     `json:"idle-seeding-limit"`
+	IdleSeedingLimitEnabled *bool    `json:"idle-seeding-limit-enabled"`
+}
+
+func (srv *Server) sessionSet(args sessionSetArgs) error {
+	for _, v := range []*int{args.SpeedLimitDown, args.SpeedLimitUp, args.DownloadQueueSize,
+		args.SeedQueueSize, args.IdleSeedingLimit} {
+		if v != nil && *v < 0 {
+			return errors.New("negative limit")
+		}
+	}
+	if args.SeedRatioLimit != nil && *args.SeedRatioLimit < 0 {
+		return errors.New("negative seedRatioLimit")
+	}
+
+	srv.mu.Lock()
+	l := &srv.limits
+	setInt := func(dst *int, v *int) {
+		if v != nil {
+			*dst = *v
+		}
+	}
+	setBool := func(dst *bool, v *bool) {
+		if v != nil {
+			*dst = *v
+		}
+	}
+	setInt(&l.speedDown, args.SpeedLimitDown)
+	setBool(&l.speedDownEnabled, args.SpeedLimitDownEnabled)
+	setInt(&l.speedUp, args.SpeedLimitUp)
+	setBool(&l.speedUpEnabled, args.SpeedLimitUpEnabled)
+	setInt(&l.downloadQueue, args.DownloadQueueSize)
+	setBool(&l.downloadQueueEnabled, args.DownloadQueueEnabled)
+	setInt(&l.seedQueue, args.SeedQueueSize)
+	setBool(&l.seedQueueEnabled, args.SeedQueueEnabled)
+	if args.SeedRatioLimit != nil {
+		l.ratio = *args.SeedRatioLimit
+	}
+	setBool(&l.ratioEnabled, args.SeedRatioLimited)
+	setInt(&l.idle, args.IdleSeedingLimit)
+	setBool(&l.idleEnabled, args.IdleSeedingLimitEnabled)
+	st := l.settings(srv.s.Settings())
+	srv.mu.Unlock()
+
+	srv.s.SetSettings(st)
+	srv.applyGoals()
+	return nil
+}
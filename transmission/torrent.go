@@ -0,0 +1,553 @@
+package transmission
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	stdio "io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/VIVelev/bittorrent/io"
+	"github.com/VIVelev/bittorrent/p2p"
+	"github.com/VIVelev/bittorrent/pex"
+	"github.com/VIVelev/bittorrent/session"
+)
+
+// fetchTimeout bounds the download of the .torrent files added by URL.
+const fetchTimeout time.Duration = 30 * time.Second
+
+// the status of a torrent in Transmission
+const (
+	statusStopped      = 0
+	statusCheckWait    = 1
+	statusCheck        = 2
+	statusDownloadWait = 3
+	statusDownload     = 4
+	statusSeedWait     = 5
+	statusSeed         = 6
+)
+
+// errorLocal is the error kind of torrents that failed on our side, e.g. writing to disk.
+const errorLocal = 3
+
+// info is what torrent-get needs to know about a torrent, gathered once per torrent.
+type info struct {
+	t     *session.Torrent
+	id    int
+	state session.State
+	files []session.FileStatus
+	modes seedModes
+	stats p2p.TorrentStats
+}
+
+// wantedLeft returns the size of the wanted files, and how much of it is left to download.
+func (i *info) wantedLeft() (int64, int64) {
+	var size, left int64
+	for _, f := range i.files {
+		if f.Priority == p2p.PrioritySkip || f.Padding {
+			continue
+		}
+		size += f.Length
+		left += f.Length - f.Completed
+	}
+	return size, left
+}
+
+func (i *info) status() int {
+	switch i.state {
+	case session.StateChecking:
+		return statusCheck
+	case session.StateMetadata, session.StateDownloading:
+		return statusDownload
+	case session.StateQueued:
+		if _, left := i.wantedLeft(); i.files != nil && left == 0 {
+			return statusSeedWait
+		}
+		return statusDownloadWait
+	case session.StateSeeding:
+		return statusSeed
+	default:
+		return statusStopped
+	}
+}
+
+// field returns the value of a field of torrent-get, false if it is not known.
+func (i *info) field(name string) (interface{}, bool) {
+	t := i.t
+	switch name {
+	case "id":
+		return i.id, true
+	case "hashString":
+		ih := t.InfoHash()
+		return hex.EncodeToString(ih[:]), true
+	case "name":
+		return t.Name(), true
+	case "status":
+		return i.status(), true
+	case "error":
+		if i.state == session.StateError {
+			return errorLocal, true
+		}
+		return 0, true
+	case "errorString":
+		if err := t.Err(); err != nil {
+			return err.Error(), true
+		}
+		return "", true
+	case "isFinished":
+		return false, true
+	case "totalSize":
+		return t.Size(), true
+	case "sizeWhenDone":
+		size, _ := i.wantedLeft()
+		return size, true
+	case "leftUntilDone":
+		_, left := i.wantedLeft()
+		return left, true
+	case "haveValid":
+		return t.BytesCompleted(), true
+	case "haveUnchecked":
+		return 0, true
+	case "percentDone":
+		size, left := i.wantedLeft()
+		if size == 0 {
+			return 0.0, true
+		}
+		return float64(size-left) / float64(size), true
+	case "metadataPercentComplete":
+		if i.files == nil {
+			return 0.0, true
+		}
+		return 1.0, true
+	case "downloadedEver":
+		return t.Downloaded(), true
+	case "uploadedEver":
+		return t.Uploaded(), true
+	case "uploadRatio":
+		return t.Ratio(), true
+	case "secondsSeeding":
+		return int64(t.SeedingTime().Seconds()), true
+	case "rateDownload":
+		return int64(i.stats.DownloadRate), true
+	case "rateUpload":
+		return int64(i.stats.UploadRate), true
+	case "eta":
+		if i.stats.ETA <= 0 {
+			return -1, true // done or unknown
+		}
+		return int64(i.stats.ETA.Seconds()), true
+	case "etaIdle":
+		return -1, true // unknown
+	case "corruptEver":
+		return i.stats.Wasted, true
+	case "queuePosition":
+		return t.QueuePosition(), true
+	case "downloadDir":
+		return t.Dir(), true
+	case "addedDate":
+		return t.Added().Unix(), true
+	case "peersConnected":
+		return i.stats.Peers, true
+	case "peersSendingToUs", "peersGettingFromUs":
+		n := 0
+		for _, p := range t.PeerStats() {
+			if name == "peersSendingToUs" && p.DownloadRate > 0 || name == "peersGettingFromUs" && p.UploadRate > 0 {
+				n++
+			}
+		}
+		return n, true
+	case "peers":
+		return peers(t), true
+	case "files":
+		ret := make([]map[string]interface{}, len(i.files))
+		for j, f := range i.files {
+			ret[j] = map[string]interface{}{"name": f.Path, "length": f.Length, "bytesCompleted": f.Completed}
+		}
+		return ret, true
+	case "fileStats":
+		ret := make([]map[string]interface{}, len(i.files))
+		for j, f := range i.files {
+			ret[j] = map[string]interface{}{
+				"bytesCompleted": f.Completed,
+				"wanted":         f.Priority != p2p.PrioritySkip,
+				"priority":       priority(f.Priority),
+			}
+		}
+		return ret, true
+	case "wanted":
+		ret := make([]int, len(i.files))
+		for j, f := range i.files {
+			if f.Priority != p2p.PrioritySkip {
+				ret[j] = 1
+			}
+		}
+		return ret, true
+	case "priorities":
+		ret := make([]int, len(i.files))
+		for j, f := range i.files {
+			ret[j] = priority(f.Priority)
+		}
+		return ret, true
+	case "trackers":
+		ret := []map[string]interface{}{}
+		for j, tr := range t.Trackers() {
+			ret = append(ret, map[string]interface{}{"id": j, "announce": tr.URL, "tier": j})
+		}
+		return ret, true
+	case "trackerStats":
+		return trackerStats(t), true
+	case "magnetLink":
+		return t.Magnet(), true
+	case "seedRatioMode":
+		return i.modes.ratioMode, true
+	case "seedRatioLimit":
+		return i.modes.ratio, true
+	case "seedIdleMode":
+		return i.modes.idleMode, true
+	case "seedIdleLimit":
+		return i.modes.idle, true
+	default:
+		return nil, false
+	}
+}
+
+// priority returns the Transmission priority of a file, skipped files keep the normal one.
+func priority(p p2p.Priority) int {
+	switch p {
+	case p2p.PriorityLow:
+		return -1
+	case p2p.PriorityHigh:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func peers(t *session.Torrent) []map[string]interface{} {
+	ret := []map[string]interface{}{}
+	for _, p := range t.PeerStats() {
+		ret = append(ret, map[string]interface{}{
+			"address":            p.Peer.IP.String(),
+			"port":               p.Peer.Port,
+			"isEncrypted":        p.Flags&pex.FlagEncryption != 0,
+			"isUTP":              p.Flags&pex.FlagUTP != 0,
+			"isIncoming":         p.Source == p2p.SourceIncoming,
+			"clientName":         p.Client,
+			"clientIsChoked":     p.Choked,
+			"clientIsInterested": p.Interested,
+			"peerIsChoked":       false, // we never choke peers
+			"peerIsInterested":   p.PeerInterested,
+			"isDownloadingFrom":  p.DownloadRate > 0,
+			"isUploadingTo":      p.UploadRate > 0,
+			"rateToClient":       int64(p.DownloadRate),
+			"rateToPeer":         int64(p.UploadRate),
+			"progress":           p.Progress,
+		})
+	}
+	return ret
+}
+
+func trackerStats(t *session.Torrent) []map[string]interface{} {
+	ret := []map[string]interface{}{}
+	for j, tr := range t.Trackers() {
+		host := tr.URL
+		if u, err := url.Parse(tr.URL); err == nil && u.Host != "" {
+			host = u.Host
+		}
+		st := map[string]interface{}{
+			"id":                    j,
+			"tier":                  j,
+			"announce":              tr.URL,
+			"host":                  host,
+			"hasAnnounced":          !tr.LastAnnounce.IsZero(),
+			"lastAnnounceTime":      int64(0),
+			"lastAnnounceSucceeded": !tr.LastAnnounce.IsZero() && tr.Err == nil,
+			"lastAnnouncePeerCount": tr.Peers,
+			"lastAnnounceResult":    "",
+		}
+		if !tr.LastAnnounce.IsZero() {
+			st["lastAnnounceTime"] = tr.LastAnnounce.Unix()
+		}
+		if tr.Err != nil {
+			st["lastAnnounceResult"] = tr.Err.Error()
+		} else if !tr.LastAnnounce.IsZero() {
+			st["lastAnnounceResult"] = "Success"
+		}
+		ret = append(ret, st)
+	}
+	return ret
+}
+
+func (srv *Server) info(t *session.Torrent) *info {
+	id := srv.id(t)
+	srv.mu.Lock()
+	modes := srv.modes[t.InfoHash()]
+	srv.mu.Unlock()
+	return &info{t: t, id: id, state: t.State(), files: t.Files(), modes: modes, stats: t.Stats()}
+}
+
+func (srv *Server) torrentGet(ids json.RawMessage, fields []string) (map[string]interface{}, error) {
+	if len(fields) == 0 {
+		return nil, errors.New("no fields")
+	}
+	torrents, err := srv.resolve(ids)
+	if err != nil {
+		return nil, err
+	}
+	ret := []map[string]interface{}{}
+	for _, t := range torrents {
+		i := srv.info(t)
+		tr := make(map[string]interface{})
+		for _, f := range fields {
+			if v, ok := i.field(f); ok {
+				tr[f] = v
+			}
+		}
+		ret = append(ret, tr)
+	}
+	args := map[string]interface{}{"torrents": ret}
+	if string(ids) == `"recently-active"` {
+		// removed torrents are forgotten
+		args["removed"] = []int{}
+	}
+	return args, nil
+}
+
+type torrentAddArgs struct {
+	// Filename is a magnet link, the URL of a .torrent file or its path.
+	Filename string `json:"filename"`
+	// Metainfo is the contents of a .torrent file, base64 encoded.
+	Metainfo    string `json:"metainfo"`
+	DownloadDir string `json:"download-dir"`
+	Paused      bool   `json:"paused"`
+}
+
+func (srv *Server) torrentAdd(args torrentAddArgs) (map[string]interface{}, error) {
+	opts := session.AddOptions{Dir: args.DownloadDir, Paused: args.Paused}
+	var (
+		infoHash [20]byte
+		add      func() (*session.Torrent, error)
+	)
+	switch {
+	case args.Metainfo != "":
+		data, err := base64.StdEncoding.DecodeString(args.Metainfo)
+		if err != nil {
+			return nil, fmt.Errorf("metainfo: %s", err)
+		}
+		if infoHash, add, err = srv.addBytes(data, opts); err != nil {
+			return nil, err
+		}
+	case strings.HasPrefix(args.Filename, "magnet:"):
+		m, err := io.ParseMagnet(args.Filename)
+		if err != nil {
+			return nil, fmt.Errorf("magnet: %s", err)
+		}
+		infoHash = m.InfoHash
+		add = func() (*session.Torrent, error) { return srv.s.AddMagnet(args.Filename, opts) }
+	case args.Filename != "":
+		data, err := fetch(args.Filename)
+		if err != nil {
+			return nil, err
+		}
+		if infoHash, add, err = srv.addBytes(data, opts); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("no filename or metainfo")
+	}
+
+	key := "torrent-added"
+	t, err := add()
+	if errors.Is(err, session.ErrExists) {
+		var ok bool
+		if t, ok = srv.s.Get(infoHash); !ok {
+			return nil, err
+		}
+		key = "torrent-duplicate"
+	} else if err != nil {
+		return nil, err
+	}
+	ih := t.InfoHash()
+	return map[string]interface{}{key: map[string]interface{}{
+		"id":         srv.id(t),
+		"name":       t.Name(),
+		"hashString": hex.EncodeToString(ih[:]),
+	}}, nil
+}
+
+// addBytes parses a .torrent file, and returns its info hash and how to add it.
+func (srv *Server) addBytes(data []byte, opts session.AddOptions) ([20]byte, func() (*session.Torrent, error), error) {
+	tf, err := io.Parse(data)
+	if err != nil {
+		return [20]byte{}, nil, fmt.Errorf("parse: %s", err)
+	}
+	return tf.InfoHash, func() (*session.Torrent, error) { return srv.s.AddBytes(data, opts) }, nil
+}
+
+// fetch reads a .torrent file from an http(s) URL or a path.
+func fetch(filename string) ([]byte, error) {
+	if !strings.HasPrefix(filename, "http://") && !strings.HasPrefix(filename, "https://") {
+		return ioutil.ReadFile(filename)
+	}
+	c := &http.Client{Timeout: fetchTimeout}
+	resp, err := c.Get(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch %s: %s", filename, resp.Status)
+	}
+	data, err := ioutil.ReadAll(stdio.LimitReader(resp.Body, maxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBodySize {
+		return nil, fmt.Errorf("fetch %s: torrent file too large", filename)
+	}
+	return data, nil
+}
+
+// torrentAction starts, stops or removes torrents.
+func (srv *Server) torrentAction(method string, torrents []*session.Torrent, deleteData bool) error {
+	for _, t := range torrents {
+		switch method {
+		case "torrent-start":
+			t.Resume()
+		case "torrent-start-now":
+			// it starts before the torrents that are queued
+			t.SetQueuePosition(0)
+			t.Resume()
+		case "torrent-stop":
+			t.Pause()
+		case "torrent-remove":
+			if err := srv.s.Remove(t.InfoHash(), deleteData); err != nil {
+				return err
+			}
+			srv.forget(t)
+		}
+	}
+	return nil
+}
+
+type torrentSetArgs struct {
+	IDs            json.RawMessage `json:"ids"`
+	FilesWanted    []int           `json:"files-wanted"`
+	FilesUnwanted  []int           `json:"files-unwanted"`
+	PriorityHigh   []int           `json:"priority-high"`
+	PriorityLow    []int           `json:"priority-low"`
+	PriorityNormal []int           `json:"priority-normal"`
+	QueuePosition  *int            `json:"queuePosition"`
+	SeedRatioLimit *float64        `json:"seedRatioLimit"`
+	SeedRatioMode  *int            `json:"seedRatioMode"`
+	SeedIdleLimit  *int            `json:"seedIdleLimit"`
+	SeedIdleMode   *int            `json:"seedIdleMode"`
+}
+
+func (srv *Server) torrentSet(torrents []*session.Torrent, args torrentSetArgs) error {
+	for _, mode := range []*int{args.SeedRatioMode, args.SeedIdleMode} {
+		if mode != nil && (*mode < modeGlobal || *mode > modeUnlimited) {
+			return fmt.Errorf("invalid seeding mode %d", *mode)
+		}
+	}
+	if args.SeedRatioLimit != nil && *args.SeedRatioLimit < 0 || args.SeedIdleLimit != nil && *args.SeedIdleLimit < 0 {
+		return errors.New("negative seeding limit")
+	}
+
+	for _, t := range torrents {
+		if err := setFiles(t, args); err != nil {
+			return err
+		}
+		if args.QueuePosition != nil {
+			t.SetQueuePosition(*args.QueuePosition)
+		}
+
+		srv.mu.Lock()
+		m := srv.modes[t.InfoHash()]
+		if args.SeedRatioLimit != nil {
+			m.ratio = *args.SeedRatioLimit
+		}
+		if args.SeedRatioMode != nil {
+			m.ratioMode = *args.SeedRatioMode
+		}
+		if args.SeedIdleLimit != nil {
+			m.idle = *args.SeedIdleLimit
+		}
+		if args.SeedIdleMode != nil {
+			m.idleMode = *args.SeedIdleMode
+		}
+		srv.modes[t.InfoHash()] = m
+		srv.mu.Unlock()
+		t.SetSeedGoals(m.goals(srv.s.Settings()))
+	}
+	return nil
+}
+
+// setFiles applies the file arguments of torrent-set. In Transmission whether a file is wanted
+// and its priority are apart, here a skipped file has no priority: a file that is wanted again
+// is normal, and the priority of skipped files does not change.
+func setFiles(t *session.Torrent, args torrentSetArgs) error {
+	if len(args.FilesWanted)+len(args.FilesUnwanted)+len(args.PriorityHigh)+
+		len(args.PriorityLow)+len(args.PriorityNormal) == 0 {
+		return nil
+	}
+	files := t.Files()
+	if files == nil {
+		return fmt.Errorf("metadata of %s is not fetched yet", t.Name())
+	}
+	prios := make([]p2p.Priority, len(files))
+	for i, f := range files {
+		prios[i] = f.Priority
+	}
+	set := func(indices []int, f func(p2p.Priority) p2p.Priority) error {
+		for _, i := range indices {
+			if i < 0 || i >= len(prios) {
+				return fmt.Errorf("file %d does not exist", i)
+			}
+			prios[i] = f(prios[i])
+		}
+		return nil
+	}
+	unlessSkipped := func(p p2p.Priority) func(p2p.Priority) p2p.Priority {
+		return func(old p2p.Priority) p2p.Priority {
+			if old == p2p.PrioritySkip {
+				return old
+			}
+			return p
+		}
+	}
+	for _, s := range []struct {
+		indices []int
+		f       func(p2p.Priority) p2p.Priority
+	}{
+		{args.FilesUnwanted, func(p2p.Priority) p2p.Priority { return p2p.PrioritySkip }},
+		{args.FilesWanted, func(old p2p.Priority) p2p.Priority {
+			if old == p2p.PrioritySkip {
+				return p2p.PriorityNormal
+			}
+			return old
+		}},
+		{args.PriorityHigh, unlessSkipped(p2p.PriorityHigh)},
+		{args.PriorityLow, unlessSkipped(p2p.PriorityLow)},
+		{args.PriorityNormal, unlessSkipped(p2p.PriorityNormal)},
+	} {
+		if err := set(s.indices, s.f); err != nil {
+			return err
+		}
+	}
+	for i, p := range prios {
+		if p == files[i].Priority {
+			continue
+		}
+		if err := t.SetFilePriority(i, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,637 @@
+package utp
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// packetSize is the largest payload of a data packet, it keeps datagrams below common MTUs.
+	packetSize int = 1200
+	// recvBufSize is the receive window we advertise.
+	recvBufSize int = 1 << 20
+	// sendBufSize is how many unacknowledged bytes Write buffers before it blocks.
+	sendBufSize int = 1 << 20
+	// maxReorder bounds how far ahead of ack_nr out of order packets are kept.
+	maxReorder uint16 = 1024
+
+	// LEDBAT parameters
+	target             time.Duration = 100 * time.Millisecond
+	maxCwndIncrease    float64       = 3000 // bytes per RTT
+	minWindow          int           = packetSize
+	maxWindow          int           = 1 << 20
+	baseDelayHistory   int           = 2 // minutes
+	initialTimeout     time.Duration = time.Second
+	minTimeout         time.Duration = 500 * time.Millisecond
+	maxTimeout         time.Duration = 30 * time.Second
+	maxTimeouts        int           = 7
+	fastResendSackHits int           = 3
+	lingerTimeout      time.Duration = 10 * time.Second
+)
+
+var errReset = errors.New("utp: connection reset by peer")
+
+type connState int
+
+const (
+	stateIdle connState = iota // responder waiting for SYN
+	stateSynSent
+	stateConnected
+	stateClosed
+)
+
+// outPacket is a packet in the send buffer.
+type outPacket struct {
+	p             *packet
+	sentAt        time.Time
+	transmissions int
+	needResend    bool
+	fastResent    bool
+}
+
+func (op *outPacket) inFlight() bool {
+	return op.transmissions > 0 && !op.needResend
+}
+
+// Conn is a uTP connection. It implements net.Conn.
+type Conn struct {
+	s          *Socket
+	raddr      net.Addr
+	recvID     uint16
+	sendID     uint16
+	ownsSocket bool
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	state connState
+	err   error // terminal error, reads may still drain readBuf
+	eof   bool
+
+	// send side
+	seqNr      uint16
+	outbuf     []*outPacket // ordered by seq_nr
+	outBytes   int
+	curWindow  int // bytes in flight
+	maxWindow  float64
+	peerWnd    int
+	rtt        time.Duration
+	rttVar     time.Duration
+	rto        time.Duration
+	timeouts   int
+	lastLoss   time.Time
+	baseDelays []uint32 // per minute minima, the last one is the current minute
+	baseMinute time.Time
+
+	// receive side
+	ackNr      uint16
+	readBuf    []byte
+	reorder    map[uint16]*packet
+	replyMicro uint32
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(s *Socket, raddr net.Addr, recvID, sendID uint16) *Conn {
+	c := &Conn{
+		s:         s,
+		raddr:     raddr,
+		recvID:    recvID,
+		sendID:    sendID,
+		maxWindow: float64(minWindow),
+		peerWnd:   recvBufSize,
+		rto:       initialTimeout,
+		reorder:   make(map[uint16]*packet),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func nowMicro() uint32 {
+	return uint32(time.Now().UnixNano() / int64(time.Microsecond))
+}
+
+// connect sends a SYN and waits for the reply.
+func (c *Conn) connect(timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	c.state = stateSynSent
+	c.seqNr = 1
+	c.queue(stSyn, nil)
+	c.flush()
+
+	for c.state == stateSynSent && c.err == nil {
+		if err := c.wait(deadline); err != nil {
+			c.fail(err)
+			return err
+		}
+	}
+	return c.err
+}
+
+// wait blocks on the condition variable until it is signaled or the deadline passes.
+// Must be called with c.mu held.
+func (c *Conn) wait(deadline time.Time) error {
+	if deadline.IsZero() {
+		c.cond.Wait()
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	t := time.AfterFunc(d, func() {
+		c.mu.Lock()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+	c.cond.Wait()
+	t.Stop()
+	return nil
+}
+
+// fail tears the connection down with err. Must be called with c.mu held.
+func (c *Conn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.state = stateClosed
+	c.cond.Broadcast()
+}
+
+func (c *Conn) reset(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fail(err)
+}
+
+// queue appends a packet consuming a sequence number to the send buffer.
+func (c *Conn) queue(typ packetType, payload []byte) {
+	p := &packet{typ: typ, seqNr: c.seqNr, payload: payload}
+	if typ == stSyn {
+		// the SYN is addressed with our receive id
+		p.connID = c.recvID
+	}
+	c.seqNr++
+	c.outbuf = append(c.outbuf, &outPacket{p: p})
+	c.outBytes += len(payload)
+}
+
+func (c *Conn) window() int {
+	w := int(c.maxWindow)
+	if c.peerWnd < w {
+		w = c.peerWnd
+	}
+	return w
+}
+
+// flush sends as many queued packets as the window allows.
+func (c *Conn) flush() {
+	for _, op := range c.outbuf {
+		if op.inFlight() {
+			continue
+		}
+		size := len(op.p.payload)
+		if c.curWindow > 0 && c.curWindow+size > c.window() {
+			return
+		}
+		c.transmit(op)
+	}
+}
+
+func (c *Conn) transmit(op *outPacket) {
+	if !op.inFlight() {
+		c.curWindow += len(op.p.payload)
+	}
+	op.needResend = false
+	op.transmissions++
+	op.sentAt = time.Now()
+	c.send(op.p)
+}
+
+// send fills in the fields describing our state and writes p to the wire.
+func (c *Conn) send(p *packet) {
+	if p.typ != stSyn {
+		p.connID = c.sendID
+	}
+	p.timestamp = nowMicro()
+	p.timestampDiff = c.replyMicro
+	p.wndSize = uint32(c.recvWindow())
+	p.ackNr = c.ackNr
+	p.sack = c.selectiveAck()
+	c.s.writeTo(p, c.raddr)
+}
+
+func (c *Conn) sendState() {
+	c.send(&packet{typ: stState, seqNr: c.seqNr})
+}
+
+func (c *Conn) recvWindow() int {
+	if free := recvBufSize - len(c.readBuf); free > 0 {
+		return free
+	}
+	return 0
+}
+
+// selectiveAck builds the bitmask of received packets past ack_nr+1.
+func (c *Conn) selectiveAck() []byte {
+	if len(c.reorder) == 0 {
+		return nil
+	}
+	var last uint16
+	for seq := range c.reorder {
+		if d := seq - c.ackNr - 2; d > last {
+			last = d
+		}
+	}
+	size := (int(last)/32 + 1) * 4
+	sack := make([]byte, size)
+	for seq := range c.reorder {
+		i := int(seq - c.ackNr - 2)
+		sack[i/8] |= 1 << (i % 8)
+	}
+	return sack
+}
+
+// handle processes a packet received from the peer.
+func (c *Conn) handle(p *packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == stateClosed {
+		return
+	}
+	c.replyMicro = nowMicro() - p.timestamp
+	c.peerWnd = int(p.wndSize)
+
+	switch p.typ {
+	case stReset:
+		c.fail(errReset)
+		return
+	case stSyn:
+		if c.state == stateIdle {
+			c.state = stateConnected
+			c.seqNr = uint16(rand.Uint32())
+			c.ackNr = p.seqNr
+		}
+		// (re)send the SYN-ACK
+		c.sendState()
+		return
+	}
+
+	if c.state == stateSynSent {
+		if p.typ != stState || p.ackNr != c.outbuf[0].p.seqNr {
+			return
+		}
+		c.state = stateConnected
+		// the state packet does not consume a sequence number
+		c.ackNr = p.seqNr - 1
+	}
+
+	c.processAck(p)
+
+	if p.typ == stData || p.typ == stFin {
+		c.receive(p)
+		c.sendState()
+	}
+
+	c.flush()
+	c.cond.Broadcast()
+}
+
+// processAck removes the packets acknowledged by p from the send buffer
+// and updates the RTT estimate and the congestion window.
+func (c *Conn) processAck(p *packet) {
+	now := time.Now()
+	acked := func(seq uint16) bool {
+		if !seqLess(p.ackNr, seq) {
+			return true
+		}
+		i := int(seq - p.ackNr - 2)
+		return i >= 0 && i/8 < len(p.sack) && p.sack[i/8]&(1<<(i%8)) != 0
+	}
+
+	bytesAcked := 0
+	kept := c.outbuf[:0]
+	for _, op := range c.outbuf {
+		if op.transmissions == 0 || !acked(op.p.seqNr) {
+			kept = append(kept, op)
+			continue
+		}
+		if op.inFlight() {
+			c.curWindow -= len(op.p.payload)
+		}
+		c.outBytes -= len(op.p.payload)
+		bytesAcked += len(op.p.payload)
+		if op.transmissions == 1 {
+			c.updateRTT(now.Sub(op.sentAt))
+		}
+	}
+	for i := len(kept); i < len(c.outbuf); i++ {
+		c.outbuf[i] = nil
+	}
+	removed := len(c.outbuf) - len(kept)
+	c.outbuf = kept
+
+	if removed > 0 {
+		c.timeouts = 0
+	}
+	if p.timestampDiff != 0 {
+		c.updateDelay(p.timestampDiff, bytesAcked)
+	}
+
+	// resend the first hole once enough packets past it made it through
+	if len(c.outbuf) > 0 && len(p.sack) > 0 {
+		first := c.outbuf[0]
+		hits := 0
+		for _, op := range c.outbuf[1:] {
+			if acked(op.p.seqNr) {
+				hits++
+			}
+		}
+		if first.inFlight() && !first.fastResent && hits >= fastResendSackHits {
+			first.fastResent = true
+			c.onLoss(now)
+			c.transmit(first)
+		}
+	}
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < minTimeout {
+		c.rto = minTimeout
+	}
+}
+
+// updateDelay applies the LEDBAT controller with the peer's measurement of our one-way delay.
+func (c *Conn) updateDelay(delay uint32, bytesAcked int) {
+	now := time.Now()
+	if len(c.baseDelays) == 0 || now.Sub(c.baseMinute) >= time.Minute {
+		c.baseDelays = append(c.baseDelays, delay)
+		if len(c.baseDelays) > baseDelayHistory {
+			c.baseDelays = c.baseDelays[1:]
+		}
+		c.baseMinute = now
+	}
+	last := len(c.baseDelays) - 1
+	if int32(delay-c.baseDelays[last]) < 0 {
+		c.baseDelays[last] = delay
+	}
+	base := c.baseDelays[0]
+	for _, d := range c.baseDelays[1:] {
+		if int32(d-base) < 0 {
+			base = d
+		}
+	}
+
+	if bytesAcked == 0 {
+		return
+	}
+	ourDelay := time.Duration(delay-base) * time.Microsecond
+	offTarget := float64(target - ourDelay)
+	delayFactor := offTarget / float64(target)
+	windowFactor := float64(bytesAcked) / c.maxWindow
+	if windowFactor > 1 {
+		windowFactor = 1
+	}
+	c.maxWindow += maxCwndIncrease * delayFactor * windowFactor
+	c.clampWindow()
+}
+
+func (c *Conn) clampWindow() {
+	if c.maxWindow < float64(minWindow) {
+		c.maxWindow = float64(minWindow)
+	}
+	if c.maxWindow > float64(maxWindow) {
+		c.maxWindow = float64(maxWindow)
+	}
+}
+
+// onLoss halves the window, at most once per RTT.
+func (c *Conn) onLoss(now time.Time) {
+	if now.Sub(c.lastLoss) < c.rtt {
+		return
+	}
+	c.lastLoss = now
+	c.maxWindow /= 2
+	c.clampWindow()
+}
+
+// receive delivers data in order and keeps out of order packets for later.
+func (c *Conn) receive(p *packet) {
+	if !seqLess(c.ackNr, p.seqNr) || c.eof {
+		// duplicate
+		return
+	}
+	if p.seqNr-c.ackNr > maxReorder {
+		return
+	}
+	if p.seqNr != c.ackNr+1 {
+		c.reorder[p.seqNr] = p
+		return
+	}
+
+	c.deliver(p)
+	for !c.eof {
+		next, ok := c.reorder[c.ackNr+1]
+		if !ok {
+			break
+		}
+		delete(c.reorder, next.seqNr)
+		c.deliver(next)
+	}
+}
+
+func (c *Conn) deliver(p *packet) {
+	c.ackNr = p.seqNr
+	if p.typ == stFin {
+		c.eof = true
+		c.reorder = make(map[uint16]*packet)
+		return
+	}
+	c.readBuf = append(c.readBuf, p.payload...)
+}
+
+// tick retransmits timed out packets.
+func (c *Conn) tick() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == stateClosed {
+		return
+	}
+
+	var oldest *outPacket
+	for _, op := range c.outbuf {
+		if op.inFlight() {
+			oldest = op
+			break
+		}
+	}
+	if oldest == nil || time.Since(oldest.sentAt) < c.rto {
+		return
+	}
+
+	c.timeouts++
+	if c.timeouts > maxTimeouts || c.state == stateSynSent && c.timeouts > 3 {
+		c.fail(os.ErrDeadlineExceeded)
+		return
+	}
+	c.rto *= 2
+	if c.rto > maxTimeout {
+		c.rto = maxTimeout
+	}
+	c.maxWindow = float64(minWindow)
+	for _, op := range c.outbuf {
+		if op.inFlight() {
+			op.needResend = true
+			c.curWindow -= len(op.p.payload)
+		}
+	}
+	c.flush()
+}
+
+// Read reads data from the connection.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.readBuf) == 0 && !c.eof && c.err == nil {
+		if err := c.wait(c.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(c.readBuf) > 0 {
+		wasFull := c.recvWindow() < packetSize
+		n := copy(b, c.readBuf)
+		c.readBuf = c.readBuf[n:]
+		if len(c.readBuf) == 0 {
+			c.readBuf = nil
+		}
+		if wasFull && c.state == stateConnected {
+			// let the peer know the window opened
+			c.sendState()
+		}
+		return n, nil
+	}
+	if c.eof {
+		return 0, io.EOF
+	}
+	return 0, c.err
+}
+
+// Write writes data to the connection.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		for c.outBytes >= sendBufSize && c.err == nil {
+			if err := c.wait(c.writeDeadline); err != nil {
+				return written, err
+			}
+		}
+		if c.err != nil {
+			return written, c.err
+		}
+		if c.state != stateConnected {
+			return written, net.ErrClosed
+		}
+
+		size := len(b)
+		if size > packetSize {
+			size = packetSize
+		}
+		c.queue(stData, append([]byte(nil), b[:size]...))
+		c.flush()
+		b = b[size:]
+		written += size
+	}
+	return written, nil
+}
+
+// Close sends a FIN and waits for the send buffer to drain.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.state == stateConnected {
+		c.queue(stFin, nil)
+		c.flush()
+
+		deadline := time.Now().Add(lingerTimeout)
+		for len(c.outbuf) > 0 && c.err == nil {
+			if err := c.wait(deadline); err != nil {
+				break
+			}
+		}
+	}
+	c.fail(net.ErrClosed)
+	c.mu.Unlock()
+
+	c.s.remove(c)
+	if c.ownsSocket {
+		return c.s.Close()
+	}
+	return nil
+}
+
+// LocalAddr returns the local network address.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.s.Addr()
+}
+
+// RemoteAddr returns the remote network address.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// SetDeadline sets the read and write deadlines.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.cond.Broadcast()
+	return nil
+}
+
+// SetReadDeadline sets the deadline for future Read calls.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for future Write calls.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
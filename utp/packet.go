@@ -0,0 +1,136 @@
+// Package utp implements the Micro Transport Protocol, BEP 29.
+// reference: https://www.bittorrent.org/beps/bep_0029.html
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+type packetType uint8
+
+const (
+	stData packetType = iota
+	stFin
+	stState
+	stReset
+	stSyn
+)
+
+func (t packetType) String() string {
+	switch t {
+	case stData:
+		return "ST_DATA"
+	case stFin:
+		return "ST_FIN"
+	case stState:
+		return "ST_STATE"
+	case stReset:
+		return "ST_RESET"
+	case stSyn:
+		return "ST_SYN"
+	default:
+		return fmt.Sprintf("ST#%d", uint8(t))
+	}
+}
+
+const (
+	version         uint8 = 1
+	headerSize      int   = 20
+	extNone         uint8 = 0
+	extSelectiveAck uint8 = 1
+)
+
+// packet is a uTP packet. The header is laid out as follows:
+// <type|ver><extension><connection_id><timestamp_microseconds>
+// <timestamp_difference_microseconds><wnd_size><seq_nr><ack_nr>
+type packet struct {
+	typ           packetType
+	connID        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	wndSize       uint32
+	seqNr         uint16
+	ackNr         uint16
+	sack          []byte // selective ack bitmask, nil if absent
+	payload       []byte
+}
+
+func (p *packet) marshal() []byte {
+	size := headerSize + len(p.payload)
+	if p.sack != nil {
+		size += 2 + len(p.sack)
+	}
+
+	ret := make([]byte, size)
+	ret[0] = byte(p.typ)<<4 | version
+	if p.sack != nil {
+		ret[1] = extSelectiveAck
+	}
+	binary.BigEndian.PutUint16(ret[2:4], p.connID)
+	binary.BigEndian.PutUint32(ret[4:8], p.timestamp)
+	binary.BigEndian.PutUint32(ret[8:12], p.timestampDiff)
+	binary.BigEndian.PutUint32(ret[12:16], p.wndSize)
+	binary.BigEndian.PutUint16(ret[16:18], p.seqNr)
+	binary.BigEndian.PutUint16(ret[18:20], p.ackNr)
+
+	curr := headerSize
+	if p.sack != nil {
+		ret[curr] = extNone
+		ret[curr+1] = byte(len(p.sack))
+		curr += 2
+		curr += copy(ret[curr:], p.sack)
+	}
+	copy(ret[curr:], p.payload)
+	return ret
+}
+
+func unmarshalPacket(b []byte) (*packet, error) {
+	if len(b) < headerSize {
+		return nil, fmt.Errorf("packet too short: %d bytes", len(b))
+	}
+	if b[0]&0x0f != version {
+		return nil, fmt.Errorf("unsupported version: %d", b[0]&0x0f)
+	}
+
+	p := &packet{
+		typ:           packetType(b[0] >> 4),
+		connID:        binary.BigEndian.Uint16(b[2:4]),
+		timestamp:     binary.BigEndian.Uint32(b[4:8]),
+		timestampDiff: binary.BigEndian.Uint32(b[8:12]),
+		wndSize:       binary.BigEndian.Uint32(b[12:16]),
+		seqNr:         binary.BigEndian.Uint16(b[16:18]),
+		ackNr:         binary.BigEndian.Uint16(b[18:20]),
+	}
+	if p.typ > stSyn {
+		return nil, fmt.Errorf("unknown packet type: %s", p.typ)
+	}
+
+	// walk the linked list of extensions
+	ext := b[1]
+	curr := headerSize
+	for ext != extNone {
+		if curr+2 > len(b) {
+			return nil, errors.New("truncated extension header")
+		}
+		next, length := b[curr], int(b[curr+1])
+		curr += 2
+		if curr+length > len(b) {
+			return nil, errors.New("truncated extension")
+		}
+		if ext == extSelectiveAck {
+			p.sack = b[curr : curr+length]
+		}
+		ext = next
+		curr += length
+	}
+
+	p.payload = b[curr:]
+	return p, nil
+}
+
+// seqLess compares sequence numbers, taking wrap-around into account.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
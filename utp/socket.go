@@ -0,0 +1,257 @@
+package utp
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	maxPacketSize int           = 65535
+	acceptBacklog int           = 64
+	tickInterval  time.Duration = 50 * time.Millisecond
+)
+
+type connKey struct {
+	addr   string
+	recvID uint16
+}
+
+// Socket multiplexes uTP connections over a single UDP socket.
+// It implements net.Listener for inbound connections.
+type Socket struct {
+	pc net.PacketConn
+
+	mu      sync.Mutex
+	conns   map[connKey]*Conn
+	acceptQ chan *Conn
+	closed  chan struct{}
+	err     error
+}
+
+// NewSocket starts multiplexing uTP connections over pc, taking ownership of it.
+func NewSocket(pc net.PacketConn) *Socket {
+	s := &Socket{
+		pc:      pc,
+		conns:   make(map[connKey]*Conn),
+		acceptQ: make(chan *Conn, acceptBacklog),
+		closed:  make(chan struct{}),
+	}
+	go s.readLoop()
+	go s.tickLoop()
+	return s
+}
+
+// Listen announces on the local UDP address.
+func Listen(network, addr string) (*Socket, error) {
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(pc), nil
+}
+
+// Dial connects to the address on an ephemeral socket which is closed together with the connection.
+func Dial(network, addr string) (net.Conn, error) {
+	return DialTimeout(network, addr, 0)
+}
+
+// DialTimeout acts like Dial but takes a timeout.
+func DialTimeout(network, addr string, timeout time.Duration) (net.Conn, error) {
+	pc, err := net.ListenPacket(network, ":0")
+	if err != nil {
+		return nil, err
+	}
+	s := NewSocket(pc)
+	c, err := s.dial(addr, timeout)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	c.ownsSocket = true
+	return c, nil
+}
+
+// Dial connects to the address over the socket.
+func (s *Socket) Dial(addr string) (net.Conn, error) {
+	return s.DialTimeout(addr, 0)
+}
+
+// DialTimeout acts like Dial but takes a timeout.
+func (s *Socket) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	c, err := s.dial(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *Socket) dial(addr string, timeout time.Duration) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	// find a free receive id, the send id is the next one
+	var recvID uint16
+	for {
+		recvID = uint16(rand.Uint32())
+		if _, ok := s.conns[connKey{raddr.String(), recvID}]; !ok {
+			break
+		}
+	}
+	c := newConn(s, raddr, recvID, recvID+1)
+	s.conns[connKey{raddr.String(), recvID}] = c
+	s.mu.Unlock()
+
+	if err := c.connect(timeout); err != nil {
+		s.remove(c)
+		return nil, err
+	}
+	return c, nil
+}
+
+// Accept waits for and returns the next inbound connection.
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.acceptQ:
+		return c, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Addr returns the local address of the socket.
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// Close closes the socket and resets all of its connections.
+func (s *Socket) Close() error {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.err = net.ErrClosed
+	close(s.closed)
+	conns := s.conns
+	s.conns = make(map[connKey]*Conn)
+	s.mu.Unlock()
+
+	for _, c := range conns {
+		c.reset(net.ErrClosed)
+	}
+	return s.pc.Close()
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := connKey{c.raddr.String(), c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *Socket) writeTo(p *packet, addr net.Addr) error {
+	_, err := s.pc.WriteTo(p.marshal(), addr)
+	return err
+}
+
+func (s *Socket) readLoop() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				s.Close()
+				return
+			}
+			// e.g. a timeout, or the ICMP error of an earlier packet, the socket still works
+			continue
+		}
+
+		p, err := unmarshalPacket(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			// not a uTP packet, ignore it
+			continue
+		}
+		s.dispatch(p, addr)
+	}
+}
+
+func (s *Socket) dispatch(p *packet, addr net.Addr) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+
+	if p.typ == stSyn {
+		key := connKey{addr.String(), p.connID + 1}
+		c, ok := s.conns[key]
+		if ok {
+			// our SYN-ACK got lost
+			s.mu.Unlock()
+			c.handle(p)
+			return
+		}
+
+		c = newConn(s, addr, p.connID+1, p.connID)
+		s.conns[key] = c
+		s.mu.Unlock()
+		c.handle(p)
+		select {
+		case s.acceptQ <- c:
+		default:
+			// backlog is full
+			c.reset(net.ErrClosed)
+			s.remove(c)
+			s.writeTo(&packet{typ: stReset, connID: p.connID, ackNr: p.seqNr}, addr)
+		}
+		return
+	}
+
+	c, ok := s.conns[connKey{addr.String(), p.connID}]
+	s.mu.Unlock()
+	if !ok {
+		if p.typ != stReset {
+			s.writeTo(&packet{typ: stReset, connID: p.connID, ackNr: p.seqNr}, addr)
+		}
+		return
+	}
+	c.handle(p)
+}
+
+func (s *Socket) tickLoop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.closed:
+			return
+		}
+
+		s.mu.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+
+		for _, c := range conns {
+			c.tick()
+		}
+	}
+}
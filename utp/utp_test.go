@@ -0,0 +1,195 @@
+package utp
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lossyConn drops and delays outgoing datagrams.
+type lossyConn struct {
+	net.PacketConn
+	mu    sync.Mutex
+	rand  *rand.Rand
+	loss  float64
+	delay time.Duration
+}
+
+func (lc *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	lc.mu.Lock()
+	drop := lc.rand.Float64() < lc.loss
+	jitter := time.Duration(lc.rand.Int63n(int64(lc.delay)/2 + 1))
+	lc.mu.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	if lc.delay == 0 {
+		return lc.PacketConn.WriteTo(b, addr)
+	}
+
+	buf := append([]byte(nil), b...)
+	time.AfterFunc(lc.delay+jitter, func() {
+		lc.PacketConn.WriteTo(buf, addr)
+	})
+	return len(b), nil
+}
+
+func newLossySocket(t *testing.T, loss float64, delay time.Duration, seed int64) *Socket {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	return NewSocket(&lossyConn{PacketConn: pc, rand: rand.New(rand.NewSource(seed)), loss: loss, delay: delay})
+}
+
+func TestPacketMarshal(t *testing.T) {
+	p := &packet{
+		typ:           stData,
+		connID:        0x1234,
+		timestamp:     1,
+		timestampDiff: 2,
+		wndSize:       3,
+		seqNr:         4,
+		ackNr:         5,
+		sack:          []byte{0x01, 0, 0, 0},
+		payload:       []byte("hello"),
+	}
+
+	b := p.marshal()
+	assert.Equal(t, byte(0x01), b[0])
+	assert.Equal(t, byte(extSelectiveAck), b[1])
+	assert.Equal(t, headerSize+2+4+5, len(b))
+
+	parsed, err := unmarshalPacket(b)
+	require.Nil(t, err)
+	assert.Equal(t, p, parsed)
+
+	_, err = unmarshalPacket(b[:10])
+	assert.NotNil(t, err)
+	_, err = unmarshalPacket(b[:headerSize+3])
+	assert.NotNil(t, err)
+}
+
+func TestSeqLess(t *testing.T) {
+	assert.True(t, seqLess(1, 2))
+	assert.False(t, seqLess(2, 1))
+	assert.True(t, seqLess(65535, 0))
+	assert.False(t, seqLess(0, 65535))
+}
+
+func TestTransfer(t *testing.T) {
+	tests := map[string]struct {
+		loss  float64
+		delay time.Duration
+	}{
+		"perfect network": {},
+		"delay":           {delay: 20 * time.Millisecond},
+		"packet loss":     {loss: 0.1},
+		"loss and delay":  {loss: 0.05, delay: 10 * time.Millisecond},
+	}
+
+	for name, test := range tests {
+		server := newLossySocket(t, test.loss, test.delay, 1)
+		client := newLossySocket(t, test.loss, test.delay, 2)
+
+		data := make([]byte, 256*1024)
+		rand.New(rand.NewSource(3)).Read(data)
+
+		received := make(chan []byte)
+		go func() {
+			conn, err := server.Accept()
+			if !assert.Nil(t, err, name) {
+				received <- nil
+				return
+			}
+			buf := make([]byte, len(data))
+			_, err = io.ReadFull(conn, buf)
+			assert.Nil(t, err, name)
+			// echo the first bytes back
+			conn.Write(buf[:1024])
+			received <- buf
+			conn.Close()
+		}()
+
+		start := time.Now()
+		conn, err := client.DialTimeout(server.Addr().String(), 10*time.Second)
+		require.Nil(t, err, name)
+		conn.SetDeadline(time.Now().Add(60 * time.Second))
+		n, err := conn.Write(data)
+		assert.Nil(t, err, name)
+		assert.Equal(t, len(data), n, name)
+
+		echo := make([]byte, 1024)
+		_, err = io.ReadFull(conn, echo)
+		assert.Nil(t, err, name)
+		assert.True(t, bytes.Equal(data[:1024], echo), name)
+		assert.True(t, bytes.Equal(data, <-received), name)
+		t.Log(name, time.Since(start))
+
+		conn.Close()
+		server.Close()
+		client.Close()
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	// nobody speaks uTP on the other end
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer pc.Close()
+
+	start := time.Now()
+	_, err = DialTimeout("udp", pc.LocalAddr().String(), 300*time.Millisecond)
+	assert.NotNil(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestReadDeadline(t *testing.T) {
+	server, err := Listen("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer server.Close()
+
+	conn, err := Dial("udp", server.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	ne, ok := err.(net.Error)
+	require.True(t, ok)
+	assert.True(t, ne.Timeout())
+}
+
+func TestClose(t *testing.T) {
+	server, err := Listen("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := server.Accept()
+		accepted <- conn
+	}()
+
+	conn, err := Dial("udp", server.Addr().String())
+	require.Nil(t, err)
+	_, err = conn.Write([]byte("bye"))
+	require.Nil(t, err)
+	require.Nil(t, conn.Close())
+
+	sc := <-accepted
+	buf, err := io.ReadAll(sc)
+	assert.Nil(t, err)
+	assert.Equal(t, "bye", string(buf))
+
+	_, err = conn.Write([]byte("again"))
+	assert.NotNil(t, err)
+
+	server.Close()
+	_, err = server.Accept()
+	assert.Equal(t, net.ErrClosed, err)
+}